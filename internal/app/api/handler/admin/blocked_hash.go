@@ -0,0 +1,75 @@
+package admin
+
+import (
+	"easymail/internal/model"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// BlockedHashController manages the hashes of attachments the filter blocks
+type BlockedHashController struct{}
+
+type searchBlockedHashRequest struct {
+	Hash   string `json:"hash"`
+	Start  int    `json:"start"`
+	Length int    `json:"length"`
+}
+
+type createBlockedHashRequest struct {
+	Type        model.HashType `json:"type"`
+	Hash        string         `json:"hash"`
+	Description string         `json:"description"`
+}
+
+// Search lists the hashes, those starting with hash when it is given
+func (b *BlockedHashController) Search(c *gin.Context) {
+	var req searchBlockedHashRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, http.StatusBadRequest, err)
+		return
+	}
+	if req.Length <= 0 {
+		req.Length = defaultLogLength
+	}
+	if req.Length > maxLogLength {
+		req.Length = maxLogLength
+	}
+	if req.Start < 0 {
+		req.Start = 0
+	}
+	total, hashes, err := model.SearchBlockedHashes(req.Hash, req.Start, req.Length)
+	if err != nil {
+		fail(c, http.StatusBadRequest, err)
+		return
+	}
+	success(c, gin.H{"total": total, "data": hashes})
+}
+
+// Create adds a md5, sha256 or ssdeep hash, the filter reads the list once a minute
+func (b *BlockedHashController) Create(c *gin.Context) {
+	var req createBlockedHashRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, http.StatusBadRequest, err)
+		return
+	}
+	h := &model.BlockedHash{Type: req.Type, Hash: req.Hash, Description: req.Description}
+	if err := model.CreateBlockedHash(h, auditor(c)); err != nil {
+		fail(c, http.StatusBadRequest, err)
+		return
+	}
+	success(c, h)
+}
+
+func (b *BlockedHashController) Delete(c *gin.Context) {
+	var req idRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, http.StatusBadRequest, err)
+		return
+	}
+	if err := model.DeleteBlockedHash(req.ID, auditor(c)); err != nil {
+		fail(c, http.StatusBadRequest, err)
+		return
+	}
+	success(c, nil)
+}
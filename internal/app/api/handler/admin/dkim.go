@@ -0,0 +1,81 @@
+package admin
+
+import (
+	"easymail/internal/app/service/dkimkey"
+	"easymail/internal/model"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type DKIMController struct{}
+
+type domainRequest struct {
+	DomainID int64 `json:"domain_id"`
+}
+
+type createDKIMKeyRequest struct {
+	DomainID  int64               `json:"domain_id"`
+	Selector  string              `json:"selector"`
+	Algorithm model.DKIMAlgorithm `json:"algorithm"`
+}
+
+// Records lists the keys of a domain with the TXT records to publish for them
+func (d *DKIMController) Records(c *gin.Context) {
+	var req domainRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, http.StatusBadRequest, err)
+		return
+	}
+	records, err := dkimkey.Records(req.DomainID)
+	if err != nil {
+		fail(c, http.StatusBadRequest, err)
+		return
+	}
+	success(c, records)
+}
+
+// Create generates a key, it is activated once its record is published
+func (d *DKIMController) Create(c *gin.Context) {
+	var req createDKIMKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, http.StatusBadRequest, err)
+		return
+	}
+	if req.Algorithm == "" {
+		req.Algorithm = model.DKIMAlgorithmRSA
+	}
+	record, err := dkimkey.Create(req.DomainID, req.Selector, req.Algorithm, auditor(c))
+	if err != nil {
+		fail(c, http.StatusBadRequest, err)
+		return
+	}
+	success(c, record)
+}
+
+// Activate signs the mail of the domain with the key, the other keys stay published until deleted
+func (d *DKIMController) Activate(c *gin.Context) {
+	var req idRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, http.StatusBadRequest, err)
+		return
+	}
+	if err := model.ActivateDKIMKey(req.ID, auditor(c)); err != nil {
+		fail(c, http.StatusBadRequest, err)
+		return
+	}
+	success(c, nil)
+}
+
+func (d *DKIMController) Delete(c *gin.Context) {
+	var req idRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, http.StatusBadRequest, err)
+		return
+	}
+	if err := model.DeleteDKIMKey(req.ID, auditor(c)); err != nil {
+		fail(c, http.StatusBadRequest, err)
+		return
+	}
+	success(c, nil)
+}
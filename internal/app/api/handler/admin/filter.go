@@ -0,0 +1,190 @@
+package admin
+
+import (
+	"easymail/internal/app/service/filter"
+	"easymail/internal/model"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultBacktestLimit = 1000
+	maxBacktestLimit     = 10000
+	defaultLogLength     = 20
+	maxLogLength         = 500
+)
+
+type FilterController struct{}
+
+// RuleStatus shows the last reload of the filter rules, a failed compile is
+// reported with the DRL error while the previous rules stay in use.
+func (f *FilterController) RuleStatus(c *gin.Context) {
+	success(c, filter.LastReload())
+}
+
+// ReloadRule asks the filter to check the rules now instead of at the next poll
+func (f *FilterController) ReloadRule(c *gin.Context) {
+	filter.SignalReload()
+	success(c, nil)
+}
+
+// SaveRule creates or updates a rule, its condition is validated against the built-in features and the filter fields
+func (f *FilterController) SaveRule(c *gin.Context) {
+	var req model.CreateFilterRuleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, http.StatusBadRequest, err)
+		return
+	}
+	if err := model.CreateFilterRule(req, filter.BuiltinFields()); err != nil {
+		fail(c, http.StatusBadRequest, err)
+		return
+	}
+	success(c, nil)
+}
+
+type idRequest struct {
+	ID int64 `json:"id"`
+}
+
+func (f *FilterController) ToggleRule(c *gin.Context) {
+	var req idRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, http.StatusBadRequest, err)
+		return
+	}
+	if err := model.ToggleFilterRule(req.ID); err != nil {
+		fail(c, http.StatusBadRequest, err)
+		return
+	}
+	success(c, nil)
+}
+
+func (f *FilterController) DeleteRule(c *gin.Context) {
+	var req idRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, http.StatusBadRequest, err)
+		return
+	}
+	if err := model.DeleteFilterRule(req.ID); err != nil {
+		fail(c, http.StatusBadRequest, err)
+		return
+	}
+	success(c, nil)
+}
+
+// requestRule returns the draft rule of a request, or the stored one
+func requestRule(id int64, draft *model.FilterRule) (model.FilterRule, error) {
+	if draft != nil {
+		return *draft, nil
+	}
+	if id <= 0 {
+		return model.FilterRule{}, errors.New("rule or rule_id is required")
+	}
+	return model.GetFilterRuleByID(id)
+}
+
+// ExplainRule runs a rule alone against sample features or the features of a
+// filter log, it tells whether the rule fires and which conditions matched.
+func (f *FilterController) ExplainRule(c *gin.Context) {
+	var req model.ExplainFilterRuleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, http.StatusBadRequest, err)
+		return
+	}
+	rule, err := requestRule(req.RuleID, req.Rule)
+	if err != nil {
+		fail(c, http.StatusBadRequest, err)
+		return
+	}
+	fact := req.Feature
+	if req.LogID > 0 {
+		log, err := model.GetFilterLogByID(req.LogID)
+		if err != nil {
+			fail(c, http.StatusBadRequest, err)
+			return
+		}
+		if fact, err = filter.LogFact(log); err != nil {
+			fail(c, http.StatusBadRequest, err)
+			return
+		}
+	}
+	explanation, err := filter.Explain(rule, fact)
+	if err != nil {
+		fail(c, http.StatusBadRequest, err)
+		return
+	}
+	success(c, explanation)
+}
+
+// BacktestRule replays the last filter logs through a rule and counts hits
+func (f *FilterController) BacktestRule(c *gin.Context) {
+	var req model.BacktestFilterRuleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, http.StatusBadRequest, err)
+		return
+	}
+	rule, err := requestRule(req.RuleID, req.Rule)
+	if err != nil {
+		fail(c, http.StatusBadRequest, err)
+		return
+	}
+	if req.Limit <= 0 {
+		req.Limit = defaultBacktestLimit
+	}
+	if req.Limit > maxBacktestLimit {
+		req.Limit = maxBacktestLimit
+	}
+	logs, err := model.GetLastFilterLogs(req.Limit)
+	if err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	result, err := filter.Backtest(rule, logs)
+	if err != nil {
+		fail(c, http.StatusBadRequest, err)
+		return
+	}
+	success(c, result)
+}
+
+// SearchLog lists filter decisions by date range, action, rule and sender,
+// the feature snapshot is left out and read with GetLog.
+func (f *FilterController) SearchLog(c *gin.Context) {
+	var req model.SearchFilterLogRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, http.StatusBadRequest, err)
+		return
+	}
+	if req.Length <= 0 {
+		req.Length = defaultLogLength
+	}
+	if req.Length > maxLogLength {
+		req.Length = maxLogLength
+	}
+	if req.Start < 0 {
+		req.Start = 0
+	}
+	total, logs, err := model.SearchFilterLog(req)
+	if err != nil {
+		fail(c, http.StatusBadRequest, err)
+		return
+	}
+	success(c, gin.H{"total": total, "data": logs})
+}
+
+// GetLog returns a filter log with its feature snapshot
+func (f *FilterController) GetLog(c *gin.Context) {
+	var req idRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, http.StatusBadRequest, err)
+		return
+	}
+	log, err := model.GetFilterLogByID(req.ID)
+	if err != nil {
+		fail(c, http.StatusBadRequest, err)
+		return
+	}
+	success(c, log)
+}
@@ -0,0 +1,65 @@
+package admin
+
+import (
+	"easymail/internal/app/service/auth"
+	"easymail/internal/app/service/session"
+	"easymail/internal/model"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+var errInvalidLogin = errors.New("invalid username or password")
+
+// LoginController logs administrators in and out, the login is kept in the session
+type LoginController struct {
+	Auth *auth.Service
+}
+
+type loginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// Login checks the password of an account which is an administrator and keeps it as session.KeyAdminAccount
+func (l *LoginController) Login(c *gin.Context) {
+	var req loginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, http.StatusBadRequest, err)
+		return
+	}
+	acc, err := l.Auth.Authenticate(c.Request.Context(), req.Username, req.Password)
+	if err != nil {
+		fail(c, http.StatusUnauthorized, errInvalidLogin)
+		return
+	}
+	if _, err = model.FindAdminByAccountID(acc.ID); err != nil {
+		if errors.Is(err, model.ErrNotAdmin) {
+			fail(c, http.StatusUnauthorized, errInvalidLogin)
+			return
+		}
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	s := sessions.Default(c)
+	s.Clear()
+	s.Set(session.KeyAdminAccount, strings.ToLower(strings.TrimSpace(req.Username)))
+	if err = s.Save(); err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	success(c, nil)
+}
+
+func (l *LoginController) Logout(c *gin.Context) {
+	s := sessions.Default(c)
+	s.Clear()
+	if err := s.Save(); err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	success(c, nil)
+}
@@ -0,0 +1,83 @@
+package admin
+
+import (
+	"easymail/internal/app/service/quarantine"
+	"easymail/internal/app/service/session"
+	"easymail/internal/model"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type QuarantineController struct{}
+
+// auditor returns the admin performing the request
+func auditor(c *gin.Context) model.Auditor {
+	return model.Auditor{Operator: c.GetString(session.KeyAdminAccount), IP: c.ClientIP()}
+}
+
+// Search lists quarantined messages, held ones unless status is given
+func (q *QuarantineController) Search(c *gin.Context) {
+	var req model.SearchQuarantineRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, http.StatusBadRequest, err)
+		return
+	}
+	if req.Length <= 0 {
+		req.Length = defaultLogLength
+	}
+	if req.Length > maxLogLength {
+		req.Length = maxLogLength
+	}
+	if req.Start < 0 {
+		req.Start = 0
+	}
+	total, mails, err := model.SearchQuarantineMail(req)
+	if err != nil {
+		fail(c, http.StatusBadRequest, err)
+		return
+	}
+	success(c, gin.H{"total": total, "data": mails})
+}
+
+// Preview returns a quarantined message with its text, html and attachment list
+func (q *QuarantineController) Preview(c *gin.Context) {
+	var req idRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, http.StatusBadRequest, err)
+		return
+	}
+	preview, err := quarantine.GetPreview(req.ID)
+	if err != nil {
+		fail(c, http.StatusBadRequest, err)
+		return
+	}
+	success(c, preview)
+}
+
+// Release moves a quarantined message to the Inbox of its recipient
+func (q *QuarantineController) Release(c *gin.Context) {
+	var req idRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, http.StatusBadRequest, err)
+		return
+	}
+	if err := model.ReleaseQuarantineMail(req.ID, auditor(c)); err != nil {
+		fail(c, http.StatusBadRequest, err)
+		return
+	}
+	success(c, nil)
+}
+
+func (q *QuarantineController) Delete(c *gin.Context) {
+	var req idRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, http.StatusBadRequest, err)
+		return
+	}
+	if err := model.DeleteQuarantineMail(req.ID, auditor(c)); err != nil {
+		fail(c, http.StatusBadRequest, err)
+		return
+	}
+	success(c, nil)
+}
@@ -0,0 +1,15 @@
+package admin
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+func success(c *gin.Context, data any) {
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": data})
+}
+
+func fail(c *gin.Context, status int, err error) {
+	c.JSON(status, gin.H{"success": false, "message": err.Error()})
+}
@@ -1,4 +1,24 @@
 package middleware
 
-func Auth() {}
+import (
+	"net/http"
 
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+// Auth 要求请求已登录，keys对应的登录信息从session放入上下文，缺少任何一个时返回401
+func Auth(keys ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		s := sessions.Default(c)
+		for _, key := range keys {
+			v := s.Get(key)
+			if v == nil {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"success": false, "message": "not login"})
+				return
+			}
+			c.Set(key, v)
+		}
+		c.Next()
+	}
+}
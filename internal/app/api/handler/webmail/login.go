@@ -0,0 +1,57 @@
+package webmail
+
+import (
+	"easymail/internal/app/service/auth"
+	"easymail/internal/app/service/session"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+var errInvalidLogin = errors.New("invalid username or password")
+
+// LoginController logs users in and out, the login is kept in the session
+type LoginController struct {
+	Auth *auth.Service
+}
+
+type loginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// Login checks the password and keeps the account as session.KeyUserID and its address as session.KeyMailbox
+func (l *LoginController) Login(c *gin.Context) {
+	var req loginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, http.StatusBadRequest, err)
+		return
+	}
+	acc, err := l.Auth.Authenticate(c.Request.Context(), req.Username, req.Password)
+	if err != nil {
+		fail(c, http.StatusUnauthorized, errInvalidLogin)
+		return
+	}
+	s := sessions.Default(c)
+	s.Clear()
+	s.Set(session.KeyUserID, acc.ID)
+	s.Set(session.KeyMailbox, strings.ToLower(strings.TrimSpace(req.Username)))
+	if err = s.Save(); err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	success(c, nil)
+}
+
+func (l *LoginController) Logout(c *gin.Context) {
+	s := sessions.Default(c)
+	s.Clear()
+	if err := s.Save(); err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	success(c, nil)
+}
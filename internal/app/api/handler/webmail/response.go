@@ -0,0 +1,24 @@
+package webmail
+
+import (
+	"easymail/internal/app/service/session"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+var errNotLogin = errors.New("not login")
+
+func success(c *gin.Context, data any) {
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": data})
+}
+
+func fail(c *gin.Context, status int, err error) {
+	c.JSON(status, gin.H{"success": false, "message": err.Error()})
+}
+
+// accountID returns the account of the logged in user, 0 when not logged in
+func accountID(c *gin.Context) int64 {
+	return c.GetInt64(session.KeyUserID)
+}
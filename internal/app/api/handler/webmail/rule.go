@@ -0,0 +1,93 @@
+package webmail
+
+import (
+	"easymail/internal/model"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RuleController manages the personal rules applied when mail is delivered to the user
+type RuleController struct{}
+
+type idRequest struct {
+	ID int64 `json:"id"`
+}
+
+func (r *RuleController) Index(c *gin.Context) {
+	accID := accountID(c)
+	if accID <= 0 {
+		fail(c, http.StatusUnauthorized, errNotLogin)
+		return
+	}
+	rules, err := model.IndexPersonalRules(accID)
+	if err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	data := make([]model.IndexPersonalRuleResponse, 0, len(rules))
+	for _, rule := range rules {
+		conditions, actions, err := rule.Parse()
+		if err != nil {
+			fail(c, http.StatusInternalServerError, err)
+			return
+		}
+		data = append(data, model.IndexPersonalRuleResponse{PersonalRule: rule, Conditions: conditions, Actions: actions})
+	}
+	success(c, gin.H{"total": len(data), "limit": model.MaxPersonalRules, "data": data})
+}
+
+// Save creates or updates a rule, an account has at most model.MaxPersonalRules rules
+func (r *RuleController) Save(c *gin.Context) {
+	accID := accountID(c)
+	if accID <= 0 {
+		fail(c, http.StatusUnauthorized, errNotLogin)
+		return
+	}
+	var req model.SavePersonalRuleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, http.StatusBadRequest, err)
+		return
+	}
+	if err := model.SavePersonalRule(accID, req); err != nil {
+		fail(c, http.StatusBadRequest, err)
+		return
+	}
+	success(c, nil)
+}
+
+func (r *RuleController) Toggle(c *gin.Context) {
+	accID := accountID(c)
+	if accID <= 0 {
+		fail(c, http.StatusUnauthorized, errNotLogin)
+		return
+	}
+	var req idRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, http.StatusBadRequest, err)
+		return
+	}
+	if err := model.TogglePersonalRule(accID, req.ID); err != nil {
+		fail(c, http.StatusBadRequest, err)
+		return
+	}
+	success(c, nil)
+}
+
+func (r *RuleController) Delete(c *gin.Context) {
+	accID := accountID(c)
+	if accID <= 0 {
+		fail(c, http.StatusUnauthorized, errNotLogin)
+		return
+	}
+	var req idRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, http.StatusBadRequest, err)
+		return
+	}
+	if err := model.DeletePersonalRule(accID, req.ID); err != nil {
+		fail(c, http.StatusBadRequest, err)
+		return
+	}
+	success(c, nil)
+}
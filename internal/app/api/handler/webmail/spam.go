@@ -0,0 +1,79 @@
+package webmail
+
+import (
+	"easymail/internal/app/service/bayes"
+	"easymail/internal/app/service/storage"
+	"easymail/internal/model"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// SpamController trains the spam classifier of the filter with the messages users mark
+type SpamController struct {
+	// Redis keeps what the classifier learned, marking fails without it
+	Redis *redis.Client
+}
+
+type markRequest struct {
+	ID   int64 `json:"id"`
+	Spam bool  `json:"spam"`
+}
+
+// Mark learns a message as spam and moves it to the Spam folder, or learns it
+// as not spam and moves it back to the Inbox when it was in the Spam folder.
+func (s *SpamController) Mark(c *gin.Context) {
+	accID := accountID(c)
+	if accID <= 0 {
+		fail(c, http.StatusUnauthorized, errNotLogin)
+		return
+	}
+	var req markRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, http.StatusBadRequest, err)
+		return
+	}
+	email, err := model.GetMail(accID, req.ID)
+	if err != nil {
+		fail(c, http.StatusBadRequest, err)
+		return
+	}
+	if strings.TrimSpace(email.SavePath) == "" {
+		fail(c, http.StatusBadRequest, errors.New("email has no content"))
+		return
+	}
+	rc := s.Redis
+	if rc == nil {
+		fail(c, http.StatusServiceUnavailable, errors.New("redis is not available"))
+		return
+	}
+	content, err := (&storage.LocalStorage{}).Read(email.SavePath)
+	if err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	classifier := bayes.New(rc)
+	tokens := classifier.Tokens(email.Subject, content.Text, content.Html)
+	id := fmt.Sprintf("%d:%d", accID, email.ID)
+	if err := classifier.Learn(c.Request.Context(), id, tokens, req.Spam); err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	folder := model.FolderID(email.FolderId)
+	switch {
+	case req.Spam && folder != model.Spam:
+		err = model.MoveMail(accID, email.ID, model.Spam)
+	case !req.Spam && folder == model.Spam:
+		err = model.MoveMail(accID, email.ID, model.Inbox)
+	}
+	if err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	success(c, nil)
+}
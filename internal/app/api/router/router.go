@@ -1,5 +1,82 @@
 package router
 
-// 仅用于占位：项目结构重组后再逐步接入实际路由实现。
-func Register() {}
+import (
+	"easymail/internal/app/api/handler/admin"
+	"easymail/internal/app/api/handler/middleware"
+	"easymail/internal/app/api/handler/webmail"
+	"easymail/internal/app/service/auth"
+	"easymail/internal/app/service/session"
 
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// Deps 接口用到的服务，由启动时创建
+type Deps struct {
+	// Auth 校验登录的账号密码
+	Auth *auth.Service
+	// Redis 保存垃圾邮件分类器学习的结果
+	Redis *redis.Client
+}
+
+// Register 注册管理后台和webmail的登录接口，其余接口在登录检查之后注册，
+// 未启用的一方传nil，登录信息由调用方注册的session中间件保存
+func Register(adminRouter, webmailRouter gin.IRouter, deps Deps) {
+	if adminRouter != nil {
+		api := adminRouter.Group("/api")
+		loginController := &admin.LoginController{Auth: deps.Auth}
+		api.POST("/login", loginController.Login)
+		api.POST("/logout", loginController.Logout)
+		Admin(api.Group("", middleware.Auth(session.KeyAdminAccount)))
+	}
+	if webmailRouter != nil {
+		api := webmailRouter.Group("/api")
+		loginController := &webmail.LoginController{Auth: deps.Auth}
+		api.POST("/login", loginController.Login)
+		api.POST("/logout", loginController.Logout)
+		Webmail(api.Group("", middleware.Auth(session.KeyUserID, session.KeyMailbox)), deps)
+	}
+}
+
+// Admin 注册管理后台接口
+func Admin(g *gin.RouterGroup) {
+	filterController := &admin.FilterController{}
+	g.POST("/filter/rule/save", filterController.SaveRule)
+	g.POST("/filter/rule/toggle", filterController.ToggleRule)
+	g.POST("/filter/rule/delete", filterController.DeleteRule)
+	g.GET("/filter/rule/status", filterController.RuleStatus)
+	g.POST("/filter/rule/reload", filterController.ReloadRule)
+	g.POST("/filter/rule/explain", filterController.ExplainRule)
+	g.POST("/filter/rule/backtest", filterController.BacktestRule)
+	g.POST("/filter/log/search", filterController.SearchLog)
+	g.POST("/filter/log/get", filterController.GetLog)
+
+	quarantineController := &admin.QuarantineController{}
+	g.POST("/quarantine/search", quarantineController.Search)
+	g.POST("/quarantine/preview", quarantineController.Preview)
+	g.POST("/quarantine/release", quarantineController.Release)
+	g.POST("/quarantine/delete", quarantineController.Delete)
+
+	dkimController := &admin.DKIMController{}
+	g.POST("/dkim/key/records", dkimController.Records)
+	g.POST("/dkim/key/create", dkimController.Create)
+	g.POST("/dkim/key/activate", dkimController.Activate)
+	g.POST("/dkim/key/delete", dkimController.Delete)
+
+	blockedHashController := &admin.BlockedHashController{}
+	g.POST("/attach/hash/search", blockedHashController.Search)
+	g.POST("/attach/hash/create", blockedHashController.Create)
+	g.POST("/attach/hash/delete", blockedHashController.Delete)
+}
+
+// Webmail 注册webmail接口
+func Webmail(g *gin.RouterGroup, deps Deps) {
+	ruleController := &webmail.RuleController{}
+	g.POST("/rule/index", ruleController.Index)
+	g.POST("/rule/save", ruleController.Save)
+	g.POST("/rule/toggle", ruleController.Toggle)
+	g.POST("/rule/delete", ruleController.Delete)
+
+	spamController := &webmail.SpamController{Redis: deps.Redis}
+	g.POST("/spam/mark", spamController.Mark)
+}
@@ -30,6 +30,13 @@ type Account struct {
 	StorageQuota       int64     `json:"storage_quota"`
 }
 
+var (
+	// ErrInvalidUsername the username is not a mail address
+	ErrInvalidUsername = errors.New("invalid username")
+	// ErrAccountNotExists no active account has the username
+	ErrAccountNotExists = errors.New("model not exists")
+)
+
 var emailRegex = regexp.MustCompile(`^[a-zA-Z0-9._%+\-]+@([a-zA-Z0-9.\-]+\.[a-zA-Z]{2,}|localhost)$`)
 
 // GeneratePassword create hashed password
@@ -152,24 +159,30 @@ func FindAccountByName(username string) (a *Account, err error) {
 		return nil, err
 	}
 	if !emailRegex.MatchString(username) {
-		return nil, errors.New("invalid username")
+		return nil, ErrInvalidUsername
 	}
 
 	username = strings.ToLower(username)
 	parts := strings.SplitN(username, "@", 2)
 	if len(parts) != 2 {
-		return nil, errors.New("invalid username")
+		return nil, ErrInvalidUsername
 	}
 
 	domain, err := FindDomainByName(parts[1])
-	if err != nil || domain == nil || domain.ID <= 0 {
-		return nil, errors.New("domain not exists")
+	if errors.Is(err, ErrDomainNotExists) || err == nil && (domain == nil || domain.ID <= 0) {
+		return nil, ErrDomainNotExists
+	}
+	if err != nil {
+		return nil, err
 	}
 
 	a = &Account{}
 	err = d.Model(&a).Where("username=? AND domain_id=? AND active=? AND deleted=?", parts[0], domain.ID, true, false).Take(&a).Error
 	if err == gorm.ErrRecordNotFound {
-		return nil, errors.New("model not exists")
+		return nil, ErrAccountNotExists
+	}
+	if err != nil {
+		return nil, err
 	}
 
 	return a, nil
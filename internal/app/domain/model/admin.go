@@ -1,6 +1,14 @@
 package model
 
-import "time"
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ErrNotAdmin the account is not an administrator
+var ErrNotAdmin = errors.New("not admin")
 
 type Admin struct {
 	ID         int64 `gorm:"primaryKey;AUTO_INCREMENT" json:"id"`
@@ -9,3 +17,20 @@ type Admin struct {
 	IsSuper    bool // super can manage all domain, otherwise only manage own domain
 	CreateTime time.Time
 }
+
+// FindAdminByAccountID finds the administrator an account is, ErrNotAdmin when it is none
+func FindAdminByAccountID(accountID int64) (*Admin, error) {
+	d, err := getDB()
+	if err != nil {
+		return nil, err
+	}
+	a := &Admin{}
+	err = d.Where("account_id=?", accountID).Take(a).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrNotAdmin
+	}
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
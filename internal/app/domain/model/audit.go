@@ -0,0 +1,65 @@
+package model
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type AuditAction string
+
+const (
+	AuditQuarantineRelease AuditAction = "quarantine.release"
+	AuditQuarantineDelete  AuditAction = "quarantine.delete"
+	AuditDKIMKeyCreate     AuditAction = "dkim.create"
+	AuditDKIMKeyActivate   AuditAction = "dkim.activate"
+	AuditDKIMKeyDelete     AuditAction = "dkim.delete"
+	AuditBlockedHashCreate AuditAction = "blocked_hash.create"
+	AuditBlockedHashDelete AuditAction = "blocked_hash.delete"
+)
+
+// AuditLog 记录管理员对邮件的操作
+type AuditLog struct {
+	ID         int64       `gorm:"primaryKey;AUTO_INCREMENT" json:"id"`
+	Operator   string      `gorm:"type:varchar(255)" json:"operator"`
+	IP         string      `gorm:"type:varchar(64)" json:"ip"`
+	Action     AuditAction `gorm:"type:varchar(64);index:idx_action" json:"action"`
+	TargetID   int64       `gorm:"type:int(11);default(0)" json:"target_id"`
+	Detail     string      `gorm:"type:varchar(1024)" json:"detail"`
+	CreateTime time.Time   `gorm:"index:idx_create_time" json:"create_time"`
+}
+
+// Auditor 为操作人信息
+type Auditor struct {
+	Operator string
+	IP       string
+}
+
+func createAuditLog(tx *gorm.DB, auditor Auditor, action AuditAction, targetID int64, detail string) error {
+	return tx.Create(&AuditLog{
+		Operator:   auditor.Operator,
+		IP:         auditor.IP,
+		Action:     action,
+		TargetID:   targetID,
+		Detail:     detail,
+		CreateTime: time.Now(),
+	}).Error
+}
+
+// SearchAuditLog 按操作类型分页查询审计日志
+func SearchAuditLog(action AuditAction, start, length int) (total int64, logs []AuditLog, err error) {
+	d, err := getDB()
+	if err != nil {
+		return 0, nil, err
+	}
+	logs = make([]AuditLog, 0)
+	query := d.Model(&AuditLog{})
+	if action != "" {
+		query = query.Where("action=?", action)
+	}
+	if err = query.Count(&total).Error; err != nil {
+		return 0, nil, err
+	}
+	err = query.Order("id desc").Offset(start).Limit(length).Find(&logs).Error
+	return
+}
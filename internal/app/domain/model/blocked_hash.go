@@ -0,0 +1,138 @@
+package model
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type HashType string
+
+const (
+	HashTypeMD5    HashType = "md5"
+	HashTypeSHA256 HashType = "sha256"
+	HashTypeSsdeep HashType = "ssdeep"
+)
+
+var (
+	ErrBlockedHashNotExists = errors.New("blocked hash not exists")
+	ErrBlockedHashExists    = errors.New("blocked hash already exists")
+	ErrBlockedHashInvalid   = errors.New("invalid hash")
+)
+
+// BlockedHash 管理员维护的恶意附件哈希，附件的md5、sha256相同或ssdeep足够相似时命中
+type BlockedHash struct {
+	ID          int64     `gorm:"primaryKey;AUTO_INCREMENT" json:"id"`
+	Type        HashType  `gorm:"type:varchar(16);uniqueIndex:idx_type_hash" json:"type"`
+	Hash        string    `gorm:"type:varchar(255);uniqueIndex:idx_type_hash" json:"hash"`
+	Description string    `gorm:"type:varchar(255)" json:"description"`
+	CreateTime  time.Time `json:"create_time"`
+}
+
+// Normalize 检查哈希格式，十六进制哈希转为小写
+func (h *BlockedHash) Normalize() error {
+	h.Hash = strings.TrimSpace(h.Hash)
+	switch h.Type {
+	case HashTypeMD5, HashTypeSHA256:
+		h.Hash = strings.ToLower(h.Hash)
+		size := 16
+		if h.Type == HashTypeSHA256 {
+			size = 32
+		}
+		if b, err := hex.DecodeString(h.Hash); err != nil || len(b) != size {
+			return ErrBlockedHashInvalid
+		}
+	case HashTypeSsdeep:
+		parts := strings.Split(h.Hash, ":")
+		if len(parts) != 3 || parts[1] == "" {
+			return ErrBlockedHashInvalid
+		}
+		if n, err := strconv.Atoi(parts[0]); err != nil || n <= 0 {
+			return ErrBlockedHashInvalid
+		}
+	default:
+		return fmt.Errorf("invalid hash type %q", h.Type)
+	}
+	return nil
+}
+
+// ListBlockedHashes 返回全部哈希，过滤器定期加载
+func ListBlockedHashes() (hashes []BlockedHash, err error) {
+	d, err := getDB()
+	if err != nil {
+		return nil, err
+	}
+	hashes = make([]BlockedHash, 0)
+	err = d.Model(&hashes).Order("id").Find(&hashes).Error
+	return
+}
+
+// SearchBlockedHashes 分页返回哈希，新添加的在前，hash不为空时按前缀查找
+func SearchBlockedHashes(hash string, start, length int) (total int64, hashes []BlockedHash, err error) {
+	d, err := getDB()
+	if err != nil {
+		return 0, nil, err
+	}
+	hashes = make([]BlockedHash, 0)
+	query := d.Model(&BlockedHash{})
+	if hash = strings.TrimSpace(hash); hash != "" {
+		query = query.Where("hash LIKE ?", strings.ToLower(hash)+"%")
+	}
+	if err = query.Count(&total).Error; err != nil {
+		return
+	}
+	err = query.Order("id desc").Offset(start).Limit(length).Find(&hashes).Error
+	return
+}
+
+// CreateBlockedHash 添加哈希
+func CreateBlockedHash(h *BlockedHash, auditor Auditor) error {
+	if err := h.Normalize(); err != nil {
+		return err
+	}
+	d, err := getDB()
+	if err != nil {
+		return err
+	}
+	return d.Transaction(func(tx *gorm.DB) error {
+		var total int64
+		if err := tx.Model(&BlockedHash{}).Where("type=? AND hash=?", h.Type, h.Hash).Count(&total).Error; err != nil {
+			return err
+		}
+		if total > 0 {
+			return ErrBlockedHashExists
+		}
+		h.CreateTime = time.Now()
+		if err := tx.Create(h).Error; err != nil {
+			return err
+		}
+		return createAuditLog(tx, auditor, AuditBlockedHashCreate, h.ID, fmt.Sprintf("%s %s", h.Type, h.Hash))
+	})
+}
+
+// DeleteBlockedHash 删除哈希
+func DeleteBlockedHash(id int64, auditor Auditor) error {
+	d, err := getDB()
+	if err != nil {
+		return err
+	}
+	return d.Transaction(func(tx *gorm.DB) error {
+		h := BlockedHash{}
+		err := tx.Model(&h).Where("id=?", id).Take(&h).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrBlockedHashNotExists
+		}
+		if err != nil {
+			return err
+		}
+		if err = tx.Delete(&BlockedHash{}, id).Error; err != nil {
+			return err
+		}
+		return createAuditLog(tx, auditor, AuditBlockedHashDelete, id, fmt.Sprintf("%s %s", h.Type, h.Hash))
+	})
+}
@@ -0,0 +1,28 @@
+package model
+
+import "testing"
+
+func TestBlockedHashNormalize(t *testing.T) {
+	cases := []struct {
+		hash BlockedHash
+		want string
+		ok   bool
+	}{
+		{BlockedHash{Type: HashTypeMD5, Hash: " 0CC175B9C0F1B6A831C399E269772661 "}, "0cc175b9c0f1b6a831c399e269772661", true},
+		{BlockedHash{Type: HashTypeMD5, Hash: "0cc175b9"}, "", false},
+		{BlockedHash{Type: HashTypeSHA256, Hash: "ca978112ca1bbdcafac231b39a23dc4da786eff8147c4e72b9807785afee48bb"}, "ca978112ca1bbdcafac231b39a23dc4da786eff8147c4e72b9807785afee48bb", true},
+		{BlockedHash{Type: HashTypeSHA256, Hash: "0cc175b9c0f1b6a831c399e269772661"}, "", false},
+		{BlockedHash{Type: HashTypeSsdeep, Hash: "3:AXGBicFlgVNhBGcL6wCrFQEv:AXGHsNhxLsr2C"}, "3:AXGBicFlgVNhBGcL6wCrFQEv:AXGHsNhxLsr2C", true},
+		{BlockedHash{Type: HashTypeSsdeep, Hash: "x:abc:def"}, "", false},
+		{BlockedHash{Type: "sha1", Hash: "abc"}, "", false},
+	}
+	for i, c := range cases {
+		err := c.hash.Normalize()
+		if (err == nil) != c.ok {
+			t.Fatalf("case %d: unexpected error %v", i, err)
+		}
+		if c.ok && c.hash.Hash != c.want {
+			t.Fatalf("case %d: expected %s, got %s", i, c.want, c.hash.Hash)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type DKIMAlgorithm string
+
+const (
+	DKIMAlgorithmRSA     DKIMAlgorithm = "rsa"
+	DKIMAlgorithmEd25519 DKIMAlgorithm = "ed25519"
+)
+
+// MaxDKIMKeys 每个域名最多保存的密钥数，轮换后旧密钥需要删除
+const MaxDKIMKeys = 10
+
+var (
+	ErrDKIMKeyNotExists = errors.New("dkim key not exists")
+	ErrDKIMKeyExists    = errors.New("dkim selector already exists")
+	ErrDKIMKeyActive    = errors.New("dkim key is active")
+	ErrDKIMKeyQuota     = fmt.Errorf("no more than %d dkim keys", MaxDKIMKeys)
+)
+
+/*
+DKIMKey 域名的DKIM签名密钥，每个selector一个密钥，每个域名最多一个启用。
+私钥加密后保存，旧密钥在DNS记录撤下之前保留。
+*/
+type DKIMKey struct {
+	ID         int64         `gorm:"primaryKey;AUTO_INCREMENT" json:"id"`
+	DomainID   int64         `gorm:"uniqueIndex:idx_domain_selector" json:"domain_id"`
+	Selector   string        `gorm:"type:varchar(63);uniqueIndex:idx_domain_selector" json:"selector"`
+	Algorithm  DKIMAlgorithm `gorm:"type:varchar(16)" json:"algorithm"`
+	PrivateKey string        `gorm:"type:text" json:"-"`
+	PublicKey  string        `gorm:"type:text" json:"public_key"`
+	Active     bool          `gorm:"default:false" json:"active"`
+	CreateTime time.Time     `json:"create_time"`
+	UpdateTime time.Time     `json:"update_time"`
+}
+
+// ListDKIMKeys 返回域名的全部密钥，新密钥在前
+func ListDKIMKeys(domainID int64) (keys []DKIMKey, err error) {
+	d, err := getDB()
+	if err != nil {
+		return nil, err
+	}
+	keys = make([]DKIMKey, 0)
+	err = d.Model(&keys).Where("domain_id=?", domainID).Order("id desc").Find(&keys).Error
+	return
+}
+
+func GetDKIMKeyByID(id int64) (*DKIMKey, error) {
+	d, err := getDB()
+	if err != nil {
+		return nil, err
+	}
+	key := &DKIMKey{}
+	err = d.Model(key).Where("id=?", id).Take(key).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrDKIMKeyNotExists
+	}
+	return key, err
+}
+
+// GetActiveDKIMKey 返回可用域名启用的密钥，没有时返回nil
+func GetActiveDKIMKey(domain string) (*DKIMKey, error) {
+	d, err := getDB()
+	if err != nil {
+		return nil, err
+	}
+	key := &DKIMKey{}
+	err = d.Model(key).
+		Joins("JOIN domains ON domains.id=dkim_keys.domain_id").
+		Where("domains.name=? AND domains.active=? AND domains.deleted=? AND dkim_keys.active=?", domain, true, false, true).
+		Take(key).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	return key, err
+}
+
+// CreateDKIMKey 保存新密钥，新密钥不启用，DNS记录发布后再启用
+func CreateDKIMKey(key *DKIMKey, auditor Auditor) error {
+	d, err := getDB()
+	if err != nil {
+		return err
+	}
+	return d.Transaction(func(tx *gorm.DB) error {
+		var total int64
+		if err := tx.Model(&DKIMKey{}).Where("domain_id=?", key.DomainID).Count(&total).Error; err != nil {
+			return err
+		}
+		if total >= MaxDKIMKeys {
+			return ErrDKIMKeyQuota
+		}
+		if err := tx.Model(&DKIMKey{}).Where("domain_id=? AND selector=?", key.DomainID, key.Selector).Count(&total).Error; err != nil {
+			return err
+		}
+		if total > 0 {
+			return ErrDKIMKeyExists
+		}
+		now := time.Now()
+		key.Active = false
+		key.CreateTime, key.UpdateTime = now, now
+		if err := tx.Create(key).Error; err != nil {
+			return err
+		}
+		return createAuditLog(tx, auditor, AuditDKIMKeyCreate, key.ID, fmt.Sprintf("domain %d selector %s", key.DomainID, key.Selector))
+	})
+}
+
+// ActivateDKIMKey 用密钥签名域名的邮件，同域名的其它密钥停用
+func ActivateDKIMKey(id int64, auditor Auditor) error {
+	d, err := getDB()
+	if err != nil {
+		return err
+	}
+	return d.Transaction(func(tx *gorm.DB) error {
+		key := DKIMKey{}
+		err := tx.Model(&key).Where("id=?", id).Take(&key).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrDKIMKeyNotExists
+		}
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		err = tx.Model(&DKIMKey{}).Where("domain_id=? AND active=? AND id<>?", key.DomainID, true, id).
+			Updates(map[string]interface{}{"active": false, "update_time": now}).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Model(&DKIMKey{}).Where("id=?", id).Updates(map[string]interface{}{"active": true, "update_time": now}).Error
+		if err != nil {
+			return err
+		}
+		return createAuditLog(tx, auditor, AuditDKIMKeyActivate, id, fmt.Sprintf("domain %d selector %s", key.DomainID, key.Selector))
+	})
+}
+
+// DeleteDKIMKey 删除密钥，启用中的密钥不能删除
+func DeleteDKIMKey(id int64, auditor Auditor) error {
+	d, err := getDB()
+	if err != nil {
+		return err
+	}
+	return d.Transaction(func(tx *gorm.DB) error {
+		key := DKIMKey{}
+		err := tx.Model(&key).Where("id=?", id).Take(&key).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrDKIMKeyNotExists
+		}
+		if err != nil {
+			return err
+		}
+		if key.Active {
+			return ErrDKIMKeyActive
+		}
+		if err = tx.Delete(&DKIMKey{}, id).Error; err != nil {
+			return err
+		}
+		return createAuditLog(tx, auditor, AuditDKIMKeyDelete, id, fmt.Sprintf("domain %d selector %s", key.DomainID, key.Selector))
+	})
+}
@@ -0,0 +1,64 @@
+package model
+
+import "time"
+
+// DMARCResult 一封邮件的DMARC评估结果，用于生成聚合报告，报告发出后删除
+type DMARCResult struct {
+	ID int64 `gorm:"primaryKey;AUTO_INCREMENT" json:"id"`
+	// Domain 发布策略的域名，报告按该域名汇总
+	Domain       string `gorm:"type:varchar(255);index:idx_domain" json:"domain"`
+	Record       string `gorm:"type:varchar(1024)" json:"record"`
+	SourceIP     string `gorm:"type:varchar(64)" json:"source_ip"`
+	HeaderFrom   string `gorm:"type:varchar(255)" json:"header_from"`
+	EnvelopeFrom string `gorm:"type:varchar(255)" json:"envelope_from"`
+	SPFResult    string `gorm:"type:varchar(16)" json:"spf_result"`
+	SPFAligned   bool   `json:"spf_aligned"`
+	// DKIM 各签名的结果，格式为domain/selector=result，逗号分隔
+	DKIM        string    `gorm:"type:varchar(1024)" json:"dkim"`
+	DKIMAligned bool      `json:"dkim_aligned"`
+	Disposition string    `gorm:"type:varchar(16)" json:"disposition"`
+	Reason      string    `gorm:"type:varchar(32)" json:"reason"`
+	CreateTime  time.Time `gorm:"index:idx_create_time" json:"create_time"`
+}
+
+func CreateDMARCResults(results []DMARCResult) error {
+	if len(results) == 0 {
+		return nil
+	}
+	d, err := getDB()
+	if err != nil {
+		return err
+	}
+	return d.CreateInBatches(results, 100).Error
+}
+
+// FindDMARCDomains 返回before之前有评估结果的域名
+func FindDMARCDomains(before time.Time) (domains []string, err error) {
+	d, err := getDB()
+	if err != nil {
+		return nil, err
+	}
+	domains = make([]string, 0)
+	err = d.Model(&DMARCResult{}).Where("create_time<?", before).Distinct("domain").Order("domain").Pluck("domain", &domains).Error
+	return
+}
+
+// FindDMARCResults 返回域名before之前的评估结果
+func FindDMARCResults(domain string, before time.Time) (results []DMARCResult, err error) {
+	d, err := getDB()
+	if err != nil {
+		return nil, err
+	}
+	results = make([]DMARCResult, 0)
+	err = d.Model(&results).Where("domain=? AND create_time<?", domain, before).Order("id").Find(&results).Error
+	return
+}
+
+// DeleteDMARCResults 删除域名before之前的评估结果，报告发出后调用
+func DeleteDMARCResults(domain string, before time.Time) error {
+	d, err := getDB()
+	if err != nil {
+		return err
+	}
+	return d.Where("domain=? AND create_time<?", domain, before).Delete(&DMARCResult{}).Error
+}
@@ -24,6 +24,9 @@ type Domain struct {
 	DeleteTime  time.Time `json:"delete_time"`
 }
 
+// ErrDomainNotExists no domain has the name
+var ErrDomainNotExists = errors.New("domain not exists")
+
 func FindDomainByID(id int64) (domain *Domain, err error) {
 	d, err := getDB()
 	if err != nil {
@@ -43,7 +46,10 @@ func FindDomainByName(name string) (domain *Domain, err error) {
 	}
 	err = d.Model(&domain).Where("name = ?", name).First(&domain).Error
 	if err == gorm.ErrRecordNotFound {
-		return nil, errors.New("domain not exists")
+		return nil, ErrDomainNotExists
+	}
+	if err != nil {
+		return nil, err
 	}
 	return domain, nil
 }
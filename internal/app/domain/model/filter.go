@@ -1,6 +1,7 @@
 package model
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"strings"
@@ -60,6 +61,7 @@ type FilterRule struct {
 	AttachContent string       `gorm:"type:varchar(255)" json:"attach_content"`
 	URL           string       `gorm:"type:varchar(255)" json:"url"`
 	Assembly      string       `gorm:"type:varchar(4098)" json:"assembly"`
+	Condition     string       `gorm:"column:rule_condition;type:text" json:"condition"` // json of RuleCondition, it replaces the fields above
 	AccountID     int          `gorm:"type:int(11);default(0)" json:"account_id"`
 	Status        uint8        `gorm:"type:int(8);default(0)" json:"status"` //0=inactive;1=active;2=deleted
 	CreateTime    time.Time    `json:"create_time"`
@@ -79,7 +81,9 @@ type FilterLog struct {
 	Subject    string       `gorm:"type:varchar(255)" json:"subject"`
 	Feature    string       `gorm:"type:mediumtext" json:"feature"`
 	Action     FilterAction `gorm:"type:int(8);default(0)" json:"action"`
-	CreateTime time.Time
+	RuleID     int64        `gorm:"type:int(11);default(0)" json:"rule_id"` // 0 means no rule matched
+	Stage      FilterStage  `gorm:"type:int(8);default(0)" json:"stage"`    // stage the decision was made at
+	CreateTime time.Time    `gorm:"index:idx_create_time"`
 }
 
 type FilterField struct {
@@ -93,6 +97,7 @@ type FilterField struct {
 	Status      uint8       `gorm:"type:int(8);default(0)" json:"status"` //0=inactive;1=active;2=deleted
 	CanMetric   bool        `gorm:"type:tinyint(1);default(0)" json:"can_metric"`
 	Stage       FilterStage `gorm:"type:int(8);default(0)" json:"stage"`
+	DataType    DataType    `gorm:"type:int(8);default(0)" json:"data_type"`
 }
 
 type MetricOperation uint8
@@ -140,28 +145,34 @@ func formatRuleDefine(s string) (string, error) {
 	operator := strings.ToLower(d[0])
 	switch operator {
 	case "contains":
-		return fmt.Sprintf(".Contains(\"%s\")", d[1]), nil
-	case "hasPrefix":
-		return fmt.Sprintf(".HasPrefix(\"%s\")", d[1]), nil
-	case "hasSuffix":
-		return fmt.Sprintf(".HasSuffix(\"%s\")", d[1]), nil
+		return fmt.Sprintf(".Contains(%s)", drlString(d[1])), nil
+	case "hasprefix":
+		return fmt.Sprintf(".HasPrefix(%s)", drlString(d[1])), nil
+	case "hassuffix":
+		return fmt.Sprintf(".HasSuffix(%s)", drlString(d[1])), nil
 	case "equals":
-		return fmt.Sprintf("==\"%s\"", d[1]), nil
-	case "notEquals":
-		return fmt.Sprintf("!=\"%s\"", d[1]), nil
+		return fmt.Sprintf("==%s", drlString(d[1])), nil
+	case "notequals":
+		return fmt.Sprintf("!=%s", drlString(d[1])), nil
+	}
+	// numeric operators, the value must be a number
+	v, err := drlLiteral(DataTypeFloat, d[1])
+	if err != nil {
+		return "", errors.New("invalid rule define")
+	}
+	switch operator {
 	case "gt":
-		return fmt.Sprintf(">%s", d[1]), nil
+		return fmt.Sprintf(">%s", v), nil
 	case "lt":
-		return fmt.Sprintf("<%s", d[1]), nil
+		return fmt.Sprintf("<%s", v), nil
 	case "gte":
-		return fmt.Sprintf(">=%s", d[1]), nil
+		return fmt.Sprintf(">=%s", v), nil
 	case "lte":
-		return fmt.Sprintf("<=%s", d[1]), nil
+		return fmt.Sprintf("<=%s", v), nil
 	case "equal":
-		return fmt.Sprintf("==%s", d[1]), nil
-	case "notEqual":
-		return fmt.Sprintf("!=%s", d[1]), nil
-
+		return fmt.Sprintf("==%s", v), nil
+	case "notequal":
+		return fmt.Sprintf("!=%s", v), nil
 	}
 	return "", errors.New("invalid rule define")
 }
@@ -169,25 +180,53 @@ func formatRuleDefine(s string) (string, error) {
 func (r FilterRule) Convert2DRL() (drl string, err error) {
 	sb := strings.Builder{}
 	sb.WriteString(
-		fmt.Sprintf("rule rule_%d \"%s\" salience %d {\n",
+		fmt.Sprintf("rule rule_%d %s salience %d {\n",
 			r.ID,
-			strings.Replace(r.Description, "\"", "", -1),
+			drlString(r.Description),
 			r.Priority,
 		),
 	)
 	sb.WriteString(fmt.Sprintf("\twhen\n"))
 	condition := make([]string, 0)
-	//The field has been defined, and it must be: operator::operator factor.
-	// it must define only one time
-	if r.ClientIP != "" {
-		if t, err := formatRuleDefine(r.ClientIP); err == nil {
-			condition = append(condition, fmt.Sprintf("feature.client_ip%s", t))
+	if r.Condition != "" {
+		// the structured condition replaces the legacy fields
+		var c RuleCondition
+		if err := json.Unmarshal([]byte(r.Condition), &c); err != nil {
+			return "", fmt.Errorf("invalid rule condition: %w", err)
 		}
-	}
-	if r.Assembly != "" {
-		aList := strings.Split(r.Assembly, ";;")
-		for _, a := range aList {
-			condition = append(condition, fmt.Sprintf("feature.%s", a))
+		t, err := c.DRL()
+		if err != nil {
+			return "", err
+		}
+		condition = append(condition, t)
+	} else {
+		//The field has been defined, and it must be: operator::operator factor.
+		// it must define only one time
+		if r.ClientIP != "" {
+			if t, err := formatRuleDefine(r.ClientIP); err == nil {
+				condition = append(condition, fmt.Sprintf("feature.client_ip%s", t))
+			}
+		}
+		// attachment and url columns compare the features of all attachments or links joined by ;
+		for _, c := range []struct{ define, feature string }{
+			{r.AttachName, "attach_name"},
+			{r.AttachHash, "attach_sha256"},
+			{r.AttachMd5, "attach_md5"},
+			{r.AttachContent, "attach_type"},
+			{r.URL, "url"},
+		} {
+			if c.define == "" {
+				continue
+			}
+			if t, err := formatRuleDefine(c.define); err == nil {
+				condition = append(condition, fmt.Sprintf("feature.%s%s", c.feature, t))
+			}
+		}
+		if r.Assembly != "" {
+			aList := strings.Split(r.Assembly, ";;")
+			for _, a := range aList {
+				condition = append(condition, fmt.Sprintf("feature.%s", a))
+			}
 		}
 	}
 	if len(condition) == 0 {
@@ -211,14 +250,224 @@ func GetFilterRules() (rules []FilterRule, err error) {
 	return
 }
 
+func GetFilterRuleByID(id int64) (rule FilterRule, err error) {
+	d, err := getDB()
+	if err != nil {
+		return FilterRule{}, err
+	}
+	err = d.Model(&rule).Where("id=? AND status<>?", id, 2).First(&rule).Error
+	if err != nil && rule.ID == 0 {
+		return FilterRule{}, errors.New("rule not exists")
+	}
+	return
+}
+
+// GetFilterLogByID 返回单条过滤日志，用于规则试运行
+func GetFilterLogByID(id int64) (log FilterLog, err error) {
+	d, err := getDB()
+	if err != nil {
+		return FilterLog{}, err
+	}
+	err = d.Model(&log).Where("id=?", id).First(&log).Error
+	if err != nil && log.ID == 0 {
+		return FilterLog{}, errors.New("filter log not exists")
+	}
+	return
+}
+
+// CreateFilterLogs 批量写入过滤日志
+func CreateFilterLogs(logs []FilterLog) error {
+	if len(logs) == 0 {
+		return nil
+	}
+	d, err := getDB()
+	if err != nil {
+		return err
+	}
+	return d.CreateInBatches(logs, 100).Error
+}
+
+func SearchFilterLog(req SearchFilterLogRequest) (total int64, logs []FilterLog, err error) {
+	d, err := getDB()
+	if err != nil {
+		return 0, nil, err
+	}
+	logs = make([]FilterLog, 0)
+	query := d.Model(&FilterLog{})
+	if req.StartDate != "" {
+		start, err := time.ParseInLocation("2006-01-02", req.StartDate, time.Local)
+		if err != nil {
+			return 0, nil, errors.New("invalid start date")
+		}
+		query = query.Where("create_time>=?", start)
+	}
+	if req.EndDate != "" {
+		end, err := time.ParseInLocation("2006-01-02", req.EndDate, time.Local)
+		if err != nil {
+			return 0, nil, errors.New("invalid end date")
+		}
+		query = query.Where("create_time<?", end.AddDate(0, 0, 1))
+	}
+	if req.Action > 0 {
+		query = query.Where("action=?", req.Action)
+	}
+	if req.RuleID > 0 {
+		query = query.Where("rule_id=?", req.RuleID)
+	}
+	if req.Sender != "" {
+		query = query.Where("sender LIKE ?", "%"+req.Sender+"%")
+	}
+	if err = query.Count(&total).Error; err != nil {
+		return 0, nil, err
+	}
+	// the feature snapshot is large, it is read by id when needed
+	err = query.Omit("feature").Order("id desc").Offset(req.Start).Limit(req.Length).Find(&logs).Error
+	return
+}
+
+// GetLastFilterLogs 返回最近的limit条过滤日志，用于规则回测
+func GetLastFilterLogs(limit int) (logs []FilterLog, err error) {
+	d, err := getDB()
+	if err != nil {
+		return nil, err
+	}
+	logs = make([]FilterLog, 0)
+	err = d.Model(&logs).Order("id desc").Limit(limit).Find(&logs).Error
+	return
+}
+
+// GetFilterFields 返回所有启用的字段，规则条件只能引用这些字段
+func GetFilterFields() (fields []FilterField, err error) {
+	d, err := getDB()
+	if err != nil {
+		return nil, err
+	}
+	err = d.Model(&fields).Where("status=?", 1).Order("name asc").Find(&fields).Error
+	return
+}
+
+// CreateFilterRule 保存规则，条件可以引用内置特征和启用的字段，同名时以内置特征的类型为准
+func CreateFilterRule(req CreateFilterRuleRequest, builtin []FilterField) error {
+	d, err := getDB()
+	if err != nil {
+		return err
+	}
+	if req.Action < FilterActionAccept || req.Action > FilterActionQuarantine {
+		return errors.New("invalid rule action")
+	}
+	if req.Condition == nil {
+		return errors.New("rule condition is empty")
+	}
+	custom, err := GetFilterFields()
+	if err != nil {
+		return err
+	}
+	fields := append(custom, builtin...)
+	if err = req.Condition.Validate(fields); err != nil {
+		return err
+	}
+	condition, err := json.Marshal(req.Condition)
+	if err != nil {
+		return err
+	}
+
+	var rule FilterRule
+	// req.ID>0 means update
+	if req.ID > 0 {
+		err := d.Model(&rule).Where("id=?", req.ID).First(&rule).Error
+		if err != nil && rule.ID == 0 {
+			return errors.New("rule not exists")
+		}
+		return d.Model(&rule).Where("id=?", req.ID).Updates(map[string]interface{}{
+			"priority":       req.Priority,
+			"description":    req.Description,
+			"action":         req.Action,
+			"rule_condition": string(condition),
+			"update_time":    time.Now(),
+		}).Error
+	}
+
+	rule.Priority = req.Priority
+	rule.Description = req.Description
+	rule.Action = req.Action
+	rule.Condition = string(condition)
+	rule.AccountID = req.AccountID
+	rule.CreateTime = time.Now()
+	rule.UpdateTime = time.Now()
+	rule.Status = 0
+	return d.Model(&rule).Create(&rule).Error
+}
+
+func ToggleFilterRule(id int64) error {
+	d, err := getDB()
+	if err != nil {
+		return err
+	}
+	var rule FilterRule
+	err = d.Model(&rule).Where("id=?", id).First(&rule).Error
+	if err != nil && rule.ID == 0 {
+		return errors.New("rule not exists")
+	}
+	if rule.Status == 0 {
+		rule.Status = 1
+	} else if rule.Status == 1 {
+		rule.Status = 0
+	} else {
+		return errors.New("rule status error")
+	}
+	return d.Model(&rule).Where("id=?", id).Updates(map[string]interface{}{
+		"status":      rule.Status,
+		"update_time": time.Now(),
+	}).Error
+}
+
+func DeleteFilterRule(id int64) error {
+	d, err := getDB()
+	if err != nil {
+		return err
+	}
+	var rule FilterRule
+	err = d.Model(&rule).Where("id=?", id).First(&rule).Error
+	if err != nil && rule.ID == 0 {
+		return errors.New("rule not exists")
+	}
+	// update_time也要更新，过滤服务据此重新加载规则
+	return d.Model(&rule).Where("id=?", id).Updates(map[string]interface{}{
+		"status":      2,
+		"update_time": time.Now(),
+		"delete_time": time.Now(),
+	}).Error
+}
+
 func GetLastTimeOfRule() (last time.Time, err error) {
 	d, err := getDB()
 	if err != nil {
 		return time.Time{}, err
 	}
 	// 从filter_rules表中，只选择出update_time，然后赋值last
-	err = d.Model(&FilterRule{}).Select("update_time").Where("status=?", 1).
+	// 不过滤status，规则被停用或删除时也需要重新加载
+	err = d.Model(&FilterRule{}).Select("update_time").
+		Order("update_time desc").Limit(1).Scan(&last).Error
+	return
+}
+
+func GetLastTimeOfFilterMetric() (last time.Time, err error) {
+	d, err := getDB()
+	if err != nil {
+		return time.Time{}, err
+	}
+	err = d.Model(&FilterMetric{}).Select("update_time").
 		Order("update_time desc").Limit(1).Scan(&last).Error
+	if err != nil {
+		return time.Time{}, err
+	}
+	// 删除指标时只更新delete_time
+	var deleted time.Time
+	err = d.Model(&FilterMetric{}).Select("delete_time").
+		Order("delete_time desc").Limit(1).Scan(&deleted).Error
+	if deleted.After(last) {
+		last = deleted
+	}
 	return
 }
 
@@ -252,7 +501,7 @@ func GetFilterMetricByStage(stage FilterStage) (metrics []FilterMetric, err erro
 	query = query.Joins("left join filter_fields on (filter_fields.id = filter_metrics.primary_field_id OR filter_fields.id = filter_metrics.secondary_field_id)").
 		Where("filter_fields.stage=?", stage).
 		Where("filter_fields.status=?", 1).
-		Where("filter_fields.can_metric", 1)
+		Where("filter_fields.can_metric=?", 1)
 	err = query.Find(&metrics).Error
 	if err != nil {
 		return nil, err
@@ -0,0 +1,250 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// DRLFunctions is the name helper functions are registered with in the rule engine
+const DRLFunctions = "Func"
+
+type ConditionOperator string
+
+const (
+	OperatorEquals    ConditionOperator = "equals"
+	OperatorNotEquals ConditionOperator = "notEquals"
+	OperatorContains  ConditionOperator = "contains"
+	OperatorHasPrefix ConditionOperator = "hasPrefix"
+	OperatorHasSuffix ConditionOperator = "hasSuffix"
+	OperatorRegex     ConditionOperator = "regex"
+	OperatorCIDR      ConditionOperator = "cidr"
+	OperatorIn        ConditionOperator = "in"
+	OperatorNotIn     ConditionOperator = "notIn"
+	OperatorGt        ConditionOperator = "gt"
+	OperatorGte       ConditionOperator = "gte"
+	OperatorLt        ConditionOperator = "lt"
+	OperatorLte       ConditionOperator = "lte"
+	OperatorBetween   ConditionOperator = "between"
+)
+
+type ConditionLogic string
+
+const (
+	ConditionAnd ConditionLogic = "and"
+	ConditionOr  ConditionLogic = "or"
+)
+
+// operators allowed by data type of the field
+var conditionOperators = map[DataType][]ConditionOperator{
+	DataTypeString: {OperatorEquals, OperatorNotEquals, OperatorContains, OperatorHasPrefix, OperatorHasSuffix, OperatorRegex, OperatorCIDR, OperatorIn, OperatorNotIn},
+	DataTypeInt:    {OperatorEquals, OperatorNotEquals, OperatorGt, OperatorGte, OperatorLt, OperatorLte, OperatorBetween, OperatorIn, OperatorNotIn},
+	DataTypeFloat:  {OperatorEquals, OperatorNotEquals, OperatorGt, OperatorGte, OperatorLt, OperatorLte, OperatorBetween, OperatorIn, OperatorNotIn},
+	DataTypeBool:   {OperatorEquals, OperatorNotEquals},
+}
+
+// cidrFields are the fields holding an ip address
+var cidrFields = map[string]bool{"client_ip": true}
+
+var fieldNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+/*
+RuleCondition is the condition of a filter rule, a group combines its
+children with Logic, a leaf compares Field with Value, or with Values for
+in, notIn and between. DataType is taken from FilterField when the rule is saved.
+*/
+type RuleCondition struct {
+	Logic    ConditionLogic    `json:"logic,omitempty"`
+	Children []RuleCondition   `json:"children,omitempty"`
+	Field    string            `json:"field,omitempty"`
+	Operator ConditionOperator `json:"operator,omitempty"`
+	DataType DataType          `json:"data_type"`
+	Value    string            `json:"value,omitempty"`
+	Values   []string          `json:"values,omitempty"`
+}
+
+func (c RuleCondition) isGroup() bool {
+	return c.Logic != ""
+}
+
+// Validate checks the condition against the registered fields and fills in
+// their data types, it must be called before the condition is saved.
+func (c *RuleCondition) Validate(fields []FilterField) error {
+	fieldMap := make(map[string]FilterField, len(fields))
+	for _, f := range fields {
+		fieldMap[f.Name] = f
+	}
+	return c.validate(fieldMap)
+}
+
+func (c *RuleCondition) validate(fields map[string]FilterField) error {
+	if c.isGroup() {
+		if c.Logic != ConditionAnd && c.Logic != ConditionOr {
+			return fmt.Errorf("invalid condition logic %q", c.Logic)
+		}
+		if len(c.Children) == 0 {
+			return errors.New("condition group is empty")
+		}
+		for i := range c.Children {
+			if err := c.Children[i].validate(fields); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	field, ok := fields[c.Field]
+	if !ok {
+		return fmt.Errorf("field %s not exists", c.Field)
+	}
+	c.DataType = field.DataType
+	_, err := c.leafDRL()
+	return err
+}
+
+// DRL compiles the condition, values are escaped and checked against the operator
+func (c RuleCondition) DRL() (string, error) {
+	if !c.isGroup() {
+		return c.leafDRL()
+	}
+	if len(c.Children) == 0 {
+		return "", errors.New("condition group is empty")
+	}
+	join := " && "
+	switch c.Logic {
+	case ConditionAnd:
+	case ConditionOr:
+		join = " || "
+	default:
+		return "", fmt.Errorf("invalid condition logic %q", c.Logic)
+	}
+	parts := make([]string, 0, len(c.Children))
+	for _, child := range c.Children {
+		drl, err := child.DRL()
+		if err != nil {
+			return "", err
+		}
+		if child.isGroup() && len(child.Children) > 1 {
+			drl = "(" + drl + ")"
+		}
+		parts = append(parts, drl)
+	}
+	return strings.Join(parts, join), nil
+}
+
+func (c RuleCondition) leafDRL() (string, error) {
+	if !fieldNamePattern.MatchString(c.Field) {
+		return "", fmt.Errorf("invalid field name %q", c.Field)
+	}
+	allowed := false
+	for _, op := range conditionOperators[c.DataType] {
+		if op == c.Operator {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return "", fmt.Errorf("operator %s is not allowed on field %s", c.Operator, c.Field)
+	}
+	field := "feature." + c.Field
+
+	switch c.Operator {
+	case OperatorContains:
+		return fmt.Sprintf("%s.Contains(%s)", field, drlString(c.Value)), nil
+	case OperatorHasPrefix:
+		return fmt.Sprintf("%s.HasPrefix(%s)", field, drlString(c.Value)), nil
+	case OperatorHasSuffix:
+		return fmt.Sprintf("%s.HasSuffix(%s)", field, drlString(c.Value)), nil
+	case OperatorRegex:
+		if _, err := regexp.Compile(c.Value); err != nil {
+			return "", fmt.Errorf("field %s: %w", c.Field, err)
+		}
+		return fmt.Sprintf("%s.MatchString(%s)", field, drlString(c.Value)), nil
+	case OperatorCIDR:
+		if !cidrFields[c.Field] {
+			return "", fmt.Errorf("operator cidr is not allowed on field %s", c.Field)
+		}
+		if _, _, err := net.ParseCIDR(c.Value); err != nil {
+			return "", fmt.Errorf("field %s: %w", c.Field, err)
+		}
+		return fmt.Sprintf("%s.InCIDR(%s, %s)", DRLFunctions, field, drlString(c.Value)), nil
+	case OperatorIn, OperatorNotIn:
+		if len(c.Values) == 0 {
+			return "", fmt.Errorf("field %s: value list is empty", c.Field)
+		}
+		op, join := "==", " || "
+		if c.Operator == OperatorNotIn {
+			op, join = "!=", " && "
+		}
+		parts := make([]string, 0, len(c.Values))
+		for _, v := range c.Values {
+			literal, err := drlLiteral(c.DataType, v)
+			if err != nil {
+				return "", fmt.Errorf("field %s: %w", c.Field, err)
+			}
+			parts = append(parts, field+op+literal)
+		}
+		return "(" + strings.Join(parts, join) + ")", nil
+	case OperatorBetween:
+		if len(c.Values) != 2 {
+			return "", fmt.Errorf("field %s: between needs a minimum and a maximum", c.Field)
+		}
+		lower, err := drlLiteral(c.DataType, c.Values[0])
+		if err != nil {
+			return "", fmt.Errorf("field %s: %w", c.Field, err)
+		}
+		upper, err := drlLiteral(c.DataType, c.Values[1])
+		if err != nil {
+			return "", fmt.Errorf("field %s: %w", c.Field, err)
+		}
+		return fmt.Sprintf("(%s>=%s && %s<=%s)", field, lower, field, upper), nil
+	}
+
+	literal, err := drlLiteral(c.DataType, c.Value)
+	if err != nil {
+		return "", fmt.Errorf("field %s: %w", c.Field, err)
+	}
+	op := map[ConditionOperator]string{
+		OperatorEquals:    "==",
+		OperatorNotEquals: "!=",
+		OperatorGt:        ">",
+		OperatorGte:       ">=",
+		OperatorLt:        "<",
+		OperatorLte:       "<=",
+	}[c.Operator]
+	return field + op + literal, nil
+}
+
+// drlString quotes a value as a DRL string literal
+func drlString(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "\t", `\t`).Replace(s) + `"`
+}
+
+// drlLiteral formats a value of the data type, numbers are parsed so nothing else gets in
+func drlLiteral(dataType DataType, value string) (string, error) {
+	switch dataType {
+	case DataTypeInt:
+		v, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("invalid integer %q", value)
+		}
+		return strconv.FormatInt(v, 10), nil
+	case DataTypeFloat:
+		v, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		// NaN and Inf parse but are no DRL literals
+		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+			return "", fmt.Errorf("invalid number %q", value)
+		}
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case DataTypeBool:
+		v, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			return "", fmt.Errorf("invalid bool %q", value)
+		}
+		return strconv.FormatBool(v), nil
+	}
+	return drlString(value), nil
+}
@@ -0,0 +1,97 @@
+package model
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRuleConditionDRL(t *testing.T) {
+	fields := []FilterField{
+		{Name: "client_ip", DataType: DataTypeString},
+		{Name: "subject", DataType: DataTypeString},
+		{Name: "size", DataType: DataTypeInt},
+		{Name: "score", DataType: DataTypeFloat},
+	}
+	c := RuleCondition{
+		Logic: ConditionAnd,
+		Children: []RuleCondition{
+			{Field: "client_ip", Operator: OperatorCIDR, Value: "10.0.0.0/8"},
+			{Logic: ConditionOr, Children: []RuleCondition{
+				{Field: "subject", Operator: OperatorRegex, Value: `^re:\s"x"`},
+				{Field: "subject", Operator: OperatorIn, Values: []string{"a", "b"}},
+			}},
+			{Field: "size", Operator: OperatorBetween, Values: []string{"10", "20"}},
+			{Field: "score", Operator: OperatorGte, Value: "0.5"},
+		},
+	}
+	if err := c.Validate(fields); err != nil {
+		t.Fatal(err)
+	}
+	drl, err := c.DRL()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `Func.InCIDR(feature.client_ip, "10.0.0.0/8") && (feature.subject.MatchString("^re:\\s\"x\"") || (feature.subject=="a" || feature.subject=="b")) && (feature.size>=10 && feature.size<=20) && feature.score>=0.5`
+	if drl != want {
+		t.Fatalf("unexpected drl\n%s\n%s", drl, want)
+	}
+
+	invalid := []RuleCondition{
+		{Field: "unknown", Operator: OperatorEquals, Value: "x"},
+		{Field: "size", Operator: OperatorContains, Value: "x"},
+		{Field: "size", Operator: OperatorGt, Value: "1) || true || (1"},
+		{Field: "score", Operator: OperatorGt, Value: "NaN"},
+		{Field: "score", Operator: OperatorLt, Value: "-Inf"},
+		{Field: "score", Operator: OperatorBetween, Values: []string{"0", "+Infinity"}},
+		{Field: "subject", Operator: OperatorCIDR, Value: "10.0.0.0/8"},
+		{Field: "client_ip", Operator: OperatorCIDR, Value: "10.0.0.0/33"},
+		{Field: "subject", Operator: OperatorRegex, Value: "("},
+		{Field: "size", Operator: OperatorBetween, Values: []string{"1"}},
+		{Logic: ConditionOr},
+		{Logic: "xor", Children: []RuleCondition{{Field: "size", Operator: OperatorGt, Value: "1"}}},
+	}
+	for i, c := range invalid {
+		if err := c.Validate(fields); err == nil {
+			t.Fatalf("case %d: expected validation error", i)
+		}
+	}
+}
+
+func TestFormatRuleDefine(t *testing.T) {
+	cases := map[string]string{
+		"hasPrefix::10.":        `.HasPrefix("10.")`,
+		"notEquals::a\"b":       `!="a\"b"`,
+		"HASSUFFIX::.cn":        `.HasSuffix(".cn")`,
+		"gte::5":                `>=5`,
+		"notEqual::3":           `!=3`,
+		"contains::x\\\") || (": `.Contains("x\\\") || (")`,
+	}
+	for define, want := range cases {
+		got, err := formatRuleDefine(define)
+		if err != nil {
+			t.Fatalf("%s: %v", define, err)
+		}
+		if got != want {
+			t.Fatalf("%s: expected %s, got %s", define, want, got)
+		}
+	}
+	if _, err := formatRuleDefine("gt::1 || true"); err == nil {
+		t.Fatal("expected invalid number")
+	}
+
+	drl, err := FilterRule{ID: 1, Description: `say "hi"`, ClientIP: "hasPrefix::10."}.Convert2DRL()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(drl, `rule rule_1 "say \"hi\""`) || !strings.Contains(drl, `feature.client_ip.HasPrefix("10.")`) {
+		t.Fatalf("unexpected drl %s", drl)
+	}
+
+	drl, err = FilterRule{ID: 2, AttachName: "hasSuffix::.exe", AttachMd5: "contains::0cc175b9c0f1b6a831c399e269772661", AttachContent: "contains::x-elf", URL: "contains::bit.ly"}.Convert2DRL()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(drl, `feature.attach_name.HasSuffix(".exe") && feature.attach_md5.Contains("0cc175b9c0f1b6a831c399e269772661") && feature.attach_type.Contains("x-elf") && feature.url.Contains("bit.ly")`) {
+		t.Fatalf("unexpected drl %s", drl)
+	}
+}
@@ -28,3 +28,62 @@ type CreateFilterMetricRequest struct {
 	Unit           MetricUnit      `json:"unit"`
 	AccountID      int64           `json:"account_id"`
 }
+
+type ExplainFilterRuleRequest struct {
+	// RuleID explains a stored rule, Rule explains a draft which is not saved
+	RuleID int64       `json:"rule_id"`
+	Rule   *FilterRule `json:"rule"`
+	// Feature is a sample feature set, LogID takes the features of a filter log
+	Feature map[string]any `json:"feature"`
+	LogID   int64          `json:"log_id"`
+}
+
+type BacktestFilterRuleRequest struct {
+	RuleID int64       `json:"rule_id"`
+	Rule   *FilterRule `json:"rule"`
+	Limit  int         `json:"limit"`
+}
+
+type CreateFilterRuleRequest struct {
+	ID          int64          `json:"id"`
+	Priority    int64          `json:"priority"`
+	Description string         `json:"description"`
+	Action      FilterAction   `json:"action"`
+	Condition   *RuleCondition `json:"condition"`
+	AccountID   int            `json:"account_id"`
+}
+
+type SearchFilterLogRequest struct {
+	DataTableRequest
+	StartDate string       `json:"startDate"`
+	EndDate   string       `json:"endDate"`
+	Action    FilterAction `json:"action"`
+	Sender    string       `json:"sender"`
+	RuleID    int64        `json:"rule_id"`
+}
+
+type SearchQuarantineRequest struct {
+	DataTableRequest
+	StartDate string           `json:"startDate"`
+	EndDate   string           `json:"endDate"`
+	Status    QuarantineStatus `json:"status"`
+	Sender    string           `json:"sender"`
+	Rcpt      string           `json:"rcpt"`
+	RuleID    int64            `json:"rule_id"`
+}
+
+type SavePersonalRuleRequest struct {
+	ID         int64               `json:"id"`
+	Name       string              `json:"name"`
+	Priority   int64               `json:"priority"`
+	Logic      ConditionLogic      `json:"logic"`
+	Conditions []PersonalCondition `json:"conditions"`
+	Actions    []PersonalAction    `json:"actions"`
+	Stop       bool                `json:"stop"`
+}
+
+type IndexPersonalRuleResponse struct {
+	PersonalRule
+	Conditions []PersonalCondition `json:"conditions"`
+	Actions    []PersonalAction    `json:"actions"`
+}
@@ -1,6 +1,11 @@
 package model
 
-import "time"
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
 
 type SsdeepHash struct {
 	ID         int64     `gorm:"primaryKey;AUTO_INCREMENT" json:"id"`
@@ -11,7 +16,17 @@ type SsdeepHash struct {
 	CreateTime time.Time `json:"create_time"`
 }
 
-func CreateSsdeepHash(hash string, sessionID string, chunkSize int, isAttach bool) (*SsdeepHash, error) {
+// SsdeepNgram 模糊哈希的n-gram索引，相似的哈希至少有一个相同的n-gram，查找时只比较这些哈希
+type SsdeepNgram struct {
+	ID     int64 `gorm:"primaryKey;AUTO_INCREMENT" json:"id"`
+	HashID int64 `gorm:"not null;index:idx_hash_id" json:"hash_id"`
+	// ChunkSize n-gram所在部分的块大小，哈希第二部分的块大小是ChunkSize的两倍
+	ChunkSize int   `gorm:"type:int(11);not null;index:idx_chunk_gram,priority:1" json:"chunk_size"`
+	Gram      int64 `gorm:"not null;index:idx_chunk_gram,priority:2" json:"gram"`
+}
+
+// CreateSsdeepHash 保存哈希及其n-gram索引，哈希已存在时返回已有记录
+func CreateSsdeepHash(hash string, sessionID string, chunkSize int, isAttach bool, ngrams []SsdeepNgram) (*SsdeepHash, error) {
 	d, err := getDB()
 	if err != nil {
 		return nil, err
@@ -23,6 +38,9 @@ func CreateSsdeepHash(hash string, sessionID string, chunkSize int, isAttach boo
 	if err == nil {
 		return &h, nil
 	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
 	h = SsdeepHash{
 		Hash:       hash,
 		SessionID:  sessionID,
@@ -31,7 +49,53 @@ func CreateSsdeepHash(hash string, sessionID string, chunkSize int, isAttach boo
 		CreateTime: time.Now(),
 	}
 
-	err = d.Create(&h).Error
+	err = d.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&h).Error; err != nil {
+			return err
+		}
+		if len(ngrams) == 0 {
+			return nil
+		}
+		rows := make([]SsdeepNgram, len(ngrams))
+		for i, n := range ngrams {
+			rows[i] = SsdeepNgram{HashID: h.ID, ChunkSize: n.ChunkSize, Gram: n.Gram}
+		}
+		return tx.CreateInBatches(rows, 100).Error
+	})
 
 	return &h, err
 }
+
+// FindSsdeepCandidates 返回与n-gram相同的最新limit个哈希，块大小相同或相差两倍的哈希才可比较
+func FindSsdeepCandidates(ngrams []SsdeepNgram, isAttach bool, limit int) (hashes []SsdeepHash, err error) {
+	hashes = make([]SsdeepHash, 0)
+	if len(ngrams) == 0 {
+		return
+	}
+	d, err := getDB()
+	if err != nil {
+		return nil, err
+	}
+	grams := make(map[int][]int64)
+	for _, n := range ngrams {
+		grams[n.ChunkSize] = append(grams[n.ChunkSize], n.Gram)
+	}
+	var cond *gorm.DB
+	for chunkSize, values := range grams {
+		if cond == nil {
+			cond = d.Where("chunk_size=? AND gram IN ?", chunkSize, values)
+		} else {
+			cond = cond.Or("chunk_size=? AND gram IN ?", chunkSize, values)
+		}
+	}
+	// 先按is_attach过滤再取limit个，否则另一类哈希会占满名额
+	kind := d.Model(&SsdeepHash{}).Select("id").Where("is_attach=?", isAttach)
+	ids := make([]int64, 0)
+	err = d.Model(&SsdeepNgram{}).Where(cond).Where("hash_id IN (?)", kind).
+		Distinct("hash_id").Order("hash_id desc").Limit(limit).Pluck("hash_id", &ids).Error
+	if err != nil || len(ids) == 0 {
+		return
+	}
+	err = d.Where("id IN ?", ids).Order("id desc").Find(&hashes).Error
+	return
+}
@@ -15,9 +15,17 @@ func AutoMigrate(db *gorm.DB) error {
 		&Admin{},
 		&Email{},
 		&SsdeepHash{},
+		&SsdeepNgram{},
 		&FilterRule{},
 		&FilterLog{},
 		&FilterField{},
 		&FilterMetric{},
+		&QuarantineMail{},
+		&AuditLog{},
+		&PersonalRule{},
+		&SieveScript{},
+		&DKIMKey{},
+		&DMARCResult{},
+		&BlockedHash{},
 	)
 }
@@ -0,0 +1,276 @@
+package model
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/mail"
+	"regexp"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// MaxPersonalRules 每个账户最多可创建的个人规则数
+const MaxPersonalRules = 50
+
+// PersonalField 个人规则可匹配的邮件字段
+type PersonalField string
+
+const (
+	PersonalFieldSender  PersonalField = "sender"
+	PersonalFieldRcpt    PersonalField = "rcpt"
+	PersonalFieldFrom    PersonalField = "from"
+	PersonalFieldTo      PersonalField = "to"
+	PersonalFieldSubject PersonalField = "subject"
+	PersonalFieldHeader  PersonalField = "header"
+)
+
+type PersonalActionType string
+
+const (
+	PersonalActionMove    PersonalActionType = "move"
+	PersonalActionRead    PersonalActionType = "read"
+	PersonalActionForward PersonalActionType = "forward"
+	PersonalActionDiscard PersonalActionType = "discard"
+)
+
+// personalOperators 个人规则只比较字符串
+var personalOperators = map[ConditionOperator]bool{
+	OperatorEquals:    true,
+	OperatorNotEquals: true,
+	OperatorContains:  true,
+	OperatorHasPrefix: true,
+	OperatorHasSuffix: true,
+	OperatorRegex:     true,
+}
+
+// personalFolders 个人规则可移入的文件夹
+var personalFolders = map[FolderID]bool{Inbox: true, Trash: true, Spam: true}
+
+var headerNamePattern = regexp.MustCompile(`^[!-9;-~]+$`)
+
+// PersonalCondition compares a field of the message, Header names the header for the header field
+type PersonalCondition struct {
+	Field    PersonalField     `json:"field"`
+	Header   string            `json:"header,omitempty"`
+	Operator ConditionOperator `json:"operator"`
+	Value    string            `json:"value"`
+}
+
+type PersonalAction struct {
+	Type    PersonalActionType `json:"type"`
+	Folder  FolderID           `json:"folder,omitempty"`
+	Address string             `json:"address,omitempty"`
+}
+
+// PersonalRule 用户在投递时执行的个人规则，条件和动作以json保存
+type PersonalRule struct {
+	ID         int64          `gorm:"primaryKey;AUTO_INCREMENT" json:"id"`
+	AccountID  int64          `gorm:"index:idx_account_id" json:"account_id"`
+	Name       string         `gorm:"type:varchar(255)" json:"name"`
+	Priority   int64          `gorm:"type:int(11);default(0)" json:"priority"`
+	Logic      ConditionLogic `gorm:"type:varchar(8)" json:"logic"`
+	Conditions string         `gorm:"type:text" json:"-"`
+	Actions    string         `gorm:"type:text" json:"-"`
+	Stop       bool           `gorm:"default:false" json:"stop"`            // 匹配后不再执行后续规则
+	Status     uint8          `gorm:"type:int(8);default(0)" json:"status"` //0=inactive;1=active;2=deleted
+	CreateTime time.Time      `json:"create_time"`
+	UpdateTime time.Time      `json:"update_time"`
+	DeleteTime time.Time      `json:"delete_time"`
+}
+
+// Parse decodes the conditions and actions of the rule
+func (r PersonalRule) Parse() (conditions []PersonalCondition, actions []PersonalAction, err error) {
+	if err = json.Unmarshal([]byte(r.Conditions), &conditions); err != nil {
+		return nil, nil, fmt.Errorf("personal rule %d conditions: %w", r.ID, err)
+	}
+	if err = json.Unmarshal([]byte(r.Actions), &actions); err != nil {
+		return nil, nil, fmt.Errorf("personal rule %d actions: %w", r.ID, err)
+	}
+	return
+}
+
+func (c PersonalCondition) Validate() error {
+	switch c.Field {
+	case PersonalFieldSender, PersonalFieldRcpt, PersonalFieldFrom, PersonalFieldTo, PersonalFieldSubject:
+	case PersonalFieldHeader:
+		if !headerNamePattern.MatchString(c.Header) {
+			return fmt.Errorf("invalid header name %q", c.Header)
+		}
+	default:
+		return fmt.Errorf("invalid field %q", c.Field)
+	}
+	if !personalOperators[c.Operator] {
+		return fmt.Errorf("operator %s is not allowed on field %s", c.Operator, c.Field)
+	}
+	if c.Operator == OperatorRegex {
+		if _, err := regexp.Compile(c.Value); err != nil {
+			return fmt.Errorf("field %s: %w", c.Field, err)
+		}
+	}
+	return nil
+}
+
+func (a PersonalAction) Validate() error {
+	switch a.Type {
+	case PersonalActionMove:
+		if !personalFolders[a.Folder] {
+			return fmt.Errorf("can not move to folder %d", a.Folder)
+		}
+	case PersonalActionForward:
+		if _, err := mail.ParseAddress(a.Address); err != nil {
+			return fmt.Errorf("invalid forward address %q", a.Address)
+		}
+	case PersonalActionRead, PersonalActionDiscard:
+	default:
+		return fmt.Errorf("invalid action %q", a.Type)
+	}
+	return nil
+}
+
+func (req SavePersonalRuleRequest) validate() error {
+	if req.Logic != ConditionAnd && req.Logic != ConditionOr {
+		return fmt.Errorf("invalid condition logic %q", req.Logic)
+	}
+	if len(req.Conditions) == 0 {
+		return errors.New("rule condition is empty")
+	}
+	if len(req.Actions) == 0 {
+		return errors.New("rule action is empty")
+	}
+	for _, c := range req.Conditions {
+		if err := c.Validate(); err != nil {
+			return err
+		}
+	}
+	for _, a := range req.Actions {
+		if err := a.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetPersonalRules 返回账户启用的个人规则，按优先级从高到低
+func GetPersonalRules(accountID int64) (rules []PersonalRule, err error) {
+	d, err := getDB()
+	if err != nil {
+		return nil, err
+	}
+	rules = make([]PersonalRule, 0)
+	err = d.Model(&rules).Where("account_id=? AND status=?", accountID, 1).Order("priority desc, id asc").Find(&rules).Error
+	return
+}
+
+// IndexPersonalRules 返回账户未删除的个人规则
+func IndexPersonalRules(accountID int64) (rules []PersonalRule, err error) {
+	d, err := getDB()
+	if err != nil {
+		return nil, err
+	}
+	rules = make([]PersonalRule, 0)
+	err = d.Model(&rules).Where("account_id=? AND status<>?", accountID, 2).Order("priority desc, id asc").Find(&rules).Error
+	return
+}
+
+func SavePersonalRule(accountID int64, req SavePersonalRuleRequest) error {
+	d, err := getDB()
+	if err != nil {
+		return err
+	}
+	if accountID <= 0 {
+		return errors.New("invalid account")
+	}
+	if err = req.validate(); err != nil {
+		return err
+	}
+	conditions, err := json.Marshal(req.Conditions)
+	if err != nil {
+		return err
+	}
+	actions, err := json.Marshal(req.Actions)
+	if err != nil {
+		return err
+	}
+
+	var rule PersonalRule
+	// req.ID>0 means update
+	if req.ID > 0 {
+		err := d.Model(&rule).Where("id=? AND account_id=? AND status<>?", req.ID, accountID, 2).First(&rule).Error
+		if err != nil && rule.ID == 0 {
+			return errors.New("rule not exists")
+		}
+		return d.Model(&rule).Where("id=?", req.ID).Updates(map[string]interface{}{
+			"name":        req.Name,
+			"priority":    req.Priority,
+			"logic":       req.Logic,
+			"conditions":  string(conditions),
+			"actions":     string(actions),
+			"stop":        req.Stop,
+			"update_time": time.Now(),
+		}).Error
+	}
+
+	return d.Transaction(func(tx *gorm.DB) error {
+		var total int64
+		err := tx.Model(&PersonalRule{}).Where("account_id=? AND status<>?", accountID, 2).Count(&total).Error
+		if err != nil {
+			return err
+		}
+		if total >= MaxPersonalRules {
+			return fmt.Errorf("no more than %d rules", MaxPersonalRules)
+		}
+		rule.AccountID = accountID
+		rule.Name = req.Name
+		rule.Priority = req.Priority
+		rule.Logic = req.Logic
+		rule.Conditions = string(conditions)
+		rule.Actions = string(actions)
+		rule.Stop = req.Stop
+		rule.Status = 1
+		rule.CreateTime = time.Now()
+		rule.UpdateTime = time.Now()
+		return tx.Model(&rule).Create(&rule).Error
+	})
+}
+
+func TogglePersonalRule(accountID, id int64) error {
+	d, err := getDB()
+	if err != nil {
+		return err
+	}
+	var rule PersonalRule
+	err = d.Model(&rule).Where("id=? AND account_id=?", id, accountID).First(&rule).Error
+	if err != nil && rule.ID == 0 {
+		return errors.New("rule not exists")
+	}
+	if rule.Status == 0 {
+		rule.Status = 1
+	} else if rule.Status == 1 {
+		rule.Status = 0
+	} else {
+		return errors.New("rule status error")
+	}
+	return d.Model(&rule).Where("id=?", id).Updates(map[string]interface{}{
+		"status":      rule.Status,
+		"update_time": time.Now(),
+	}).Error
+}
+
+func DeletePersonalRule(accountID, id int64) error {
+	d, err := getDB()
+	if err != nil {
+		return err
+	}
+	var rule PersonalRule
+	err = d.Model(&rule).Where("id=? AND account_id=?", id, accountID).First(&rule).Error
+	if err != nil && rule.ID == 0 {
+		return errors.New("rule not exists")
+	}
+	return d.Model(&rule).Where("id=?", id).Updates(map[string]interface{}{
+		"status":      2,
+		"update_time": time.Now(),
+		"delete_time": time.Now(),
+	}).Error
+}
@@ -0,0 +1,180 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type QuarantineStatus uint8
+
+const (
+	QuarantineHeld QuarantineStatus = iota
+	QuarantineReleased
+	QuarantineDeleted
+)
+
+// QuarantineMail 隔离邮件，邮件内容保存在对应账户的Quarantine文件夹
+type QuarantineMail struct {
+	ID          int64            `gorm:"primaryKey;AUTO_INCREMENT" json:"id"`
+	EmailID     int64            `gorm:"index:idx_email_id" json:"email_id"`
+	AccountID   int64            `gorm:"index:idx_account_id" json:"account_id"`
+	QueueID     string           `gorm:"type:varchar(255)" json:"queue_id"`
+	Sender      string           `gorm:"type:varchar(255)" json:"sender"`
+	Rcpt        string           `gorm:"type:varchar(255)" json:"rcpt"`
+	Subject     string           `gorm:"type:varchar(255)" json:"subject"`
+	Size        int64            `gorm:"default:0" json:"size"`
+	RuleID      int64            `gorm:"type:int(11);default(0)" json:"rule_id"`
+	Reason      string           `gorm:"type:varchar(255)" json:"reason"`
+	Status      QuarantineStatus `gorm:"type:int(8);default(0)" json:"status"` //0=held;1=released;2=deleted
+	CreateTime  time.Time        `gorm:"index:idx_create_time" json:"create_time"`
+	ReleaseTime time.Time        `json:"release_time"`
+	DeleteTime  time.Time        `json:"delete_time"`
+}
+
+func CreateQuarantineMail(q *QuarantineMail) error {
+	return CreateQuarantineMails([]*QuarantineMail{q})
+}
+
+// CreateQuarantineMails 在一个事务中保存同一封邮件的所有收件人的隔离记录
+func CreateQuarantineMails(qs []*QuarantineMail) error {
+	d, err := getDB()
+	if err != nil {
+		return err
+	}
+	for _, q := range qs {
+		if q.EmailID <= 0 || q.AccountID <= 0 {
+			return errors.New("invalid quarantine mail")
+		}
+		if q.CreateTime.IsZero() {
+			q.CreateTime = time.Now()
+		}
+	}
+	return d.Transaction(func(tx *gorm.DB) error {
+		for _, q := range qs {
+			if err := tx.Create(q).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func GetQuarantineMailByID(id int64) (q QuarantineMail, err error) {
+	d, err := getDB()
+	if err != nil {
+		return q, err
+	}
+	err = d.Model(&q).Where("id=?", id).Take(&q).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return q, errors.New("quarantine mail not exists")
+	}
+	return
+}
+
+// SearchQuarantineMail 按日期、状态、发件人、收件人分页查询隔离邮件
+func SearchQuarantineMail(req SearchQuarantineRequest) (total int64, mails []QuarantineMail, err error) {
+	d, err := getDB()
+	if err != nil {
+		return 0, nil, err
+	}
+	mails = make([]QuarantineMail, 0)
+	query := d.Model(&QuarantineMail{}).Where("status=?", req.Status)
+	if req.StartDate != "" {
+		start, err := time.ParseInLocation("2006-01-02", req.StartDate, time.Local)
+		if err != nil {
+			return 0, nil, errors.New("invalid start date")
+		}
+		query = query.Where("create_time>=?", start)
+	}
+	if req.EndDate != "" {
+		end, err := time.ParseInLocation("2006-01-02", req.EndDate, time.Local)
+		if err != nil {
+			return 0, nil, errors.New("invalid end date")
+		}
+		query = query.Where("create_time<?", end.AddDate(0, 0, 1))
+	}
+	if req.RuleID > 0 {
+		query = query.Where("rule_id=?", req.RuleID)
+	}
+	if req.Sender != "" {
+		query = query.Where("sender LIKE ?", "%"+req.Sender+"%")
+	}
+	if req.Rcpt != "" {
+		query = query.Where("rcpt LIKE ?", "%"+req.Rcpt+"%")
+	}
+	if err = query.Count(&total).Error; err != nil {
+		return 0, nil, err
+	}
+	err = query.Order("id desc").Offset(req.Start).Limit(req.Length).Find(&mails).Error
+	return
+}
+
+// ReleaseQuarantineMail 将隔离邮件移回收件人的收件箱，并记录审计日志
+func ReleaseQuarantineMail(id int64, auditor Auditor) error {
+	d, err := getDB()
+	if err != nil {
+		return err
+	}
+	return d.Transaction(func(tx *gorm.DB) error {
+		q, err := heldQuarantineMail(tx, id)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		result := tx.Model(&Email{}).Where("id=? AND account_id=? AND folder_id=? AND deleted=?", q.EmailID, q.AccountID, Quarantine, false).
+			Updates(map[string]interface{}{"folder_id": Inbox, "read_status": UnRead})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errors.New("quarantined email not exists")
+		}
+		err = tx.Model(&q).Where("id=?", id).Updates(map[string]interface{}{"status": QuarantineReleased, "release_time": now}).Error
+		if err != nil {
+			return err
+		}
+		return createAuditLog(tx, auditor, AuditQuarantineRelease, id, fmt.Sprintf("released email %d of rule %d to %s", q.EmailID, q.RuleID, q.Rcpt))
+	})
+}
+
+// DeleteQuarantineMail 删除隔离邮件，并记录审计日志
+func DeleteQuarantineMail(id int64, auditor Auditor) error {
+	d, err := getDB()
+	if err != nil {
+		return err
+	}
+	return d.Transaction(func(tx *gorm.DB) error {
+		q, err := heldQuarantineMail(tx, id)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		err = tx.Model(&Email{}).Where("id=? AND account_id=?", q.EmailID, q.AccountID).
+			Updates(map[string]interface{}{"deleted": true, "delete_time": now}).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Model(&q).Where("id=?", id).Updates(map[string]interface{}{"status": QuarantineDeleted, "delete_time": now}).Error
+		if err != nil {
+			return err
+		}
+		return createAuditLog(tx, auditor, AuditQuarantineDelete, id, fmt.Sprintf("deleted email %d of rule %d to %s", q.EmailID, q.RuleID, q.Rcpt))
+	})
+}
+
+func heldQuarantineMail(tx *gorm.DB, id int64) (q QuarantineMail, err error) {
+	err = tx.Model(&q).Where("id=?", id).Take(&q).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return q, errors.New("quarantine mail not exists")
+	}
+	if err != nil {
+		return q, err
+	}
+	if q.Status != QuarantineHeld {
+		return q, errors.New("quarantine mail is already released or deleted")
+	}
+	return q, nil
+}
@@ -0,0 +1,163 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// MaxSieveScripts 每个账户最多保存的sieve脚本数
+	MaxSieveScripts = 10
+	// MaxSieveScriptSize sieve脚本的最大字节数
+	MaxSieveScriptSize = 64 << 10
+)
+
+var (
+	ErrSieveScriptNotExists = errors.New("script not exists")
+	ErrSieveScriptExists    = errors.New("script already exists")
+	ErrSieveScriptActive    = errors.New("script is active")
+	ErrSieveScriptQuota     = fmt.Errorf("no more than %d scripts", MaxSieveScripts)
+)
+
+// SieveScript 用户的sieve脚本，每个账户最多一个启用
+type SieveScript struct {
+	ID         int64     `gorm:"primaryKey;AUTO_INCREMENT" json:"id"`
+	AccountID  int64     `gorm:"uniqueIndex:idx_account_name" json:"account_id"`
+	Name       string    `gorm:"type:varchar(255);uniqueIndex:idx_account_name" json:"name"`
+	Content    string    `gorm:"type:mediumtext" json:"content"`
+	Active     bool      `gorm:"default:false" json:"active"`
+	CreateTime time.Time `json:"create_time"`
+	UpdateTime time.Time `json:"update_time"`
+}
+
+func ListSieveScripts(accountID int64) (scripts []SieveScript, err error) {
+	d, err := getDB()
+	if err != nil {
+		return nil, err
+	}
+	scripts = make([]SieveScript, 0)
+	err = d.Model(&scripts).Where("account_id=?", accountID).Order("name asc").Find(&scripts).Error
+	return
+}
+
+func GetSieveScript(accountID int64, name string) (*SieveScript, error) {
+	d, err := getDB()
+	if err != nil {
+		return nil, err
+	}
+	script := &SieveScript{}
+	err = d.Model(script).Where("account_id=? AND name=?", accountID, name).Take(script).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrSieveScriptNotExists
+	}
+	return script, err
+}
+
+// GetActiveSieveScript 返回账户启用的脚本，没有时返回nil
+func GetActiveSieveScript(accountID int64) (*SieveScript, error) {
+	d, err := getDB()
+	if err != nil {
+		return nil, err
+	}
+	script := &SieveScript{}
+	err = d.Model(script).Where("account_id=? AND active=?", accountID, true).Take(script).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	return script, err
+}
+
+// PutSieveScript 保存脚本，同名脚本被覆盖，脚本内容由调用方校验
+func PutSieveScript(accountID int64, name, content string) error {
+	d, err := getDB()
+	if err != nil {
+		return err
+	}
+	if len(content) > MaxSieveScriptSize {
+		return fmt.Errorf("script is larger than %d bytes", MaxSieveScriptSize)
+	}
+	return d.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		result := tx.Model(&SieveScript{}).Where("account_id=? AND name=?", accountID, name).Updates(map[string]interface{}{
+			"content":     content,
+			"update_time": now,
+		})
+		if result.Error != nil || result.RowsAffected > 0 {
+			return result.Error
+		}
+		var total int64
+		if err := tx.Model(&SieveScript{}).Where("account_id=?", accountID).Count(&total).Error; err != nil {
+			return err
+		}
+		if total >= MaxSieveScripts {
+			return ErrSieveScriptQuota
+		}
+		return tx.Create(&SieveScript{AccountID: accountID, Name: name, Content: content, CreateTime: now, UpdateTime: now}).Error
+	})
+}
+
+// SetActiveSieveScript 启用脚本并停用其它脚本，name为空时全部停用
+func SetActiveSieveScript(accountID int64, name string) error {
+	d, err := getDB()
+	if err != nil {
+		return err
+	}
+	return d.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		if name != "" {
+			var total int64
+			if err := tx.Model(&SieveScript{}).Where("account_id=? AND name=?", accountID, name).Count(&total).Error; err != nil {
+				return err
+			}
+			if total == 0 {
+				return ErrSieveScriptNotExists
+			}
+		}
+		err := tx.Model(&SieveScript{}).Where("account_id=? AND active=? AND name<>?", accountID, true, name).
+			Updates(map[string]interface{}{"active": false, "update_time": now}).Error
+		if err != nil || name == "" {
+			return err
+		}
+		return tx.Model(&SieveScript{}).Where("account_id=? AND name=?", accountID, name).
+			Updates(map[string]interface{}{"active": true, "update_time": now}).Error
+	})
+}
+
+// DeleteSieveScript 删除脚本，启用中的脚本不能删除
+func DeleteSieveScript(accountID int64, name string) error {
+	script, err := GetSieveScript(accountID, name)
+	if err != nil {
+		return err
+	}
+	if script.Active {
+		return ErrSieveScriptActive
+	}
+	d, err := getDB()
+	if err != nil {
+		return err
+	}
+	return d.Delete(&SieveScript{}, script.ID).Error
+}
+
+func RenameSieveScript(accountID int64, oldName, newName string) error {
+	script, err := GetSieveScript(accountID, oldName)
+	if err != nil {
+		return err
+	}
+	if _, err = GetSieveScript(accountID, newName); err == nil {
+		return ErrSieveScriptExists
+	} else if !errors.Is(err, ErrSieveScriptNotExists) {
+		return err
+	}
+	d, err := getDB()
+	if err != nil {
+		return err
+	}
+	return d.Model(script).Where("id=?", script.ID).Updates(map[string]interface{}{
+		"name":        newName,
+		"update_time": time.Now(),
+	}).Error
+}
@@ -0,0 +1,217 @@
+package attachment
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"easymail/internal/app/service/milter/third_party/ssdeep"
+	"encoding/hex"
+	"io"
+	"mime"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/gabriel-vasile/mimetype"
+	"github.com/jhillyerd/enmime"
+)
+
+const (
+	// maxDepth bounds the nesting of attached messages and archives
+	maxDepth = 3
+	// maxFiles bounds the files examined per message
+	maxFiles = 100
+	// maxFileSize and maxTotalSize bound what is unpacked from archives, larger files are only named
+	maxFileSize  = 16 << 20
+	maxTotalSize = 64 << 20
+)
+
+// File is an attachment, or a file of an attached message or archive
+type File struct {
+	// Name is the path of the file in the message, e.g. invoice.zip/invoice.exe
+	Name string
+	// DeclaredType is the content type of the mime part, empty for archived files
+	DeclaredType string
+	// Type is the type detected from the content, empty when it was not unpacked
+	Type   string
+	Size   int64
+	MD5    string
+	SHA256 string
+	// Ssdeep is empty for files too small for a meaningful hash
+	Ssdeep string
+	// Executable is set for executables by content or by extension
+	Executable bool
+	// ExtMismatch is set when the content is not what the extension claims
+	ExtMismatch bool
+	// Encrypted archive entries can't be examined, only their names are checked
+	Encrypted bool
+}
+
+// extractor collects the files of a message within the limits
+type extractor struct {
+	files    []File
+	unpacked int64
+}
+
+// Extract returns the attachments and inline parts of a message, attached
+// messages and zip archives are unpacked up to maxDepth levels.
+func Extract(env *enmime.Envelope) []File {
+	e := &extractor{}
+	e.envelope(env, "", 0)
+	return e.files
+}
+
+func (e *extractor) envelope(env *enmime.Envelope, prefix string, depth int) {
+	parts := append(append([]*enmime.Part(nil), env.Attachments...), env.Inlines...)
+	for i, p := range parts {
+		name := p.FileName
+		if name == "" {
+			name = "part-" + strconv.Itoa(i+1)
+		}
+		e.add(prefix+name, p.ContentType, p.Content, depth)
+	}
+}
+
+func (e *extractor) add(name, declared string, data []byte, depth int) {
+	if len(e.files) >= maxFiles {
+		return
+	}
+	detected := mimetype.Detect(data)
+	f := File{
+		Name:         name,
+		DeclaredType: declared,
+		Type:         mediaType(detected.String()),
+		Size:         int64(len(data)),
+		Executable:   executable(name, detected),
+		ExtMismatch:  extMismatch(name, detected),
+	}
+	md5Sum, sha256Sum := md5.Sum(data), sha256.Sum256(data)
+	f.MD5, f.SHA256 = hex.EncodeToString(md5Sum[:]), hex.EncodeToString(sha256Sum[:])
+	// small files have no ssdeep hash
+	f.Ssdeep, _ = ssdeep.FuzzyBytes(data)
+	e.files = append(e.files, f)
+
+	if depth >= maxDepth {
+		return
+	}
+	switch {
+	case detected.Is("application/zip"):
+		e.zip(name, data, depth+1)
+	case strings.EqualFold(mediaType(declared), "message/rfc822") || detected.Is("message/rfc822"):
+		if env, err := enmime.ReadEnvelope(bytes.NewReader(data)); err == nil {
+			e.envelope(env, name+"/", depth+1)
+		}
+	}
+}
+
+// zip adds the files of an archive, a broken archive is left as it is
+func (e *extractor) zip(name string, data []byte, depth int) {
+	r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return
+	}
+	for _, zf := range r.File {
+		if len(e.files) >= maxFiles {
+			return
+		}
+		if zf.FileInfo().IsDir() {
+			continue
+		}
+		fileName := name + "/" + zf.Name
+		// bit 0 of the flags marks an encrypted entry
+		encrypted := zf.Flags&0x1 != 0
+		size := int64(zf.UncompressedSize64)
+		if encrypted || size > maxFileSize || e.unpacked+size > maxTotalSize {
+			e.files = append(e.files, File{
+				Name:       fileName,
+				Size:       size,
+				Executable: executableExt(fileName),
+				Encrypted:  encrypted,
+			})
+			continue
+		}
+		rc, err := zf.Open()
+		if err != nil {
+			continue
+		}
+		// the declared size may lie, reading stops at the limit
+		content, err := io.ReadAll(io.LimitReader(rc, maxFileSize+1))
+		_ = rc.Close()
+		if err != nil || len(content) > maxFileSize {
+			continue
+		}
+		e.unpacked += int64(len(content))
+		e.add(fileName, "", content, depth)
+	}
+}
+
+// mediaType drops the parameters of a content type
+func mediaType(contentType string) string {
+	t, _, _ := strings.Cut(contentType, ";")
+	return strings.ToLower(strings.TrimSpace(t))
+}
+
+// executableExts are run by a double click on common desktops
+var executableExts = map[string]bool{
+	".exe": true, ".scr": true, ".com": true, ".pif": true, ".bat": true, ".cmd": true,
+	".vbs": true, ".vbe": true, ".js": true, ".jse": true, ".wsf": true, ".wsh": true,
+	".hta": true, ".ps1": true, ".psm1": true, ".msi": true, ".msp": true, ".lnk": true,
+	".jar": true, ".cpl": true, ".dll": true, ".reg": true, ".app": true, ".sh": true,
+}
+
+// executableTypes are detected from the content
+var executableTypes = []string{
+	"application/vnd.microsoft.portable-executable",
+	"application/x-elf",
+	"application/x-mach-binary",
+	"application/x-ms-installer",
+	"application/x-ms-shortcut",
+	"application/jar",
+}
+
+func executableExt(name string) bool {
+	return executableExts[strings.ToLower(path.Ext(name))]
+}
+
+func executable(name string, detected *mimetype.MIME) bool {
+	if executableExt(name) {
+		return true
+	}
+	for t := detected; t != nil; t = t.Parent() {
+		for _, e := range executableTypes {
+			if t.Is(e) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// extAliases are extensions of the same format the detection reports under another one
+var extAliases = map[string]string{
+	".jpeg": ".jpg", ".jpe": ".jpg", ".tif": ".tiff", ".htm": ".html",
+	".docm": ".docx", ".dotx": ".docx", ".dotm": ".docx",
+	".xlsm": ".xlsx", ".xltx": ".xlsx", ".xltm": ".xlsx",
+	".pptm": ".pptx", ".potx": ".pptx", ".ppsx": ".pptx",
+	".dot": ".doc", ".xlt": ".xls", ".pps": ".ppt", ".pot": ".ppt",
+}
+
+// extMismatch tells whether the content is not of the type the extension of
+// name claims, content without a known signature never mismatches.
+func extMismatch(name string, detected *mimetype.MIME) bool {
+	ext := strings.ToLower(path.Ext(name))
+	if ext == "" || detected.Is("application/octet-stream") || detected.Is("text/plain") {
+		return false
+	}
+	if alias, ok := extAliases[ext]; ok {
+		ext = alias
+	}
+	declared := mediaType(mime.TypeByExtension(ext))
+	for t := detected; t != nil; t = t.Parent() {
+		if t.Extension() == ext || (declared != "" && t.Is(declared)) {
+			return false
+		}
+	}
+	return true
+}
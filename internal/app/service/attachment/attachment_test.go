@@ -0,0 +1,151 @@
+package attachment
+
+import (
+	"archive/zip"
+	"bytes"
+	"easymail/internal/model"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jhillyerd/enmime"
+)
+
+var (
+	exeData = append([]byte("MZ"), bytes.Repeat([]byte{0x90}, 300)...)
+	pngData = append([]byte{0x89, 0x50, 0x4E, 0x47, 0x0D, 0x0A, 0x1A, 0x0A}, bytes.Repeat([]byte{0}, 32)...)
+)
+
+func zipOf(t *testing.T, files map[string][]byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for name, data := range files {
+		f, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = f.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// message builds a multipart message with base64 encoded attachments
+func message(parts map[string][]byte, types map[string]string) string {
+	var b strings.Builder
+	b.WriteString("Subject: files\r\nMIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=b\r\n\r\n")
+	b.WriteString("--b\r\nContent-Type: text/plain\r\n\r\nsee attached\r\n")
+	for name, data := range parts {
+		contentType := types[name]
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		b.WriteString("--b\r\nContent-Type: " + contentType + "\r\nContent-Disposition: attachment; filename=" + name + "\r\n")
+		b.WriteString("Content-Transfer-Encoding: base64\r\n\r\n")
+		b.WriteString(base64.StdEncoding.EncodeToString(data) + "\r\n")
+	}
+	b.WriteString("--b--\r\n")
+	return b.String()
+}
+
+func extract(t *testing.T, raw string) map[string]File {
+	t.Helper()
+	env, err := enmime.ReadEnvelope(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]File)
+	for _, f := range Extract(env) {
+		files[f.Name] = f
+	}
+	return files
+}
+
+func TestExtract(t *testing.T) {
+	inner := message(map[string][]byte{"setup.exe": exeData}, nil)
+	raw := message(map[string][]byte{
+		"invoice.pdf": exeData,
+		"photo.jpeg":  pngData,
+		"logo.png":    pngData,
+		"docs.zip":    zipOf(t, map[string][]byte{"readme.txt": []byte("hello"), "run.js": []byte("alert(1)")}),
+		"fwd.eml":     []byte(inner),
+	}, map[string]string{"fwd.eml": "message/rfc822"})
+	files := extract(t, raw)
+
+	cases := []struct {
+		name       string
+		executable bool
+		mismatch   bool
+	}{
+		{"invoice.pdf", true, true},
+		{"photo.jpeg", false, true},
+		{"logo.png", false, false},
+		{"docs.zip", false, false},
+		{"docs.zip/readme.txt", false, false},
+		{"docs.zip/run.js", true, false},
+		{"fwd.eml", false, false},
+		{"fwd.eml/setup.exe", true, false},
+	}
+	for _, c := range cases {
+		f, ok := files[c.name]
+		if !ok {
+			t.Fatalf("missing file %s in %v", c.name, files)
+		}
+		if f.Executable != c.executable || f.ExtMismatch != c.mismatch {
+			t.Fatalf("%s: expected executable %v and mismatch %v, got %+v", c.name, c.executable, c.mismatch, f)
+		}
+	}
+	if len(files) != len(cases) {
+		t.Fatalf("expected %d files, got %d", len(cases), len(files))
+	}
+	exe := files["fwd.eml/setup.exe"]
+	if exe.Type != "application/vnd.microsoft.portable-executable" || len(exe.MD5) != 32 || len(exe.SHA256) != 64 || exe.Ssdeep == "" {
+		t.Fatalf("unexpected hashes %+v", exe)
+	}
+	if files["docs.zip/readme.txt"].Ssdeep != "" {
+		t.Fatal("expected no ssdeep hash of a small file")
+	}
+}
+
+func TestHashList(t *testing.T) {
+	files := extract(t, message(map[string][]byte{"a.exe": exeData, "b.png": pngData}, nil))
+	exe, png := files["a.exe"], files["b.png"]
+
+	loads := 0
+	hashes := []model.BlockedHash{{Type: model.HashTypeSHA256, Hash: exe.SHA256}}
+	now := time.Now()
+	l := NewHashList()
+	l.now = func() time.Time { return now }
+	l.load = func() ([]model.BlockedHash, error) {
+		loads++
+		return hashes, nil
+	}
+	if !l.Blocked(exe) || l.Blocked(png) {
+		t.Fatal("expected the exe to be blocked by sha256")
+	}
+
+	// the list is cached for a minute
+	hashes = []model.BlockedHash{{Type: model.HashTypeMD5, Hash: png.MD5}}
+	if !l.Blocked(exe) || loads != 1 {
+		t.Fatalf("expected the cached list, loaded %d times", loads)
+	}
+	now = now.Add(reloadInterval)
+	if l.Blocked(exe) || !l.Blocked(png) {
+		t.Fatal("expected the png to be blocked by md5")
+	}
+
+	// a variant of a blocked file
+	variant := append(append([]byte(nil), exeData...), 'x')
+	changed := extract(t, message(map[string][]byte{"c.exe": variant}, nil))["c.exe"]
+	hashes = []model.BlockedHash{{Type: model.HashTypeSsdeep, Hash: exe.Ssdeep}}
+	now = now.Add(reloadInterval)
+	if changed.SHA256 == exe.SHA256 || !l.Blocked(changed) {
+		t.Fatalf("expected the variant to match the ssdeep hash %s, got %s", exe.Ssdeep, changed.Ssdeep)
+	}
+}
@@ -0,0 +1,104 @@
+package attachment
+
+import (
+	"easymail/internal/app/service/milter/third_party/ssdeep"
+	"easymail/internal/model"
+	"sync"
+	"time"
+)
+
+const (
+	// reloadInterval is how long a loaded list is used before it is read again
+	reloadInterval = time.Minute
+	// DefaultSsdeepThreshold is the score from which a file matches a blocked ssdeep hash
+	DefaultSsdeepThreshold = 80
+)
+
+/*
+HashList is the list of blocked hashes the admin manages, a file is blocked
+when its md5 or sha256 is listed or its ssdeep hash is similar enough to a
+listed one. The list is read again once a minute, a failed read keeps the
+last one.
+*/
+type HashList struct {
+	load      func() ([]model.BlockedHash, error)
+	now       func() time.Time
+	logf      func(format string, args ...any)
+	threshold int
+
+	lock   sync.Mutex
+	loaded time.Time
+	md5    map[string]struct{}
+	sha256 map[string]struct{}
+	ssdeep []string
+}
+
+// NewHashList creates the list of the blocked hashes in database
+func NewHashList() *HashList {
+	return &HashList{
+		load:      model.ListBlockedHashes,
+		now:       time.Now,
+		threshold: DefaultSsdeepThreshold,
+	}
+}
+
+// SetLogf sets where failed reads are reported
+func (l *HashList) SetLogf(logf func(format string, args ...any)) {
+	l.logf = logf
+}
+
+// SetSsdeepThreshold sets the score from which a file matches a blocked ssdeep hash
+func (l *HashList) SetSsdeepThreshold(threshold int) {
+	l.threshold = threshold
+}
+
+// reload reads the list when it is older than reloadInterval, the lock is held
+func (l *HashList) reload() {
+	now := l.now()
+	if !l.loaded.IsZero() && now.Sub(l.loaded) < reloadInterval {
+		return
+	}
+	l.loaded = now
+	hashes, err := l.load()
+	if err != nil {
+		if l.logf != nil {
+			l.logf("load blocked hashes: %v", err)
+		}
+		return
+	}
+	l.md5 = make(map[string]struct{})
+	l.sha256 = make(map[string]struct{})
+	l.ssdeep = l.ssdeep[:0]
+	for _, h := range hashes {
+		switch h.Type {
+		case model.HashTypeMD5:
+			l.md5[h.Hash] = struct{}{}
+		case model.HashTypeSHA256:
+			l.sha256[h.Hash] = struct{}{}
+		case model.HashTypeSsdeep:
+			l.ssdeep = append(l.ssdeep, h.Hash)
+		}
+	}
+}
+
+// Blocked tells whether a file matches a blocked hash
+func (l *HashList) Blocked(f File) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.reload()
+	if _, ok := l.md5[f.MD5]; ok && f.MD5 != "" {
+		return true
+	}
+	if _, ok := l.sha256[f.SHA256]; ok && f.SHA256 != "" {
+		return true
+	}
+	if f.Ssdeep == "" {
+		return false
+	}
+	for _, h := range l.ssdeep {
+		if score, err := ssdeep.Distance(f.Ssdeep, h); err == nil && score >= l.threshold {
+			return true
+		}
+	}
+	return false
+}
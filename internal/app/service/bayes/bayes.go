@@ -0,0 +1,272 @@
+package bayes
+
+import (
+	"context"
+	"easymail/internal/pkg/utils/preprocessing"
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	keyPrefix = "bayes"
+	// DefaultMinMessages is how many spam and ham messages are learned before messages are scored
+	DefaultMinMessages = 200
+
+	// maxTokens caps the tokens of a message, the rest is ignored
+	maxTokens = 1000
+	// maxTokenLength drops tokens which are rather encoded data than words
+	maxTokenLength = 64
+	// maxSignificant is how many tokens far from neutral are combined into the score
+	maxSignificant = 150
+	// minDeviation drops tokens whose probability is too close to neutral to tell
+	minDeviation = 0.1
+	// strength and neutral are s and x of Robinson, a token seen n times moves from x to its ratio
+	strength = 1.0
+	neutral  = 0.5
+
+	// maxLearnRetries is how often a learn losing the race on the learned hash is tried
+	maxLearnRetries = 10
+)
+
+const (
+	classSpam = "spam"
+	classHam  = "ham"
+)
+
+/*
+Classifier is a naive Bayes spam classifier, it counts in redis how many
+spam and ham messages every token appeared in and combines the probabilities
+of the tokens of a message with the chi-square method of Robinson and Fisher.
+Messages are only scored once enough of both classes were learned.
+*/
+type Classifier struct {
+	rc          *redis.Client
+	prefix      string
+	tokenizer   preprocessing.Tokenizer
+	html        *preprocessing.Html2Text
+	minMessages int64
+}
+
+// New creates a classifier kept in redis, texts are cut by the fuzzy tokenizer
+func New(rc *redis.Client) *Classifier {
+	return &Classifier{
+		rc:          rc,
+		prefix:      keyPrefix,
+		tokenizer:   preprocessing.NewTokenizerFuzzy(nil),
+		html:        preprocessing.NewHtml2Text(nil),
+		minMessages: DefaultMinMessages,
+	}
+}
+
+// SetTokenizer cuts texts with another tokenizer, e.g. preprocessing.NewTokenizerDefault
+func (c *Classifier) SetTokenizer(t preprocessing.Tokenizer) {
+	c.tokenizer = t
+}
+
+// SetMinMessages sets how many messages of each class are learned before scoring
+func (c *Classifier) SetMinMessages(n int64) {
+	c.minMessages = n
+}
+
+// tokensKey is the hash of the token counters of a class
+func (c *Classifier) tokensKey(class string) string {
+	return c.prefix + ":" + class
+}
+
+// messagesKey is the hash of the message counters by class
+func (c *Classifier) messagesKey() string {
+	return c.prefix + ":messages"
+}
+
+// learnedKey is the hash of the class every learned message was learned as
+func (c *Classifier) learnedKey() string {
+	return c.prefix + ":learned"
+}
+
+// Tokens returns the distinct tokens of a message, subject tokens and the
+// hosts of links are prefixed so they count apart from the body words.
+func (c *Classifier) Tokens(subject, text, html string) []string {
+	seen := make(map[string]struct{})
+	tokens := make([]string, 0, 256)
+	add := func(prefix string, words []string) {
+		for _, w := range words {
+			w = strings.TrimSpace(w)
+			if w == "" || len(w) > maxTokenLength || len(tokens) >= maxTokens {
+				continue
+			}
+			w = prefix + w
+			if _, ok := seen[w]; ok {
+				continue
+			}
+			seen[w] = struct{}{}
+			tokens = append(tokens, w)
+		}
+	}
+	add("subject:", c.tokenizer.Cut(subject, true, true, false, false))
+	add("", c.tokenizer.Cut(text, true, true, false, false))
+	if html != "" {
+		parts, links := c.html.Parse(html)
+		add("", c.tokenizer.Cut(strings.Join(parts, "\n"), true, true, false, false))
+		hosts := make([]string, 0, len(links))
+		for _, link := range links {
+			if u, err := url.Parse(strings.TrimSpace(link)); err == nil && u.Hostname() != "" {
+				hosts = append(hosts, strings.ToLower(u.Hostname()))
+			}
+		}
+		add("url:", hosts)
+	}
+	return tokens
+}
+
+// Classify returns the spam probability of a message between 0 and 1, trained
+// is false while too few messages were learned to tell.
+func (c *Classifier) Classify(ctx context.Context, subject, text, html string) (score float64, trained bool, err error) {
+	return c.Score(ctx, c.Tokens(subject, text, html))
+}
+
+// Score returns the spam probability of the tokens of a message, see Classify
+func (c *Classifier) Score(ctx context.Context, tokens []string) (float64, bool, error) {
+	messages, err := c.rc.HMGet(ctx, c.messagesKey(), classSpam, classHam).Result()
+	if err != nil {
+		return neutral, false, err
+	}
+	nspam, nham := count(messages[0]), count(messages[1])
+	if nspam < c.minMessages || nham < c.minMessages || nspam == 0 || nham == 0 {
+		return neutral, false, nil
+	}
+	if len(tokens) == 0 {
+		return neutral, true, nil
+	}
+	var spam, ham *redis.SliceCmd
+	_, err = c.rc.Pipelined(ctx, func(p redis.Pipeliner) error {
+		spam = p.HMGet(ctx, c.tokensKey(classSpam), tokens...)
+		ham = p.HMGet(ctx, c.tokensKey(classHam), tokens...)
+		return nil
+	})
+	if err != nil {
+		return neutral, false, err
+	}
+	probs := make([]float64, 0, len(tokens))
+	for i := range tokens {
+		s, h := count(spam.Val()[i]), count(ham.Val()[i])
+		if s+h == 0 {
+			continue
+		}
+		probs = append(probs, tokenProb(s, h, nspam, nham))
+	}
+	return combine(probs), true, nil
+}
+
+// Learn counts the tokens of a message as spam or ham, id names the message so
+// learning it again is ignored and learning it as the other class moves it.
+// The class learned before is watched, a concurrent learn of the message
+// makes the transaction fail and it is tried again.
+func (c *Classifier) Learn(ctx context.Context, id string, tokens []string, spam bool) error {
+	class, other := classHam, classSpam
+	if spam {
+		class, other = classSpam, classHam
+	}
+	learn := func(tx *redis.Tx) error {
+		prev, err := tx.HGet(ctx, c.learnedKey(), id).Result()
+		if err != nil && !errors.Is(err, redis.Nil) {
+			return err
+		}
+		if prev == class {
+			return nil
+		}
+		_, err = tx.TxPipelined(ctx, func(p redis.Pipeliner) error {
+			if prev == other {
+				for _, token := range tokens {
+					p.HIncrBy(ctx, c.tokensKey(other), token, -1)
+				}
+				p.HIncrBy(ctx, c.messagesKey(), other, -1)
+			}
+			for _, token := range tokens {
+				p.HIncrBy(ctx, c.tokensKey(class), token, 1)
+			}
+			p.HIncrBy(ctx, c.messagesKey(), class, 1)
+			p.HSet(ctx, c.learnedKey(), id, class)
+			return nil
+		})
+		return err
+	}
+	for i := 0; i < maxLearnRetries; i++ {
+		err := c.rc.Watch(ctx, learn, c.learnedKey())
+		if !errors.Is(err, redis.TxFailedErr) {
+			return err
+		}
+	}
+	return fmt.Errorf("bayes learn %s: %w", id, redis.TxFailedErr)
+}
+
+// count converts a counter read by HMGET, missing and negative ones are 0
+func count(v any) int64 {
+	s, ok := v.(string)
+	if !ok {
+		return 0
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// tokenProb is the probability that a message with the token is spam, tokens
+// seen rarely stay near neutral.
+func tokenProb(s, h, nspam, nham int64) float64 {
+	spamRatio := math.Min(float64(s)/float64(nspam), 1)
+	hamRatio := math.Min(float64(h)/float64(nham), 1)
+	p := spamRatio / (spamRatio + hamRatio)
+	n := float64(s + h)
+	return (strength*neutral + n*p) / (strength + n)
+}
+
+// combine joins the most significant token probabilities by the chi-square
+// method, no significant token gives a neutral score.
+func combine(probs []float64) float64 {
+	significant := make([]float64, 0, len(probs))
+	for _, p := range probs {
+		if math.Abs(p-neutral) >= minDeviation {
+			significant = append(significant, p)
+		}
+	}
+	if len(significant) == 0 {
+		return neutral
+	}
+	sort.Slice(significant, func(i, j int) bool {
+		return math.Abs(significant[i]-neutral) > math.Abs(significant[j]-neutral)
+	})
+	if len(significant) > maxSignificant {
+		significant = significant[:maxSignificant]
+	}
+	var lnSpam, lnHam float64
+	for _, p := range significant {
+		lnSpam += math.Log(1 - p)
+		lnHam += math.Log(p)
+	}
+	n := 2 * len(significant)
+	s := 1 - chi2Q(-2*lnSpam, n)
+	h := 1 - chi2Q(-2*lnHam, n)
+	return (s - h + 1) / 2
+}
+
+// chi2Q is the probability that chi-square with v degrees of freedom, v even,
+// is at least x2.
+func chi2Q(x2 float64, v int) float64 {
+	m := x2 / 2
+	term := math.Exp(-m)
+	sum := term
+	for i := 1; i < v/2; i++ {
+		term *= m / float64(i)
+		sum += term
+	}
+	return math.Min(sum, 1)
+}
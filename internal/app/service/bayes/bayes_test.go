@@ -0,0 +1,119 @@
+package bayes
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestTokens(t *testing.T) {
+	c := New(nil)
+	tokens := c.Tokens("Cheap Watches", "cheap watches, buy now! 便宜手表",
+		`<html><body><p>Buy now</p><a href="https://Shop.example/x">click</a></body></html>`)
+	seen := make(map[string]bool)
+	for _, token := range tokens {
+		if seen[token] {
+			t.Fatalf("duplicate token %q in %v", token, tokens)
+		}
+		seen[token] = true
+	}
+	for _, want := range []string{"subject:cheap", "subject:cheap watches", "cheap", "buy now", "便宜", "手表", "url:shop.example"} {
+		if !seen[want] {
+			t.Fatalf("missing token %q in %v", want, tokens)
+		}
+	}
+}
+
+func TestCombine(t *testing.T) {
+	if got := combine(nil); got != neutral {
+		t.Fatalf("expected a neutral score without tokens, got %v", got)
+	}
+	if got := combine([]float64{0.55, 0.45}); got != neutral {
+		t.Fatalf("expected near neutral tokens to be dropped, got %v", got)
+	}
+	if got := combine([]float64{0.99, 0.98, 0.95, 0.9}); got < 0.9 {
+		t.Fatalf("expected a spam score, got %v", got)
+	}
+	if got := combine([]float64{0.01, 0.02, 0.05, 0.1}); got > 0.1 {
+		t.Fatalf("expected a ham score, got %v", got)
+	}
+	// a token seen once stays closer to neutral than one seen often
+	if once, often := tokenProb(1, 0, 10, 10), tokenProb(9, 0, 10, 10); once >= often || once <= neutral {
+		t.Fatalf("unexpected token probabilities %v and %v", once, often)
+	}
+}
+
+func TestClassifier(t *testing.T) {
+	rc := redis.NewClient(&redis.Options{Addr: "127.0.0.1:6379"})
+	defer rc.Close()
+	ctx := context.Background()
+	if err := rc.Ping(ctx).Err(); err != nil {
+		t.Skip(err)
+	}
+	c := New(rc)
+	c.prefix = "bayes-test-" + time.Now().Format("150405.000000")
+	c.SetMinMessages(3)
+	defer rc.Del(ctx, c.tokensKey(classSpam), c.tokensKey(classHam), c.messagesKey(), c.learnedKey())
+
+	learn := func(id string, subject, text string, spam bool) {
+		t.Helper()
+		if err := c.Learn(ctx, id, c.Tokens(subject, text, ""), spam); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, trained, err := c.Classify(ctx, "cheap watches", "", ""); err != nil || trained {
+		t.Fatalf("expected an untrained classifier, got %v %v", trained, err)
+	}
+	for i := 0; i < 3; i++ {
+		learn(fmt.Sprintf("spam-%d", i), "cheap watches", "buy cheap replica watches now", true)
+		learn(fmt.Sprintf("ham-%d", i), "meeting notes", "the notes of the project meeting are attached", false)
+	}
+	// learning a message again is ignored
+	learn("spam-0", "cheap watches", "buy cheap replica watches now", true)
+	counts, err := rc.HGetAll(ctx, c.messagesKey()).Result()
+	if err != nil || counts[classSpam] != "3" || counts[classHam] != "3" {
+		t.Fatalf("unexpected message counts %v %v", counts, err)
+	}
+
+	spam, trained, err := c.Classify(ctx, "Cheap watches", "replica watches for you", "")
+	if err != nil || !trained || spam < 0.9 {
+		t.Fatalf("expected spam, got %v %v %v", spam, trained, err)
+	}
+	ham, _, err := c.Classify(ctx, "Meeting", "notes of the meeting", "")
+	if err != nil || ham > 0.1 {
+		t.Fatalf("expected ham, got %v %v", ham, err)
+	}
+
+	// a message marked as not spam moves to ham
+	learn("spam-0", "cheap watches", "buy cheap replica watches now", false)
+	counts, err = rc.HGetAll(ctx, c.messagesKey()).Result()
+	if err != nil || counts[classSpam] != "2" || counts[classHam] != "4" {
+		t.Fatalf("unexpected message counts %v %v", counts, err)
+	}
+
+	// users marking the same message at once count it once
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- c.Learn(ctx, "spam-1", c.Tokens("cheap watches", "buy cheap replica watches now", ""), false)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	counts, err = rc.HGetAll(ctx, c.messagesKey()).Result()
+	if err != nil || counts[classSpam] != "1" || counts[classHam] != "5" {
+		t.Fatalf("unexpected message counts %v %v", counts, err)
+	}
+}
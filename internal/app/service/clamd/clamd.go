@@ -0,0 +1,171 @@
+package clamd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultTimeout bounds the dial, each chunk written and the wait for the verdict
+	DefaultTimeout = 30 * time.Second
+	// chunkSize is the most sent in one INSTREAM chunk
+	chunkSize = 64 << 10
+	// maxReply bounds the reply read from clamd
+	maxReply = 4096
+)
+
+// ErrSizeLimit is returned when the stream exceeds StreamMaxLength of clamd
+var ErrSizeLimit = errors.New("clamd: stream size limit exceeded")
+
+// Result is the verdict on a scanned stream
+type Result struct {
+	Infected bool
+	// Virus is the signature name clamd reported, e.g. Win.Test.EICAR_HDB-1
+	Virus string
+}
+
+// Client scans streams with the INSTREAM command of clamd, every scan has a connection of its own
+type Client struct {
+	network string
+	address string
+	timeout time.Duration
+}
+
+/*
+New creates a client of the clamd at address, unix:/run/clamav/clamd.ctl or
+an absolute path is a unix socket, tcp:127.0.0.1:3310 or host:port is tcp.
+*/
+func New(address string) *Client {
+	c := &Client{network: "tcp", address: address, timeout: DefaultTimeout}
+	switch {
+	case strings.HasPrefix(address, "unix:"):
+		c.network, c.address = "unix", strings.TrimPrefix(address, "unix:")
+	case strings.HasPrefix(address, "tcp:"):
+		c.address = strings.TrimPrefix(address, "tcp:")
+	case strings.HasPrefix(address, "/"):
+		c.network = "unix"
+	}
+	return c
+}
+
+// SetTimeout sets the timeout of the dial, each chunk written and the wait for the verdict
+func (c *Client) SetTimeout(timeout time.Duration) {
+	c.timeout = timeout
+}
+
+func (c *Client) dial() (net.Conn, error) {
+	conn, err := net.DialTimeout(c.network, c.address, c.timeout)
+	if err != nil {
+		return nil, fmt.Errorf("clamd: %w", err)
+	}
+	return conn, nil
+}
+
+// Ping tells whether clamd is reachable and answering
+func (c *Client) Ping() error {
+	conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(c.timeout))
+	if _, err = conn.Write([]byte("zPING\x00")); err != nil {
+		return fmt.Errorf("clamd: %w", err)
+	}
+	reply, err := readReply(conn)
+	if err != nil {
+		return err
+	}
+	if reply != "PONG" {
+		return fmt.Errorf("clamd: unexpected reply %q", reply)
+	}
+	return nil
+}
+
+/*
+Scan sends r to clamd as it is read, so a message can be scanned while it is
+still arriving. When clamd stops reading early, e.g. at its size limit, the
+rest of r is left unread and its reply is returned.
+*/
+func (c *Client) Scan(r io.Reader) (Result, error) {
+	conn, err := c.dial()
+	if err != nil {
+		return Result{}, err
+	}
+	defer conn.Close()
+	_ = conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	if _, err = conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return Result{}, fmt.Errorf("clamd: %w", err)
+	}
+	writeErr := writeChunks(conn, r, c.timeout)
+	_ = conn.SetReadDeadline(time.Now().Add(c.timeout))
+	reply, err := readReply(conn)
+	if err != nil {
+		// the reply tells why a write failed, without one the write error does
+		if writeErr != nil {
+			return Result{}, writeErr
+		}
+		return Result{}, err
+	}
+	result, err := parseReply(reply)
+	if err == nil && writeErr != nil {
+		return Result{}, writeErr
+	}
+	return result, err
+}
+
+// writeChunks sends r in length prefixed chunks and ends the stream with an empty one
+func writeChunks(conn net.Conn, r io.Reader, timeout time.Duration) error {
+	buf := make([]byte, 4+chunkSize)
+	for {
+		n, err := r.Read(buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			_ = conn.SetWriteDeadline(time.Now().Add(timeout))
+			if _, werr := conn.Write(buf[:4+n]); werr != nil {
+				return fmt.Errorf("clamd: %w", werr)
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("clamd: read stream: %w", err)
+		}
+	}
+	_ = conn.SetWriteDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return fmt.Errorf("clamd: %w", err)
+	}
+	return nil
+}
+
+// readReply reads a reply terminated by NUL as the z prefixed commands get them
+func readReply(conn net.Conn) (string, error) {
+	reply, err := bufio.NewReader(io.LimitReader(conn, maxReply)).ReadBytes(0)
+	if len(reply) == 0 && err != nil {
+		return "", fmt.Errorf("clamd: read reply: %w", err)
+	}
+	return string(bytes.TrimRight(reply, "\x00\r\n")), nil
+}
+
+// parseReply maps a reply like "stream: OK" or "stream: Eicar-Signature FOUND" to the verdict
+func parseReply(reply string) (Result, error) {
+	switch {
+	case strings.HasSuffix(reply, " FOUND"):
+		virus := strings.TrimSuffix(strings.TrimPrefix(reply, "stream: "), " FOUND")
+		return Result{Infected: true, Virus: virus}, nil
+	case reply == "stream: OK":
+		return Result{}, nil
+	case strings.Contains(reply, "size limit exceeded"):
+		return Result{}, ErrSizeLimit
+	}
+	return Result{}, fmt.Errorf("clamd: %s", reply)
+}
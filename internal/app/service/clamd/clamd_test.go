@@ -0,0 +1,79 @@
+package clamd
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+func TestNew(t *testing.T) {
+	cases := []struct {
+		address, network, want string
+	}{
+		{"unix:/run/clamav/clamd.ctl", "unix", "/run/clamav/clamd.ctl"},
+		{"/run/clamav/clamd.ctl", "unix", "/run/clamav/clamd.ctl"},
+		{"tcp:127.0.0.1:3310", "tcp", "127.0.0.1:3310"},
+		{"clamav:3310", "tcp", "clamav:3310"},
+	}
+	for _, c := range cases {
+		client := New(c.address)
+		if client.network != c.network || client.address != c.want {
+			t.Fatalf("%s: got %s %s", c.address, client.network, client.address)
+		}
+	}
+}
+
+func TestParseReply(t *testing.T) {
+	cases := []struct {
+		reply  string
+		result Result
+		err    bool
+	}{
+		{"stream: OK", Result{}, false},
+		{"stream: Win.Test.EICAR_HDB-1 FOUND", Result{Infected: true, Virus: "Win.Test.EICAR_HDB-1"}, false},
+		{"INSTREAM size limit exceeded. ERROR", Result{}, true},
+		{"stream: lstat() failed. ERROR", Result{}, true},
+	}
+	for _, c := range cases {
+		result, err := parseReply(c.reply)
+		if result != c.result || (err != nil) != c.err {
+			t.Fatalf("%s: got %+v %v", c.reply, result, err)
+		}
+	}
+}
+
+func TestScan(t *testing.T) {
+	fake, err := NewFake(map[string]string{eicar: "Win.Test.EICAR_HDB-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fake.Close()
+	c := New(fake.Address())
+	if err = c.Ping(); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := c.Scan(strings.NewReader("Subject: hello\r\n\r\nhi\r\n"))
+	if err != nil || result.Infected {
+		t.Fatalf("expected a clean message, got %+v %v", result, err)
+	}
+	// the signature spans two chunks
+	infected := append(bytes.Repeat([]byte("a"), chunkSize-10), eicar...)
+	result, err = c.Scan(bytes.NewReader(infected))
+	if err != nil || !result.Infected || result.Virus != "Win.Test.EICAR_HDB-1" {
+		t.Fatalf("expected the eicar signature, got %+v %v", result, err)
+	}
+
+	fake.SetMaxSize(1024)
+	if _, err = c.Scan(bytes.NewReader(bytes.Repeat([]byte("a"), 4*chunkSize))); !errors.Is(err, ErrSizeLimit) {
+		t.Fatalf("expected the size limit, got %v", err)
+	}
+
+	_ = fake.Close()
+	if _, err = c.Scan(strings.NewReader("hi")); err == nil {
+		t.Fatal("expected an error of a stopped clamd")
+	}
+}
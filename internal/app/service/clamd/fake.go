@@ -0,0 +1,119 @@
+package clamd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"sort"
+	"sync"
+)
+
+/*
+Fake is a clamd for tests, it answers PING and INSTREAM and reports a
+stream as infected when it contains one of the signatures.
+*/
+type Fake struct {
+	ln         net.Listener
+	signatures map[string]string
+	maxSize    int
+	wg         sync.WaitGroup
+}
+
+// NewFake listens on a local tcp port, signatures maps content to the virus name reported for it
+func NewFake(signatures map[string]string) (*Fake, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	f := &Fake{ln: ln, signatures: signatures, maxSize: 25 << 20}
+	f.wg.Add(1)
+	go f.serve()
+	return f, nil
+}
+
+// SetMaxSize sets StreamMaxLength, longer streams get the size limit error
+func (f *Fake) SetMaxSize(n int) {
+	f.maxSize = n
+}
+
+// Address returns the address to pass to New
+func (f *Fake) Address() string {
+	return "tcp:" + f.ln.Addr().String()
+}
+
+// Close stops listening, scans which are running are finished
+func (f *Fake) Close() error {
+	err := f.ln.Close()
+	f.wg.Wait()
+	return err
+}
+
+func (f *Fake) serve() {
+	defer f.wg.Done()
+	for {
+		conn, err := f.ln.Accept()
+		if err != nil {
+			return
+		}
+		f.wg.Add(1)
+		go func() {
+			defer f.wg.Done()
+			defer conn.Close()
+			f.handle(conn)
+		}()
+	}
+}
+
+func (f *Fake) handle(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	command, err := r.ReadString(0)
+	if err != nil {
+		return
+	}
+	switch command {
+	case "zPING\x00":
+		_, _ = conn.Write([]byte("PONG\x00"))
+	case "zINSTREAM\x00":
+		_, _ = conn.Write([]byte(f.scan(r) + "\x00"))
+		// what is left of a stream over the limit is read until the client hangs up
+		_, _ = io.Copy(io.Discard, r)
+	default:
+		_, _ = conn.Write([]byte("UNKNOWN COMMAND\x00"))
+	}
+}
+
+// scan reads the chunks of a stream and returns the reply on it
+func (f *Fake) scan(r io.Reader) string {
+	var data []byte
+	size := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(r, size); err != nil {
+			return "stream: read error. ERROR"
+		}
+		n := int(binary.BigEndian.Uint32(size))
+		if n == 0 {
+			break
+		}
+		if len(data)+n > f.maxSize {
+			return "INSTREAM size limit exceeded. ERROR"
+		}
+		chunk := make([]byte, n)
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return "stream: read error. ERROR"
+		}
+		data = append(data, chunk...)
+	}
+	contents := make([]string, 0, len(f.signatures))
+	for content := range f.signatures {
+		contents = append(contents, content)
+	}
+	sort.Strings(contents)
+	for _, content := range contents {
+		if bytes.Contains(data, []byte(content)) {
+			return "stream: " + f.signatures[content] + " FOUND"
+		}
+	}
+	return "stream: OK"
+}
@@ -0,0 +1,69 @@
+package dkimkey
+
+import (
+	"bufio"
+	"bytes"
+	"easymail/internal/app/service/milter/third_party/dkim"
+	"net/textproto"
+	"strings"
+)
+
+/*
+ARCSealer adds an ARC set to the messages forwarded for the users of a
+domain, signed with the active key of the domain. The results of the filter
+are taken from the Authentication-Results header of authServID, which is the
+myhostname of postfix the filter reports as. The filter puts its header on
+top and removes the ones the sender wrote with authServID.
+*/
+type ARCSealer struct {
+	keys       *Keyring
+	authServID string
+	// lookup fetches the keys of the chain received, the project resolver when nil
+	lookup func(name string) ([]string, error)
+}
+
+func NewARCSealer(keys *Keyring, authServID string) *ARCSealer {
+	return &ARCSealer{keys: keys, authServID: authServID}
+}
+
+// Seal returns the message with an ARC set of the domain on top, it is
+// returned unchanged when the domain has no active key.
+func (s *ARCSealer) Seal(domain string, raw []byte) ([]byte, error) {
+	options, err := s.keys.SignOptions(domain)
+	if err != nil || options == nil {
+		return raw, err
+	}
+	v, err := dkim.VerifyARC(bytes.NewReader(raw), &dkim.VerifyOptions{LookupTXT: s.lookup})
+	if err != nil {
+		return raw, err
+	}
+	fields, err := dkim.Seal(bytes.NewReader(raw), &dkim.SealOptions{
+		Domain:          options.Domain,
+		Selector:        options.Selector,
+		Signer:          options.Signer,
+		AuthServID:      s.authServID,
+		Results:         authResults(raw, s.authServID),
+		ChainValidation: v.Result,
+	})
+	if err != nil {
+		return raw, err
+	}
+	sealed := make([]byte, 0, len(fields)+len(raw))
+	sealed = append(sealed, fields...)
+	return append(sealed, raw...), nil
+}
+
+// authResults returns the results of the topmost Authentication-Results
+// header when it is the one of authServID, a header of authServID further
+// down was not written by the filter and is not trusted.
+func authResults(raw []byte, authServID string) string {
+	h, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(raw))).ReadMIMEHeader()
+	if err != nil && len(h) == 0 {
+		return ""
+	}
+	id, results, _ := strings.Cut(h.Get("Authentication-Results"), ";")
+	if fields := strings.Fields(id); len(fields) == 0 || !strings.EqualFold(fields[0], authServID) {
+		return ""
+	}
+	return strings.TrimSpace(results)
+}
@@ -0,0 +1,186 @@
+package dkimkey
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"easymail/internal/model"
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// rsaBits is the size of generated RSA keys
+const rsaBits = 2048
+
+// txtChunk is the longest string of a TXT record, longer values are split
+const txtChunk = 255
+
+var selectorPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// Record is the TXT record publishing the public key of a selector
+type Record struct {
+	ID        int64               `json:"id"`
+	Selector  string              `json:"selector"`
+	Algorithm model.DKIMAlgorithm `json:"algorithm"`
+	Active    bool                `json:"active"`
+	// Name is the owner name of the record, Value its text
+	Name  string `json:"name"`
+	Value string `json:"value"`
+	// Zone is the record in zone file syntax, the value split in strings of 255 bytes
+	Zone string `json:"zone"`
+}
+
+// NewRecord returns the record of a key of the domain
+func NewRecord(domain string, key model.DKIMKey) Record {
+	name := key.Selector + "._domainkey." + strings.ToLower(domain)
+	value := fmt.Sprintf("v=DKIM1; k=%s; p=%s", key.Algorithm, key.PublicKey)
+	chunks := make([]string, 0, len(value)/txtChunk+1)
+	for s := value; s != ""; {
+		n := min(len(s), txtChunk)
+		chunks = append(chunks, `"`+s[:n]+`"`)
+		s = s[n:]
+	}
+	return Record{
+		ID:        key.ID,
+		Selector:  key.Selector,
+		Algorithm: key.Algorithm,
+		Active:    key.Active,
+		Name:      name,
+		Value:     value,
+		Zone:      fmt.Sprintf("%s. IN TXT ( %s )", name, strings.Join(chunks, " ")),
+	}
+}
+
+// DefaultSelector names a key by month and algorithm, e.g. 202610r and 202610e
+func DefaultSelector(algorithm model.DKIMAlgorithm, now time.Time) string {
+	return now.Format("200601") + string(algorithm)[:1]
+}
+
+// ValidateSelector checks the selector is a DNS label
+func ValidateSelector(selector string) error {
+	if !selectorPattern.MatchString(selector) {
+		return fmt.Errorf("invalid dkim selector %q", selector)
+	}
+	return nil
+}
+
+// Generate creates a key pair, the private key is sealed with the secret
+func Generate(domainID int64, selector string, algorithm model.DKIMAlgorithm) (*model.DKIMKey, error) {
+	if err := ValidateSelector(selector); err != nil {
+		return nil, err
+	}
+	var (
+		signer crypto.Signer
+		public []byte
+		err    error
+	)
+	switch algorithm {
+	case model.DKIMAlgorithmRSA:
+		var key *rsa.PrivateKey
+		if key, err = rsa.GenerateKey(rand.Reader, rsaBits); err != nil {
+			return nil, err
+		}
+		signer = key
+		if public, err = x509.MarshalPKIXPublicKey(&key.PublicKey); err != nil {
+			return nil, err
+		}
+	case model.DKIMAlgorithmEd25519:
+		var pub ed25519.PublicKey
+		if pub, signer, err = ed25519.GenerateKey(rand.Reader); err != nil {
+			return nil, err
+		}
+		// the record holds the raw key of RFC 8463
+		public = pub
+	default:
+		return nil, fmt.Errorf("unknown dkim algorithm %q", algorithm)
+	}
+	private, err := x509.MarshalPKCS8PrivateKey(signer)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := seal(private)
+	if err != nil {
+		return nil, err
+	}
+	return &model.DKIMKey{
+		DomainID:   domainID,
+		Selector:   selector,
+		Algorithm:  algorithm,
+		PrivateKey: sealed,
+		PublicKey:  base64.StdEncoding.EncodeToString(public),
+	}, nil
+}
+
+// Signer opens the private key of a stored key
+func Signer(key *model.DKIMKey) (crypto.Signer, error) {
+	der, err := open(key.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	private, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := private.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("dkim key %d is not a signing key", key.ID)
+	}
+	return signer, nil
+}
+
+// Create generates a key of the domain and returns its record, the selector
+// defaults to the month and algorithm. The key signs nothing until it is
+// activated, which is done once its record is published.
+func Create(domainID int64, selector string, algorithm model.DKIMAlgorithm, auditor model.Auditor) (Record, error) {
+	if algorithm != model.DKIMAlgorithmRSA && algorithm != model.DKIMAlgorithmEd25519 {
+		return Record{}, fmt.Errorf("unknown dkim algorithm %q", algorithm)
+	}
+	domain, err := findDomain(domainID)
+	if err != nil {
+		return Record{}, err
+	}
+	if selector == "" {
+		selector = DefaultSelector(algorithm, time.Now())
+	}
+	key, err := Generate(domain.ID, strings.ToLower(selector), algorithm)
+	if err != nil {
+		return Record{}, err
+	}
+	if err = model.CreateDKIMKey(key, auditor); err != nil {
+		return Record{}, err
+	}
+	return NewRecord(domain.Name, *key), nil
+}
+
+func findDomain(id int64) (*model.Domain, error) {
+	domain, err := model.FindDomainByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if domain == nil || domain.ID == 0 {
+		return nil, model.ErrDomainNotExists
+	}
+	return domain, nil
+}
+
+// Records returns the records to publish for all keys of the domain
+func Records(domainID int64) ([]Record, error) {
+	domain, err := findDomain(domainID)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := model.ListDKIMKeys(domain.ID)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]Record, 0, len(keys))
+	for _, key := range keys {
+		records = append(records, NewRecord(domain.Name, key))
+	}
+	return records, nil
+}
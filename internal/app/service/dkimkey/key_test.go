@@ -0,0 +1,200 @@
+package dkimkey
+
+import (
+	"bytes"
+	"crypto/rand"
+	"easymail/internal/app/service/milter/third_party/dkim"
+	"easymail/internal/model"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func setTestSecret(t *testing.T) {
+	t.Helper()
+	secret := make([]byte, secretSize)
+	if _, err := rand.Read(secret); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetSecret(secret); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSeal(t *testing.T) {
+	if err := SetSecret([]byte("short")); err == nil {
+		t.Fatal("expected an error for a short secret")
+	}
+	setTestSecret(t)
+	sealed, err := seal([]byte("private"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain, err := open(sealed); err != nil || string(plain) != "private" {
+		t.Fatalf("unexpected plain %q, err %v", plain, err)
+	}
+	// another secret can not open the key
+	setTestSecret(t)
+	if _, err = open(sealed); err == nil {
+		t.Fatal("expected an error with another secret")
+	}
+}
+
+func TestSelector(t *testing.T) {
+	now := time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)
+	if s := DefaultSelector(model.DKIMAlgorithmEd25519, now); s != "202610e" {
+		t.Fatalf("unexpected selector %s", s)
+	}
+	for selector, ok := range map[string]bool{"202610r": true, "mail-1": true, "-mail": false, "a.b": false, "": false, strings.Repeat("a", 64): false} {
+		if err := ValidateSelector(selector); (err == nil) != ok {
+			t.Fatalf("%q: unexpected error %v", selector, err)
+		}
+	}
+}
+
+func TestKeyring(t *testing.T) {
+	setTestSecret(t)
+	keys := make(map[string]*model.DKIMKey)
+	for _, algorithm := range []model.DKIMAlgorithm{model.DKIMAlgorithmRSA, model.DKIMAlgorithmEd25519} {
+		key, err := Generate(1, "s"+string(algorithm), algorithm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[string(algorithm)+".example"] = key
+	}
+	finds := 0
+	k := NewKeyring()
+	k.find = func(domain string) (*model.DKIMKey, error) {
+		finds++
+		if domain == "broken.example" {
+			return nil, errors.New("database is down")
+		}
+		return keys[domain], nil
+	}
+
+	for domain, key := range keys {
+		options, err := k.SignOptions(strings.ToUpper(domain))
+		if err != nil || options == nil || options.Selector != key.Selector {
+			t.Fatalf("%s: unexpected options %+v, err %v", domain, options, err)
+		}
+		raw := "From: a@" + domain + "\r\nSubject: hi\r\nReceived: from x\r\n\r\nhello\r\n"
+		var signed bytes.Buffer
+		if err = dkim.Sign(&signed, strings.NewReader(raw), options); err != nil {
+			t.Fatal(err)
+		}
+		record := NewRecord(domain, *key)
+		lookup := func(name string) ([]string, error) {
+			if name != record.Name {
+				return nil, errors.New("unexpected name " + name)
+			}
+			return []string{record.Value}, nil
+		}
+		vs, err := dkim.VerifyWithOptions(&signed, &dkim.VerifyOptions{LookupTXT: lookup})
+		if err != nil || len(vs) != 1 || vs[0].Err != nil {
+			t.Fatalf("%s: verification failed %+v, err %v", domain, vs, err)
+		}
+	}
+	// keys and their absence are cached, errors are not
+	if options, err := k.SignOptions("none.example"); options != nil || err != nil {
+		t.Fatalf("unexpected options %+v, err %v", options, err)
+	}
+	_, _ = k.SignOptions("none.example")
+	_, _ = k.SignOptions("rsa.example")
+	if _, err := k.SignOptions("broken.example"); err == nil {
+		t.Fatal("expected the error of the database")
+	}
+	if finds != 4 {
+		t.Fatalf("expected 4 lookups, got %d", finds)
+	}
+}
+
+func TestRecord(t *testing.T) {
+	key := model.DKIMKey{Selector: "s1", Algorithm: model.DKIMAlgorithmRSA, PublicKey: strings.Repeat("A", 400)}
+	r := NewRecord("Example.ORG", key)
+	if r.Name != "s1._domainkey.example.org" || r.Value != "v=DKIM1; k=rsa; p="+key.PublicKey {
+		t.Fatalf("unexpected record %+v", r)
+	}
+	expected := `s1._domainkey.example.org. IN TXT ( "` + r.Value[:255] + `" "` + r.Value[255:] + `" )`
+	if r.Zone != expected {
+		t.Fatalf("unexpected zone %s", r.Zone)
+	}
+}
+
+func TestARCSealer(t *testing.T) {
+	setTestSecret(t)
+	keys := make(map[string]*model.DKIMKey)
+	records := make(map[string]string)
+	for domain, algorithm := range map[string]model.DKIMAlgorithm{"rsa.example": model.DKIMAlgorithmRSA, "ed.example": model.DKIMAlgorithmEd25519} {
+		key, err := Generate(1, "arc", algorithm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[domain] = key
+		record := NewRecord(domain, *key)
+		records[record.Name] = record.Value
+	}
+	lookup := func(name string) ([]string, error) {
+		if v, ok := records[name]; ok {
+			return []string{v}, nil
+		}
+		return nil, errors.New("unexpected name " + name)
+	}
+	k := NewKeyring()
+	k.find = func(domain string) (*model.DKIMKey, error) { return keys[domain], nil }
+	s := NewARCSealer(k, "mx.rsa.example")
+	s.lookup = lookup
+
+	raw := []byte("Authentication-Results: mx.rsa.example;\r\n\tspf=pass smtp.mailfrom=a@origin.example\r\n" +
+		"Authentication-Results: mx.rsa.example; spf=fail\r\n" +
+		"From: a@origin.example\r\nSubject: hi\r\n\r\nhello\r\n")
+	sealed, err := s.Seal("rsa.example", raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(sealed, []byte("ARC-Authentication-Results: i=1; mx.rsa.example; spf=pass smtp.mailfrom=a@origin.example\r\n")) {
+		t.Fatalf("unexpected arc set %s", sealed)
+	}
+	v, err := dkim.VerifyARC(bytes.NewReader(sealed), &dkim.VerifyOptions{LookupTXT: lookup})
+	if err != nil || v.Result != dkim.ARCPass || v.Instance != 1 || v.Domain != "rsa.example" {
+		t.Fatalf("unexpected verification %+v, err %v", v, err)
+	}
+
+	// the next hop extends the chain
+	s.authServID = "mx.ed.example"
+	resealed, err := s.Seal("ed.example", sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(resealed, []byte("cv=pass;")) {
+		t.Fatalf("expected the chain passed on, got %s", resealed)
+	}
+	v, err = dkim.VerifyARC(bytes.NewReader(resealed), &dkim.VerifyOptions{LookupTXT: lookup})
+	if err != nil || v.Result != dkim.ARCPass || v.Instance != 2 || v.Domain != "ed.example" {
+		t.Fatalf("unexpected verification %+v, err %v", v, err)
+	}
+
+	// a changed body breaks the chain, it is not sealed again
+	broken := bytes.Replace(resealed, []byte("hello"), []byte("hullo"), 1)
+	if v, err = dkim.VerifyARC(bytes.NewReader(broken), &dkim.VerifyOptions{LookupTXT: lookup}); err != nil || v.Result != dkim.ARCFail {
+		t.Fatalf("expected a failed chain, got %+v, err %v", v, err)
+	}
+	if out, err := s.Seal("rsa.example", broken); err == nil || !bytes.Equal(out, broken) {
+		t.Fatalf("expected the failed chain left unsealed, err %v", err)
+	}
+	// results of authServID below the ones of another host are the sender's
+	forged := []byte("Authentication-Results: relay.example.net; spf=fail\r\n" +
+		"Authentication-Results: mx.rsa.example; spf=pass smtp.mailfrom=a@origin.example\r\n" +
+		"From: a@origin.example\r\nSubject: hi\r\n\r\nhello\r\n")
+	if got := authResults(forged, "mx.rsa.example"); got != "" {
+		t.Fatalf("expected no results, got %q", got)
+	}
+	if got := authResults(raw, "MX.rsa.example"); got != "spf=pass smtp.mailfrom=a@origin.example" {
+		t.Fatalf("unexpected results %q", got)
+	}
+
+	// domains without a key leave the message as it is
+	if out, err := s.Seal("none.example", raw); err != nil || !bytes.Equal(out, raw) {
+		t.Fatalf("unexpected seal without a key, err %v", err)
+	}
+}
@@ -0,0 +1,80 @@
+package dkimkey
+
+import (
+	"easymail/internal/app/service/milter/third_party/dkim"
+	"easymail/internal/model"
+	"strings"
+	"sync"
+	"time"
+)
+
+// keyringTTL is how long a key, or its absence, is kept before it is read again
+const keyringTTL = time.Minute
+
+// signedHeaders are the header fields signed when present, RFC 6376 section 5.4.1
+var signedHeaders = []string{
+	"From", "Reply-To", "Subject", "Date", "To", "Cc", "Message-ID",
+	"In-Reply-To", "References", "MIME-Version", "Content-Type", "Content-Transfer-Encoding",
+}
+
+type cachedKey struct {
+	options *dkim.SignOptions
+	expire  time.Time
+}
+
+/*
+Keyring hands the active keys of the domains to the filter, keys are read
+from the database at most once a minute so an activated key signs within a
+minute.
+*/
+type Keyring struct {
+	find func(domain string) (*model.DKIMKey, error)
+	now  func() time.Time
+
+	lock sync.Mutex
+	keys map[string]cachedKey
+}
+
+func NewKeyring() *Keyring {
+	return &Keyring{
+		find: model.GetActiveDKIMKey,
+		now:  time.Now,
+		keys: make(map[string]cachedKey),
+	}
+}
+
+// SignOptions returns how mail of the domain is signed, nil when it has no active key
+func (k *Keyring) SignOptions(domain string) (*dkim.SignOptions, error) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	now := k.now()
+	k.lock.Lock()
+	cached, ok := k.keys[domain]
+	k.lock.Unlock()
+	if ok && now.Before(cached.expire) {
+		return cached.options, nil
+	}
+
+	key, err := k.find(domain)
+	if err != nil {
+		return nil, err
+	}
+	var options *dkim.SignOptions
+	if key != nil {
+		signer, err := Signer(key)
+		if err != nil {
+			return nil, err
+		}
+		options = &dkim.SignOptions{
+			Domain:                 domain,
+			Selector:               key.Selector,
+			Signer:                 signer,
+			HeaderCanonicalization: dkim.CanonicalizationRelaxed,
+			BodyCanonicalization:   dkim.CanonicalizationRelaxed,
+			HeaderKeys:             signedHeaders,
+		}
+	}
+	k.lock.Lock()
+	k.keys[domain] = cachedKey{options: options, expire: now.Add(keyringTTL)}
+	k.lock.Unlock()
+	return options, nil
+}
@@ -0,0 +1,104 @@
+package dkimkey
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// secretSize is the size of the AES-256 key sealing the private keys
+const secretSize = 32
+
+// ErrNoSecret is returned when keys are used before the secret is set
+var ErrNoSecret = errors.New("dkim key secret is not set")
+
+var (
+	sealLock sync.RWMutex
+	sealer   cipher.AEAD
+)
+
+// SetSecret sets the key sealing the private keys stored in the database
+func SetSecret(secret []byte) error {
+	if len(secret) != secretSize {
+		return fmt.Errorf("dkim key secret must be %d bytes, got %d", secretSize, len(secret))
+	}
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	sealLock.Lock()
+	sealer = aead
+	sealLock.Unlock()
+	return nil
+}
+
+/*
+LoadSecret reads the base64 encoded secret from a file only the server can
+read, e.g. created with
+
+	head -c 32 /dev/urandom | base64 > dkim.secret && chmod 600 dkim.secret
+
+The keys sealed with a secret can not be used once it is lost.
+*/
+func LoadSecret(filename string) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	secret, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return fmt.Errorf("dkim key secret %s: %w", filename, err)
+	}
+	return SetSecret(secret)
+}
+
+func getSealer() (cipher.AEAD, error) {
+	sealLock.RLock()
+	defer sealLock.RUnlock()
+	if sealer == nil {
+		return nil, ErrNoSecret
+	}
+	return sealer, nil
+}
+
+// seal encrypts a private key, the nonce is kept in front of the ciphertext
+func seal(plain []byte) (string, error) {
+	aead, err := getSealer()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plain)+aead.Overhead())
+	if _, err = rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, plain, nil)), nil
+}
+
+func open(sealed string) ([]byte, error) {
+	aead, err := getSealer()
+	if err != nil {
+		return nil, err
+	}
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("dkim key is too short")
+	}
+	plain, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, errors.New("dkim key can not be opened with the secret")
+	}
+	return plain, nil
+}
@@ -0,0 +1,216 @@
+package dmarc
+
+import (
+	"easymail/internal/easydns"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// results of the evaluation, as in Authentication-Results
+const (
+	ResultPass      = "pass"
+	ResultFail      = "fail"
+	ResultNone      = "none"
+	ResultTempError = "temperror"
+	ResultPermError = "permerror"
+)
+
+// reasons a failing message was not handled as the policy asks
+const (
+	ReasonSampledOut  = "sampled_out"
+	ReasonLocalPolicy = "local_policy"
+)
+
+// TXTLookup returns the TXT records of a name
+type TXTLookup func(name string) ([]string, error)
+
+// DKIMResult is the verification of one DKIM signature
+type DKIMResult struct {
+	Domain   string
+	Selector string
+	// Result is pass, fail, permerror or temperror
+	Result string
+}
+
+// Message is what the receiver knows about the authentication of a message
+type Message struct {
+	SourceIP net.IP
+	// HeaderFrom is the domain of the From header
+	HeaderFrom string
+	// EnvelopeFrom is the domain SPF checked, the helo name for bounces
+	EnvelopeFrom string
+	SPF          string
+	DKIM         []DKIMResult
+}
+
+// Result is the evaluation of a message against the policy of its From domain
+type Result struct {
+	Message
+	// Domain published the record, the organizational domain when the From domain has none
+	Domain string
+	Record *Record
+	Result string
+	// Policy is the policy asked for the From domain, Disposition what pct leaves of it
+	Policy      Policy
+	Disposition Policy
+	Reason      string
+	SPFAligned  bool
+	DKIMAligned bool
+	Time        time.Time
+}
+
+// Evaluator looks the policies up and evaluates messages against them
+type Evaluator struct {
+	lookup   TXTLookup
+	recorder *Recorder
+	// sample returns a number in [0, 100) for pct
+	sample func() int
+	now    func() time.Time
+}
+
+// New returns an evaluator using lookup, the project resolver when it is nil
+func New(lookup TXTLookup) *Evaluator {
+	if lookup == nil {
+		lookup = easydns.CreateDefaultResolver().LookupTXT
+	}
+	return &Evaluator{
+		lookup: lookup,
+		sample: func() int { return rand.IntN(100) },
+		now:    time.Now,
+	}
+}
+
+// SetRecorder makes Record store the results for the aggregate reports
+func (e *Evaluator) SetRecorder(r *Recorder) {
+	e.recorder = r
+}
+
+// Record stores the result once the disposition is final, nothing is stored without a recorder
+func (e *Evaluator) Record(result Result) {
+	e.recorder.Record(result)
+}
+
+// OrganizationalDomain returns the registered domain of a name, the name when it has none
+func OrganizationalDomain(domain string) string {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if org, err := publicsuffix.EffectiveTLDPlusOne(domain); err == nil {
+		return org
+	}
+	return domain
+}
+
+// aligned compares an authenticated domain with the From domain
+func aligned(domain, from string, mode Alignment) bool {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if domain == "" {
+		return false
+	}
+	if mode == AlignmentStrict {
+		return domain == from
+	}
+	return OrganizationalDomain(domain) == OrganizationalDomain(from)
+}
+
+// findRecord returns the record of the domain, nil when it publishes none
+func (e *Evaluator) findRecord(domain string) (*Record, error) {
+	txts, err := e.lookup("_dmarc." + domain)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var records []*Record
+	var invalid error
+	for _, txt := range txts {
+		r, err := ParseRecord(txt)
+		if errors.Is(err, errNotDMARC) {
+			continue
+		}
+		if err != nil {
+			invalid = err
+			continue
+		}
+		records = append(records, r)
+	}
+	// several records are as good as none, section 6.6.3
+	if len(records) > 1 {
+		return nil, nil
+	}
+	if len(records) == 0 {
+		return nil, invalid
+	}
+	return records[0], nil
+}
+
+/*
+Evaluate applies the policy of the From domain, or of its organizational
+domain, to the message. A message passes when SPF or a DKIM signature passed
+for a domain aligned with the From domain. The pct tag moves the failures not
+sampled one step down, from reject to quarantine and from quarantine to none.
+*/
+func (e *Evaluator) Evaluate(msg Message) (Result, error) {
+	from := strings.ToLower(strings.TrimSuffix(msg.HeaderFrom, "."))
+	result := Result{Message: msg, Result: ResultNone, Time: e.now()}
+	if from == "" {
+		return result, nil
+	}
+	result.Domain = from
+	record, err := e.findRecord(from)
+	subdomain := false
+	if err == nil && record == nil {
+		if org := OrganizationalDomain(from); org != from {
+			result.Domain, subdomain = org, true
+			record, err = e.findRecord(org)
+		}
+	}
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) {
+			result.Result = ResultTempError
+		} else {
+			result.Result = ResultPermError
+		}
+		return result, fmt.Errorf("dmarc record of %s: %w", result.Domain, err)
+	}
+	if record == nil {
+		result.Domain = from
+		return result, nil
+	}
+	result.Record = record
+
+	result.SPFAligned = msg.SPF == "pass" && aligned(msg.EnvelopeFrom, from, record.SPFAlignment)
+	for _, d := range msg.DKIM {
+		if d.Result == "pass" && aligned(d.Domain, from, record.DKIMAlignment) {
+			result.DKIMAligned = true
+			break
+		}
+	}
+	result.Policy, result.Disposition = record.Policy, PolicyNone
+	if subdomain {
+		result.Policy = record.SubdomainPolicy
+	}
+	if result.SPFAligned || result.DKIMAligned {
+		result.Result = ResultPass
+		return result, nil
+	}
+	result.Result = ResultFail
+	result.Disposition = result.Policy
+	if result.Policy != PolicyNone && record.Percent < 100 && e.sample() >= record.Percent {
+		result.Reason = ReasonSampledOut
+		switch result.Policy {
+		case PolicyReject:
+			result.Disposition = PolicyQuarantine
+		case PolicyQuarantine:
+			result.Disposition = PolicyNone
+		}
+	}
+	return result, nil
+}
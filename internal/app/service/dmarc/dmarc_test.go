@@ -0,0 +1,249 @@
+package dmarc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"easymail/internal/model"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRecord(t *testing.T) {
+	r, err := ParseRecord("v=DMARC1; p=Reject; sp=none; pct=50; adkim=s; rua=mailto:a@example.org!10m, https://example.org/r, mailto:b@example.net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Policy != PolicyReject || r.SubdomainPolicy != PolicyNone || r.Percent != 50 ||
+		r.DKIMAlignment != AlignmentStrict || r.SPFAlignment != AlignmentRelaxed {
+		t.Fatalf("unexpected record %+v", r)
+	}
+	if addrs := r.ReportAddresses(); len(addrs) != 2 || addrs[0] != "a@example.org" || addrs[1] != "b@example.net" {
+		t.Fatalf("unexpected report addresses %v", addrs)
+	}
+
+	// sp defaults to p, a record asking for reports is used without a policy
+	if r, err = ParseRecord("v=DMARC1; p=quarantine"); err != nil || r.SubdomainPolicy != PolicyQuarantine || r.Percent != 100 {
+		t.Fatalf("unexpected record %+v, err %v", r, err)
+	}
+	if r, err = ParseRecord("v=DMARC1; p=bogus; rua=mailto:a@example.org"); err != nil || r.Policy != PolicyNone {
+		t.Fatalf("unexpected record %+v, err %v", r, err)
+	}
+
+	for _, txt := range []string{"v=DMARC1; p=bogus", "v=DMARC1; p=none; pct=101", "v=DMARC1; p=none; aspf=x"} {
+		if _, err := ParseRecord(txt); err == nil {
+			t.Fatalf("%q: expected an error", txt)
+		}
+	}
+	if _, err := ParseRecord("v=spf1 -all"); !errors.Is(err, errNotDMARC) {
+		t.Fatalf("expected no dmarc record, got %v", err)
+	}
+}
+
+func newTestEvaluator(records map[string][]string) *Evaluator {
+	e := New(func(name string) ([]string, error) {
+		if name == "_dmarc.broken.example" {
+			return nil, &net.DNSError{Err: "timeout", Name: name, IsTimeout: true}
+		}
+		if txts, ok := records[name]; ok {
+			return txts, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	})
+	e.now = func() time.Time { return time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC) }
+	return e
+}
+
+func TestEvaluate(t *testing.T) {
+	e := newTestEvaluator(map[string][]string{
+		"_dmarc.example.org": {"v=DMARC1; p=reject; sp=quarantine; aspf=s"},
+		"_dmarc.example.net": {"v=DMARC1; p=reject; pct=20"},
+		"_dmarc.example.com": {"v=DMARC1; p=reject", "v=DMARC1; p=none"},
+	})
+	cases := []struct {
+		name        string
+		msg         Message
+		result      string
+		disposition Policy
+		domain      string
+	}{
+		{"spf aligned", Message{HeaderFrom: "example.org", EnvelopeFrom: "example.org", SPF: "pass"}, ResultPass, PolicyNone, "example.org"},
+		{"spf not strictly aligned", Message{HeaderFrom: "example.org", EnvelopeFrom: "mail.example.org", SPF: "pass"}, ResultFail, PolicyReject, "example.org"},
+		{"dkim relaxed", Message{HeaderFrom: "example.org", DKIM: []DKIMResult{{Domain: "a.example.org", Result: "fail"}, {Domain: "b.example.org", Result: "pass"}}}, ResultPass, PolicyNone, "example.org"},
+		{"dkim of another domain", Message{HeaderFrom: "example.org", DKIM: []DKIMResult{{Domain: "example.net", Result: "pass"}}}, ResultFail, PolicyReject, "example.org"},
+		{"subdomain policy", Message{HeaderFrom: "news.example.org"}, ResultFail, PolicyQuarantine, "example.org"},
+		{"no record", Message{HeaderFrom: "example.info"}, ResultNone, "", "example.info"},
+		{"several records", Message{HeaderFrom: "example.com"}, ResultNone, "", "example.com"},
+	}
+	for _, c := range cases {
+		r, err := e.Evaluate(c.msg)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if r.Result != c.result || r.Disposition != c.disposition || r.Domain != c.domain {
+			t.Fatalf("%s: unexpected result %+v", c.name, r)
+		}
+	}
+
+	// failures not sampled move one step down
+	e.sample = func() int { return 50 }
+	r, err := e.Evaluate(Message{HeaderFrom: "example.net"})
+	if err != nil || r.Policy != PolicyReject || r.Disposition != PolicyQuarantine || r.Reason != ReasonSampledOut {
+		t.Fatalf("unexpected sampled result %+v, err %v", r, err)
+	}
+	e.sample = func() int { return 10 }
+	if r, err = e.Evaluate(Message{HeaderFrom: "example.net"}); err != nil || r.Disposition != PolicyReject || r.Reason != "" {
+		t.Fatalf("unexpected sampled result %+v, err %v", r, err)
+	}
+
+	if r, err = e.Evaluate(Message{HeaderFrom: "broken.example"}); err == nil || r.Result != ResultTempError {
+		t.Fatalf("expected a temperror, got %+v, err %v", r, err)
+	}
+}
+
+func testResults() []model.DMARCResult {
+	day := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	row := model.DMARCResult{
+		Domain: "example.org", Record: "v=DMARC1; p=reject; rua=mailto:dmarc@example.org",
+		SourceIP: "192.0.2.1", HeaderFrom: "example.org", EnvelopeFrom: "example.org", SPFResult: "pass", SPFAligned: true,
+		DKIM: "example.org/sel=pass", DKIMAligned: true, Disposition: "none", CreateTime: day.Add(time.Hour),
+	}
+	failed := row
+	failed.SourceIP, failed.SPFResult, failed.SPFAligned, failed.DKIM, failed.DKIMAligned = "198.51.100.1", "fail", false, "", false
+	failed.Disposition, failed.CreateTime = "reject", day.Add(2*time.Hour)
+	return []model.DMARCResult{failed, row, row}
+}
+
+func TestNewFeedback(t *testing.T) {
+	begin := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	org := Organization{Name: "easymail", Email: "reports@mx.example.com"}
+	f, err := NewFeedback(org, "example.org", begin, begin.Add(24*time.Hour), testResults())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f.Records) != 2 || f.Records[0].Row.Count != 2 || f.Records[0].Row.SourceIP != "192.0.2.1" ||
+		f.Records[1].Row.PolicyEvaluated.Disposition != PolicyReject || f.Records[1].Row.PolicyEvaluated.SPF != ResultFail {
+		t.Fatalf("unexpected records %+v", f.Records)
+	}
+	if dkim := f.Records[0].AuthResults.DKIM; len(dkim) != 1 || dkim[0].Domain != "example.org" || dkim[0].Selector != "sel" {
+		t.Fatalf("unexpected dkim results %+v", dkim)
+	}
+	if name := f.Filename(); name != "example.com!example.org!1790812800!1790899200.xml.gz" {
+		t.Fatalf("unexpected filename %s", name)
+	}
+
+	data, err := f.Gzip()
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parsed Feedback
+	if err := xml.Unmarshal(raw, &parsed); err != nil {
+		t.Fatal(err)
+	}
+	if parsed.PolicyPublished.P != PolicyReject || parsed.ReportMetadata.DateRange.Begin != begin.Unix() || len(parsed.Records) != 2 {
+		t.Fatalf("unexpected parsed report %+v", parsed)
+	}
+
+	msg, err := f.Message([]string{"dmarc@example.org"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"To: dmarc@example.org\r\n", "Content-Type: application/gzip", f.Filename()} {
+		if !strings.Contains(string(msg), want) {
+			t.Fatalf("message misses %q", want)
+		}
+	}
+}
+
+type fakeRelay struct {
+	to  [][]string
+	err error
+}
+
+func (r *fakeRelay) Send(from string, to []string, msg []byte) error {
+	r.to = append(r.to, to)
+	return r.err
+}
+
+func TestReporter(t *testing.T) {
+	relay := &fakeRelay{}
+	r := NewReporter(Organization{Name: "easymail", Email: "reports@mx.example.com"}, relay, func(name string) ([]string, error) {
+		if name == "example.org._report._dmarc.example.net" {
+			return []string{"v=DMARC1"}, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	})
+	now := time.Date(2026, 10, 2, 8, 0, 0, 0, time.UTC)
+	r.now = func() time.Time { return now }
+	results := testResults()
+	results[2].Record = "v=DMARC1; p=reject; rua=mailto:dmarc@example.org,mailto:a@example.net,mailto:b@example.info"
+	removed := make([]string, 0)
+	r.domains = func(before time.Time) ([]string, error) { return []string{"example.org"}, nil }
+	r.results = func(domain string, before time.Time) ([]model.DMARCResult, error) {
+		if !before.Equal(now.Truncate(24 * time.Hour)) {
+			t.Fatalf("unexpected end %v", before)
+		}
+		return results, nil
+	}
+	r.remove = func(domain string, before time.Time) error {
+		removed = append(removed, domain)
+		return nil
+	}
+
+	// the address of another domain is only used when that domain agreed
+	if err := r.Report(); err != nil {
+		t.Fatal(err)
+	}
+	if len(relay.to) != 1 || strings.Join(relay.to[0], ",") != "dmarc@example.org,a@example.net" || len(removed) != 1 {
+		t.Fatalf("unexpected report to %v, removed %v", relay.to, removed)
+	}
+
+	// failed reports are kept and tried again
+	relay.err = errors.New("relay down")
+	if err := r.Report(); err == nil || len(removed) != 1 {
+		t.Fatalf("expected the results kept, err %v, removed %v", err, removed)
+	}
+	now = now.Add(72 * time.Hour)
+	if err := r.Report(); err == nil || len(removed) != 2 {
+		t.Fatalf("expected old results dropped, err %v, removed %v", err, removed)
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	saved := make(chan []model.DMARCResult, 1)
+	r := NewRecorder(nil)
+	r.save = func(results []model.DMARCResult) error {
+		saved <- results
+		return nil
+	}
+	record, err := ParseRecord("v=DMARC1; p=none; rua=mailto:dmarc@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := Result{
+		Message: Message{SourceIP: net.ParseIP("192.0.2.1"), HeaderFrom: "Example.org", DKIM: []DKIMResult{{Domain: "example.org", Selector: "sel", Result: "pass"}}},
+		Domain:  "example.org", Record: record, Result: ResultPass, Disposition: PolicyNone,
+	}
+	r.Record(result)
+	// domains which do not ask for reports are not stored
+	result.Record = &Record{Policy: PolicyNone}
+	r.Record(result)
+	r.Start()
+	r.Stop()
+	got := <-saved
+	if len(got) != 1 || got[0].SourceIP != "192.0.2.1" || got[0].HeaderFrom != "example.org" || got[0].DKIM != "example.org/sel=pass" {
+		t.Fatalf("unexpected saved results %+v", got)
+	}
+}
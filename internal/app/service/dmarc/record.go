@@ -0,0 +1,136 @@
+package dmarc
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Policy is what the domain owner asks receivers to do with failing mail
+type Policy string
+
+const (
+	PolicyNone       Policy = "none"
+	PolicyQuarantine Policy = "quarantine"
+	PolicyReject     Policy = "reject"
+)
+
+// Alignment is the identifier alignment mode of RFC 7489 section 3.1
+type Alignment string
+
+const (
+	AlignmentRelaxed Alignment = "r"
+	AlignmentStrict  Alignment = "s"
+)
+
+var errNotDMARC = errors.New("not a dmarc record")
+
+// Record is a DMARC policy record published at _dmarc.<domain>
+type Record struct {
+	Policy          Policy
+	SubdomainPolicy Policy
+	Percent         int
+	DKIMAlignment   Alignment
+	SPFAlignment    Alignment
+	// ReportURIs are the rua destinations of aggregate reports
+	ReportURIs []string
+	// Raw is the text of the record
+	Raw string
+}
+
+/*
+ParseRecord parses the tags of a record, unknown tags are ignored. A record
+without a valid p= tag is still used as p=none when it asks for reports, as
+section 6.6.3 of RFC 7489 says.
+*/
+func ParseRecord(txt string) (*Record, error) {
+	tags := strings.Split(txt, ";")
+	if name, value, _ := strings.Cut(tags[0], "="); strings.TrimSpace(name) != "v" || strings.TrimSpace(value) != "DMARC1" {
+		return nil, errNotDMARC
+	}
+	r := &Record{Percent: 100, DKIMAlignment: AlignmentRelaxed, SPFAlignment: AlignmentRelaxed, Raw: txt}
+	var invalid error
+	for _, tag := range tags[1:] {
+		name, value, found := strings.Cut(tag, "=")
+		name, value = strings.ToLower(strings.TrimSpace(name)), strings.TrimSpace(value)
+		if !found || name == "" {
+			continue
+		}
+		switch name {
+		case "p", "sp":
+			p, err := parsePolicy(value)
+			if err != nil {
+				invalid = err
+				continue
+			}
+			if name == "p" {
+				r.Policy = p
+			} else {
+				r.SubdomainPolicy = p
+			}
+		case "pct":
+			pct, err := strconv.Atoi(value)
+			if err != nil || pct < 0 || pct > 100 {
+				return nil, fmt.Errorf("invalid dmarc pct %q", value)
+			}
+			r.Percent = pct
+		case "adkim", "aspf":
+			a := Alignment(strings.ToLower(value))
+			if a != AlignmentRelaxed && a != AlignmentStrict {
+				return nil, fmt.Errorf("invalid dmarc %s %q", name, value)
+			}
+			if name == "adkim" {
+				r.DKIMAlignment = a
+			} else {
+				r.SPFAlignment = a
+			}
+		case "rua":
+			for _, uri := range strings.Split(value, ",") {
+				if uri = strings.TrimSpace(uri); uri != "" {
+					r.ReportURIs = append(r.ReportURIs, uri)
+				}
+			}
+		}
+	}
+	if r.Policy == "" {
+		if len(r.ReportURIs) == 0 {
+			if invalid == nil {
+				invalid = errors.New("dmarc record has no policy")
+			}
+			return nil, invalid
+		}
+		r.Policy = PolicyNone
+	}
+	if r.SubdomainPolicy == "" {
+		r.SubdomainPolicy = r.Policy
+	}
+	return r, nil
+}
+
+func parsePolicy(s string) (Policy, error) {
+	switch p := Policy(strings.ToLower(s)); p {
+	case PolicyNone, PolicyQuarantine, PolicyReject:
+		return p, nil
+	}
+	return "", fmt.Errorf("invalid dmarc policy %q", s)
+}
+
+// ReportAddresses returns the mailto addresses of the aggregate reports,
+// size limits are dropped, other schemes are not supported.
+func (r *Record) ReportAddresses() []string {
+	addrs := make([]string, 0, len(r.ReportURIs))
+	for _, uri := range r.ReportURIs {
+		scheme, addr, found := strings.Cut(uri, ":")
+		if !found || !strings.EqualFold(scheme, "mailto") {
+			continue
+		}
+		if i := strings.IndexByte(addr, '!'); i >= 0 {
+			addr = addr[:i]
+		}
+		if strings.Contains(addr, "@") {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
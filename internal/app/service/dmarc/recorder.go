@@ -0,0 +1,156 @@
+package dmarc
+
+import (
+	"easymail/internal/easylog"
+	"easymail/internal/model"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	recordQueueSize     = 10000
+	recordBatchSize     = 100
+	recordFlushInterval = time.Second
+)
+
+/*
+Recorder stores the results of messages for the aggregate reports in batches
+from a background goroutine, Record never blocks the SMTP transaction and
+results are dropped when the queue is full. Only results of domains asking
+for reports are stored.
+*/
+type Recorder struct {
+	queue   chan model.DMARCResult
+	dropped atomic.Int64
+	lock    sync.Mutex
+	stopCh  chan struct{}
+	doneCh  chan struct{}
+	_log    *easylog.Logger
+
+	// save is replaced in tests
+	save func(results []model.DMARCResult) error
+}
+
+func NewRecorder(_log *easylog.Logger) *Recorder {
+	return &Recorder{
+		queue: make(chan model.DMARCResult, recordQueueSize),
+		_log:  _log,
+		save:  model.CreateDMARCResults,
+	}
+}
+
+// Record queues the result of a message, it is safe to call on a nil recorder
+func (r *Recorder) Record(result Result) {
+	if r == nil || result.Record == nil || len(result.Record.ReportAddresses()) == 0 {
+		return
+	}
+	select {
+	case r.queue <- newDMARCResult(result):
+	default:
+		r.dropped.Add(1)
+	}
+}
+
+// Dropped returns how many results were lost because the queue was full
+func (r *Recorder) Dropped() int64 {
+	return r.dropped.Load()
+}
+
+func newDMARCResult(r Result) model.DMARCResult {
+	dkim := make([]string, 0, len(r.DKIM))
+	for _, d := range r.DKIM {
+		dkim = append(dkim, fmt.Sprintf("%s/%s=%s", d.Domain, d.Selector, d.Result))
+	}
+	row := model.DMARCResult{
+		Domain:       r.Domain,
+		Record:       truncate(r.Record.Raw, 1024),
+		HeaderFrom:   truncate(strings.ToLower(r.HeaderFrom), 255),
+		EnvelopeFrom: truncate(strings.ToLower(r.EnvelopeFrom), 255),
+		SPFResult:    r.SPF,
+		SPFAligned:   r.SPFAligned,
+		DKIM:         truncate(strings.Join(dkim, ","), 1024),
+		DKIMAligned:  r.DKIMAligned,
+		Disposition:  string(r.Disposition),
+		Reason:       r.Reason,
+		CreateTime:   r.Time,
+	}
+	if r.SourceIP != nil {
+		row.SourceIP = r.SourceIP.String()
+	}
+	return row
+}
+
+// truncate cuts s to at most n bytes, the values are ASCII
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n]
+}
+
+// Start runs the recorder, results queued before are stored too
+func (r *Recorder) Start() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.stopCh != nil {
+		return
+	}
+	r.stopCh, r.doneCh = make(chan struct{}), make(chan struct{})
+	go r.run(r.stopCh, r.doneCh)
+}
+
+// Stop stores the queued results and waits for the recorder to finish
+func (r *Recorder) Stop() {
+	r.lock.Lock()
+	stopCh, doneCh := r.stopCh, r.doneCh
+	r.stopCh, r.doneCh = nil, nil
+	r.lock.Unlock()
+	if stopCh == nil {
+		return
+	}
+	close(stopCh)
+	<-doneCh
+}
+
+func (r *Recorder) run(stopCh, doneCh chan struct{}) {
+	defer close(doneCh)
+	ticker := time.NewTicker(recordFlushInterval)
+	defer ticker.Stop()
+	batch := make([]model.DMARCResult, 0, recordBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := r.save(batch); err != nil && r._log != nil {
+			r._log.Errorf("dmarc save %d results: %v", len(batch), err)
+		}
+		batch = make([]model.DMARCResult, 0, recordBatchSize)
+	}
+	for {
+		select {
+		case result := <-r.queue:
+			batch = append(batch, result)
+			if len(batch) >= recordBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-stopCh:
+			for {
+				select {
+				case result := <-r.queue:
+					batch = append(batch, result)
+					if len(batch) >= recordBatchSize {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package dmarc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"easymail/internal/model"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"mime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Feedback is the aggregate report of RFC 7489 appendix C
+type Feedback struct {
+	XMLName         xml.Name        `xml:"feedback"`
+	Version         string          `xml:"version"`
+	ReportMetadata  ReportMetadata  `xml:"report_metadata"`
+	PolicyPublished PolicyPublished `xml:"policy_published"`
+	Records         []ReportRecord  `xml:"record"`
+}
+
+type ReportMetadata struct {
+	OrgName          string    `xml:"org_name"`
+	Email            string    `xml:"email"`
+	ExtraContactInfo string    `xml:"extra_contact_info,omitempty"`
+	ReportID         string    `xml:"report_id"`
+	DateRange        DateRange `xml:"date_range"`
+}
+
+type DateRange struct {
+	Begin int64 `xml:"begin"`
+	End   int64 `xml:"end"`
+}
+
+type PolicyPublished struct {
+	Domain string    `xml:"domain"`
+	ADKIM  Alignment `xml:"adkim"`
+	ASPF   Alignment `xml:"aspf"`
+	P      Policy    `xml:"p"`
+	SP     Policy    `xml:"sp"`
+	Pct    int       `xml:"pct"`
+}
+
+type ReportRecord struct {
+	Row         ReportRow   `xml:"row"`
+	Identifiers Identifiers `xml:"identifiers"`
+	AuthResults AuthResults `xml:"auth_results"`
+}
+
+type ReportRow struct {
+	SourceIP        string          `xml:"source_ip"`
+	Count           int             `xml:"count"`
+	PolicyEvaluated PolicyEvaluated `xml:"policy_evaluated"`
+}
+
+type PolicyEvaluated struct {
+	Disposition Policy         `xml:"disposition"`
+	DKIM        string         `xml:"dkim"`
+	SPF         string         `xml:"spf"`
+	Reasons     []PolicyReason `xml:"reason,omitempty"`
+}
+
+type PolicyReason struct {
+	Type string `xml:"type"`
+}
+
+type Identifiers struct {
+	HeaderFrom   string `xml:"header_from"`
+	EnvelopeFrom string `xml:"envelope_from,omitempty"`
+}
+
+type AuthResults struct {
+	DKIM []DKIMAuthResult `xml:"dkim,omitempty"`
+	SPF  SPFAuthResult    `xml:"spf"`
+}
+
+type DKIMAuthResult struct {
+	Domain   string `xml:"domain"`
+	Selector string `xml:"selector,omitempty"`
+	Result   string `xml:"result"`
+}
+
+type SPFAuthResult struct {
+	Domain string `xml:"domain"`
+	Scope  string `xml:"scope"`
+	Result string `xml:"result"`
+}
+
+// Organization is the reporter named in the reports
+type Organization struct {
+	Name string
+	// Email sends the reports and receives the questions about them
+	Email            string
+	ExtraContactInfo string
+}
+
+// passFail names an alignment in the policy evaluated
+func passFail(aligned bool) string {
+	if aligned {
+		return ResultPass
+	}
+	return ResultFail
+}
+
+// spfResult maps the result of the spf check to the values of the report schema
+func spfResult(s string) string {
+	switch s {
+	case "none", "neutral", "pass", "fail", "softfail", "temperror", "permerror":
+		return s
+	}
+	return "none"
+}
+
+// dkimResults parses the signatures of a stored result
+func dkimResults(s string) []DKIMAuthResult {
+	results := make([]DKIMAuthResult, 0)
+	for _, item := range strings.Split(s, ",") {
+		sig, result, found := strings.Cut(item, "=")
+		if !found {
+			continue
+		}
+		domain, selector, _ := strings.Cut(sig, "/")
+		results = append(results, DKIMAuthResult{Domain: domain, Selector: selector, Result: result})
+	}
+	return results
+}
+
+/*
+NewFeedback aggregates the results of a domain between begin and end, rows
+with the same source, evaluation and identifiers are counted once. The
+policy published is the last record seen.
+*/
+func NewFeedback(org Organization, domain string, begin, end time.Time, results []model.DMARCResult) (*Feedback, error) {
+	if len(results) == 0 {
+		return nil, fmt.Errorf("no dmarc results of %s", domain)
+	}
+	record, err := ParseRecord(results[len(results)-1].Record)
+	if err != nil {
+		return nil, err
+	}
+	f := &Feedback{
+		Version: "1.0",
+		ReportMetadata: ReportMetadata{
+			OrgName:          org.Name,
+			Email:            org.Email,
+			ExtraContactInfo: org.ExtraContactInfo,
+			ReportID:         uuid.NewString(),
+			DateRange:        DateRange{Begin: begin.Unix(), End: end.Unix()},
+		},
+		PolicyPublished: PolicyPublished{
+			Domain: domain,
+			ADKIM:  record.DKIMAlignment,
+			ASPF:   record.SPFAlignment,
+			P:      record.Policy,
+			SP:     record.SubdomainPolicy,
+			Pct:    record.Percent,
+		},
+	}
+	index := make(map[string]int)
+	for _, r := range results {
+		key := strings.Join([]string{r.SourceIP, r.Disposition, r.Reason, passFail(r.DKIMAligned), passFail(r.SPFAligned),
+			r.HeaderFrom, r.EnvelopeFrom, r.DKIM, r.SPFResult}, "|")
+		if i, ok := index[key]; ok {
+			f.Records[i].Row.Count++
+			continue
+		}
+		rec := ReportRecord{
+			Row: ReportRow{
+				SourceIP: r.SourceIP,
+				Count:    1,
+				PolicyEvaluated: PolicyEvaluated{
+					Disposition: Policy(r.Disposition),
+					DKIM:        passFail(r.DKIMAligned),
+					SPF:         passFail(r.SPFAligned),
+				},
+			},
+			Identifiers: Identifiers{HeaderFrom: r.HeaderFrom, EnvelopeFrom: r.EnvelopeFrom},
+			AuthResults: AuthResults{
+				DKIM: dkimResults(r.DKIM),
+				SPF:  SPFAuthResult{Domain: r.EnvelopeFrom, Scope: "mfrom", Result: spfResult(r.SPFResult)},
+			},
+		}
+		if r.Reason != "" {
+			rec.Row.PolicyEvaluated.Reasons = []PolicyReason{{Type: r.Reason}}
+		}
+		index[key] = len(f.Records)
+		f.Records = append(f.Records, rec)
+	}
+	sort.SliceStable(f.Records, func(i, j int) bool { return f.Records[i].Row.Count > f.Records[j].Row.Count })
+	return f, nil
+}
+
+// Filename names the report file as section 7.2.1.1 asks
+func (f *Feedback) Filename() string {
+	return fmt.Sprintf("%s!%s!%d!%d.xml.gz", OrganizationalDomain(addressDomain(f.ReportMetadata.Email)),
+		f.PolicyPublished.Domain, f.ReportMetadata.DateRange.Begin, f.ReportMetadata.DateRange.End)
+}
+
+// Gzip returns the compressed XML of the report
+func (f *Feedback) Gzip() ([]byte, error) {
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	if _, err := w.Write([]byte(xml.Header)); err != nil {
+		return nil, err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(f); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// Message builds the mail carrying the report to the addresses
+func (f *Feedback) Message(to []string) ([]byte, error) {
+	data, err := f.Gzip()
+	if err != nil {
+		return nil, err
+	}
+	meta := f.ReportMetadata
+	boundary := "report-" + strings.ReplaceAll(meta.ReportID, "-", "")
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", meta.Email)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8",
+		fmt.Sprintf("Report Domain: %s Submitter: %s Report-ID: <%s>", f.PolicyPublished.Domain, meta.OrgName, meta.ReportID)))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-Id: <%s@%s>\r\n", meta.ReportID, addressDomain(meta.Email))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&b, "Content-Type: multipart/mixed; boundary=\"%s\"\r\n\r\n", boundary)
+	fmt.Fprintf(&b, "--%s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n", boundary)
+	fmt.Fprintf(&b, "This is a DMARC aggregate report of %s for %s.\r\n\r\n", meta.OrgName, f.PolicyPublished.Domain)
+	fmt.Fprintf(&b, "--%s\r\nContent-Type: application/gzip\r\nContent-Transfer-Encoding: base64\r\n", boundary)
+	fmt.Fprintf(&b, "Content-Disposition: attachment; filename=\"%s\"\r\n\r\n", f.Filename())
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 76 {
+		b.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	b.WriteString(encoded + "\r\n")
+	fmt.Fprintf(&b, "--%s--\r\n", boundary)
+	return []byte(b.String()), nil
+}
+
+func addressDomain(addr string) string {
+	if i := strings.LastIndexByte(addr, '@'); i >= 0 {
+		return strings.ToLower(strings.TrimRight(addr[i+1:], ">"))
+	}
+	return ""
+}
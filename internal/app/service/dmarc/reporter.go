@@ -0,0 +1,215 @@
+package dmarc
+
+import (
+	"easymail/internal/easylog"
+	"easymail/internal/model"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// reportCheckInterval is how often the reporter looks for a finished day
+	reportCheckInterval = time.Hour
+	// maxReportAge drops results which could not be sent for so long
+	maxReportAge = 72 * time.Hour
+)
+
+// Relay sends messages out, lmtp.SMTPRelay hands them to postfix
+type Relay interface {
+	Send(from string, to []string, msg []byte) error
+}
+
+/*
+Reporter sends the aggregate reports of the results recorded by the filter,
+one report per domain and UTC day, to the rua addresses of the domain. Sent
+results are deleted, failed reports are tried again each hour for three days.
+*/
+type Reporter struct {
+	name     string
+	org      Organization
+	relay    Relay
+	lookup   TXTLookup
+	recorder *Recorder
+	now      func() time.Time
+	lock     *sync.Mutex
+	started  bool
+	stopCh   chan struct{}
+	doneCh   chan struct{}
+	_log     *easylog.Logger
+
+	// replaced in tests
+	domains func(before time.Time) ([]string, error)
+	results func(domain string, before time.Time) ([]model.DMARCResult, error)
+	remove  func(domain string, before time.Time) error
+}
+
+// NewReporter returns a reporter sending with relay, lookup verifies the
+// report addresses of other domains and defaults to the project resolver.
+func NewReporter(org Organization, relay Relay, lookup TXTLookup) *Reporter {
+	return &Reporter{
+		name:     "dmarc",
+		org:      org,
+		relay:    relay,
+		lookup:   New(lookup).lookup,
+		recorder: NewRecorder(nil),
+		now:      time.Now,
+		lock:     &sync.Mutex{},
+		domains:  model.FindDMARCDomains,
+		results:  model.FindDMARCResults,
+		remove:   model.DeleteDMARCResults,
+	}
+}
+
+func (r *Reporter) SetLogger(_log *easylog.Logger) error {
+	if _log == nil {
+		return fmt.Errorf("%s logger is nil", r.name)
+	}
+	r._log = _log
+	r.recorder._log = _log
+	return nil
+}
+
+// Recorder returns the recorder the evaluator of the filter stores the results with
+func (r *Reporter) Recorder() *Recorder {
+	return r.recorder
+}
+
+func (r *Reporter) Name() string {
+	return r.name
+}
+
+func (r *Reporter) Start() error {
+	if r._log == nil {
+		return fmt.Errorf("%s logger is nil", r.name)
+	}
+	if r.org.Email == "" || r.relay == nil {
+		return fmt.Errorf("%s reporter needs an email address and a relay", r.name)
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.started {
+		return fmt.Errorf("%s server already started", r.name)
+	}
+	r.stopCh, r.doneCh = make(chan struct{}), make(chan struct{})
+	r.recorder.Start()
+	go r.run(r.stopCh, r.doneCh)
+	r.started = true
+	r._log.Infof("%s server started!", r.name)
+	return nil
+}
+
+func (r *Reporter) Stop() error {
+	r.lock.Lock()
+	if !r.started {
+		r.lock.Unlock()
+		return fmt.Errorf("%s server not started", r.name)
+	}
+	r.started = false
+	stopCh, doneCh := r.stopCh, r.doneCh
+	r.lock.Unlock()
+	close(stopCh)
+	<-doneCh
+	r.recorder.Stop()
+	r._log.Infof("%s server stopped!", r.name)
+	return nil
+}
+
+func (r *Reporter) run(stopCh, doneCh chan struct{}) {
+	defer close(doneCh)
+	ticker := time.NewTicker(reportCheckInterval)
+	defer ticker.Stop()
+	for {
+		if err := r.Report(); err != nil {
+			r._log.Errorf("%s report: %v", r.name, err)
+		}
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Report sends the reports of the results recorded before today, UTC
+func (r *Reporter) Report() error {
+	now := r.now().UTC()
+	end := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	domains, err := r.domains(end)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, domain := range domains {
+		if err := r.reportDomain(domain, end); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", domain, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (r *Reporter) reportDomain(domain string, end time.Time) error {
+	results, err := r.results(domain, end)
+	if err != nil || len(results) == 0 {
+		return err
+	}
+	begin := results[0].CreateTime.UTC()
+	begin = time.Date(begin.Year(), begin.Month(), begin.Day(), 0, 0, 0, 0, time.UTC)
+	record, err := ParseRecord(results[len(results)-1].Record)
+	if err == nil {
+		err = r.send(domain, begin, end, record, results)
+	}
+	if err != nil && end.Sub(begin) < maxReportAge {
+		return err
+	}
+	// sent, or failed for too long
+	if removeErr := r.remove(domain, end); removeErr != nil {
+		return errors.Join(err, removeErr)
+	}
+	return err
+}
+
+func (r *Reporter) send(domain string, begin, end time.Time, record *Record, results []model.DMARCResult) error {
+	to := make([]string, 0)
+	for _, addr := range record.ReportAddresses() {
+		if r.accepts(domain, addr) {
+			to = append(to, addr)
+		}
+	}
+	if len(to) == 0 {
+		return nil
+	}
+	feedback, err := NewFeedback(r.org, domain, begin, end, results)
+	if err != nil {
+		return err
+	}
+	msg, err := feedback.Message(to)
+	if err != nil {
+		return err
+	}
+	return r.relay.Send(r.org.Email, to, msg)
+}
+
+// accepts verifies an address outside the organizational domain of the
+// policy asked for reports of the domain, section 7.1 of RFC 7489
+func (r *Reporter) accepts(domain, addr string) bool {
+	target := addressDomain(addr)
+	if target == "" {
+		return false
+	}
+	if OrganizationalDomain(target) == OrganizationalDomain(domain) {
+		return true
+	}
+	txts, err := r.lookup(domain + "._report._dmarc." + target)
+	if err != nil {
+		return false
+	}
+	for _, txt := range txts {
+		if strings.HasPrefix(strings.ReplaceAll(txt, " ", ""), "v=DMARC1") {
+			return true
+		}
+	}
+	return false
+}
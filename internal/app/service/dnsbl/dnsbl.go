@@ -0,0 +1,284 @@
+package dnsbl
+
+import (
+	"context"
+	"easymail/internal/easydns"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/net/publicsuffix"
+)
+
+const (
+	keyPrefix = "dnsbl"
+	// reloadInterval is how long loaded settings are used before they are read again
+	reloadInterval = time.Minute
+)
+
+// Result lists the zones that listed a query, Listed holds the domains listed by any zone
+type Result struct {
+	Zones  []string
+	Listed []string
+}
+
+/*
+Blocklist looks up client addresses in DNSBL zones and body domains in
+URIBL/SURBL zones, all queries of a check run in parallel, each with the
+timeout of its zone. Answers are cached in redis, a zone that fails or times
+out counts as not listing the query.
+*/
+type Blocklist struct {
+	rc     *redis.Client
+	lookup func(host string) ([]string, error)
+	load   func() (*Settings, error)
+	now    func() time.Time
+	logf   func(format string, args ...any)
+
+	lock     sync.Mutex
+	settings *Settings
+	loaded   time.Time
+}
+
+// New creates a blocklist querying the project resolver, answers are not cached without redis
+func New(rc *redis.Client) *Blocklist {
+	return &Blocklist{
+		rc:     rc,
+		lookup: easydns.CreateDefaultResolver().LookupIPAddr,
+		load:   LoadSettings,
+		now:    time.Now,
+	}
+}
+
+// SetLogf sets where broken settings are reported
+func (b *Blocklist) SetLogf(logf func(format string, args ...any)) {
+	b.logf = logf
+}
+
+// SetSettings uses fixed settings instead of the configure tree
+func (b *Blocklist) SetSettings(s *Settings) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.load = nil
+	b.settings = s
+}
+
+// Settings returns the current settings, they are read again once a minute
+func (b *Blocklist) Settings() *Settings {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.load != nil && (b.settings == nil || b.now().Sub(b.loaded) >= reloadInterval) {
+		s, err := b.load()
+		if err != nil && b.logf != nil {
+			b.logf("dnsbl settings: %v", err)
+		}
+		// the last settings are kept when the database is not reachable
+		if s != nil && (err == nil || b.settings == nil) {
+			b.settings = s
+		}
+		b.loaded = b.now()
+	}
+	if b.settings == nil {
+		return NewSettings()
+	}
+	return b.settings
+}
+
+// CheckIP looks up the client address in the client zones
+func (b *Blocklist) CheckIP(ctx context.Context, ip net.IP) (Result, error) {
+	name := reverseIP(ip)
+	if name == "" {
+		return Result{}, nil
+	}
+	s := b.Settings()
+	return b.check(ctx, s, s.Clients, []query{{item: ip.String(), name: name}}, false)
+}
+
+// CheckDomains looks up the domains in the uri zones, they are reduced to
+// their registered domain first, addresses are looked up reversed.
+func (b *Blocklist) CheckDomains(ctx context.Context, domains []string) (Result, error) {
+	s := b.Settings()
+	queries := make([]query, 0, len(domains))
+	seen := make(map[string]bool)
+	for _, d := range domains {
+		q, ok := domainQuery(d)
+		if !ok || seen[q.item] {
+			continue
+		}
+		seen[q.item] = true
+		queries = append(queries, q)
+		if len(queries) >= s.MaxDomains {
+			break
+		}
+	}
+	return b.check(ctx, s, s.URIs, queries, true)
+}
+
+// query is an item looked up, name is how it is put in front of a zone
+type query struct {
+	item string
+	name string
+}
+
+// domainQuery reduces a host to what uri zones list
+func domainQuery(host string) (query, bool) {
+	host = strings.Trim(strings.ToLower(strings.TrimSpace(host)), ".[]")
+	if host == "" {
+		return query{}, false
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		// uri zones list addresses reversed like a dnsbl, ipv6 is not listed
+		if ip.To4() == nil {
+			return query{}, false
+		}
+		return query{item: ip.String(), name: reverseIP(ip)}, true
+	}
+	domain, err := publicsuffix.EffectiveTLDPlusOne(host)
+	if err != nil {
+		return query{}, false
+	}
+	return query{item: domain, name: domain}, true
+}
+
+// reverseIP returns the address in dnsbl order, nibbles for ipv6
+func reverseIP(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d", v4[3], v4[2], v4[1], v4[0])
+	}
+	v6 := ip.To16()
+	if v6 == nil {
+		return ""
+	}
+	const hex = "0123456789abcdef"
+	nibbles := make([]string, 0, 32)
+	for i := len(v6) - 1; i >= 0; i-- {
+		nibbles = append(nibbles, string(hex[v6[i]&0xf]), string(hex[v6[i]>>4]))
+	}
+	return strings.Join(nibbles, ".")
+}
+
+// check runs every query against every zone in parallel
+func (b *Blocklist) check(ctx context.Context, s *Settings, zones []Zone, queries []query, uri bool) (Result, error) {
+	if len(zones) == 0 || len(queries) == 0 {
+		return Result{}, nil
+	}
+	type answer struct {
+		zone   string
+		item   string
+		listed bool
+		err    error
+	}
+	answers := make(chan answer, len(zones)*len(queries))
+	var wg sync.WaitGroup
+	for _, zone := range zones {
+		for _, q := range queries {
+			wg.Add(1)
+			go func(zone Zone, q query) {
+				defer wg.Done()
+				listed, err := b.query(ctx, s, zone, q.name, uri)
+				answers <- answer{zone: zone.Name, item: q.item, listed: listed, err: err}
+			}(zone, q)
+		}
+	}
+	wg.Wait()
+	close(answers)
+
+	zoneSet, listedSet := make(map[string]bool), make(map[string]bool)
+	errs := make([]error, 0)
+	for a := range answers {
+		if a.err != nil {
+			errs = append(errs, fmt.Errorf("%s in %s: %w", a.item, a.zone, a.err))
+			continue
+		}
+		if a.listed {
+			zoneSet[a.zone], listedSet[a.item] = true, true
+		}
+	}
+	return Result{Zones: sortedKeys(zoneSet), Listed: sortedKeys(listedSet)}, errors.Join(errs...)
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func cacheKey(zone, name string) string {
+	return fmt.Sprintf("%s:%s:%s", keyPrefix, zone, name)
+}
+
+// query looks a name up in a zone, the cached answer is used when there is one
+func (b *Blocklist) query(ctx context.Context, s *Settings, zone Zone, name string, uri bool) (bool, error) {
+	key := cacheKey(zone.Name, name)
+	if b.rc != nil {
+		if v, err := b.rc.Get(ctx, key).Result(); err == nil {
+			return v == "1", nil
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, zone.Timeout)
+	defer cancel()
+	type reply struct {
+		addrs []string
+		err   error
+	}
+	// the resolver takes no context, a late reply is dropped
+	replies := make(chan reply, 1)
+	go func() {
+		addrs, err := b.lookup(name + "." + zone.Name)
+		replies <- reply{addrs, err}
+	}()
+	var r reply
+	select {
+	case r = <-replies:
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+	var dnsErr *net.DNSError
+	if errors.As(r.err, &dnsErr) && dnsErr.IsNotFound {
+		r.err = nil
+	}
+	if r.err != nil {
+		return false, r.err
+	}
+	listed := isListed(r.addrs, uri)
+	if b.rc != nil {
+		v := "0"
+		if listed {
+			v = "1"
+		}
+		if err := b.rc.Set(ctx, key, v, s.Cache).Err(); err != nil && b.logf != nil {
+			b.logf("dnsbl cache %s: %v", key, err)
+		}
+	}
+	return listed, nil
+}
+
+/*
+isListed tells a listing from the other answers of a zone, listings are in
+127.0.0.0/8. 127.255.255.0/24 reports a refused query, e.g. through a public
+resolver, and uri zones answer 127.0.0.1 when they refuse the query.
+*/
+func isListed(addrs []string, uri bool) bool {
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr).To4()
+		if ip == nil || ip[0] != 127 {
+			continue
+		}
+		if ip[1] == 255 && ip[2] == 255 {
+			continue
+		}
+		if uri && ip.Equal(net.IPv4(127, 0, 0, 1)) {
+			continue
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,142 @@
+package dnsbl
+
+import (
+	"context"
+	"easymail/internal/model"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReverseIP(t *testing.T) {
+	cases := map[string]string{
+		"192.0.2.1":   "1.2.0.192",
+		"2001:db8::1": "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2",
+	}
+	for ip, name := range cases {
+		if got := reverseIP(net.ParseIP(ip)); got != name {
+			t.Fatalf("%s: expected %s, got %s", ip, name, got)
+		}
+	}
+}
+
+func TestDomainQuery(t *testing.T) {
+	cases := []struct {
+		host string
+		item string
+		name string
+	}{
+		{"WWW.Example.co.uk.", "example.co.uk", "example.co.uk"},
+		{"a.b.example.com", "example.com", "example.com"},
+		{"[192.0.2.1]", "192.0.2.1", "1.2.0.192"},
+		{"2001:db8::1", "", ""},
+		{"co.uk", "", ""},
+	}
+	for _, c := range cases {
+		q, ok := domainQuery(c.host)
+		if ok != (c.item != "") || q.item != c.item || q.name != c.name {
+			t.Fatalf("%s: unexpected query %+v, ok %v", c.host, q, ok)
+		}
+	}
+}
+
+func TestIsListed(t *testing.T) {
+	cases := []struct {
+		addrs  []string
+		uri    bool
+		listed bool
+	}{
+		{[]string{"127.0.0.2"}, false, true},
+		{[]string{"127.0.0.1"}, false, true},
+		{[]string{"127.0.0.1"}, true, false},
+		{[]string{"127.0.0.4"}, true, true},
+		{[]string{"127.255.255.254"}, false, false},
+		{[]string{"192.0.2.1"}, false, false},
+		{nil, false, false},
+	}
+	for i, c := range cases {
+		if got := isListed(c.addrs, c.uri); got != c.listed {
+			t.Fatalf("case %d: expected %v, got %v", i, c.listed, got)
+		}
+	}
+}
+
+func TestSettings(t *testing.T) {
+	s := NewSettings()
+	nodes := []struct {
+		section string
+		node    model.Configure
+		ok      bool
+	}{
+		{sectionClient, model.Configure{Name: "zen.spamhaus.org", Value: "500"}, true},
+		{sectionClient, model.Configure{Name: "bl.example.org."}, true},
+		{sectionClient, model.Configure{Name: "bad zone"}, false},
+		{sectionURI, model.Configure{Name: "multi.surbl.org", Value: "soon"}, false},
+		{sectionURI, model.Configure{Name: "multi.uribl.com"}, true},
+		{sectionSetting, model.Configure{Name: "max_domains", Value: "5"}, true},
+		{sectionSetting, model.Configure{Name: "cache", Value: "-1"}, false},
+	}
+	for _, n := range nodes {
+		if err := s.set(n.section, n.node); (err == nil) != n.ok {
+			t.Fatalf("%s/%s: unexpected error %v", n.section, n.node.Name, err)
+		}
+	}
+	expected := []Zone{{"zen.spamhaus.org", 500 * time.Millisecond}, {"bl.example.org", DefaultTimeout}}
+	if !reflect.DeepEqual(s.Clients, expected) || len(s.URIs) != 1 || s.MaxDomains != 5 || s.Cache != DefaultCache {
+		t.Fatalf("unexpected settings %+v", s)
+	}
+}
+
+func TestBlocklist(t *testing.T) {
+	b := New(nil)
+	var lock sync.Mutex
+	uriLookups := 0
+	b.lookup = func(host string) ([]string, error) {
+		if strings.HasSuffix(host, ".uri.example") {
+			lock.Lock()
+			uriLookups++
+			lock.Unlock()
+		}
+		switch {
+		case strings.HasSuffix(host, ".slow.example"):
+			time.Sleep(time.Second)
+			return []string{"127.0.0.2"}, nil
+		case strings.HasPrefix(host, "1.2.0.192."), strings.HasPrefix(host, "spam.example."):
+			return []string{"127.0.0.2"}, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	b.SetSettings(&Settings{
+		Clients: []Zone{
+			{Name: "a.example", Timeout: time.Second},
+			{Name: "b.example", Timeout: time.Second},
+			{Name: "slow.example", Timeout: 50 * time.Millisecond},
+		},
+		URIs:       []Zone{{Name: "uri.example", Timeout: time.Second}},
+		MaxDomains: 2,
+	})
+
+	ctx := context.Background()
+	result, err := b.CheckIP(ctx, net.ParseIP("192.0.2.1"))
+	// the slow zone times out and does not count
+	if err == nil || !reflect.DeepEqual(result.Zones, []string{"a.example", "b.example"}) {
+		t.Fatalf("unexpected result %+v, err %v", result, err)
+	}
+	if result, err = b.CheckIP(ctx, net.ParseIP("192.0.2.2")); len(result.Zones) != 0 {
+		t.Fatalf("unexpected result %+v, err %v", result, err)
+	}
+
+	result, err = b.CheckDomains(ctx, []string{"www.spam.example", "spam.example", "ham.example", "third.example"})
+	if err != nil || !reflect.DeepEqual(result.Listed, []string{"spam.example"}) || !reflect.DeepEqual(result.Zones, []string{"uri.example"}) {
+		t.Fatalf("unexpected result %+v, err %v", result, err)
+	}
+	// duplicates are looked up once and the domains are capped
+	lock.Lock()
+	defer lock.Unlock()
+	if uriLookups != 2 {
+		t.Fatalf("expected 2 lookups, got %d", uriLookups)
+	}
+}
@@ -0,0 +1,141 @@
+package dnsbl
+
+import (
+	"easymail/internal/model"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+/*
+the configure tree of the blocklists, admins manage it as any other node:
+
+	dnsbl/client/<zone>        zone the client address is looked up in, the value is the timeout in milliseconds
+	dnsbl/uri/<zone>           zone the domains of the body are looked up in, the value is the timeout in milliseconds
+	dnsbl/setting/cache        seconds answers are cached in redis
+	dnsbl/setting/max_domains  domains of a message looked up at most
+*/
+const (
+	configRoot     = "dnsbl"
+	sectionSetting = "setting"
+	sectionClient  = "client"
+	sectionURI     = "uri"
+)
+
+// defaults of the settings not configured
+const (
+	DefaultTimeout    = 2 * time.Second
+	DefaultCache      = time.Hour
+	DefaultMaxDomains = 20
+)
+
+// Zone is a blocklist and how long a query of it may take
+type Zone struct {
+	Name    string
+	Timeout time.Duration
+}
+
+// Settings are the blocklists of clients and of body domains
+type Settings struct {
+	Clients []Zone
+	URIs    []Zone
+	// Cache is how long an answer is kept, failed queries are not cached
+	Cache time.Duration
+	// MaxDomains caps the domains of a message, a long list of links does not flood the zones
+	MaxDomains int
+}
+
+// NewSettings returns the default settings without zones
+func NewSettings() *Settings {
+	return &Settings{
+		Cache:      DefaultCache,
+		MaxDomains: DefaultMaxDomains,
+	}
+}
+
+// LoadSettings reads the settings from the configure tree, defaults are kept
+// for the missing nodes, a broken node is skipped and reported.
+func LoadSettings() (*Settings, error) {
+	s := NewSettings()
+	root, err := model.GetConfigureByName(configRoot, 0)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return s, nil
+	}
+	if err != nil {
+		return s, err
+	}
+	sections, err := model.GetSubConfigureByParentId(root.ID)
+	if err != nil {
+		return s, err
+	}
+	errs := make([]error, 0)
+	for _, section := range sections {
+		nodes, err := model.GetSubConfigureByParentId(section.ID)
+		if err != nil {
+			return s, err
+		}
+		for _, node := range nodes {
+			if err := s.set(section.Name, node); err != nil {
+				errs = append(errs, fmt.Errorf("dnsbl %s/%s: %w", section.Name, node.Name, err))
+			}
+		}
+	}
+	// the order of the zones in features does not depend on the database
+	sort.Slice(s.Clients, func(i, j int) bool { return s.Clients[i].Name < s.Clients[j].Name })
+	sort.Slice(s.URIs, func(i, j int) bool { return s.URIs[i].Name < s.URIs[j].Name })
+	return s, errors.Join(errs...)
+}
+
+// set applies one node of a section
+func (s *Settings) set(section string, node model.Configure) error {
+	switch section {
+	case sectionSetting:
+		n, err := strconv.Atoi(strings.TrimSpace(node.Value))
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid number %q", node.Value)
+		}
+		switch node.Name {
+		case "cache":
+			s.Cache = time.Duration(n) * time.Second
+		case "max_domains":
+			s.MaxDomains = n
+		default:
+			return errors.New("unknown setting")
+		}
+	case sectionClient, sectionURI:
+		zone, err := newZone(node.Name, node.Value)
+		if err != nil {
+			return err
+		}
+		if section == sectionClient {
+			s.Clients = append(s.Clients, zone)
+		} else {
+			s.URIs = append(s.URIs, zone)
+		}
+	default:
+		return errors.New("unknown section")
+	}
+	return nil
+}
+
+// newZone parses a zone node, an empty value takes the default timeout
+func newZone(name, timeout string) (Zone, error) {
+	name = strings.Trim(strings.ToLower(strings.TrimSpace(name)), ".")
+	if name == "" || strings.ContainsAny(name, " /:") {
+		return Zone{}, fmt.Errorf("invalid zone %q", name)
+	}
+	zone := Zone{Name: name, Timeout: DefaultTimeout}
+	if timeout = strings.TrimSpace(timeout); timeout != "" {
+		ms, err := strconv.Atoi(timeout)
+		if err != nil || ms <= 0 {
+			return Zone{}, fmt.Errorf("invalid timeout %q", timeout)
+		}
+		zone.Timeout = time.Duration(ms) * time.Millisecond
+	}
+	return zone, nil
+}
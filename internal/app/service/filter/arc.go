@@ -0,0 +1,97 @@
+package filter
+
+import (
+	"easymail/internal/app/service/milter"
+	"easymail/internal/app/service/milter/third_party/dkim"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// arcOutcome is what the validation of a chain returns
+type arcOutcome struct {
+	verification *dkim.ARCVerification
+	err          error
+}
+
+// startARC starts the validation of the ARC chain of a message, it is fed
+// like the DKIM verification.
+func (f *Filter) startARC(sealed bool) {
+	if f.opts.ARC == nil || f.features[FeatureSaslUsername].Value != "" {
+		return
+	}
+	f.arcEnabled = true
+	if !sealed {
+		return
+	}
+	pr, pw := io.Pipe()
+	done := make(chan arcOutcome, 1)
+	lookup := f.opts.ARC
+	go func() {
+		v, err := dkim.VerifyARC(pr, &dkim.VerifyOptions{LookupTXT: lookup})
+		_, _ = io.Copy(io.Discard, pr)
+		done <- arcOutcome{v, err}
+	}()
+	f.arcWriter, f.arcDone = pw, done
+	f.writeARC(f.header.Bytes())
+	f.writeARC([]byte("\r\n"))
+}
+
+func (f *Filter) writeARC(p []byte) {
+	if f.arcWriter == nil {
+		return
+	}
+	if _, err := f.arcWriter.Write(p); err != nil {
+		f.logf("filter arc: %v", err)
+		f.arcWriter = nil
+	}
+}
+
+// stopARC drops a running validation
+func (f *Filter) stopARC() {
+	if f.arcWriter != nil {
+		_ = f.arcWriter.CloseWithError(errDKIMAborted)
+	}
+	f.arcWriter, f.arcDone, f.arcEnabled = nil, nil, false
+}
+
+// finishARC waits for the validation and returns its features, the sealer
+// of the newest set lets rules trust the forwarders they know.
+func (f *Filter) finishARC() []milter.Feature {
+	if !f.arcEnabled {
+		return nil
+	}
+	if f.arcDone == nil {
+		f.authResults = append(f.authResults, "arc=none")
+		return []milter.Feature{stringFeature(FeatureARC, string(dkim.ARCNone))}
+	}
+	if f.arcWriter != nil {
+		_ = f.arcWriter.Close()
+	}
+	var outcome arcOutcome
+	select {
+	case outcome = <-f.arcDone:
+	case <-time.After(dkimTimeout):
+		outcome.err = errors.New("arc: validation timed out")
+	}
+	f.arcWriter, f.arcDone = nil, nil
+	if outcome.err != nil {
+		f.logf("filter %v", outcome.err)
+		f.authResults = append(f.authResults, "arc=fail")
+		return []milter.Feature{stringFeature(FeatureARC, string(dkim.ARCFail))}
+	}
+
+	v := outcome.verification
+	entry := fmt.Sprintf("arc=%s (i=%d)", v.Result, v.Instance)
+	if v.Err != nil {
+		entry += fmt.Sprintf(" reason=\"%s\"", headerValue(strings.TrimPrefix(v.Err.Error(), "dkim: ")))
+	}
+	f.authResults = append(f.authResults, entry)
+	features := []milter.Feature{stringFeature(FeatureARC, string(v.Result))}
+	if v.Result == dkim.ARCPass {
+		features = append(features, stringFeature(FeatureARCDomain, strings.ToLower(v.Domain)))
+	}
+	return features
+}
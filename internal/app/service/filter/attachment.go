@@ -0,0 +1,47 @@
+package filter
+
+import (
+	"easymail/internal/app/service/attachment"
+	"easymail/internal/app/service/milter"
+	"strings"
+
+	"github.com/jhillyerd/enmime"
+)
+
+// HashBlocklist tells the files of known bad hashes, *attachment.HashList implements it
+type HashBlocklist interface {
+	Blocked(f attachment.File) bool
+}
+
+// attachments gives the features of the files of a message, attached
+// messages and archives included. Lists are joined by ; like attach_name.
+func (f *Filter) attachments(env *enmime.Envelope) []milter.Feature {
+	files := attachment.Extract(env)
+	var mismatch, executable, blocked bool
+	types := make([]string, 0, len(files))
+	md5s := make([]string, 0, len(files))
+	sha256s := make([]string, 0, len(files))
+	for _, file := range files {
+		mismatch = mismatch || file.ExtMismatch
+		executable = executable || file.Executable
+		if file.Type != "" {
+			types = append(types, file.Type)
+		}
+		if file.MD5 != "" {
+			md5s = append(md5s, file.MD5)
+			sha256s = append(sha256s, file.SHA256)
+		}
+		if !blocked && f.opts.Hashes != nil && f.opts.Hashes.Blocked(file) {
+			f.logf("filter attachment %s matches a blocked hash", file.Name)
+			blocked = true
+		}
+	}
+	return []milter.Feature{
+		boolFeature(FeatureAttachExtMismatch, mismatch),
+		boolFeature(FeatureAttachExecutable, executable),
+		boolFeature(FeatureAttachHashBlocked, blocked),
+		stringFeature(FeatureAttachType, strings.Join(types, ";")),
+		stringFeature(FeatureAttachMd5, strings.Join(md5s, ";")),
+		stringFeature(FeatureAttachSha256, strings.Join(sha256s, ";")),
+	}
+}
@@ -0,0 +1,35 @@
+package filter
+
+import (
+	"context"
+	"easymail/internal/app/service/milter"
+	"time"
+)
+
+// bayesTimeout bounds the token lookups of a message
+const bayesTimeout = 5 * time.Second
+
+// Classifier scores how likely a message is spam, *bayes.Classifier implements it
+type Classifier interface {
+	// Classify returns a score between 0 and 1, trained is false while it can't tell yet
+	Classify(ctx context.Context, subject, text, html string) (score float64, trained bool, err error)
+}
+
+// classify gives the bayes score of the content, it is missing while the
+// classifier is not trained so rules don't act on a neutral guess.
+func (f *Filter) classify(text, html string) []milter.Feature {
+	if f.opts.Bayes == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), bayesTimeout)
+	defer cancel()
+	score, trained, err := f.opts.Bayes.Classify(ctx, f.features[FeatureSubject].Value, text, html)
+	if err != nil {
+		f.logf("filter bayes: %v", err)
+		return nil
+	}
+	if !trained {
+		return nil
+	}
+	return []milter.Feature{floatFeature(FeatureBayesScore, score)}
+}
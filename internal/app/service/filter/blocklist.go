@@ -0,0 +1,68 @@
+package filter
+
+import (
+	"context"
+	"easymail/internal/app/service/dnsbl"
+	"easymail/internal/app/service/links"
+	"easymail/internal/app/service/milter"
+	"net"
+	"strings"
+	"time"
+)
+
+// blocklistTimeout bounds all lookups of a stage, zones have shorter timeouts of their own
+const blocklistTimeout = 5 * time.Second
+
+// Blocklist looks up the client and the domains linked in the body in DNS blocklists
+type Blocklist interface {
+	CheckIP(ctx context.Context, ip net.IP) (dnsbl.Result, error)
+	CheckDomains(ctx context.Context, domains []string) (dnsbl.Result, error)
+}
+
+// urlHosts returns the distinct hosts of the links, in order of appearance
+func urlHosts(found []links.Link) []string {
+	hosts := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, l := range found {
+		if !seen[l.Host] {
+			seen[l.Host] = true
+			hosts = append(hosts, l.Host)
+		}
+	}
+	return hosts
+}
+
+// clientListed returns the dnsbl features of the client, failed lookups are logged
+func (f *Filter) clientListed(ip net.IP) []milter.Feature {
+	if f.opts.Blocklist == nil || ip == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), blocklistTimeout)
+	defer cancel()
+	result, err := f.opts.Blocklist.CheckIP(ctx, ip)
+	if err != nil {
+		f.logf("filter dnsbl: %v", err)
+	}
+	return []milter.Feature{
+		intFeature(FeatureDnsblHits, int64(len(result.Zones))),
+		stringFeature(FeatureDnsblZones, strings.Join(result.Zones, ";")),
+	}
+}
+
+// uriListed returns the uribl features of the linked hosts, failed lookups are logged
+func (f *Filter) uriListed(hosts []string) []milter.Feature {
+	if f.opts.Blocklist == nil || len(hosts) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), blocklistTimeout)
+	defer cancel()
+	result, err := f.opts.Blocklist.CheckDomains(ctx, hosts)
+	if err != nil {
+		f.logf("filter uribl: %v", err)
+	}
+	return []milter.Feature{
+		boolFeature(FeatureUriblListed, len(result.Listed) > 0),
+		intFeature(FeatureUriblHits, int64(len(result.Listed))),
+		stringFeature(FeatureUriblDomains, strings.Join(result.Listed, ";")),
+	}
+}
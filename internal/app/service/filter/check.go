@@ -0,0 +1,111 @@
+package filter
+
+import (
+	"context"
+	"easymail/internal/app/service/milter"
+	"easymail/internal/model"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hyperjumptech/grule-rule-engine/ast"
+	"github.com/redis/go-redis/v9"
+)
+
+/*
+Checker evaluates the rules of the stages before DATA outside the milter, the
+policy server keeps one per postfix connection. Metrics are read but never
+counted, the milter counts every message once.
+*/
+type Checker struct {
+	engine  *Engine
+	kbs     map[model.FilterStage]*ast.KnowledgeBase
+	metrics *metricCounter
+}
+
+// NewChecker creates a checker of the engine, metrics read 0 without redis
+func NewChecker(e *Engine, rc *redis.Client) *Checker {
+	c := &Checker{
+		engine: e,
+		kbs:    make(map[model.FilterStage]*ast.KnowledgeBase),
+	}
+	if rc != nil {
+		c.metrics = &metricCounter{rc: rc}
+	}
+	return c
+}
+
+// Engine returns the engine the checker evaluates
+func (c *Checker) Engine() *Engine {
+	return c.engine
+}
+
+/*
+Check evaluates the stages from connect up to stage in order with the
+features, the first matched rule decides and its stage is returned. Errors of
+a stage are returned along with the result, the stage is skipped.
+*/
+func (c *Checker) Check(stage model.FilterStage, features Features) (*Result, model.FilterStage, error) {
+	for _, metric := range c.engine.allMetrics() {
+		if _, ok := features[metric.Name]; !ok {
+			features.Add(intFeature(metric.Name, 0))
+		}
+	}
+	errs := make([]error, 0)
+	for s := model.FilterStageConnect; s <= stage; s++ {
+		metrics, err := c.metrics.peek(c.engine.Metrics(s), features)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("filter stage %d: %w", s, err))
+		}
+		features.Add(metrics...)
+
+		kb, ok := c.kbs[s]
+		if !ok {
+			if kb, err = c.engine.NewKnowledgeBase(s); err != nil {
+				errs = append(errs, fmt.Errorf("filter knowledge base of stage %d: %w", s, err))
+				continue
+			}
+			c.kbs[s] = kb
+		}
+		result, err := Execute(kb, features)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("filter stage %d: %w", s, err))
+			continue
+		}
+		if result.Matched() {
+			return result, s, errors.Join(errs...)
+		}
+	}
+	return &Result{}, stage, errors.Join(errs...)
+}
+
+// Log builds the filter log of a rule matched by Check
+func (c *Checker) Log(stage model.FilterStage, result *Result, features Features, queueID string) (model.FilterLog, error) {
+	log, err := newFilterLog(features, features[FeatureRcpt].Value, stage, result, model.FilterAction(result.Action))
+	if err != nil {
+		return log, err
+	}
+	log.QueueID = queueID
+	return log, nil
+}
+
+// peek injects the metrics of a stage without counting the message
+func (c *metricCounter) peek(metrics []model.FilterMetric, features Features) ([]milter.Feature, error) {
+	if c == nil || len(metrics) == 0 {
+		return nil, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), metricTimeout)
+	defer cancel()
+	now := time.Now()
+	result := make([]milter.Feature, 0, len(metrics))
+	for _, m := range metrics {
+		v, ok, err := c.read(ctx, m, features, now)
+		if err != nil {
+			return result, fmt.Errorf("metric %s: %w", m.Name, err)
+		}
+		if ok {
+			result = append(result, intFeature(m.Name, v))
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,206 @@
+package filter
+
+import (
+	"context"
+	"easymail/internal/app/service/dmarc"
+	"easymail/internal/app/service/milter"
+	"easymail/internal/app/service/milter/third_party/dkim"
+	"easymail/internal/easydns"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	dkimKeyPrefix = "dkim:txt"
+	// maxDKIMSignatures caps the signatures verified, the others are ignored
+	maxDKIMSignatures = 5
+	// dkimTimeout bounds the wait for the verification at end of body
+	dkimTimeout = 10 * time.Second
+	// dkimCacheTTL keeps published keys, dkimMissingTTL keeps the names without a key
+	dkimCacheTTL   = time.Hour
+	dkimMissingTTL = 5 * time.Minute
+)
+
+var errDKIMAborted = errors.New("dkim: message aborted")
+
+// TXTLookup returns the TXT records of a name
+type TXTLookup func(name string) ([]string, error)
+
+// NewDKIMLookup looks keys up with the project resolver, cached in redis when rc is set
+func NewDKIMLookup(rc *redis.Client) TXTLookup {
+	lookup := easydns.CreateDefaultResolver().LookupTXT
+	if rc == nil {
+		return lookup
+	}
+	return cachedTXT(rc, lookup)
+}
+
+// cachedTXT caches the records and the names without records, failed lookups are not cached
+func cachedTXT(rc *redis.Client, lookup TXTLookup) TXTLookup {
+	return func(name string) ([]string, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), metricTimeout)
+		defer cancel()
+		key := dkimKeyPrefix + ":" + strings.ToLower(name)
+		if v, err := rc.Get(ctx, key).Bytes(); err == nil {
+			var txts []string
+			if err = json.Unmarshal(v, &txts); err == nil {
+				if len(txts) == 0 {
+					return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+				}
+				return txts, nil
+			}
+		}
+		txts, err := lookup(name)
+		ttl := dkimCacheTTL
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			txts, ttl = nil, dkimMissingTTL
+		} else if err != nil {
+			return nil, err
+		}
+		if v, e := json.Marshal(txts); e == nil {
+			_ = rc.Set(ctx, key, v, ttl).Err()
+		}
+		return txts, err
+	}
+}
+
+// dkimOutcome is what the verifier of a message returns
+type dkimOutcome struct {
+	verifications []*dkim.Verification
+	err           error
+}
+
+// dkimResult maps the error of a verification to its Authentication-Results value
+func dkimResult(v *dkim.Verification) string {
+	switch {
+	case v.Err == nil:
+		return "pass"
+	case dkim.IsTempFail(v.Err):
+		return "temperror"
+	case dkim.IsPermFail(v.Err):
+		return "permerror"
+	}
+	return "fail"
+}
+
+// startDKIM starts the verification of a signed message, the header is
+// streamed into it at once and the body chunk by chunk as it arrives.
+func (f *Filter) startDKIM(signed bool) {
+	// logged in clients send their own mail, it is signed instead
+	if f.opts.DKIM == nil || f.features[FeatureSaslUsername].Value != "" {
+		return
+	}
+	f.dkimEnabled = true
+	if !signed {
+		return
+	}
+	pr, pw := io.Pipe()
+	done := make(chan dkimOutcome, 1)
+	lookup := f.opts.DKIM
+	go func() {
+		vs, err := dkim.VerifyWithOptions(pr, &dkim.VerifyOptions{LookupTXT: lookup, MaxVerifications: maxDKIMSignatures})
+		// the verifier may stop before the end, the writer must not block
+		_, _ = io.Copy(io.Discard, pr)
+		done <- dkimOutcome{vs, err}
+	}()
+	f.dkimWriter, f.dkimDone = pw, done
+	f.writeDKIM(f.header.Bytes())
+	f.writeDKIM([]byte("\r\n"))
+}
+
+func (f *Filter) writeDKIM(p []byte) {
+	if f.dkimWriter == nil {
+		return
+	}
+	if _, err := f.dkimWriter.Write(p); err != nil {
+		f.logf("filter dkim: %v", err)
+		f.dkimWriter = nil
+	}
+}
+
+// stopDKIM drops a running verification, e.g. when the message is aborted
+func (f *Filter) stopDKIM() {
+	if f.dkimWriter != nil {
+		_ = f.dkimWriter.CloseWithError(errDKIMAborted)
+	}
+	f.dkimWriter, f.dkimDone, f.dkimEnabled = nil, nil, false
+}
+
+// finishDKIM waits for the verification and returns its features, every
+// signature is recorded in Authentication-Results.
+func (f *Filter) finishDKIM() []milter.Feature {
+	if !f.dkimEnabled {
+		return nil
+	}
+	if f.dkimDone == nil {
+		f.authResults = append(f.authResults, "dkim=none")
+		return []milter.Feature{stringFeature(FeatureDKIM, "none")}
+	}
+	if f.dkimWriter != nil {
+		_ = f.dkimWriter.Close()
+	}
+	var outcome dkimOutcome
+	select {
+	case outcome = <-f.dkimDone:
+	case <-time.After(dkimTimeout):
+		outcome.err = errors.New("dkim: verification timed out")
+	}
+	f.dkimWriter, f.dkimDone = nil, nil
+	if outcome.err != nil && len(outcome.verifications) == 0 {
+		f.logf("filter %v", outcome.err)
+		f.authResults = append(f.authResults, "dkim=temperror")
+		return []milter.Feature{stringFeature(FeatureDKIM, "temperror")}
+	}
+
+	overall := ""
+	passed := make([]string, 0)
+	results := make([]string, 0, len(outcome.verifications))
+	for _, v := range outcome.verifications {
+		result := dkimResult(v)
+		results = append(results, fmt.Sprintf("%s/%s=%s", v.Domain, v.Selector, result))
+		f.dkimResults = append(f.dkimResults, dmarc.DKIMResult{Domain: v.Domain, Selector: v.Selector, Result: result})
+		entry := fmt.Sprintf("dkim=%s header.d=%s header.s=%s", result, headerValue(v.Domain), headerValue(v.Selector))
+		if v.Err != nil {
+			entry += fmt.Sprintf(" reason=\"%s\"", headerValue(strings.TrimPrefix(v.Err.Error(), "dkim: ")))
+		}
+		f.authResults = append(f.authResults, entry)
+		if result == "pass" {
+			passed = append(passed, strings.ToLower(v.Domain))
+		}
+		// the best result stands for the message
+		if dkimRank[result] > dkimRank[overall] {
+			overall = result
+		}
+	}
+	return []milter.Feature{
+		stringFeature(FeatureDKIM, overall),
+		stringFeature(FeatureDKIMDomains, strings.Join(passed, ",")),
+		stringFeature(FeatureDKIMResults, strings.Join(results, ",")),
+	}
+}
+
+// dkimRank orders the results of the signatures, a single pass makes the message pass
+var dkimRank = map[string]int{"": 0, "permerror": 1, "fail": 2, "temperror": 3, "pass": 4}
+
+// dkimPassed tells whether a signature of the sender domain or a parent of it passed
+func (f *Filter) dkimPassed() bool {
+	domain := strings.ToLower(f.features[FeatureSenderDomain].Value)
+	if domain == "" {
+		return false
+	}
+	for _, r := range f.dkimResults {
+		d := strings.ToLower(r.Domain)
+		if r.Result == "pass" && (domain == d || strings.HasSuffix(domain, "."+d)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,115 @@
+package filter
+
+import (
+	"easymail/internal/app/service/dmarc"
+	"easymail/internal/app/service/milter"
+	"easymail/internal/model"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// DMARCMode tells what the filter does with the DMARC policy of the From domain
+type DMARCMode uint8
+
+const (
+	// DMARCOff skips the evaluation, the dmarc features stay empty
+	DMARCOff DMARCMode = iota
+	// DMARCHeader gives the result to the rules and records it in the headers
+	DMARCHeader
+	// DMARCEnforce also rejects or quarantines failing messages as the policy asks,
+	// unless a rule decided on the message
+	DMARCEnforce
+)
+
+// ParseDMARCMode parses the mode of the filter configuration, empty is off
+func ParseDMARCMode(s string) (DMARCMode, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "off":
+		return DMARCOff, nil
+	case "header":
+		return DMARCHeader, nil
+	case "enforce":
+		return DMARCEnforce, nil
+	}
+	return DMARCOff, fmt.Errorf("invalid dmarc mode %q", s)
+}
+
+// DMARC evaluates messages against the policy of their From domain and
+// records the results for the aggregate reports, e.g. dmarc.Evaluator
+type DMARC interface {
+	Evaluate(msg dmarc.Message) (dmarc.Result, error)
+	Record(result dmarc.Result)
+}
+
+// domainOf returns the domain of an address, the name itself when it is no address
+func domainOf(addr string) string {
+	if i := strings.LastIndex(addr, "@"); i >= 0 {
+		addr = addr[i+1:]
+	}
+	return strings.ToLower(strings.Trim(addr, "<>"))
+}
+
+// checkDMARC evaluates the message once SPF and DKIM are known, mail of
+// logged in clients is not evaluated.
+func (f *Filter) checkDMARC() []milter.Feature {
+	if f.opts.DMARC == nil || f.opts.DMARCMode == DMARCOff || f.features[FeatureSaslUsername].Value != "" {
+		return nil
+	}
+	from := f.features[FeatureHeaderFrom].Value
+	if !strings.Contains(from, "@") {
+		return nil
+	}
+	_, identity := spfIdentity(f.features[FeatureHelo].Value, f.features[FeatureSender].Value)
+	result, err := f.opts.DMARC.Evaluate(dmarc.Message{
+		SourceIP:     net.ParseIP(f.features[FeatureClientIP].Value),
+		HeaderFrom:   domainOf(from),
+		EnvelopeFrom: domainOf(identity),
+		SPF:          f.features[FeatureSPF].Value,
+		DKIM:         f.dkimResults,
+	})
+	if err != nil {
+		f.logf("filter %v", err)
+	}
+	f.dmarcResult = &result
+	entry := "dmarc=" + result.Result
+	if result.Record != nil {
+		entry += fmt.Sprintf(" (p=%s dis=%s)", result.Policy, strings.ToUpper(string(result.Disposition)))
+	}
+	f.authResults = append(f.authResults, entry+" header.from="+headerValue(domainOf(from)))
+	return []milter.Feature{
+		stringFeature(FeatureDMARC, result.Result),
+		stringFeature(FeatureDMARCPolicy, string(result.Disposition)),
+	}
+}
+
+// dmarcEnforced applies the disposition of a failing message no rule decided on
+func (f *Filter) dmarcEnforced(resp milter.Response, m *milter.Modifier) milter.Response {
+	r := f.dmarcResult
+	if resp != milter.RespContinue || r == nil || f.opts.DMARCMode != DMARCEnforce {
+		return resp
+	}
+	switch r.Disposition {
+	case dmarc.PolicyReject:
+		f.dmarcApplied = true
+		f.finish(model.FilterStageData, &Result{Action: int64(model.FilterActionReject)}, m)
+		return milter.NewResponseStr(byte(milter.ActReplyCode), "550 5.7.1 Rejected by the DMARC policy of "+r.Domain)
+	case dmarc.PolicyQuarantine:
+		f.dmarcApplied = true
+		return f.apply(model.FilterStageData, &Result{Action: int64(model.FilterActionQuarantine), Reason: "dmarc policy of " + r.Domain}, m)
+	}
+	return resp
+}
+
+// recordDMARC records what was done with the message, a disposition which
+// was not applied is reported as overridden by local policy.
+func (f *Filter) recordDMARC() {
+	r := f.dmarcResult
+	if r == nil || r.Record == nil {
+		return
+	}
+	if !f.dmarcApplied && r.Disposition != dmarc.PolicyNone {
+		r.Disposition, r.Reason = dmarc.PolicyNone, dmarc.ReasonLocalPolicy
+	}
+	f.opts.DMARC.Record(*r)
+}
@@ -0,0 +1,258 @@
+package filter
+
+import (
+	"easymail/internal/model"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/hyperjumptech/grule-rule-engine/ast"
+	"github.com/hyperjumptech/grule-rule-engine/builder"
+	"github.com/hyperjumptech/grule-rule-engine/engine"
+	"github.com/hyperjumptech/grule-rule-engine/pkg"
+)
+
+const knowledgeVersion = "1"
+
+func knowledgeName(stage model.FilterStage) string {
+	return fmt.Sprintf("filter_%d", stage)
+}
+
+// BuildError is returned when the DRL of a stage does not compile, Rules
+// holds the error of each rule that fails to compile on its own.
+type BuildError struct {
+	Stage model.FilterStage
+	Rules map[int64]error
+	Err   error
+}
+
+func (e *BuildError) Error() string {
+	if len(e.Rules) == 0 {
+		return fmt.Sprintf("build filter rules of stage %d: %v", e.Stage, e.Err)
+	}
+	ids := make([]int64, 0, len(e.Rules))
+	for id := range e.Rules {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	msgs := make([]string, 0, len(ids))
+	for _, id := range ids {
+		msgs = append(msgs, fmt.Sprintf("rule %d: %v", id, e.Rules[id]))
+	}
+	return fmt.Sprintf("build filter rules of stage %d: %s", e.Stage, strings.Join(msgs, "; "))
+}
+
+func (e *BuildError) Unwrap() error {
+	return e.Err
+}
+
+// Result is filled by the rule matched first, RuleID is 0 when no rule matched
+type Result struct {
+	RuleID int64
+	Action int64
+	// Reason replaces the rule in the quarantine reason, e.g. for a DMARC policy
+	Reason string
+}
+
+// Matched reports whether a rule fired
+func (r *Result) Matched() bool {
+	return r != nil && r.RuleID > 0
+}
+
+/*
+Engine holds the compiled filter rules, grouped by the stage their features
+become available at. A rule is evaluated once, at its own stage, so that a
+condition like feature.size<1000 does not match at connect time.
+*/
+type Engine struct {
+	lib *ast.KnowledgeLibrary
+	// rules counts compiled rules per stage, stages without rules are not built
+	rules map[model.FilterStage]int
+	// skipped rules could not be converted to DRL
+	skipped map[int64]error
+	// metrics are injected as features at the stage both their fields are known
+	metrics map[model.FilterStage][]model.FilterMetric
+}
+
+// NewEngine compiles the rules into a knowledge library, fields and metrics
+// give the stage of custom features.
+func NewEngine(rules []model.FilterRule, fields []model.FilterField, metrics []model.FilterMetric) (*Engine, error) {
+	e := &Engine{
+		lib:     ast.NewKnowledgeLibrary(),
+		rules:   make(map[model.FilterStage]int),
+		skipped: make(map[int64]error),
+		metrics: make(map[model.FilterStage][]model.FilterMetric),
+	}
+	fieldStages := make(map[string]model.FilterStage, len(fields)+len(metrics))
+	for _, f := range fields {
+		fieldStages[f.Name] = f.Stage
+	}
+	for _, m := range metrics {
+		stage := metricStage(m)
+		fieldStages[m.Name] = stage
+		e.metrics[stage] = append(e.metrics[stage], m)
+	}
+
+	drls := make(map[model.FilterStage]map[int64]string)
+	for _, r := range rules {
+		drl, err := r.Convert2DRL()
+		if err != nil {
+			e.skipped[r.ID] = err
+			continue
+		}
+		// grule only logs a field missing from the fact, the rule would never match
+		if unknown := unknownFeatures(drl, fieldStages); len(unknown) > 0 {
+			e.skipped[r.ID] = fmt.Errorf("unknown feature %s", strings.Join(unknown, ", "))
+			continue
+		}
+		stage := ruleStage(drl, fieldStages)
+		if drls[stage] == nil {
+			drls[stage] = make(map[int64]string)
+		}
+		drls[stage][r.ID] = drl
+		e.rules[stage]++
+	}
+	for stage, stageDRLs := range drls {
+		sb := strings.Builder{}
+		for _, drl := range stageDRLs {
+			sb.WriteString(drl)
+		}
+		if err := buildDRL(e.lib, knowledgeName(stage), sb.String()); err != nil {
+			return nil, &BuildError{Stage: stage, Rules: brokenRules(stageDRLs), Err: err}
+		}
+	}
+	return e, nil
+}
+
+func buildDRL(lib *ast.KnowledgeLibrary, name, drl string) error {
+	return builder.NewRuleBuilder(lib).BuildRuleFromResource(name, knowledgeVersion, pkg.NewBytesResource([]byte(drl)))
+}
+
+// brokenRules compiles each rule alone to tell the admin which ones are wrong
+func brokenRules(drls map[int64]string) map[int64]error {
+	broken := make(map[int64]error)
+	for id, drl := range drls {
+		if err := buildDRL(ast.NewKnowledgeLibrary(), "check", drl); err != nil {
+			broken[id] = err
+		}
+	}
+	return broken
+}
+
+// Validate runs every stage once with empty features, it catches knowledge
+// bases that compile but cannot be executed, e.g. a rule cycling forever.
+func (e *Engine) Validate() error {
+	for stage := range e.rules {
+		kb, err := e.NewKnowledgeBase(stage)
+		if err != nil {
+			return fmt.Errorf("filter rules of stage %d: %w", stage, err)
+		}
+		if _, err = Execute(kb, make(Features)); err != nil {
+			return fmt.Errorf("filter rules of stage %d: %w", stage, err)
+		}
+	}
+	return nil
+}
+
+// LoadEngine compiles the active filter rules in database
+func LoadEngine() (*Engine, error) {
+	rules, err := model.GetFilterRules()
+	if err != nil {
+		return nil, err
+	}
+	fields, err := model.GetFilterFields()
+	if err != nil {
+		return nil, err
+	}
+	// a metric is found by the stage of each of its fields
+	metrics := make([]model.FilterMetric, 0)
+	seen := make(map[int64]bool)
+	for stage := model.FilterStageConnect; stage <= model.FilterStageData; stage++ {
+		stageMetrics, err := model.GetFilterMetricByStage(stage)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range stageMetrics {
+			if !seen[m.ID] {
+				seen[m.ID] = true
+				metrics = append(metrics, m)
+			}
+		}
+	}
+	return NewEngine(rules, fields, metrics)
+}
+
+// Rules returns the number of compiled rules
+func (e *Engine) Rules() int {
+	total := 0
+	for _, n := range e.rules {
+		total += n
+	}
+	return total
+}
+
+// Skipped returns the rules which could not be converted to DRL
+func (e *Engine) Skipped() map[int64]error {
+	return e.skipped
+}
+
+// Metrics returns the metrics injected at the stage
+func (e *Engine) Metrics(stage model.FilterStage) []model.FilterMetric {
+	if e == nil {
+		return nil
+	}
+	return e.metrics[stage]
+}
+
+func (e *Engine) allMetrics() []model.FilterMetric {
+	if e == nil {
+		return nil
+	}
+	metrics := make([]model.FilterMetric, 0)
+	for _, stageMetrics := range e.metrics {
+		metrics = append(metrics, stageMetrics...)
+	}
+	return metrics
+}
+
+// NewKnowledgeBase returns a knowledge base instance of the stage for one
+// session, nil if the stage has no rule.
+func (e *Engine) NewKnowledgeBase(stage model.FilterStage) (*ast.KnowledgeBase, error) {
+	if e == nil || e.rules[stage] == 0 {
+		return nil, nil
+	}
+	return e.lib.NewKnowledgeBaseInstance(knowledgeName(stage), knowledgeVersion)
+}
+
+// Execute evaluates the features against the knowledge base
+func Execute(kb *ast.KnowledgeBase, features Features) (*Result, error) {
+	if kb == nil {
+		return &Result{}, nil
+	}
+	fact, err := features.JSON()
+	if err != nil {
+		return nil, err
+	}
+	return executeFact(kb, fact)
+}
+
+// executeFact evaluates a fact already serialized to JSON
+func executeFact(kb *ast.KnowledgeBase, fact []byte) (*Result, error) {
+	result := &Result{}
+	dctx := ast.NewDataContext()
+	if err := dctx.Add("result", result); err != nil {
+		return nil, err
+	}
+	if err := dctx.AddJSON("feature", fact); err != nil {
+		return nil, err
+	}
+	if err := dctx.Add(model.DRLFunctions, &ruleFunctions{}); err != nil {
+		return nil, err
+	}
+	// retracted rules are kept in the instance, reset them for each evaluation
+	kb.Reset()
+	if err := engine.NewGruleEngine().Execute(dctx, kb); err != nil {
+		return nil, fmt.Errorf("execute filter rules: %w", err)
+	}
+	return result, nil
+}
@@ -0,0 +1,246 @@
+package filter
+
+import (
+	"easymail/internal/model"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/hyperjumptech/grule-rule-engine/ast"
+)
+
+const (
+	// draftRuleID stands in for a rule which is not saved yet, the DRL needs an id
+	draftRuleID = math.MaxInt32
+	// maxBacktestHits caps the log ids returned with a backtest
+	maxBacktestHits = 100
+)
+
+// Condition is one condition of a rule evaluated on its own
+type Condition struct {
+	Expression string `json:"expression"`
+	Matched    bool   `json:"matched"`
+	Error      string `json:"error,omitempty"`
+}
+
+// Explanation tells what a rule does with a feature set
+type Explanation struct {
+	RuleID     int64              `json:"rule_id"`
+	DRL        string             `json:"drl"`
+	Stage      model.FilterStage  `json:"stage"`
+	Fired      bool               `json:"fired"`
+	Action     model.FilterAction `json:"action"`
+	Conditions []Condition        `json:"conditions"`
+}
+
+// BacktestResult counts the filter logs a rule would have matched
+type BacktestResult struct {
+	RuleID int64 `json:"rule_id"`
+	Total  int   `json:"total"`
+	Hits   int   `json:"hits"`
+	// Errors counts logs without features or failing evaluation
+	Errors int `json:"errors"`
+	// Changed counts hits whose logged action differs from the rule action
+	Changed int `json:"changed"`
+	// ByAction counts hits by the action logged at that time
+	ByAction map[model.FilterAction]int `json:"by_action"`
+	HitLogs  []int64                    `json:"hit_logs"`
+}
+
+// ruleProgram is a single rule compiled in isolation, with each of its conditions
+type ruleProgram struct {
+	rule       model.FilterRule
+	drl        string
+	stage      model.FilterStage
+	kb         *ast.KnowledgeBase
+	conditions []string
+	condKBs    []*ast.KnowledgeBase
+	condErrs   []error
+}
+
+func compileRule(rule model.FilterRule) (*ruleProgram, error) {
+	if rule.ID == 0 {
+		rule.ID = draftRuleID
+	}
+	drl, err := rule.Convert2DRL()
+	if err != nil {
+		return nil, err
+	}
+	p := &ruleProgram{rule: rule, drl: drl, stage: ruleStage(drl, nil)}
+	if p.kb, err = buildKnowledgeBase(drl); err != nil {
+		return nil, &BuildError{Stage: p.stage, Rules: map[int64]error{rule.ID: err}, Err: err}
+	}
+	p.conditions = splitConditions(drlCondition(drl))
+	for i, c := range p.conditions {
+		condDRL := fmt.Sprintf("rule cond_%d \"\" {\n\twhen\n\t\t%s\n\tthen\n\t\tresult.RuleID=%d;\n\t\tRetract(\"cond_%d\");\n\t\tComplete();\n}\n", i, c, rule.ID, i)
+		kb, err := buildKnowledgeBase(condDRL)
+		p.condKBs = append(p.condKBs, kb)
+		p.condErrs = append(p.condErrs, err)
+	}
+	return p, nil
+}
+
+func buildKnowledgeBase(drl string) (*ast.KnowledgeBase, error) {
+	lib := ast.NewKnowledgeLibrary()
+	if err := buildDRL(lib, "explain", drl); err != nil {
+		return nil, err
+	}
+	return lib.NewKnowledgeBaseInstance("explain", knowledgeVersion)
+}
+
+// drlCondition returns the when part of a DRL written by Convert2DRL
+func drlCondition(drl string) string {
+	_, when, _ := strings.Cut(drl, "\twhen\n")
+	when, _, _ = strings.Cut(when, "\n\tthen\n")
+	return strings.TrimSpace(when)
+}
+
+// splitConditions splits on && outside of quotes and parentheses
+func splitConditions(when string) []string {
+	conditions := make([]string, 0)
+	depth, quoted, start := 0, false, 0
+	for i := 0; i < len(when); i++ {
+		switch c := when[i]; {
+		case c == '\\' && quoted:
+			i++
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == '&' && depth == 0 && strings.HasPrefix(when[i:], "&&"):
+			conditions = append(conditions, strings.TrimSpace(when[start:i]))
+			start = i + 2
+			i++
+		}
+	}
+	return append(conditions, strings.TrimSpace(when[start:]))
+}
+
+// withDefaults adds zero values of missing built-in features and serializes the fact
+func withDefaults(fact map[string]any) ([]byte, error) {
+	full := Features{}.Fact()
+	for k, v := range fact {
+		full[k] = v
+	}
+	return json.Marshal(full)
+}
+
+// missingFeatures lists features referred by the expression but not in the fact
+func missingFeatures(expression string, fact map[string]any) []string {
+	missing := make([]string, 0)
+	for _, m := range featureRef.FindAllStringSubmatch(expression, -1) {
+		if _, ok := fact[m[1]]; !ok {
+			if _, ok = defaultFeatures[m[1]]; !ok {
+				missing = append(missing, m[1])
+			}
+		}
+	}
+	return missing
+}
+
+func (p *ruleProgram) explain(fact map[string]any) (*Explanation, error) {
+	data, err := withDefaults(fact)
+	if err != nil {
+		return nil, err
+	}
+	result, err := executeFact(p.kb, data)
+	if err != nil {
+		return nil, err
+	}
+	e := &Explanation{
+		RuleID:     p.rule.ID,
+		DRL:        p.drl,
+		Stage:      p.stage,
+		Fired:      result.RuleID == p.rule.ID,
+		Conditions: make([]Condition, 0, len(p.conditions)),
+	}
+	if e.RuleID == draftRuleID {
+		e.RuleID = 0
+	}
+	if e.Fired {
+		e.Action = p.rule.Action
+	}
+	for i, c := range p.conditions {
+		cond := Condition{Expression: c}
+		if missing := missingFeatures(c, fact); len(missing) > 0 {
+			cond.Error = "missing feature " + strings.Join(missing, ", ")
+		} else if p.condErrs[i] != nil {
+			cond.Error = p.condErrs[i].Error()
+		} else if r, err := executeFact(p.condKBs[i], data); err != nil {
+			cond.Error = err.Error()
+		} else {
+			cond.Matched = r.RuleID == p.rule.ID
+		}
+		e.Conditions = append(e.Conditions, cond)
+	}
+	return e, nil
+}
+
+// Explain compiles the rule alone and runs it against the sample features
+func Explain(rule model.FilterRule, fact map[string]any) (*Explanation, error) {
+	p, err := compileRule(rule)
+	if err != nil {
+		return nil, err
+	}
+	return p.explain(fact)
+}
+
+// LogFact returns the features stored with a filter log
+func LogFact(log model.FilterLog) (map[string]any, error) {
+	if strings.TrimSpace(log.Feature) == "" {
+		return nil, errors.New("filter log has no feature")
+	}
+	fact := make(map[string]any)
+	if err := json.Unmarshal([]byte(log.Feature), &fact); err != nil {
+		return nil, err
+	}
+	return fact, nil
+}
+
+// Backtest replays the features of filter logs through the rule
+func Backtest(rule model.FilterRule, logs []model.FilterLog) (*BacktestResult, error) {
+	p, err := compileRule(rule)
+	if err != nil {
+		return nil, err
+	}
+	result := &BacktestResult{
+		RuleID:   rule.ID,
+		ByAction: make(map[model.FilterAction]int),
+		HitLogs:  make([]int64, 0),
+	}
+	for _, log := range logs {
+		result.Total++
+		fact, err := LogFact(log)
+		if err != nil {
+			result.Errors++
+			continue
+		}
+		data, err := withDefaults(fact)
+		if err != nil {
+			result.Errors++
+			continue
+		}
+		r, err := executeFact(p.kb, data)
+		if err != nil {
+			result.Errors++
+			continue
+		}
+		if r.RuleID != p.rule.ID {
+			continue
+		}
+		result.Hits++
+		result.ByAction[log.Action]++
+		if log.Action != rule.Action {
+			result.Changed++
+		}
+		if len(result.HitLogs) < maxBacktestHits {
+			result.HitLogs = append(result.HitLogs, log.ID)
+		}
+	}
+	return result, nil
+}
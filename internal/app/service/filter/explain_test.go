@@ -0,0 +1,102 @@
+package filter
+
+import (
+	"easymail/internal/model"
+	"reflect"
+	"testing"
+)
+
+func TestSplitConditions(t *testing.T) {
+	got := splitConditions(`feature.subject.Contains("a && b") && (feature.size>1 && feature.size<9) && feature.helo=="x\"&&"`)
+	want := []string{`feature.subject.Contains("a && b")`, `(feature.size>1 && feature.size<9)`, `feature.helo=="x\"&&"`}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+}
+
+func TestExplain(t *testing.T) {
+	rule := model.FilterRule{
+		Action:   model.FilterActionReject,
+		ClientIP: "equals::192.0.2.1",
+		Assembly: `subject.Contains("offer");;sender_rcpt_count_1h>50`,
+	}
+	e, err := Explain(rule, map[string]any{"client_ip": "192.0.2.1", "subject": "special offer", "sender_rcpt_count_1h": 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Fired || e.Action != 0 || e.RuleID != 0 || e.Stage != model.FilterStageData {
+		t.Fatalf("unexpected explanation %+v", e)
+	}
+	matched := make([]bool, 0)
+	for _, c := range e.Conditions {
+		matched = append(matched, c.Matched)
+	}
+	if !reflect.DeepEqual(matched, []bool{true, true, false}) {
+		t.Fatalf("unexpected conditions %+v", e.Conditions)
+	}
+
+	// a missing custom feature is reported instead of silently not matching
+	e, err = Explain(rule, map[string]any{"client_ip": "192.0.2.1", "subject": "special offer"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Conditions[2].Error == "" {
+		t.Fatalf("expected missing feature, got %+v", e.Conditions[2])
+	}
+
+	e, err = Explain(rule, map[string]any{"client_ip": "192.0.2.1", "subject": "special offer", "sender_rcpt_count_1h": 51})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !e.Fired || e.Action != model.FilterActionReject {
+		t.Fatalf("expected rule to fire, got %+v", e)
+	}
+
+	if _, err = Explain(model.FilterRule{Assembly: `subject.Contains("x"`}, nil); err == nil {
+		t.Fatal("expected compile error")
+	}
+}
+
+func TestBacktest(t *testing.T) {
+	rule := model.FilterRule{ID: 7, Action: model.FilterActionReject, Assembly: `subject.Contains("offer")`}
+	logs := []model.FilterLog{
+		{ID: 1, Action: model.FilterActionAccept, Feature: `{"subject":"special offer"}`},
+		{ID: 2, Action: model.FilterActionReject, Feature: `{"subject":"offer"}`},
+		{ID: 3, Action: model.FilterActionAccept, Feature: `{"subject":"hello"}`},
+		{ID: 4, Action: model.FilterActionAccept},
+	}
+	result, err := Backtest(rule, logs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Total != 4 || result.Hits != 2 || result.Errors != 1 || result.Changed != 1 {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	if !reflect.DeepEqual(result.HitLogs, []int64{1, 2}) || result.ByAction[model.FilterActionAccept] != 1 {
+		t.Fatalf("unexpected hits %+v", result)
+	}
+}
+
+func TestExplainStructuredCondition(t *testing.T) {
+	condition := `{"logic":"and","children":[` +
+		`{"field":"client_ip","operator":"cidr","value":"10.0.0.0/8"},` +
+		`{"field":"subject","operator":"regex","value":"^\\[ad\\]"}]}`
+	rule := model.FilterRule{Description: `quote "me"`, Action: model.FilterActionReject, Condition: condition}
+	cases := []struct {
+		ip, subject string
+		fired       bool
+	}{
+		{"10.1.2.3", "[ad] buy", true},
+		{"192.0.2.1", "[ad] buy", false},
+		{"10.1.2.3", "hello [ad]", false},
+	}
+	for _, c := range cases {
+		e, err := Explain(rule, map[string]any{"client_ip": c.ip, "subject": c.subject})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.Fired != c.fired {
+			t.Fatalf("%s %q: expected fired %v, got %+v", c.ip, c.subject, c.fired, e)
+		}
+	}
+}
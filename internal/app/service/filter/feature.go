@@ -0,0 +1,310 @@
+package filter
+
+import (
+	"easymail/internal/app/service/milter"
+	"easymail/internal/model"
+	"encoding/json"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// built-in feature names, rules refer to them as feature.<name>
+const (
+	FeatureClientIP     = "client_ip"
+	FeatureClientHost   = "client_host"
+	FeatureHelo         = "helo"
+	FeatureSender       = "sender"
+	FeatureSenderDomain = "sender_domain"
+	FeatureSaslUsername = "sasl_username"
+	FeatureSPF          = "spf"
+	FeatureRcpt         = "rcpt"
+	FeatureRcptCount    = "rcpt_count"
+	FeatureHeaderFrom   = "header_from"
+	FeatureNick         = "nick"
+	FeatureSubject      = "subject"
+	FeatureMailer       = "mailer"
+	FeatureSize         = "size"
+	FeatureText         = "text"
+	FeatureHtml         = "html"
+	FeatureAttachName   = "attach_name"
+	FeatureAttachCount  = "attach_count"
+	FeatureDnsblHits    = "dnsbl_hits"
+	FeatureDnsblZones   = "dnsbl_zones"
+	FeatureUriblListed  = "uribl_listed"
+	FeatureUriblHits    = "uribl_hits"
+	FeatureUriblDomains = "uribl_domains"
+	FeatureDKIM         = "dkim"
+	FeatureDKIMDomains  = "dkim_domains"
+	FeatureDKIMResults  = "dkim_results"
+	FeatureDMARC        = "dmarc"
+	FeatureDMARCPolicy  = "dmarc_policy"
+	FeatureARC          = "arc"
+	FeatureARCDomain    = "arc_domain"
+	FeatureBayesScore   = "bayes_score"
+
+	FeatureBodySimilarityMax   = "body_similarity_max"
+	FeatureAttachSimilarityMax = "attach_similarity_max"
+	FeatureSimilarSessions     = "similar_sessions"
+
+	FeatureAttachExtMismatch = "attach_ext_mismatch"
+	FeatureAttachExecutable  = "attach_executable"
+	FeatureAttachHashBlocked = "attach_hash_blocked"
+	FeatureAttachType        = "attach_type"
+	FeatureAttachMd5         = "attach_md5"
+	FeatureAttachSha256      = "attach_sha256"
+
+	FeatureVirus     = "virus"
+	FeatureVirusName = "virus_name"
+
+	FeatureURL            = "url"
+	FeatureURLCount       = "url_count"
+	FeatureURLDomains     = "url_domains"
+	FeatureURLDomainCount = "url_domain_count"
+	FeatureURLMismatch    = "url_mismatch"
+	FeatureURLIP          = "url_ip"
+	FeatureURLShortener   = "url_shortener"
+	FeatureURLRedirect    = "url_redirect"
+	FeatureURLObfuscated  = "url_obfuscated"
+)
+
+// defaultFeatures seeds the fact so rules referring to features of a later
+// stage evaluate to false instead of failing on an undefined field.
+var defaultFeatures = map[string]milter.FeatureType{
+	FeatureClientIP:     milter.DataTypeString,
+	FeatureClientHost:   milter.DataTypeString,
+	FeatureHelo:         milter.DataTypeString,
+	FeatureSender:       milter.DataTypeString,
+	FeatureSenderDomain: milter.DataTypeString,
+	FeatureSaslUsername: milter.DataTypeString,
+	FeatureSPF:          milter.DataTypeString,
+	FeatureRcpt:         milter.DataTypeString,
+	FeatureRcptCount:    milter.DataTypeInt,
+	FeatureHeaderFrom:   milter.DataTypeString,
+	FeatureNick:         milter.DataTypeString,
+	FeatureSubject:      milter.DataTypeString,
+	FeatureMailer:       milter.DataTypeString,
+	FeatureSize:         milter.DataTypeInt,
+	FeatureText:         milter.DataTypeString,
+	FeatureHtml:         milter.DataTypeString,
+	FeatureAttachName:   milter.DataTypeString,
+	FeatureAttachCount:  milter.DataTypeInt,
+	FeatureDnsblHits:    milter.DataTypeInt,
+	FeatureDnsblZones:   milter.DataTypeString,
+	FeatureUriblListed:  milter.DataTypeBool,
+	FeatureUriblHits:    milter.DataTypeInt,
+	FeatureUriblDomains: milter.DataTypeString,
+	FeatureDKIM:         milter.DataTypeString,
+	FeatureDKIMDomains:  milter.DataTypeString,
+	FeatureDKIMResults:  milter.DataTypeString,
+	FeatureDMARC:        milter.DataTypeString,
+	FeatureDMARCPolicy:  milter.DataTypeString,
+	FeatureARC:          milter.DataTypeString,
+	FeatureARCDomain:    milter.DataTypeString,
+	FeatureBayesScore:   milter.DataTypeFloat,
+
+	FeatureBodySimilarityMax:   milter.DataTypeInt,
+	FeatureAttachSimilarityMax: milter.DataTypeInt,
+	FeatureSimilarSessions:     milter.DataTypeString,
+
+	FeatureAttachExtMismatch: milter.DataTypeBool,
+	FeatureAttachExecutable:  milter.DataTypeBool,
+	FeatureAttachHashBlocked: milter.DataTypeBool,
+	FeatureAttachType:        milter.DataTypeString,
+	FeatureAttachMd5:         milter.DataTypeString,
+	FeatureAttachSha256:      milter.DataTypeString,
+
+	FeatureVirus:     milter.DataTypeString,
+	FeatureVirusName: milter.DataTypeString,
+
+	FeatureURL:            milter.DataTypeString,
+	FeatureURLCount:       milter.DataTypeInt,
+	FeatureURLDomains:     milter.DataTypeString,
+	FeatureURLDomainCount: milter.DataTypeInt,
+	FeatureURLMismatch:    milter.DataTypeBool,
+	FeatureURLIP:          milter.DataTypeBool,
+	FeatureURLShortener:   milter.DataTypeBool,
+	FeatureURLRedirect:    milter.DataTypeBool,
+	FeatureURLObfuscated:  milter.DataTypeBool,
+}
+
+// featureStages is the stage a built-in feature becomes available at
+var featureStages = map[string]model.FilterStage{
+	FeatureClientIP:     model.FilterStageConnect,
+	FeatureClientHost:   model.FilterStageConnect,
+	FeatureHelo:         model.FilterStageHelo,
+	FeatureSender:       model.FilterStageMailFrom,
+	FeatureSenderDomain: model.FilterStageMailFrom,
+	FeatureSaslUsername: model.FilterStageMailFrom,
+	FeatureSPF:          model.FilterStageMailFrom,
+	FeatureRcpt:         model.FilterStageRcptTo,
+	FeatureRcptCount:    model.FilterStageRcptTo,
+	FeatureHeaderFrom:   model.FilterStageHeader,
+	FeatureNick:         model.FilterStageHeader,
+	FeatureSubject:      model.FilterStageHeader,
+	FeatureMailer:       model.FilterStageHeader,
+	FeatureSize:         model.FilterStageData,
+	FeatureText:         model.FilterStageData,
+	FeatureHtml:         model.FilterStageData,
+	FeatureAttachName:   model.FilterStageData,
+	FeatureAttachCount:  model.FilterStageData,
+	FeatureDnsblHits:    model.FilterStageConnect,
+	FeatureDnsblZones:   model.FilterStageConnect,
+	FeatureUriblListed:  model.FilterStageData,
+	FeatureUriblHits:    model.FilterStageData,
+	FeatureUriblDomains: model.FilterStageData,
+	FeatureDKIM:         model.FilterStageData,
+	FeatureDKIMDomains:  model.FilterStageData,
+	FeatureDKIMResults:  model.FilterStageData,
+	FeatureDMARC:        model.FilterStageData,
+	FeatureDMARCPolicy:  model.FilterStageData,
+	FeatureARC:          model.FilterStageData,
+	FeatureARCDomain:    model.FilterStageData,
+	FeatureBayesScore:   model.FilterStageData,
+
+	FeatureBodySimilarityMax:   model.FilterStageData,
+	FeatureAttachSimilarityMax: model.FilterStageData,
+	FeatureSimilarSessions:     model.FilterStageData,
+
+	FeatureAttachExtMismatch: model.FilterStageData,
+	FeatureAttachExecutable:  model.FilterStageData,
+	FeatureAttachHashBlocked: model.FilterStageData,
+	FeatureAttachType:        model.FilterStageData,
+	FeatureAttachMd5:         model.FilterStageData,
+	FeatureAttachSha256:      model.FilterStageData,
+
+	FeatureVirus:     model.FilterStageData,
+	FeatureVirusName: model.FilterStageData,
+
+	FeatureURL:            model.FilterStageData,
+	FeatureURLCount:       model.FilterStageData,
+	FeatureURLDomains:     model.FilterStageData,
+	FeatureURLDomainCount: model.FilterStageData,
+	FeatureURLMismatch:    model.FilterStageData,
+	FeatureURLIP:          model.FilterStageData,
+	FeatureURLShortener:   model.FilterStageData,
+	FeatureURLRedirect:    model.FilterStageData,
+	FeatureURLObfuscated:  model.FilterStageData,
+}
+
+var featureRef = regexp.MustCompile(`feature\.([A-Za-z_][A-Za-z0-9_]*)`)
+
+// ruleStage returns the first stage all features referred by the DRL are
+// available at, unknown features are only trusted at end of body.
+func ruleStage(drl string, fields map[string]model.FilterStage) model.FilterStage {
+	stage := model.FilterStageConnect
+	for _, m := range featureRef.FindAllStringSubmatch(drl, -1) {
+		s, ok := featureStages[m[1]]
+		if !ok {
+			if s, ok = fields[m[1]]; !ok {
+				s = model.FilterStageData
+			}
+		}
+		if s > stage {
+			stage = s
+		}
+	}
+	return stage
+}
+
+// BuiltinFields returns the built-in features as filter fields, rule conditions
+// may refer to them besides the custom fields
+func BuiltinFields() []model.FilterField {
+	dataTypes := map[milter.FeatureType]model.DataType{
+		milter.DataTypeString: model.DataTypeString,
+		milter.DataTypeInt:    model.DataTypeInt,
+		milter.DataTypeFloat:  model.DataTypeFloat,
+		milter.DataTypeBool:   model.DataTypeBool,
+	}
+	fields := make([]model.FilterField, 0, len(featureStages))
+	for name, stage := range featureStages {
+		fields = append(fields, model.FilterField{Name: name, Status: 1, Stage: stage, DataType: dataTypes[defaultFeatures[name]]})
+	}
+	slices.SortFunc(fields, func(a, b model.FilterField) int { return strings.Compare(a.Name, b.Name) })
+	return fields
+}
+
+// unknownFeatures returns the features referred by the DRL which are neither
+// built in nor custom fields or metrics
+func unknownFeatures(drl string, fields map[string]model.FilterStage) []string {
+	unknown := make([]string, 0)
+	for _, m := range featureRef.FindAllStringSubmatch(drl, -1) {
+		if _, ok := featureStages[m[1]]; ok {
+			continue
+		}
+		if _, ok := fields[m[1]]; ok || slices.Contains(unknown, m[1]) {
+			continue
+		}
+		unknown = append(unknown, m[1])
+	}
+	return unknown
+}
+
+func stringFeature(name, value string) milter.Feature {
+	return milter.Feature{Name: name, Value: value, ValueType: milter.DataTypeString}
+}
+
+func intFeature(name string, value int64) milter.Feature {
+	return milter.Feature{Name: name, Value: strconv.FormatInt(value, 10), ValueType: milter.DataTypeInt}
+}
+
+func floatFeature(name string, value float64) milter.Feature {
+	return milter.Feature{Name: name, Value: strconv.FormatFloat(value, 'f', -1, 64), ValueType: milter.DataTypeFloat}
+}
+
+func boolFeature(name string, value bool) milter.Feature {
+	return milter.Feature{Name: name, Value: strconv.FormatBool(value), ValueType: milter.DataTypeBool}
+}
+
+// typedValue converts the string value of a feature to its go type
+func typedValue(valueType milter.FeatureType, value string) any {
+	switch valueType {
+	case milter.DataTypeInt:
+		v, _ := strconv.ParseInt(value, 10, 64)
+		return v
+	case milter.DataTypeFloat:
+		v, _ := strconv.ParseFloat(value, 64)
+		return v
+	case milter.DataTypeBool:
+		v, _ := strconv.ParseBool(value)
+		return v
+	}
+	return value
+}
+
+// Features collects the features of a message, later values overwrite earlier ones
+type Features map[string]milter.Feature
+
+// Add stores features by name
+func (f Features) Add(features ...milter.Feature) {
+	for _, feature := range features {
+		f[feature.Name] = feature
+	}
+}
+
+// Clone copies the features, used to keep connection features between messages
+func (f Features) Clone() Features {
+	c := make(Features, len(f))
+	for k, v := range f {
+		c[k] = v
+	}
+	return c
+}
+
+// Fact converts features to typed values, missing built-in features get zero values
+func (f Features) Fact() map[string]any {
+	fact := make(map[string]any, len(defaultFeatures)+len(f))
+	for name, valueType := range defaultFeatures {
+		fact[name] = typedValue(valueType, "")
+	}
+	for name, feature := range f {
+		fact[name] = typedValue(feature.ValueType, feature.Value)
+	}
+	return fact
+}
+
+// JSON serializes the fact, it is handed to the rule engine and stored in filter log
+func (f Features) JSON() ([]byte, error) {
+	return json.Marshal(f.Fact())
+}
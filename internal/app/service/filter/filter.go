@@ -0,0 +1,612 @@
+package filter
+
+import (
+	"bytes"
+	"context"
+	"easymail/internal/app/service/dmarc"
+	"easymail/internal/app/service/links"
+	"easymail/internal/app/service/milter"
+	"easymail/internal/app/service/milter/third_party/dkim"
+	"easymail/internal/app/service/quarantine"
+	"easymail/internal/easylog"
+	"easymail/internal/model"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/hyperjumptech/grule-rule-engine/ast"
+	"github.com/jhillyerd/enmime"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// maxBodySize caps the body kept for data stage features, the rest is only counted
+	maxBodySize = 32 << 20
+	// maxLogBodySize caps the text and html stored with the features in filter log
+	maxLogBodySize = 4 << 10
+
+	// FolderHeader tells the delivery agent to put the message into a folder
+	FolderHeader = "X-Easymail-Folder"
+)
+
+var wordDecoder = new(mime.WordDecoder)
+
+// Quarantiner keeps quarantined messages out of the postfix queue
+type Quarantiner interface {
+	Hold(msg quarantine.Message) error
+}
+
+// Greylister defers recipients of unknown client, sender and recipient triplets
+type Greylister interface {
+	// Greylist returns how long the client has to wait, 0 when the recipient passes
+	Greylist(ctx context.Context, ip net.IP, sender, rcpt string) (time.Duration, error)
+	// Whitelist lets a sender whose message passed SPF or DKIM skip greylisting at the client network
+	Whitelist(ctx context.Context, ip net.IP, sender string) error
+}
+
+/*
+Filter is the milter handler of one postfix connection, it collects features
+stage by stage and evaluates the filter rules after each stage.
+*/
+type Filter struct {
+	engine *Engine
+	// kbs are the knowledge base instances of this session by stage
+	kbs     map[model.FilterStage]*ast.KnowledgeBase
+	metrics *metricCounter
+	logs    *LogWriter
+	opts    Options
+	_log    *easylog.Logger
+
+	// connFeatures survive between messages of the same connection
+	connFeatures Features
+	features     Features
+	rcpts        []string
+	header       bytes.Buffer
+	body         bytes.Buffer
+	size         int64
+
+	// headerIndex counts the headers by name, stripped are removed at end of body
+	headerIndex map[string]int
+	stripped    []strippedHeader
+
+	// receivedSPF and authResults are added to the headers at end of body
+	receivedSPF string
+	authResults []string
+
+	// dkimWriter streams the message into the running DKIM verification
+	dkimWriter  *io.PipeWriter
+	dkimDone    chan dkimOutcome
+	dkimEnabled bool
+	dkimSigner  *dkim.Signer
+	dkimResults []dmarc.DKIMResult
+
+	// arcWriter streams the message into the running ARC validation
+	arcWriter  *io.PipeWriter
+	arcDone    chan arcOutcome
+	arcEnabled bool
+
+	// scanWriter streams the message into the running virus scan
+	scanWriter *io.PipeWriter
+	scanDone   chan virusOutcome
+	scanFailed bool
+
+	// dmarcResult is the evaluation of the message, dmarcApplied is set once its disposition was
+	dmarcResult  *dmarc.Result
+	dmarcApplied bool
+
+	// pending holds a trash or quarantine decision, it is applied at end of body
+	pending *Result
+	// decided is set once the message is recorded in metrics and filter log
+	decided bool
+}
+
+// NewFilter creates the filter of one connection, metrics are not counted without redis
+func NewFilter(e *Engine, rc *redis.Client, _log *easylog.Logger, opts Options) *Filter {
+	f := &Filter{
+		engine:       e,
+		kbs:          make(map[model.FilterStage]*ast.KnowledgeBase),
+		opts:         opts,
+		_log:         _log,
+		connFeatures: make(Features),
+		features:     make(Features),
+	}
+	if rc != nil {
+		f.metrics = &metricCounter{rc: rc}
+	}
+	// rules on metrics see 0 when redis is not reachable
+	for _, metric := range e.allMetrics() {
+		f.connFeatures.Add(intFeature(metric.Name, 0))
+	}
+	f.features = f.connFeatures.Clone()
+	return f
+}
+
+// SetLogWriter makes the filter log every decision
+func (f *Filter) SetLogWriter(w *LogWriter) {
+	f.logs = w
+}
+
+func (f *Filter) logf(format string, args ...any) {
+	if f._log != nil {
+		f._log.Errorf(format, args...)
+	}
+}
+
+// stage stores the features of a stage, injects its metrics and evaluates
+// the rules, connection stage features are kept for the next messages.
+func (f *Filter) stage(stage model.FilterStage, features []milter.Feature, m *milter.Modifier) (milter.Response, []milter.Feature) {
+	f.features.Add(features...)
+	metrics, err := f.metrics.collect(f.engine.Metrics(stage), f.features)
+	if err != nil {
+		f.logf("filter stage %d: %v", stage, err)
+	}
+	f.features.Add(metrics...)
+	features = append(features, metrics...)
+	if stage <= model.FilterStageHelo {
+		f.connFeatures.Add(features...)
+	}
+	return f.evaluate(stage, m), features
+}
+
+// finish records the decision on the message in metrics and filter log, once
+// per message, result is nil when nothing decided on the message.
+func (f *Filter) finish(stage model.FilterStage, result *Result, m *milter.Modifier) {
+	if f.decided {
+		return
+	}
+	f.decided = true
+	action, category := model.FilterActionAccept, model.FilterCategoryUnknown
+	if result != nil && result.Action != 0 {
+		action = model.FilterAction(result.Action)
+		category = categoryOf(action)
+	}
+	if err := f.metrics.record(f.engine.allMetrics(), f.features, category); err != nil {
+		f.logf("filter record metrics: %v", err)
+	}
+	if f.logs == nil {
+		return
+	}
+	f.writeLog(strings.Join(f.rcpts, ","), stage, result, action, m)
+}
+
+// rejectRcpt logs a recipient the rules rejected, the message goes on with
+// the other recipients and is logged once it is decided.
+func (f *Filter) rejectRcpt(result *Result, action model.FilterAction, m *milter.Modifier) {
+	if f.logs != nil {
+		f.writeLog(f.features[FeatureRcpt].Value, model.FilterStageRcptTo, result, action, m)
+	}
+}
+
+func (f *Filter) writeLog(rcpts string, stage model.FilterStage, result *Result, action model.FilterAction, m *milter.Modifier) {
+	log, err := newFilterLog(f.features, rcpts, stage, result, action)
+	if err != nil {
+		f.logf("filter log: %v", err)
+		return
+	}
+	if m != nil {
+		log.QueueID = m.Macros["i"]
+	}
+	f.logs.Write(log)
+}
+
+// newFilterLog builds the filter log of a decision from the features, the
+// bodies are cut to maxLogBodySize so a large message fits in the batch
+func newFilterLog(features Features, rcpts string, stage model.FilterStage, result *Result, action model.FilterAction) (model.FilterLog, error) {
+	kept := features.Clone()
+	for _, name := range []string{FeatureText, FeatureHtml} {
+		if body, ok := kept[name]; ok {
+			body.Value = truncate(body.Value, maxLogBodySize)
+			kept[name] = body
+		}
+	}
+	feature, err := kept.JSON()
+	if err != nil {
+		return model.FilterLog{}, err
+	}
+	log := model.FilterLog{
+		ClientIP:   truncate(features[FeatureClientIP].Value, 64),
+		Sender:     truncate(features[FeatureSender].Value, 255),
+		Nick:       truncate(features[FeatureNick].Value, 255),
+		Rcpt:       truncate(rcpts, 1024),
+		Size:       features[FeatureSize].Value,
+		Mailer:     truncate(features[FeatureMailer].Value, 255),
+		Subject:    truncate(features[FeatureSubject].Value, 255),
+		Feature:    string(feature),
+		Action:     action,
+		Stage:      stage,
+		CreateTime: time.Now(),
+	}
+	if result.Matched() {
+		log.RuleID = result.RuleID
+	}
+	return log, nil
+}
+
+// truncate cuts s to at most n bytes without splitting a character
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// evaluate runs the rules and maps the matched action to a milter response,
+// errors are logged and the message goes on, a broken rule never blocks mail.
+// A pending trash or quarantine is kept until end of body unless a later
+// stage matches a stronger action.
+func (f *Filter) evaluate(stage model.FilterStage, m *milter.Modifier) milter.Response {
+	result := f.execute(stage)
+	if f.pending != nil && (result == nil || actionRank(result.Action) <= actionRank(f.pending.Action)) {
+		if stage != model.FilterStageData {
+			return milter.RespContinue
+		}
+		result = f.pending
+	}
+	if result == nil {
+		return milter.RespContinue
+	}
+	return f.apply(stage, result, m)
+}
+
+// execute runs the rules of the stage, it is nil when no rule matched
+func (f *Filter) execute(stage model.FilterStage) *Result {
+	kb, ok := f.kbs[stage]
+	if !ok {
+		var err error
+		if kb, err = f.engine.NewKnowledgeBase(stage); err != nil {
+			f.logf("filter knowledge base of stage %d: %v", stage, err)
+			return nil
+		}
+		f.kbs[stage] = kb
+	}
+	result, err := Execute(kb, f.features)
+	if err != nil {
+		f.logf("filter stage %d: %v", stage, err)
+		return nil
+	}
+	if !result.Matched() {
+		return nil
+	}
+	return result
+}
+
+// actionRank orders the actions by how much they keep the message from the inbox,
+// refusing the message outranks holding it, holding it outranks the trash
+func actionRank(action int64) int {
+	switch model.FilterAction(action) {
+	case model.FilterActionTrash:
+		return 1
+	case model.FilterActionQuarantine:
+		return 2
+	case model.FilterActionDefer, model.FilterActionReject, model.FilterActionDiscard:
+		return 3
+	}
+	return 0
+}
+
+func (f *Filter) apply(stage model.FilterStage, result *Result, m *milter.Modifier) milter.Response {
+	action := model.FilterAction(result.Action)
+	// trash and quarantine are decided at end of body, a rejected recipient
+	// does not decide on the message, a discard drops all of them
+	deferred := (action == model.FilterActionTrash || action == model.FilterActionQuarantine) && stage != model.FilterStageData
+	switch {
+	case deferred:
+	case stage == model.FilterStageRcptTo && action != model.FilterActionAccept && action != model.FilterActionDiscard:
+		f.rejectRcpt(result, action, m)
+	default:
+		f.finish(stage, result, m)
+	}
+	switch action {
+	case model.FilterActionAccept:
+		return milter.RespAccept
+	case model.FilterActionDefer:
+		return milter.RespTempFail
+	case model.FilterActionReject:
+		return milter.RespReject
+	case model.FilterActionDiscard:
+		return milter.RespDiscard
+	case model.FilterActionTrash, model.FilterActionQuarantine:
+		// message changes are only allowed at end of body
+		if stage != model.FilterStageData {
+			f.pending = result
+			return milter.RespContinue
+		}
+		var err error
+		if action == model.FilterActionQuarantine {
+			reason := result.Reason
+			if reason == "" {
+				reason = fmt.Sprintf("filter rule %d", result.RuleID)
+			}
+			var held bool
+			if held, err = f.hold(result.RuleID, reason, m); err != nil {
+				// nothing is kept, the sender tries again once the store is back
+				f.logf("filter quarantine: %v", err)
+				return milter.RespTempFail
+			}
+			if held {
+				// the stored copy is released by the admin, postfix drops the message
+				return milter.RespDiscard
+			}
+			err = m.Quarantine(reason)
+		} else {
+			err = m.AddHeader(FolderHeader, "Trash")
+		}
+		if err != nil {
+			f.logf("filter rule %d: %v", result.RuleID, err)
+		}
+		return milter.RespAccept
+	}
+	f.logf("filter rule %d has unknown action %d", result.RuleID, result.Action)
+	return milter.RespContinue
+}
+
+func (f *Filter) Connect(host string, addr net.IP, payload map[string]string, m *milter.Modifier) (milter.Response, []milter.Feature, error) {
+	features := []milter.Feature{stringFeature(FeatureClientHost, host)}
+	if addr != nil {
+		features = append(features, stringFeature(FeatureClientIP, addr.String()))
+		features = append(features, f.clientListed(addr)...)
+	}
+	resp, features := f.stage(model.FilterStageConnect, features, m)
+	return resp, features, nil
+}
+
+func (f *Filter) Helo(name string, payload map[string]string, m *milter.Modifier) (milter.Response, []milter.Feature, error) {
+	resp, features := f.stage(model.FilterStageHelo, []milter.Feature{stringFeature(FeatureHelo, name)}, m)
+	return resp, features, nil
+}
+
+func (f *Filter) MailFrom(from string, payload map[string]string, m *milter.Modifier) (milter.Response, []milter.Feature, error) {
+	// a new message starts, postfix does not always abort the previous one
+	f.reset()
+	features := []milter.Feature{stringFeature(FeatureSender, from)}
+	if i := strings.LastIndex(from, "@"); i >= 0 {
+		features = append(features, stringFeature(FeatureSenderDomain, strings.ToLower(from[i+1:])))
+	}
+	// postfix sends the login of authenticated clients with MAIL FROM
+	var login string
+	if m != nil {
+		login = m.Macros["auth_authen"]
+	}
+	if login != "" {
+		features = append(features, stringFeature(FeatureSaslUsername, login))
+	}
+	features = append(features, f.checkSPF(from, login)...)
+	resp, features := f.stage(model.FilterStageMailFrom, features, m)
+	return f.spfRejected(resp), features, nil
+}
+
+func (f *Filter) RcptTo(rcptTo string, payload map[string]string, m *milter.Modifier) (milter.Response, []milter.Feature, error) {
+	f.rcpts = append(f.rcpts, rcptTo)
+	// rules see the current recipient, the others are kept for logging
+	features := []milter.Feature{
+		stringFeature(FeatureRcpt, rcptTo),
+		intFeature(FeatureRcptCount, int64(len(f.rcpts))),
+	}
+	resp, features := f.stage(model.FilterStageRcptTo, features, m)
+	if resp == milter.RespContinue {
+		resp = f.greylisted(rcptTo)
+	}
+	if resp != milter.RespContinue && resp != milter.RespAccept {
+		// a rejected recipient is not part of the message
+		f.rcpts = f.rcpts[:len(f.rcpts)-1]
+		f.features.Add(intFeature(FeatureRcptCount, int64(len(f.rcpts))))
+	}
+	return resp, features, nil
+}
+
+// greylisted defers the recipient while its triplet is greylisted, errors let it pass
+func (f *Filter) greylisted(rcpt string) milter.Response {
+	if f.opts.Greylist == nil || f.features[FeatureSaslUsername].Value != "" {
+		return milter.RespContinue
+	}
+	ip := net.ParseIP(f.features[FeatureClientIP].Value)
+	if ip == nil {
+		return milter.RespContinue
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), metricTimeout)
+	defer cancel()
+	wait, err := f.opts.Greylist.Greylist(ctx, ip, f.features[FeatureSender].Value, rcpt)
+	if err != nil {
+		f.logf("filter greylist: %v", err)
+		return milter.RespContinue
+	}
+	if wait <= 0 {
+		return milter.RespContinue
+	}
+	seconds := int64(wait.Round(time.Second) / time.Second)
+	return milter.NewResponseStr(byte(milter.ActReplyCode), fmt.Sprintf("451 4.7.1 Greylisted, please try again in %d seconds", seconds))
+}
+
+// whitelist lets the sender of an accepted message skip greylisting when it
+// passed SPF or DKIM, the recipients of this message were decided on before
+func (f *Filter) whitelist() {
+	if f.opts.Greylist == nil || (!f.spfPassed() && !f.dkimPassed()) {
+		return
+	}
+	ip := net.ParseIP(f.features[FeatureClientIP].Value)
+	if ip == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), metricTimeout)
+	defer cancel()
+	if err := f.opts.Greylist.Whitelist(ctx, ip, f.features[FeatureSender].Value); err != nil {
+		f.logf("filter greylist whitelist: %v", err)
+	}
+}
+
+func (f *Filter) Header(name string, value string, payload map[string]string, m *milter.Modifier) (milter.Response, []milter.Feature, error) {
+	// the leading space is kept when postfix sends it, DKIM signs the header as it was
+	sep := ": "
+	if strings.HasPrefix(value, " ") || strings.HasPrefix(value, "\t") {
+		sep = ":"
+	}
+	f.header.WriteString(name + sep + strings.ReplaceAll(value, "\n", "\r\n") + "\r\n")
+	f.countHeader(name, value, m)
+	return milter.RespContinue, nil, nil
+}
+
+func (f *Filter) Headers(h textproto.MIMEHeader, payload map[string]string, m *milter.Modifier) (milter.Response, []milter.Feature, error) {
+	f.startDKIM(len(h.Values("DKIM-Signature")) > 0)
+	f.startARC(len(h.Values("ARC-Seal")) > 0)
+	f.startSigning(h)
+	f.startScan()
+	features := make([]milter.Feature, 0)
+	if subject := headerGet(h, "Subject"); subject != "" {
+		if decoded, err := wordDecoder.DecodeHeader(subject); err == nil {
+			subject = decoded
+		}
+		features = append(features, stringFeature(FeatureSubject, subject))
+	}
+	if from := headerGet(h, "From"); from != "" {
+		if addr, err := mail.ParseAddress(from); err == nil {
+			features = append(features, stringFeature(FeatureHeaderFrom, addr.Address), stringFeature(FeatureNick, addr.Name))
+		} else {
+			features = append(features, stringFeature(FeatureHeaderFrom, from))
+		}
+	}
+	if mailer := headerGet(h, "X-Mailer"); mailer != "" {
+		features = append(features, stringFeature(FeatureMailer, mailer))
+	} else if agent := headerGet(h, "User-Agent"); agent != "" {
+		features = append(features, stringFeature(FeatureMailer, agent))
+	}
+	resp, features := f.stage(model.FilterStageHeader, features, m)
+	return resp, features, nil
+}
+
+// headerGet returns the first value of a header without the leading space postfix may send
+func headerGet(h textproto.MIMEHeader, name string) string {
+	return strings.TrimLeft(h.Get(name), " \t")
+}
+
+func (f *Filter) BodyChunk(chunk []byte, payload map[string]string, m *milter.Modifier) (milter.Response, []milter.Feature, error) {
+	f.size += int64(len(chunk))
+	if f.body.Len()+len(chunk) <= maxBodySize {
+		f.body.Write(chunk)
+	}
+	f.writeDKIM(chunk)
+	f.writeARC(chunk)
+	f.writeSigner(chunk)
+	f.writeScan(chunk)
+	return milter.RespContinue, nil, nil
+}
+
+func (f *Filter) Body(payload map[string]string, m *milter.Modifier, macro map[string]string) (milter.Response, []milter.Feature, error) {
+	features := []milter.Feature{intFeature(FeatureSize, int64(f.header.Len())+2+f.size)}
+	features = append(features, f.parseBody(m)...)
+	features = append(features, f.finishDKIM()...)
+	features = append(features, f.finishARC()...)
+	features = append(features, f.finishScan()...)
+	features = append(features, f.checkDMARC()...)
+	resp, features := f.stage(model.FilterStageData, features, m)
+	resp = f.dmarcEnforced(resp, m)
+	resp = f.scanFailClosed(resp, m)
+	if resp == milter.RespContinue || resp == milter.RespAccept {
+		f.stripHeaders(m)
+		f.addAuthHeaders(m)
+		f.addSignature(m)
+		f.whitelist()
+	}
+	f.recordDMARC()
+	// nothing matched, the message is accepted as unknown
+	f.finish(model.FilterStageData, nil, m)
+	f.reset()
+	return resp, features, nil
+}
+
+// hold stores the message in the quarantine, it is left to postfix when there
+// is no store, the body was cut or a recipient has no local mailbox.
+func (f *Filter) hold(ruleID int64, reason string, m *milter.Modifier) (bool, error) {
+	if f.opts.Quarantine == nil || f.size > int64(f.body.Len()) {
+		return false, nil
+	}
+	msg := quarantine.Message{
+		Sender:  f.features[FeatureSender].Value,
+		Rcpts:   append([]string(nil), f.rcpts...),
+		Subject: f.features[FeatureSubject].Value,
+		RuleID:  ruleID,
+		Reason:  reason,
+		Content: f.message(),
+	}
+	if m != nil {
+		msg.QueueID = m.Macros["i"]
+	}
+	if err := f.opts.Quarantine.Hold(msg); err != nil {
+		if errors.Is(err, quarantine.ErrNotLocal) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// message returns the header and the kept body of the current message
+func (f *Filter) message() []byte {
+	raw := make([]byte, 0, f.header.Len()+2+f.body.Len())
+	raw = append(raw, f.header.Bytes()...)
+	raw = append(raw, "\r\n"...)
+	return append(raw, f.body.Bytes()...)
+}
+
+// parseBody extracts content features, a broken mime structure leaves them empty
+func (f *Filter) parseBody(m *milter.Modifier) []milter.Feature {
+	env, err := enmime.ReadEnvelope(bytes.NewReader(f.message()))
+	if err != nil {
+		f.logf("filter parse body: %v", err)
+		return nil
+	}
+	names := make([]string, 0, len(env.Attachments))
+	for _, a := range env.Attachments {
+		names = append(names, a.FileName)
+	}
+	features := []milter.Feature{
+		stringFeature(FeatureText, env.Text),
+		stringFeature(FeatureHtml, env.HTML),
+		stringFeature(FeatureAttachName, strings.Join(names, ";")),
+		intFeature(FeatureAttachCount, int64(len(env.Attachments))),
+	}
+	features = append(features, f.attachments(env)...)
+	features = append(features, f.classify(env.Text, env.HTML)...)
+	var queueID string
+	if m != nil {
+		queueID = m.Macros["i"]
+	}
+	features = append(features, f.similar(env, queueID)...)
+	found := links.Extract(env.Text, env.HTML)
+	features = append(features, urlFeatures(found)...)
+	return append(features, f.uriListed(urlHosts(found))...)
+}
+
+// reset drops message features, connection features are kept
+func (f *Filter) reset() {
+	f.features = f.connFeatures.Clone()
+	f.rcpts = f.rcpts[:0]
+	f.header.Reset()
+	f.headerIndex, f.stripped = nil, nil
+	f.body.Reset()
+	f.size = 0
+	f.receivedSPF = ""
+	f.authResults = nil
+	f.stopDKIM()
+	f.stopARC()
+	f.stopSigning()
+	f.stopScan()
+	f.dkimResults = nil
+	f.dmarcResult, f.dmarcApplied = nil, false
+	f.pending = nil
+	f.decided = false
+}
+
+func (f *Filter) Abort(m *milter.Modifier) error {
+	f.reset()
+	return nil
+}
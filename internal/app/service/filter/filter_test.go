@@ -0,0 +1,1039 @@
+package filter
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/md5"
+	"crypto/rand"
+	"easymail/internal/app/service/attachment"
+	"easymail/internal/app/service/clamd"
+	"easymail/internal/app/service/dmarc"
+	"easymail/internal/app/service/dnsbl"
+	"easymail/internal/app/service/links"
+	"easymail/internal/app/service/milter"
+	"easymail/internal/app/service/milter/third_party/dkim"
+	"easymail/internal/app/service/milter/third_party/spf"
+	"easymail/internal/app/service/quarantine"
+	"easymail/internal/app/service/similarity"
+	"easymail/internal/model"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRuleStage(t *testing.T) {
+	fields := map[string]model.FilterStage{"sender_count": model.FilterStageMailFrom}
+	cases := []struct {
+		drl   string
+		stage model.FilterStage
+	}{
+		{`feature.client_ip=="192.0.2.1"`, model.FilterStageConnect},
+		{`feature.client_ip=="192.0.2.1" && feature.subject.Contains("x")`, model.FilterStageHeader},
+		{`feature.sender_count>10`, model.FilterStageMailFrom},
+		{`feature.unknown_field>10`, model.FilterStageData},
+		{`feature.size<1000`, model.FilterStageData},
+	}
+	for _, c := range cases {
+		if got := ruleStage(c.drl, fields); got != c.stage {
+			t.Fatalf("%s: expected stage %d, got %d", c.drl, c.stage, got)
+		}
+	}
+}
+
+func TestUnknownFeatures(t *testing.T) {
+	rules := []model.FilterRule{
+		{ID: 1, Action: model.FilterActionReject, Assembly: `sender_count>10`},
+		{ID: 2, Action: model.FilterActionReject, Assembly: `ip_count>10`},
+		{ID: 3, Action: model.FilterActionReject, Assembly: `sendr=="a@example.com";;subjct.Contains("x")`},
+		{ID: 4, Action: model.FilterActionReject, Assembly: `subject.Contains("x")`},
+	}
+	fields := []model.FilterField{{Name: "sender_count", Stage: model.FilterStageMailFrom}}
+	metrics := []model.FilterMetric{{Name: "ip_count", PrimaryField: model.FilterField{Name: "client_ip"}}}
+	e, err := NewEngine(rules, fields, metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a misspelled feature is reported instead of never matching
+	if e.Rules() != 3 || len(e.Skipped()) != 1 || e.Skipped()[3] == nil ||
+		e.Skipped()[3].Error() != "unknown feature sendr, subjct" {
+		t.Fatalf("expected rule 3 skipped, got %d rules and %v", e.Rules(), e.Skipped())
+	}
+}
+
+func TestBuiltinFields(t *testing.T) {
+	condition := model.RuleCondition{Logic: model.ConditionAnd, Children: []model.RuleCondition{
+		{Field: FeatureSize, Operator: model.OperatorGt, Value: "1000"},
+		{Field: FeatureBayesScore, Operator: model.OperatorBetween, Values: []string{"0.5", "1"}},
+		{Field: FeatureURLShortener, Operator: model.OperatorEquals, Value: "true"},
+		{Field: FeatureSubject, Operator: model.OperatorContains, Value: "offer"},
+	}}
+	if err := condition.Validate(BuiltinFields()); err != nil {
+		t.Fatal(err)
+	}
+	drl, err := condition.DRL()
+	if err != nil || drl != `feature.size>1000 && (feature.bayes_score>=0.5 && feature.bayes_score<=1) && feature.url_shortener==true && feature.subject.Contains("offer")` {
+		t.Fatalf("unexpected drl %s, err %v", drl, err)
+	}
+}
+
+// testEnv is the envelope of a plain message from a remote client
+var testEnv = milter.Envelope{Addr: "192.0.2.1", Helo: "client", From: "sender@example.com", Rcpts: []string{"rcpt@example.com"}}
+
+func testEngine(t *testing.T, rules []model.FilterRule) *Engine {
+	t.Helper()
+	e, err := NewEngine(rules, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+// replayer connects a filter of e and opts to a pipe client speaking protocol,
+// setup is called with the filter of the connection when it is not nil. The
+// returned func replays one message of env through the connection.
+func replayer(t *testing.T, e *Engine, opts Options, protocol milter.OptProtocol, setup func(*Filter)) func(env milter.Envelope, raw string) *milter.ReplayResult {
+	t.Helper()
+	client, err := milter.NewPipeClient(func() (milter.Milter, milter.OptAction, milter.OptProtocol) {
+		f := NewFilter(e, nil, nil, opts)
+		if setup != nil {
+			setup(f)
+		}
+		return f, filterActions, protocol
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+	return func(env milter.Envelope, raw string) *milter.ReplayResult {
+		t.Helper()
+		result, err := milter.Replay(client, env, strings.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+}
+
+// passed tells the message went through unchanged
+func passed(r *milter.ReplayResult) bool {
+	return (r.Action.Code == milter.ActAccept || r.Action.Code == milter.ActContinue) && len(r.Modifications) == 0
+}
+
+// trashed tells the message was moved to the trash
+func trashed(r *milter.ReplayResult) bool {
+	return len(r.Modifications) == 1 && r.Modifications[0].Value == "Trash"
+}
+
+func TestFilterReplay(t *testing.T) {
+	rules := []model.FilterRule{
+		{ID: 1, Priority: 10, Action: model.FilterActionReject, ClientIP: "equals::198.51.100.1"},
+		{ID: 2, Priority: 9, Action: model.FilterActionDefer, Assembly: `sender_domain=="defer.example.com"`},
+		{ID: 3, Priority: 8, Action: model.FilterActionQuarantine, Assembly: `subject.Contains("hold")`},
+		{ID: 4, Priority: 7, Action: model.FilterActionTrash, Assembly: `text.Contains("lottery")`},
+		{ID: 5, Priority: 6, Action: model.FilterActionDiscard, Assembly: `size>100000`},
+		// no condition, it is skipped
+		{ID: 6, Action: model.FilterActionReject},
+		{ID: 7, Priority: 5, Action: model.FilterActionReject, Assembly: `rcpt=="blocked@example.com"`},
+		{ID: 8, Priority: 4, Action: model.FilterActionTrash, Assembly: `sender_domain=="junk.example.com"`},
+	}
+	e := testEngine(t, rules)
+	if e.Rules() != 7 || len(e.Skipped()) != 1 {
+		t.Fatalf("expected 7 rules and 1 skipped, got %d and %v", e.Rules(), e.Skipped())
+	}
+
+	message := "From: Sender <sender@example.com>\r\nSubject: %s\r\n\r\n%s\r\n"
+	cases := []struct {
+		name    string
+		addr    string
+		from    string
+		subject string
+		body    string
+		stage   milter.Code
+		action  milter.ActionCode
+		mod     string
+	}{
+		{name: "accepted", subject: "hello", body: "hi", stage: milter.CodeEOB, action: milter.ActContinue},
+		{name: "rejected client", addr: "198.51.100.1", subject: "hello", body: "hi", stage: milter.CodeConn, action: milter.ActReject},
+		{name: "deferred sender", from: "a@defer.example.com", subject: "hello", body: "hi", stage: milter.CodeMail, action: milter.ActTempFail},
+		{name: "quarantined subject", subject: "please hold", body: "hi", stage: milter.CodeEOB, action: milter.ActAccept, mod: "q:filter rule 3"},
+		{name: "trashed text", subject: "hello", body: "you won the lottery", stage: milter.CodeEOB, action: milter.ActAccept, mod: "h:" + FolderHeader + "=Trash"},
+		{name: "discarded size", subject: "hello", body: strings.Repeat("x", 100001), stage: milter.CodeEOB, action: milter.ActDiscard},
+		// the trash of the sender waits for end of body, a stronger match of the body wins
+		{name: "trashed sender", from: "a@junk.example.com", subject: "hello", body: "hi", stage: milter.CodeEOB, action: milter.ActAccept, mod: "h:" + FolderHeader + "=Trash"},
+		{name: "quarantined trashed sender", from: "a@junk.example.com", subject: "please hold", body: "hi", stage: milter.CodeEOB, action: milter.ActAccept, mod: "q:filter rule 3"},
+		{name: "discarded trashed sender", from: "a@junk.example.com", subject: "hello", body: strings.Repeat("x", 100001), stage: milter.CodeEOB, action: milter.ActDiscard},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			env := testEnv
+			env.Host = "client.example.com"
+			if c.addr != "" {
+				env.Addr = c.addr
+			}
+			if c.from != "" {
+				env.From = c.from
+			}
+			// every case is a new connection, connect stage decisions stick to it
+			replay := replayer(t, e, Options{}, 0, nil)
+			result := replay(env, strings.Replace(strings.Replace(message, "%s", c.subject, 1), "%s", c.body, 1))
+			if result.Stage != c.stage || result.Action.Code != c.action {
+				t.Fatalf("expected %c/%c, got %c/%c", c.stage, c.action, result.Stage, result.Action.Code)
+			}
+			mod := ""
+			if len(result.Modifications) > 0 {
+				m := result.Modifications[0]
+				mod = string(m.Code) + ":" + m.Value
+				if m.Name != "" {
+					mod = string(m.Code) + ":" + m.Name + "=" + m.Value
+				}
+			}
+			if mod != c.mod {
+				t.Fatalf("expected modification %q, got %q", c.mod, mod)
+			}
+		})
+	}
+
+	// messages of the same connection do not leak features into each other
+	logs := make([]model.FilterLog, 0)
+	w := NewLogWriter(nil)
+	w.save = func(batch []model.FilterLog) error {
+		logs = append(logs, batch...)
+		return nil
+	}
+	w.Start()
+	replay := replayer(t, e, Options{}, 0, func(f *Filter) { f.SetLogWriter(w) })
+	env := testEnv
+	env.Rcpts = []string{"blocked@example.com", "rcpt@example.com"}
+	body := strings.Repeat("hi ", 5000)
+	for _, subject := range []string{"please hold", "hello"} {
+		result := replay(env, "Subject: "+subject+"\r\n\r\n"+body+"\r\n")
+		if held := len(result.Modifications) > 0; held != (subject == "please hold") {
+			t.Fatalf("subject %q: unexpected modifications %+v", subject, result.Modifications)
+		}
+	}
+
+	// every message is logged once with its features and the matched rule,
+	// a rejected recipient on its own
+	w.Stop()
+	if len(logs) != 4 {
+		t.Fatalf("expected 4 filter logs, got %d", len(logs))
+	}
+	for _, i := range []int{0, 2} {
+		if logs[i].RuleID != 7 || logs[i].Stage != model.FilterStageRcptTo || logs[i].Action != model.FilterActionReject || logs[i].Rcpt != "blocked@example.com" {
+			t.Fatalf("unexpected log %+v", logs[i])
+		}
+	}
+	if logs[1].RuleID != 3 || logs[1].Action != model.FilterActionQuarantine || logs[1].Subject != "please hold" {
+		t.Fatalf("unexpected log %+v", logs[1])
+	}
+	if logs[3].RuleID != 0 || logs[3].Action != model.FilterActionAccept || logs[3].Rcpt != "rcpt@example.com" {
+		t.Fatalf("unexpected log %+v", logs[3])
+	}
+	fact, err := LogFact(logs[3])
+	if err != nil || fact[FeatureSubject] != "hello" {
+		t.Fatalf("unexpected log features %v, err %v", fact, err)
+	}
+	// the body is cut, it is not needed to tell why the message was filtered
+	if text, _ := fact[FeatureText].(string); len(text) != maxLogBodySize {
+		t.Fatalf("expected the text cut to %d bytes, got %d", maxLogBodySize, len(text))
+	}
+}
+
+type fakeQuarantine struct {
+	held []quarantine.Message
+	err  error
+}
+
+func (q *fakeQuarantine) Hold(msg quarantine.Message) error {
+	if q.err != nil {
+		return q.err
+	}
+	q.held = append(q.held, msg)
+	return nil
+}
+
+func TestFilterQuarantine(t *testing.T) {
+	rules := []model.FilterRule{
+		{ID: 3, Action: model.FilterActionQuarantine, Assembly: `subject.Contains("hold")`},
+	}
+	q := &fakeQuarantine{}
+	replay := replayer(t, testEngine(t, rules), Options{Quarantine: q}, 0, nil)
+	env := testEnv
+	env.Rcpts = []string{"a@example.com", "b@example.com"}
+	raw := "Subject: please hold\r\n\r\nhi\r\n"
+
+	cases := []struct {
+		name   string
+		err    error
+		action milter.ActionCode
+		mod    string
+	}{
+		// the stored message is dropped from postfix
+		{"stored", nil, milter.ActDiscard, ""},
+		// remote recipients leave the message to the postfix hold queue
+		{"remote", quarantine.ErrNotLocal, milter.ActAccept, "filter rule 3"},
+		// a failing store keeps the message with the sender
+		{"failed", errors.New("database is down"), milter.ActTempFail, ""},
+	}
+	for _, c := range cases {
+		q.err = c.err
+		result := replay(env, raw)
+		mod := ""
+		for _, m := range result.Modifications {
+			mod += m.Value
+		}
+		if result.Action.Code != c.action || mod != c.mod {
+			t.Fatalf("%s: expected %c %q, got %c %+v", c.name, c.action, c.mod, result.Action.Code, result.Modifications)
+		}
+	}
+	if len(q.held) != 1 {
+		t.Fatalf("expected 1 held message, got %d", len(q.held))
+	}
+	held := q.held[0]
+	if held.RuleID != 3 || held.Sender != "sender@example.com" || len(held.Rcpts) != 2 || !strings.Contains(string(held.Content), "please hold") {
+		t.Fatalf("unexpected held message %+v", held)
+	}
+}
+
+func TestFilterFolderHeader(t *testing.T) {
+	rules := []model.FilterRule{
+		{ID: 4, Action: model.FilterActionTrash, Assembly: `text.Contains("lottery")`},
+	}
+	replay := replayer(t, testEngine(t, rules), Options{}, 0, nil)
+
+	// the sender cannot pick the folder, its headers are removed and only the one of the filter is left
+	forged := "Subject: hi\r\nX-Easymail-Folder: Inbox\r\nx-easymail-folder: Inbox\r\n\r\n"
+	cases := []struct {
+		body string
+		mods []string
+	}{
+		{"hello", []string{"m:2:X-Easymail-Folder=", "m:1:X-Easymail-Folder="}},
+		{"you won the lottery", []string{"h:0:" + FolderHeader + "=Trash", "m:2:X-Easymail-Folder=", "m:1:X-Easymail-Folder="}},
+	}
+	for _, c := range cases {
+		result := replay(testEnv, forged+c.body+"\r\n")
+		mods := make([]string, 0, len(result.Modifications))
+		for _, m := range result.Modifications {
+			mods = append(mods, fmt.Sprintf("%c:%d:%s=%s", m.Code, m.Index, m.Name, m.Value))
+		}
+		if !reflect.DeepEqual(mods, c.mods) {
+			t.Fatalf("%s: expected %v, got %v", c.body, c.mods, mods)
+		}
+	}
+}
+
+type fakeGreylist struct {
+	seen        map[string]bool
+	whitelisted []string
+}
+
+func (g *fakeGreylist) Whitelist(_ context.Context, ip net.IP, sender string) error {
+	g.whitelisted = append(g.whitelisted, ip.String()+","+sender)
+	return nil
+}
+
+func (g *fakeGreylist) Greylist(_ context.Context, ip net.IP, sender, rcpt string) (time.Duration, error) {
+	key := ip.String() + "," + sender + "," + rcpt
+	if g.seen[key] {
+		return 0, nil
+	}
+	g.seen[key] = true
+	return 5 * time.Minute, nil
+}
+
+func TestFilterGreylist(t *testing.T) {
+	rules := []model.FilterRule{
+		{ID: 1, Action: model.FilterActionAccept, Assembly: `rcpt=="postmaster@example.com"`},
+	}
+	g := &fakeGreylist{seen: make(map[string]bool)}
+	replay := replayer(t, testEngine(t, rules), Options{Greylist: g}, 0, nil)
+
+	cases := []struct {
+		name   string
+		from   string
+		rcpts  []string
+		macros map[milter.Code]map[string]string
+		check  func(r *milter.ReplayResult) bool
+	}{
+		{"first", "sender@example.org", []string{"a@example.com", "b@example.com"}, nil, func(r *milter.ReplayResult) bool {
+			return len(r.Rejected) == 2 && r.Action.Code == milter.ActReplyCode && r.Action.SMTPCode == 451
+		}},
+		// the retry passes
+		{"retry", "sender@example.org", []string{"a@example.com", "b@example.com"}, nil, func(r *milter.ReplayResult) bool {
+			return len(r.Rejected) == 0 && r.Stage == milter.CodeEOB
+		}},
+		// recipients accepted by a rule and logged in clients are not greylisted
+		{"accepted", "other@example.org", []string{"postmaster@example.com"}, nil, func(r *milter.ReplayResult) bool {
+			return r.Stage == milter.CodeRcpt && r.Action.Code == milter.ActAccept
+		}},
+		{"login", "other@example.org", []string{"c@example.com"}, map[milter.Code]map[string]string{milter.CodeMail: {"{auth_authen}": "bob"}}, func(r *milter.ReplayResult) bool {
+			return len(r.Rejected) == 0
+		}},
+	}
+	for _, c := range cases {
+		env := testEnv
+		env.From, env.Rcpts, env.Macros = c.from, c.rcpts, c.macros
+		if result := replay(env, "Subject: hello\r\n\r\nhi\r\n"); !c.check(result) {
+			t.Fatalf("%s: got %+v", c.name, result)
+		}
+	}
+}
+
+type fakeBlocklist struct{}
+
+func (fakeBlocklist) CheckIP(_ context.Context, ip net.IP) (dnsbl.Result, error) {
+	if ip.String() == "198.51.100.1" {
+		return dnsbl.Result{Zones: []string{"a.example", "b.example"}, Listed: []string{"198.51.100.1"}}, nil
+	}
+	return dnsbl.Result{}, nil
+}
+
+func (fakeBlocklist) CheckDomains(_ context.Context, domains []string) (dnsbl.Result, error) {
+	for _, d := range domains {
+		if strings.HasSuffix(d, "spam.example") {
+			return dnsbl.Result{Zones: []string{"uri.example"}, Listed: []string{"spam.example"}}, nil
+		}
+	}
+	return dnsbl.Result{}, nil
+}
+
+func TestURLHosts(t *testing.T) {
+	text := "see https://Example.com/a?b=c, www.spam.example. and http://192.0.2.7:8080/x"
+	html := `<a href="http://example.com/other">x</a><img src='https://cdn.example.net/i.png'>`
+	expected := []string{"example.com", "www.spam.example", "192.0.2.7", "cdn.example.net"}
+	if hosts := urlHosts(links.Extract(text, html)); !reflect.DeepEqual(hosts, expected) {
+		t.Fatalf("expected %v, got %v", expected, hosts)
+	}
+}
+
+func TestFilterBlocklist(t *testing.T) {
+	rules := []model.FilterRule{
+		{ID: 1, Priority: 2, Action: model.FilterActionReject, Assembly: `dnsbl_hits>1`},
+		{ID: 2, Priority: 1, Action: model.FilterActionTrash, Assembly: `uribl_listed==true`},
+	}
+	replay := replayer(t, testEngine(t, rules), Options{Blocklist: fakeBlocklist{}}, 0, nil)
+
+	cases := []struct {
+		name  string
+		addr  string
+		body  string
+		check func(r *milter.ReplayResult) bool
+	}{
+		{"listed client", "198.51.100.1", "hi", func(r *milter.ReplayResult) bool {
+			return r.Stage == milter.CodeConn && r.Action.Code == milter.ActReject
+		}},
+		{"listed link", "192.0.2.1", "visit http://www.spam.example/now", func(r *milter.ReplayResult) bool {
+			return len(r.Modifications) == 1 && r.Modifications[0].Value == "Trash"
+		}},
+	}
+	for _, c := range cases {
+		env := testEnv
+		env.Addr = c.addr
+		if result := replay(env, "Subject: hi\r\n\r\n"+c.body+"\r\n"); !c.check(result) {
+			t.Fatalf("%s: got %+v", c.name, result)
+		}
+	}
+}
+
+type fakeSPF map[string]spf.Result
+
+func (f fakeSPF) CheckHost(ip net.IP, helo, sender string) (spf.Result, error) {
+	if r, ok := f[sender]; ok {
+		return r, nil
+	}
+	return spf.None, nil
+}
+
+func TestFilterSPF(t *testing.T) {
+	rules := []model.FilterRule{
+		{ID: 1, Action: model.FilterActionTrash, Assembly: `spf=="softfail"`},
+	}
+	e := testEngine(t, rules)
+	checker := fakeSPF{
+		"good@example.org": spf.Pass,
+		"bad@example.org":  spf.Fail,
+		"soft@example.org": spf.SoftFail,
+	}
+	g := &fakeGreylist{seen: make(map[string]bool)}
+	replay := replayer(t, e, Options{SPF: checker, SPFMode: SPFReject, Greylist: g}, 0, nil)
+
+	raw := "Subject: hi\r\n\r\nhi\r\n"
+	env := milter.Envelope{
+		Addr: "192.0.2.1", Helo: "client.example.org", From: "good@example.org", Rcpts: []string{"a@example.com"},
+		Macros: map[milter.Code]map[string]string{milter.CodeConn: {"j": "mx.example.com"}},
+	}
+	// the greylisted attempt is not whitelisted by its own pass
+	result := replay(env, raw)
+	if len(result.Rejected) != 1 || len(g.whitelisted) != 0 {
+		t.Fatalf("expected the greylisted attempt deferred, got %+v and whitelist %v", result, g.whitelisted)
+	}
+
+	// the retry is recorded on top of the headers, once accepted the sender is whitelisted
+	result = replay(env, raw)
+	headers := make(map[string]string)
+	for _, mod := range result.Modifications {
+		if mod.Code != milter.ActInsertHeader || mod.Index != 0 {
+			t.Fatalf("unexpected modification %+v", mod)
+		}
+		headers[mod.Name] = mod.Value
+	}
+	if headers["Received-SPF"] != `pass (domain of good@example.org designates 192.0.2.1 as permitted sender) client-ip=192.0.2.1; envelope-from="good@example.org"; helo=client.example.org; identity=mailfrom;` ||
+		headers["Authentication-Results"] != "mx.example.com;\n\tspf=pass smtp.mailfrom=good@example.org" {
+		t.Fatalf("unexpected headers %q", headers)
+	}
+	if len(g.whitelisted) != 1 || g.whitelisted[0] != "192.0.2.1,good@example.org" {
+		t.Fatalf("unexpected whitelist %v", g.whitelisted)
+	}
+
+	// results the sender wrote in our name are removed, the ones of other hosts are kept
+	forged := "Authentication-Results: relay.example.net; spf=fail\r\nAuthentication-Results: MX.example.com (checked); dkim=pass\r\n" + raw
+	result = replay(env, forged)
+	if len(result.Modifications) != 3 {
+		t.Fatalf("expected 3 modifications, got %+v", result.Modifications)
+	}
+	if mod := result.Modifications[0]; mod.Code != milter.ActChangeHeader || mod.Index != 2 || mod.Name != "Authentication-Results" || mod.Value != "" {
+		t.Fatalf("expected the forged results removed, got %+v", mod)
+	}
+
+	// a fail is rejected at MAIL FROM
+	env.From = "bad@example.org"
+	result = replay(env, raw)
+	if result.Stage != milter.CodeMail || result.Action.SMTPCode != 550 {
+		t.Fatalf("expected the fail rejected, got %+v", result)
+	}
+
+	// the rules see the result
+	env.From = "soft@example.org"
+	g.seen["192.0.2.1,soft@example.org,a@example.com"] = true
+	result = replay(env, raw)
+	if len(result.Modifications) != 3 || result.Modifications[0].Value != "Trash" {
+		t.Fatalf("expected the softfail trashed, got %+v", result)
+	}
+
+	// the header mode lets the fail pass, bounces are checked by helo
+	replayHeader := replayer(t, e, Options{SPF: checker, SPFMode: SPFHeader}, 0, nil)
+	env.From = "bad@example.org"
+	result = replayHeader(env, raw)
+	if result.Stage != milter.CodeEOB || len(result.Modifications) != 2 {
+		t.Fatalf("expected the fail to pass in header mode, got %+v", result)
+	}
+	env.From = ""
+	result = replayHeader(env, raw)
+	if len(result.Modifications) != 2 || !strings.HasSuffix(result.Modifications[1].Value, "spf=none smtp.helo=client.example.org") {
+		t.Fatalf("unexpected bounce headers %+v", result.Modifications)
+	}
+}
+
+func TestParseSPFMode(t *testing.T) {
+	for s, mode := range map[string]SPFMode{"": SPFOff, "off": SPFOff, "Header": SPFHeader, " reject ": SPFReject} {
+		if got, err := ParseSPFMode(s); err != nil || got != mode {
+			t.Fatalf("%q: expected %d, got %d, err %v", s, mode, got, err)
+		}
+	}
+	if _, err := ParseSPFMode("strict"); err == nil {
+		t.Fatal("expected an error for an unknown mode")
+	}
+}
+
+func TestFilterDKIM(t *testing.T) {
+	rules := []model.FilterRule{
+		{ID: 1, Action: model.FilterActionTrash, Assembly: `dkim=="fail"`},
+	}
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := map[string]string{
+		"sel._domainkey.example.org": "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub),
+	}
+	lookup := func(name string) ([]string, error) {
+		if txt, ok := records[name]; ok {
+			return []string{txt}, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	g := &fakeGreylist{seen: make(map[string]bool)}
+	// headers are verified as they were signed, with the space after the colon
+	send := replayer(t, testEngine(t, rules), Options{DKIM: lookup, Greylist: g}, milter.OptHeaderLeadingSpace, nil)
+
+	sign := func(selector, body string) string {
+		t.Helper()
+		raw := "From: Sender <a@mail.example.org>\r\nSubject:  two spaces\r\n\tand a fold\r\n\r\n" + body
+		var signed bytes.Buffer
+		err := dkim.Sign(&signed, strings.NewReader(raw), &dkim.SignOptions{Domain: "example.org", Selector: selector, Signer: key})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed.String()
+	}
+	env := milter.Envelope{
+		Addr: "192.0.2.1", Helo: "client.example.org", From: "a@mail.example.org", Rcpts: []string{"b@example.com"},
+		Macros: map[milter.Code]map[string]string{milter.CodeConn: {"j": "mx.example.com"}},
+	}
+	replay := func(raw string) string {
+		t.Helper()
+		g.seen["192.0.2.1,a@mail.example.org,b@example.com"] = true
+		result := send(env, raw)
+		for _, mod := range result.Modifications {
+			if mod.Name == "Authentication-Results" {
+				return mod.Value
+			}
+		}
+		t.Fatalf("no authentication results in %+v", result)
+		return ""
+	}
+
+	// the signature of a parent domain of the sender passes, the accepted message whitelists it
+	if got := replay(sign("sel", "hello\r\n")); got != " mx.example.com;\n\tdkim=pass header.d=example.org header.s=sel" {
+		t.Fatalf("unexpected results %q", got)
+	}
+	if len(g.whitelisted) != 1 || g.whitelisted[0] != "192.0.2.1,a@mail.example.org" {
+		t.Fatalf("unexpected whitelist %v", g.whitelisted)
+	}
+	// a changed body fails and the rules see it
+	raw := strings.Replace(sign("sel", "hello\r\n"), "hello", "hullo", 1)
+	if got := replay(raw); !strings.HasPrefix(got, " mx.example.com;\n\tdkim=fail header.d=example.org header.s=sel reason=") {
+		t.Fatalf("unexpected results %q", got)
+	}
+	// an unknown selector has no key
+	if got := replay(sign("old", "hello\r\n")); !strings.HasPrefix(got, " mx.example.com;\n\tdkim=permerror header.d=example.org header.s=old") {
+		t.Fatalf("unexpected results %q", got)
+	}
+	if got := replay("Subject: hi\r\n\r\nhi\r\n"); got != " mx.example.com;\n\tdkim=none" {
+		t.Fatalf("unexpected results %q", got)
+	}
+	if len(g.whitelisted) != 1 {
+		t.Fatalf("unexpected whitelist %v", g.whitelisted)
+	}
+}
+
+func TestDKIMResult(t *testing.T) {
+	features := make(Features)
+	f := &Filter{features: features, dkimEnabled: true, dkimDone: make(chan dkimOutcome, 1)}
+	f.dkimDone <- dkimOutcome{verifications: []*dkim.Verification{
+		{Domain: "a.example", Selector: "s1", Err: errors.New("dkim: signature did not verify")},
+		{Domain: "b.example", Selector: "s2"},
+	}}
+	got := make(map[string]string)
+	for _, feature := range f.finishDKIM() {
+		got[feature.Name] = feature.Value
+	}
+	expected := map[string]string{
+		FeatureDKIM:        "pass",
+		FeatureDKIMDomains: "b.example",
+		FeatureDKIMResults: "a.example/s1=fail,b.example/s2=pass",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+}
+
+type fakeSigner map[string]*dkim.SignOptions
+
+func (s fakeSigner) SignOptions(domain string) (*dkim.SignOptions, error) {
+	return s[domain], nil
+}
+
+func TestFilterSign(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := fakeSigner{"example.org": {
+		Domain: "example.org", Selector: "sel", Signer: key,
+		HeaderCanonicalization: dkim.CanonicalizationRelaxed, BodyCanonicalization: dkim.CanonicalizationRelaxed,
+		HeaderKeys: []string{"From", "Subject"},
+	}}
+	replay := replayer(t, testEngine(t, nil), Options{Signer: signer}, milter.OptHeaderLeadingSpace, nil)
+
+	raw := "From: Bob <bob@example.org>\r\nSubject: hello\r\n\r\nhi\r\n"
+	env := milter.Envelope{
+		Addr: "192.0.2.1", Helo: "client.example.org", From: "bob@example.org", Rcpts: []string{"a@example.com"},
+		Macros: map[milter.Code]map[string]string{milter.CodeMail: {"auth_authen": "bob@example.org"}},
+	}
+	result := replay(env, raw)
+	if len(result.Modifications) != 1 || result.Modifications[0].Name != "DKIM-Signature" {
+		t.Fatalf("expected a signature, got %+v", result.Modifications)
+	}
+	// the message as postfix sends it on verifies with the published key
+	signature := strings.ReplaceAll(result.Modifications[0].Value, "\n", "\r\n")
+	lookup := func(name string) ([]string, error) {
+		return []string{"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub)}, nil
+	}
+	vs, err := dkim.VerifyWithOptions(strings.NewReader("DKIM-Signature:"+signature+"\r\n"+raw), &dkim.VerifyOptions{LookupTXT: lookup})
+	if err != nil || len(vs) != 1 || vs[0].Err != nil || vs[0].Domain != "example.org" {
+		t.Fatalf("unexpected verification %+v, err %v", vs, err)
+	}
+
+	// clients which are not logged in and domains without a key are not signed
+	env.Macros = nil
+	if result = replay(env, raw); len(result.Modifications) != 0 {
+		t.Fatalf("unexpected modifications %+v", result)
+	}
+	env.Macros = map[milter.Code]map[string]string{milter.CodeMail: {"auth_authen": "bob@example.net"}}
+	raw = strings.Replace(raw, "example.org", "example.net", 1)
+	if result = replay(env, raw); len(result.Modifications) != 0 {
+		t.Fatalf("unexpected modifications %+v", result)
+	}
+}
+
+type fakeDMARC struct {
+	*dmarc.Evaluator
+	recorded []dmarc.Result
+}
+
+func (d *fakeDMARC) Record(result dmarc.Result) {
+	d.recorded = append(d.recorded, result)
+}
+
+func TestFilterDMARC(t *testing.T) {
+	e := testEngine(t, nil)
+	records := map[string]string{
+		"_dmarc.example.org": "v=DMARC1; p=reject; rua=mailto:dmarc@example.org",
+		"_dmarc.example.net": "v=DMARC1; p=quarantine",
+	}
+	d := &fakeDMARC{Evaluator: dmarc.New(func(name string) ([]string, error) {
+		if txt, ok := records[name]; ok {
+			return []string{txt}, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	})}
+	opts := Options{SPF: fakeSPF{"bob@example.org": spf.Pass}, SPFMode: SPFHeader, DMARC: d, DMARCMode: DMARCEnforce}
+	replay := replayer(t, e, opts, 0, nil)
+
+	env := milter.Envelope{
+		Addr: "192.0.2.1", Helo: "client.example.org", From: "bob@example.org", Rcpts: []string{"a@example.com"},
+		Macros: map[milter.Code]map[string]string{milter.CodeConn: {"j": "mx.example.com"}},
+	}
+	// the aligned spf pass passes
+	raw := "From: Bob <bob@example.org>\r\nSubject: hi\r\n\r\nhi\r\n"
+	result := replay(env, raw)
+	if result.Action.Code != milter.ActContinue || len(result.Modifications) != 2 ||
+		!strings.HasSuffix(result.Modifications[1].Value, "dmarc=pass (p=reject dis=NONE) header.from=example.org") {
+		t.Fatalf("expected a pass, got %+v", result)
+	}
+
+	// the failure is rejected as the policy asks
+	env.From = "other@example.com"
+	result = replay(env, raw)
+	if result.Stage != milter.CodeEOB || result.Action.SMTPCode != 550 {
+		t.Fatalf("expected the failure rejected, got %+v", result)
+	}
+
+	// postfix holds the failure of a quarantine policy
+	raw = strings.Replace(raw, "example.org", "example.net", 1)
+	result = replay(env, raw)
+	if result.Action.Code != milter.ActAccept || result.Modifications[0].Code != milter.ActQuarantine ||
+		result.Modifications[0].Value != "dmarc policy of example.net" {
+		t.Fatalf("expected the failure quarantined, got %+v", result)
+	}
+
+	if len(d.recorded) != 3 || d.recorded[0].Result != dmarc.ResultPass ||
+		d.recorded[1].Disposition != dmarc.PolicyReject || d.recorded[2].Disposition != dmarc.PolicyQuarantine {
+		t.Fatalf("unexpected recorded results %+v", d.recorded)
+	}
+
+	// the header mode only records the result, the policy was overridden
+	opts.DMARCMode = DMARCHeader
+	replayHeader := replayer(t, e, opts, 0, nil)
+	raw = strings.Replace(raw, "example.net", "example.org", 1)
+	result = replayHeader(env, raw)
+	if result.Action.Code != milter.ActContinue ||
+		!strings.HasSuffix(result.Modifications[len(result.Modifications)-1].Value, "dmarc=fail (p=reject dis=REJECT) header.from=example.org") {
+		t.Fatalf("expected the failure to pass in header mode, got %+v", result)
+	}
+	last := d.recorded[len(d.recorded)-1]
+	if last.Disposition != dmarc.PolicyNone || last.Reason != dmarc.ReasonLocalPolicy {
+		t.Fatalf("unexpected recorded result %+v", last)
+	}
+}
+
+func TestParseDMARCMode(t *testing.T) {
+	for s, mode := range map[string]DMARCMode{"": DMARCOff, "off": DMARCOff, "Header": DMARCHeader, " enforce ": DMARCEnforce} {
+		if got, err := ParseDMARCMode(s); err != nil || got != mode {
+			t.Fatalf("%q: expected %d, got %d, err %v", s, mode, got, err)
+		}
+	}
+	if _, err := ParseDMARCMode("reject"); err == nil {
+		t.Fatal("expected an error for an unknown mode")
+	}
+}
+
+func TestFilterARC(t *testing.T) {
+	rules := []model.FilterRule{
+		{ID: 1, Action: model.FilterActionTrash, Assembly: `arc_domain=="fwd.example"`},
+	}
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lookup := func(name string) ([]string, error) {
+		if name == "arc._domainkey.fwd.example" {
+			return []string{"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub)}, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	replay := replayer(t, testEngine(t, rules), Options{ARC: lookup}, milter.OptHeaderLeadingSpace, nil)
+
+	raw := "From: a@origin.example\r\nSubject: hi\r\n\r\nhello\r\n"
+	fields, err := dkim.Seal(strings.NewReader(raw), &dkim.SealOptions{
+		Domain: "fwd.example", Selector: "arc", Signer: key, AuthServID: "mx.fwd.example", Results: "spf=pass",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := milter.Envelope{
+		Addr: "192.0.2.1", Helo: "mx.fwd.example", From: "a@origin.example", Rcpts: []string{"b@example.com"},
+		Macros: map[milter.Code]map[string]string{milter.CodeConn: {"j": "mx.example.com"}},
+	}
+	authResults := func(result *milter.ReplayResult) string {
+		for _, mod := range result.Modifications {
+			if mod.Name == "Authentication-Results" {
+				return mod.Value
+			}
+		}
+		return ""
+	}
+
+	// the rules trust the forwarder of a valid chain
+	result := replay(env, fields+raw)
+	if len(result.Modifications) != 2 || strings.TrimSpace(result.Modifications[0].Value) != "Trash" ||
+		!strings.HasSuffix(authResults(result), "arc=pass (i=1)") {
+		t.Fatalf("expected a valid chain, got %+v", result.Modifications)
+	}
+
+	// a changed body breaks the chain
+	result = replay(env, fields+strings.Replace(raw, "hello", "hullo", 1))
+	if len(result.Modifications) != 1 || !strings.Contains(authResults(result), "arc=fail (i=1) reason=") {
+		t.Fatalf("expected a failed chain, got %+v", result.Modifications)
+	}
+
+	result = replay(env, raw)
+	if len(result.Modifications) != 1 || !strings.HasSuffix(authResults(result), "arc=none") {
+		t.Fatalf("expected no chain, got %+v", result.Modifications)
+	}
+}
+
+type fakeClassifier struct {
+	trained bool
+}
+
+func (c *fakeClassifier) Classify(_ context.Context, subject, text, html string) (float64, bool, error) {
+	if strings.Contains(subject+text, "replica") {
+		return 0.99, c.trained, nil
+	}
+	return 0.01, c.trained, nil
+}
+
+func TestFilterBayes(t *testing.T) {
+	rules := []model.FilterRule{
+		{ID: 1, Action: model.FilterActionTrash, Assembly: `bayes_score > 0.9`},
+	}
+	classifier := &fakeClassifier{}
+	replay := replayer(t, testEngine(t, rules), Options{Bayes: classifier}, 0, nil)
+
+	spam := "Subject: offer\r\n\r\nreplica watches\r\n"
+	cases := []struct {
+		name    string
+		trained bool
+		raw     string
+		check   func(*milter.ReplayResult) bool
+	}{
+		{"spam", true, spam, trashed},
+		{"ham", true, "Subject: notes\r\n\r\nmeeting notes\r\n", passed},
+		// an untrained classifier gives no score
+		{"untrained", false, spam, passed},
+	}
+	for _, c := range cases {
+		classifier.trained = c.trained
+		if result := replay(testEnv, c.raw); !c.check(result) {
+			t.Fatalf("%s: got %c %+v", c.name, result.Action.Code, result.Modifications)
+		}
+	}
+}
+
+type fakeSimilarity struct {
+	queueIDs    []string
+	attachments int
+}
+
+func (s *fakeSimilarity) Match(sessionID, text string, attachments [][]byte) (similarity.Match, error) {
+	s.queueIDs = append(s.queueIDs, sessionID)
+	s.attachments += len(attachments)
+	if strings.Contains(text, "offer") {
+		return similarity.Match{BodyMax: 88, Sessions: []string{"4ABC001", "4ABC002"}}, nil
+	}
+	return similarity.Match{}, nil
+}
+
+func TestFilterSimilarity(t *testing.T) {
+	rules := []model.FilterRule{
+		{ID: 1, Action: model.FilterActionTrash, Assembly: `body_similarity_max >= 80;;similar_sessions.Contains("4ABC001")`},
+	}
+	s := &fakeSimilarity{}
+	env := testEnv
+	env.Macros = map[milter.Code]map[string]string{milter.CodeEOB: {"i": "4ABC003"}}
+	replay := replayer(t, testEngine(t, rules), Options{Similarity: s}, 0, nil)
+
+	cases := []struct {
+		name  string
+		raw   string
+		check func(*milter.ReplayResult) bool
+	}{
+		{"campaign", "Subject: hi\r\n\r\nour offer\r\n", trashed},
+		{"other", "Subject: hi\r\nMIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=b\r\n\r\n" +
+			"--b\r\nContent-Type: text/plain\r\n\r\nnotes\r\n" +
+			"--b\r\nContent-Type: application/pdf\r\nContent-Disposition: attachment; filename=a.pdf\r\n\r\n%PDF\r\n--b--\r\n", passed},
+	}
+	for _, c := range cases {
+		if result := replay(env, c.raw); !c.check(result) {
+			t.Fatalf("%s: got %c %+v", c.name, result.Action.Code, result.Modifications)
+		}
+	}
+	if len(s.queueIDs) != 2 || s.queueIDs[0] != "4ABC003" || s.attachments != 1 {
+		t.Fatalf("unexpected lookups %+v", s)
+	}
+}
+
+type fakeHashBlocklist map[string]bool
+
+func (b fakeHashBlocklist) Blocked(f attachment.File) bool {
+	return b[f.MD5]
+}
+
+func TestFilterAttachment(t *testing.T) {
+	rules := []model.FilterRule{
+		{ID: 1, Priority: 2, Action: model.FilterActionReject, Assembly: `attach_hash_blocked==true`},
+		{ID: 2, Priority: 1, Action: model.FilterActionQuarantine, Assembly: `attach_executable==true;;attach_ext_mismatch==true`},
+	}
+	blocked := fakeHashBlocklist{}
+	replay := replayer(t, testEngine(t, rules), Options{Hashes: blocked}, 0, nil)
+
+	withAttachment := func(name string, data []byte) string {
+		return "Subject: files\r\nMIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=b\r\n\r\n" +
+			"--b\r\nContent-Type: text/plain\r\n\r\nsee attached\r\n" +
+			"--b\r\nContent-Type: application/octet-stream\r\nContent-Disposition: attachment; filename=" + name + "\r\n" +
+			"Content-Transfer-Encoding: base64\r\n\r\n" + base64.StdEncoding.EncodeToString(data) + "\r\n--b--\r\n"
+	}
+	exe := append([]byte("MZ"), make([]byte, 64)...)
+	sum := md5.Sum(exe)
+
+	cases := []struct {
+		name    string
+		blocked bool
+		raw     string
+		check   func(*milter.ReplayResult) bool
+	}{
+		// an executable disguised as a document is held by postfix
+		{"disguised", false, withAttachment("invoice.pdf", exe), func(r *milter.ReplayResult) bool {
+			return r.Action.Code == milter.ActAccept && len(r.Modifications) == 1 && r.Modifications[0].Value == "filter rule 2"
+		}},
+		{"blocked", true, withAttachment("invoice.pdf", exe), func(r *milter.ReplayResult) bool {
+			return r.Action.Code == milter.ActReject
+		}},
+		{"plain", true, withAttachment("notes.txt", []byte("meeting notes")), passed},
+	}
+	for _, c := range cases {
+		blocked[hex.EncodeToString(sum[:])] = c.blocked
+		if result := replay(testEnv, c.raw); !c.check(result) {
+			t.Fatalf("%s: got %c %+v", c.name, result.Action.Code, result.Modifications)
+		}
+	}
+}
+
+func TestFilterVirus(t *testing.T) {
+	const signature = "EICAR-STANDARD-ANTIVIRUS-TEST-FILE"
+	fake, err := clamd.NewFake(map[string]string{signature: "Win.Test.EICAR_HDB-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fake.Close()
+	rules := []model.FilterRule{
+		{ID: 1, Action: model.FilterActionReject, Assembly: `virus=="infected";;virus_name.HasPrefix("Win.")`},
+		{ID: 2, Action: model.FilterActionTrash, Assembly: `virus=="too_big"`},
+	}
+	e := testEngine(t, rules)
+	scanner := clamd.New(fake.Address())
+	replays := map[VirusFailMode]func(milter.Envelope, string) *milter.ReplayResult{
+		VirusFailOpen:   replayer(t, e, Options{Scanner: scanner, ScanFailMode: VirusFailOpen}, 0, nil),
+		VirusFailClosed: replayer(t, e, Options{Scanner: scanner, ScanFailMode: VirusFailClosed}, 0, nil),
+	}
+
+	clean := "Subject: hello\r\n\r\nhi\r\n"
+	cases := []struct {
+		name    string
+		maxSize int
+		down    bool
+		mode    VirusFailMode
+		raw     string
+		check   func(*milter.ReplayResult) bool
+	}{
+		// the signature is split over body chunks
+		{"infected", 0, false, VirusFailOpen, "Subject: hello\r\n\r\n" + strings.Repeat("a", 65530) + signature + "\r\n", func(r *milter.ReplayResult) bool {
+			return r.Stage == milter.CodeEOB && r.Action.Code == milter.ActReject
+		}},
+		{"clean", 0, false, VirusFailOpen, clean, passed},
+		// a message over the size limit is no failure, the rules decide on it
+		{"too big closed", 1024, false, VirusFailClosed, "Subject: hello\r\n\r\n" + strings.Repeat("a", 4096) + "\r\n", trashed},
+		// clamd is down, the message passes unless the filter fails closed
+		{"down open", 0, true, VirusFailOpen, clean, passed},
+		{"down closed", 0, true, VirusFailClosed, clean, func(r *milter.ReplayResult) bool {
+			return r.Action.Code == milter.ActReplyCode && r.Action.SMTPCode == 451
+		}},
+	}
+	for _, c := range cases {
+		if c.maxSize > 0 {
+			fake.SetMaxSize(c.maxSize)
+		}
+		if c.down {
+			_ = fake.Close()
+		}
+		if result := replays[c.mode](testEnv, c.raw); !c.check(result) {
+			t.Fatalf("%s: got %c %d at %c", c.name, result.Action.Code, result.Action.SMTPCode, result.Stage)
+		}
+	}
+}
+
+func TestParseVirusFailMode(t *testing.T) {
+	for s, want := range map[string]VirusFailMode{"": VirusFailOpen, "open": VirusFailOpen, "Closed": VirusFailClosed} {
+		if mode, err := ParseVirusFailMode(s); err != nil || mode != want {
+			t.Fatalf("%q: got %d %v", s, mode, err)
+		}
+	}
+	if _, err := ParseVirusFailMode("reject"); err == nil {
+		t.Fatal("expected an invalid mode")
+	}
+}
+
+func TestFilterURL(t *testing.T) {
+	rules := []model.FilterRule{
+		{ID: 1, Priority: 2, Action: model.FilterActionReject, Assembly: `url_mismatch==true`},
+		{ID: 2, Priority: 1, Action: model.FilterActionTrash, Assembly: `url_shortener==true;;url_domains.Contains("bit.ly")`},
+	}
+	replay := replayer(t, testEngine(t, rules), Options{}, 0, nil)
+
+	cases := []struct {
+		name  string
+		body  string
+		check func(*milter.ReplayResult) bool
+	}{
+		{"mismatch", `<a href="https://evil.example.net/">https://www.paypal.com/</a>`, func(r *milter.ReplayResult) bool {
+			return r.Action.Code == milter.ActReject
+		}},
+		{"shortener", `<a href="https://bit.ly/3abc">your invoice</a>`, trashed},
+		{"plain", `<a href="https://www.example.com/">example.com</a>`, passed},
+	}
+	for _, c := range cases {
+		raw := "Subject: account\r\nMIME-Version: 1.0\r\nContent-Type: text/html\r\n\r\n" + c.body + "\r\n"
+		if result := replay(testEnv, raw); !c.check(result) {
+			t.Fatalf("%s: got %c %+v", c.name, result.Action.Code, result.Modifications)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package filter
+
+import (
+	"net"
+	"sync"
+)
+
+// cidrs caches parsed networks, rules use the same few networks over and over
+var cidrs sync.Map
+
+// ruleFunctions are the helpers a condition can call, e.g. Func.InCIDR(feature.client_ip, "10.0.0.0/8")
+type ruleFunctions struct{}
+
+// InCIDR reports whether ip belongs to the network
+func (ruleFunctions) InCIDR(ip, cidr string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	v, ok := cidrs.Load(cidr)
+	if !ok {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return false
+		}
+		v, _ = cidrs.LoadOrStore(cidr, network)
+	}
+	return v.(*net.IPNet).Contains(addr)
+}
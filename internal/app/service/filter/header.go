@@ -0,0 +1,58 @@
+package filter
+
+import (
+	"easymail/internal/app/service/milter"
+	"net/textproto"
+	"strings"
+)
+
+// strippedHeader is a header of the sender which is removed at end of body
+type strippedHeader struct {
+	name  string
+	index int
+}
+
+/*
+countHeader numbers the headers of a name the way milter changes them, a
+header which only this filter may write is kept to be removed, e.g. the
+folder header the delivery agent trusts or authentication results in the
+name of this host.
+*/
+func (f *Filter) countHeader(name, value string, m *milter.Modifier) {
+	name = textproto.CanonicalMIMEHeaderKey(name)
+	if f.headerIndex == nil {
+		f.headerIndex = make(map[string]int)
+	}
+	f.headerIndex[name]++
+	if f.forged(name, value, m) {
+		f.stripped = append(f.stripped, strippedHeader{name: name, index: f.headerIndex[name]})
+	}
+}
+
+// forged reports a header the sender wrote in place of this filter, the folder
+// the policy service prepends is removed too, the same rules trash it again here
+func (f *Filter) forged(name, value string, m *milter.Modifier) bool {
+	switch name {
+	case FolderHeader:
+		return true
+	case "Authentication-Results":
+		// RFC 8601 section 5, results claiming our authserv-id are removed
+		id, _, _ := strings.Cut(value, ";")
+		fields := strings.Fields(id)
+		return len(fields) > 0 && strings.EqualFold(fields[0], authServID(m))
+	}
+	return false
+}
+
+// stripHeaders removes the forged headers, the last first so the index of the others does not move
+func (f *Filter) stripHeaders(m *milter.Modifier) {
+	if m == nil {
+		return
+	}
+	for i := len(f.stripped) - 1; i >= 0; i-- {
+		h := f.stripped[i]
+		if err := m.ChangeHeader(h.index, h.name, ""); err != nil {
+			f.logf("filter remove %s: %v", h.name, err)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package filter
+
+import (
+	"easymail/internal/easylog"
+	"easymail/internal/model"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	logQueueSize     = 10000
+	logBatchSize     = 100
+	logFlushInterval = time.Second
+)
+
+/*
+LogWriter persists filter logs in batches from a background goroutine, Write
+never blocks the SMTP transaction, logs are dropped when the queue is full.
+*/
+type LogWriter struct {
+	queue   chan model.FilterLog
+	dropped atomic.Int64
+	stopCh  chan struct{}
+	doneCh  chan struct{}
+	once    sync.Once
+	_log    *easylog.Logger
+
+	// save is replaced in tests
+	save func(logs []model.FilterLog) error
+}
+
+func NewLogWriter(_log *easylog.Logger) *LogWriter {
+	return &LogWriter{
+		queue:  make(chan model.FilterLog, logQueueSize),
+		stopCh: make(chan struct{}),
+		doneCh: make(chan struct{}),
+		_log:   _log,
+		save:   model.CreateFilterLogs,
+	}
+}
+
+// Write queues a log, it is safe to call on a nil writer
+func (w *LogWriter) Write(log model.FilterLog) {
+	if w == nil {
+		return
+	}
+	select {
+	case w.queue <- log:
+	default:
+		w.dropped.Add(1)
+	}
+}
+
+// Dropped returns how many logs were lost because the queue was full
+func (w *LogWriter) Dropped() int64 {
+	return w.dropped.Load()
+}
+
+func (w *LogWriter) Start() {
+	go w.run()
+}
+
+// Stop flushes the queued logs and waits for the writer to finish
+func (w *LogWriter) Stop() {
+	w.once.Do(func() {
+		close(w.stopCh)
+	})
+	<-w.doneCh
+}
+
+func (w *LogWriter) run() {
+	defer close(w.doneCh)
+	ticker := time.NewTicker(logFlushInterval)
+	defer ticker.Stop()
+	batch := make([]model.FilterLog, 0, logBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := w.save(batch); err != nil && w._log != nil {
+			w._log.Errorf("filter save %d logs: %v", len(batch), err)
+		}
+		batch = make([]model.FilterLog, 0, logBatchSize)
+	}
+	for {
+		select {
+		case log := <-w.queue:
+			batch = append(batch, log)
+			if len(batch) >= logBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-w.stopCh:
+			for {
+				select {
+				case log := <-w.queue:
+					batch = append(batch, log)
+					if len(batch) >= logBatchSize {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
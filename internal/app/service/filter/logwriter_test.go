@@ -0,0 +1,50 @@
+package filter
+
+import (
+	"easymail/internal/model"
+	"sync"
+	"testing"
+)
+
+func TestLogWriterBatches(t *testing.T) {
+	var lock sync.Mutex
+	batches := make([]int, 0)
+	w := NewLogWriter(nil)
+	w.save = func(logs []model.FilterLog) error {
+		lock.Lock()
+		defer lock.Unlock()
+		batches = append(batches, len(logs))
+		return nil
+	}
+	// logs queued before the writer starts are flushed in full batches
+	for i := 0; i < logBatchSize*2+1; i++ {
+		w.Write(model.FilterLog{QueueID: "q"})
+	}
+	w.Start()
+	w.Stop()
+
+	total := 0
+	for _, n := range batches {
+		if n > logBatchSize {
+			t.Fatalf("batch of %d logs exceeds %d", n, logBatchSize)
+		}
+		total += n
+	}
+	if total != logBatchSize*2+1 {
+		t.Fatalf("expected %d logs saved, got %d in %v", logBatchSize*2+1, total, batches)
+	}
+	// stop is idempotent
+	w.Stop()
+}
+
+func TestLogWriterDrops(t *testing.T) {
+	w := NewLogWriter(nil)
+	for i := 0; i < logQueueSize+3; i++ {
+		w.Write(model.FilterLog{})
+	}
+	if w.Dropped() != 3 {
+		t.Fatalf("expected 3 dropped logs, got %d", w.Dropped())
+	}
+	var nilWriter *LogWriter
+	nilWriter.Write(model.FilterLog{})
+}
@@ -0,0 +1,171 @@
+package filter
+
+import (
+	"context"
+	"easymail/internal/app/service/milter"
+	"easymail/internal/model"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	metricKeyPrefix = "filter:metric"
+	// metricTimeout bounds a metric update, a slow redis must not hold the mail
+	metricTimeout = time.Second
+)
+
+// metricStage is the stage both fields of a metric are available at
+func metricStage(m model.FilterMetric) model.FilterStage {
+	stage := fieldStage(m.PrimaryField)
+	if m.SecondaryFieldID > 0 {
+		if s := fieldStage(m.SecondaryField); s > stage {
+			stage = s
+		}
+	}
+	return stage
+}
+
+// fieldStage prefers the stage of a built-in feature over the configured one
+func fieldStage(f model.FilterField) model.FilterStage {
+	if s, ok := featureStages[f.Name]; ok {
+		return s
+	}
+	return f.Stage
+}
+
+// categoryOf maps the decision on a message to the category metrics are filtered by
+func categoryOf(action model.FilterAction) model.FilterCategory {
+	switch action {
+	case model.FilterActionAccept:
+		return model.FilterCategoryHam
+	case model.FilterActionTrash, model.FilterActionReject, model.FilterActionDiscard, model.FilterActionQuarantine:
+		return model.FilterCategorySpam
+	}
+	return model.FilterCategoryUnknown
+}
+
+/*
+metricCounter keeps sliding window counters in redis sorted sets, members are
+scored with the time they were seen and dropped when they leave the window.
+MetricOperationCount counts messages by primary and secondary value,
+MetricOperationCollect counts distinct secondary values by primary value.
+*/
+type metricCounter struct {
+	rc *redis.Client
+}
+
+func metricKey(m model.FilterMetric, primary, secondary string) string {
+	if m.Operation == model.MetricOperationCount && m.SecondaryFieldID > 0 {
+		return fmt.Sprintf("%s:%s:%s:%s", metricKeyPrefix, m.Name, primary, secondary)
+	}
+	return fmt.Sprintf("%s:%s:%s", metricKeyPrefix, m.Name, primary)
+}
+
+// metricValues returns the field values of the metric, ok is false when a field is missing
+func metricValues(m model.FilterMetric, features Features) (primary, secondary string, ok bool) {
+	primary = features[m.PrimaryField.Name].Value
+	if primary == "" {
+		return "", "", false
+	}
+	if m.SecondaryFieldID > 0 {
+		secondary = features[m.SecondaryField.Name].Value
+		if secondary == "" {
+			return "", "", false
+		}
+	}
+	return primary, secondary, true
+}
+
+// update records the message and returns the value in the window including it
+func (c *metricCounter) update(ctx context.Context, m model.FilterMetric, features Features, now time.Time) (int64, bool, error) {
+	primary, secondary, ok := metricValues(m, features)
+	if !ok {
+		return 0, false, nil
+	}
+	key := metricKey(m, primary, secondary)
+	window := m.MakeFilterMetricTimeout()
+	member := uuid.NewString()
+	if m.Operation == model.MetricOperationCollect {
+		// the same value only moves its score forward
+		member = secondary
+	}
+
+	pipe := c.rc.TxPipeline()
+	pipe.ZRemRangeByScore(ctx, key, "-inf", strconv.FormatInt(now.Add(-window).UnixMilli(), 10))
+	pipe.ZAdd(ctx, key, redis.Z{Score: float64(now.UnixMilli()), Member: member})
+	card := pipe.ZCard(ctx, key)
+	pipe.PExpire(ctx, key, window)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, false, err
+	}
+	return card.Val(), true, nil
+}
+
+// read returns the value in the window without recording the message
+func (c *metricCounter) read(ctx context.Context, m model.FilterMetric, features Features, now time.Time) (int64, bool, error) {
+	primary, secondary, ok := metricValues(m, features)
+	if !ok {
+		return 0, false, nil
+	}
+	key := metricKey(m, primary, secondary)
+	from := strconv.FormatInt(now.Add(-m.MakeFilterMetricTimeout()).UnixMilli(), 10)
+	v, err := c.rc.ZCount(ctx, key, "("+from, "+inf").Result()
+	if err != nil {
+		return 0, false, err
+	}
+	return v, true, nil
+}
+
+// collect injects the metrics of the stage as features, metrics of all
+// categories are updated right away, the others wait for the decision.
+func (c *metricCounter) collect(metrics []model.FilterMetric, features Features) ([]milter.Feature, error) {
+	if c == nil || len(metrics) == 0 {
+		return nil, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), metricTimeout)
+	defer cancel()
+	now := time.Now()
+	result := make([]milter.Feature, 0, len(metrics))
+	for _, m := range metrics {
+		var (
+			v   int64
+			ok  bool
+			err error
+		)
+		if m.Category == model.FilterCategoryAll {
+			v, ok, err = c.update(ctx, m, features, now)
+		} else {
+			v, ok, err = c.read(ctx, m, features, now)
+		}
+		if err != nil {
+			return result, fmt.Errorf("metric %s: %w", m.Name, err)
+		}
+		if ok {
+			result = append(result, intFeature(m.Name, v))
+		}
+	}
+	return result, nil
+}
+
+// record updates the metrics of the category once the message is decided
+func (c *metricCounter) record(metrics []model.FilterMetric, features Features, category model.FilterCategory) error {
+	if c == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), metricTimeout)
+	defer cancel()
+	now := time.Now()
+	for _, m := range metrics {
+		if m.Category != category {
+			continue
+		}
+		if _, _, err := c.update(ctx, m, features, now); err != nil {
+			return fmt.Errorf("metric %s: %w", m.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package filter
+
+import (
+	"context"
+	"easymail/internal/model"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestMetricStage(t *testing.T) {
+	ip := model.FilterField{ID: 1, Name: FeatureClientIP}
+	rcpt := model.FilterField{ID: 2, Name: FeatureRcpt}
+	custom := model.FilterField{ID: 3, Name: "custom", Stage: model.FilterStageHeader}
+	cases := []struct {
+		metric model.FilterMetric
+		stage  model.FilterStage
+	}{
+		{model.FilterMetric{PrimaryField: ip, PrimaryFieldID: 1}, model.FilterStageConnect},
+		{model.FilterMetric{PrimaryField: ip, PrimaryFieldID: 1, SecondaryField: rcpt, SecondaryFieldID: 2}, model.FilterStageRcptTo},
+		{model.FilterMetric{PrimaryField: ip, PrimaryFieldID: 1, SecondaryField: custom, SecondaryFieldID: 3}, model.FilterStageHeader},
+	}
+	for i, c := range cases {
+		if got := metricStage(c.metric); got != c.stage {
+			t.Fatalf("case %d: expected stage %d, got %d", i, c.stage, got)
+		}
+	}
+}
+
+func TestMetricCounter(t *testing.T) {
+	rc := redis.NewClient(&redis.Options{Addr: "127.0.0.1:6379"})
+	defer rc.Close()
+	ctx := context.Background()
+	if err := rc.Ping(ctx).Err(); err != nil {
+		t.Skip(err)
+	}
+	c := &metricCounter{rc: rc}
+	name := "test_ip_rcpt_" + time.Now().Format("150405.000000")
+	metric := model.FilterMetric{
+		Name:             name,
+		PrimaryField:     model.FilterField{ID: 1, Name: FeatureClientIP},
+		PrimaryFieldID:   1,
+		SecondaryField:   model.FilterField{ID: 2, Name: FeatureRcpt},
+		SecondaryFieldID: 2,
+		Operation:        model.MetricOperationCollect,
+		Unit:             model.MetricUnitMinute,
+		Interval:         1,
+	}
+	defer rc.Del(ctx, metricKey(metric, "192.0.2.1", ""))
+
+	features := make(Features)
+	features.Add(stringFeature(FeatureClientIP, "192.0.2.1"))
+	now := time.Now()
+	for i, rcpt := range []string{"a@example.com", "b@example.com", "a@example.com"} {
+		features.Add(stringFeature(FeatureRcpt, rcpt))
+		v, ok, err := c.update(ctx, metric, features, now.Add(time.Duration(i)*time.Second))
+		if err != nil || !ok {
+			t.Fatal(ok, err)
+		}
+		if want := []int64{1, 2, 2}[i]; v != want {
+			t.Fatalf("rcpt %d: expected %d distinct, got %d", i, want, v)
+		}
+	}
+	// values leave the window after a minute
+	v, _, err := c.read(ctx, metric, features, now.Add(61*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != 1 {
+		t.Fatalf("expected 1 value in the window, got %d", v)
+	}
+}
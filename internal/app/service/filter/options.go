@@ -0,0 +1,37 @@
+package filter
+
+/*
+Options are the optional checks of the filter, the server passes the same
+options to the filter of every connection. A check left nil is skipped and
+its features are missing, unless noted otherwise.
+*/
+type Options struct {
+	// Quarantine stores quarantined messages, postfix holds them when it is nil
+	Quarantine Quarantiner
+	// Greylist is asked for every recipient the rules passed, logged in clients are not greylisted
+	Greylist Greylister
+	// Blocklist looks the client and the linked domains up in DNS blocklists
+	Blocklist Blocklist
+	// SPF checks the policy of senders, e.g. NewSPFChecker
+	SPF     SPFChecker
+	SPFMode SPFMode
+	// DKIM fetches the keys of DKIM signatures, e.g. NewDKIMLookup
+	DKIM TXTLookup
+	// ARC fetches the keys of ARC chains, e.g. NewDKIMLookup
+	ARC TXTLookup
+	// Signer gives the keys mail of logged in clients is signed with, e.g. dkimkey.NewKeyring
+	Signer DKIMSigner
+	// DMARC evaluates the policy of the From domain once SPF and DKIM are known, e.g. dmarc.New
+	DMARC     DMARC
+	DMARCMode DMARCMode
+	// Bayes scores the content, e.g. bayes.New
+	Bayes Classifier
+	// Similarity compares the content with earlier messages, e.g. similarity.New
+	Similarity Similarity
+	// Hashes blocks attachments by hash, feature.attach_hash_blocked is false
+	// without it, e.g. attachment.NewHashList
+	Hashes HashBlocklist
+	// Scanner scans messages for viruses, ScanFailMode tells what happens when it fails, e.g. clamd.New
+	Scanner      VirusScanner
+	ScanFailMode VirusFailMode
+}
@@ -0,0 +1,198 @@
+package filter
+
+import (
+	"easymail/internal/easylog"
+	"easymail/internal/model"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultReloadInterval = 30 * time.Second
+
+// ReloadStatus is the outcome of the last rule reload, it is shown to the admin
+type ReloadStatus struct {
+	Time time.Time `json:"time"`
+	// RuleTime is the latest update_time of the rules and metrics in use
+	RuleTime time.Time        `json:"rule_time"`
+	Rules    int              `json:"rules"`
+	Skipped  map[int64]string `json:"skipped"`
+	// Error is set when the last reload failed, the previous rules are still in use
+	Error       string           `json:"error"`
+	BrokenRules map[int64]string `json:"broken_rules"`
+}
+
+var (
+	// lastReload is read by the admin, there is one filter server per process
+	lastReload atomic.Pointer[ReloadStatus]
+	// reloadSignal asks the running reloader to check the rules now
+	reloadSignal = make(chan struct{}, 1)
+)
+
+// LastReload returns the status of the last rule reload, nil before the first one
+func LastReload() *ReloadStatus {
+	return lastReload.Load()
+}
+
+// SignalReload asks the filter to check the rules without waiting for the next poll
+func SignalReload() {
+	select {
+	case reloadSignal <- struct{}{}:
+	default:
+	}
+}
+
+/*
+Reloader polls the update time of the filter rules and metrics, rebuilds the
+engine in the background and swaps it atomically. Sessions keep the engine
+they started with, a rule set that does not compile never replaces a working
+one.
+*/
+type Reloader struct {
+	interval time.Duration
+	current  atomic.Pointer[Engine]
+	// ruleTime is the update time the current engine was built from
+	ruleTime time.Time
+	lock     *sync.Mutex
+	stopCh   chan struct{}
+	doneCh   chan struct{}
+	_log     *easylog.Logger
+
+	// lastTime and load are replaced in tests
+	lastTime func() (time.Time, error)
+	load     func() (*Engine, error)
+}
+
+func NewReloader(interval time.Duration, _log *easylog.Logger) *Reloader {
+	if interval <= 0 {
+		interval = defaultReloadInterval
+	}
+	return &Reloader{
+		interval: interval,
+		lock:     &sync.Mutex{},
+		_log:     _log,
+		lastTime: lastChange,
+		load:     LoadEngine,
+	}
+}
+
+// lastChange returns the latest change of rules and metrics
+func lastChange() (time.Time, error) {
+	last, err := model.GetLastTimeOfRule()
+	if err != nil {
+		return time.Time{}, err
+	}
+	metric, err := model.GetLastTimeOfFilterMetric()
+	if err != nil {
+		return time.Time{}, err
+	}
+	if metric.After(last) {
+		last = metric
+	}
+	return last, nil
+}
+
+// Engine returns the engine new sessions are started with, nil if rules never loaded
+func (r *Reloader) Engine() *Engine {
+	return r.current.Load()
+}
+
+// Reload rebuilds the engine when the rules changed since the last build,
+// force rebuilds it anyway.
+func (r *Reloader) Reload(force bool) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	last, err := r.lastTime()
+	if err != nil {
+		return fmt.Errorf("filter rule time: %w", err)
+	}
+	if !force && r.current.Load() != nil && !last.After(r.ruleTime) {
+		return nil
+	}
+
+	status := &ReloadStatus{Time: time.Now(), RuleTime: r.ruleTime}
+	e, err := r.load()
+	if err == nil {
+		err = e.Validate()
+	}
+	if err != nil {
+		status.Error = err.Error()
+		var buildErr *BuildError
+		if errors.As(err, &buildErr) {
+			status.BrokenRules = make(map[int64]string, len(buildErr.Rules))
+			for id, ruleErr := range buildErr.Rules {
+				status.BrokenRules[id] = ruleErr.Error()
+			}
+		}
+		if current := r.current.Load(); current != nil {
+			status.Rules = current.Rules()
+		}
+		lastReload.Store(status)
+		// the failed update time is remembered, it is not rebuilt until rules change again
+		r.ruleTime = last
+		return err
+	}
+
+	r.current.Store(e)
+	r.ruleTime = last
+	status.RuleTime = last
+	status.Rules = e.Rules()
+	status.Skipped = make(map[int64]string, len(e.Skipped()))
+	for id, skipErr := range e.Skipped() {
+		status.Skipped[id] = skipErr.Error()
+	}
+	lastReload.Store(status)
+	return nil
+}
+
+func (r *Reloader) Start() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.stopCh != nil {
+		return
+	}
+	r.stopCh = make(chan struct{})
+	r.doneCh = make(chan struct{})
+	go r.run(r.stopCh, r.doneCh)
+}
+
+func (r *Reloader) Stop() {
+	r.lock.Lock()
+	stopCh, doneCh := r.stopCh, r.doneCh
+	r.stopCh, r.doneCh = nil, nil
+	r.lock.Unlock()
+	if stopCh == nil {
+		return
+	}
+	close(stopCh)
+	<-doneCh
+}
+
+func (r *Reloader) run(stopCh, doneCh chan struct{}) {
+	defer close(doneCh)
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		force := false
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		case <-reloadSignal:
+			force = true
+		}
+		before := r.Engine()
+		if err := r.Reload(force); err != nil {
+			if r._log != nil {
+				r._log.Errorf("filter reload rules: %v", err)
+			}
+			continue
+		}
+		if e := r.Engine(); e != before && r._log != nil {
+			r._log.Infof("filter reloaded %d rules", e.Rules())
+		}
+	}
+}
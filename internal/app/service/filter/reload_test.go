@@ -0,0 +1,77 @@
+package filter
+
+import (
+	"easymail/internal/model"
+	"testing"
+	"time"
+)
+
+func TestReloaderKeepsEngineOnBrokenRules(t *testing.T) {
+	ruleTime := time.Date(2026, 10, 18, 8, 0, 0, 0, time.UTC)
+	rules := []model.FilterRule{
+		{ID: 1, Action: model.FilterActionReject, Assembly: `subject.Contains("spam")`},
+	}
+	loads := 0
+	r := NewReloader(time.Hour, nil)
+	r.lastTime = func() (time.Time, error) { return ruleTime, nil }
+	r.load = func() (*Engine, error) {
+		loads++
+		return NewEngine(rules, nil, nil)
+	}
+
+	if err := r.Reload(false); err != nil {
+		t.Fatal(err)
+	}
+	first := r.Engine()
+	if first == nil || first.Rules() != 1 {
+		t.Fatalf("unexpected engine %+v", first)
+	}
+	// rules did not change, nothing is rebuilt
+	if err := r.Reload(false); err != nil || loads != 1 {
+		t.Fatalf("expected no rebuild, got %d loads, err %v", loads, err)
+	}
+
+	ruleTime = ruleTime.Add(time.Minute)
+	rules = append(rules, model.FilterRule{ID: 2, Action: model.FilterActionReject, Assembly: `subject.Contains("spam"`})
+	if err := r.Reload(false); err == nil {
+		t.Fatal("expected compile error")
+	}
+	if r.Engine() != first {
+		t.Fatal("broken rules replaced the engine")
+	}
+	status := LastReload()
+	if status == nil || status.Error == "" || status.BrokenRules[2] == "" || status.Rules != 1 {
+		t.Fatalf("unexpected status %+v", status)
+	}
+
+	ruleTime = ruleTime.Add(time.Minute)
+	rules[1].Assembly = `subject.Contains("spam")`
+	if err := r.Reload(false); err != nil {
+		t.Fatal(err)
+	}
+	if r.Engine() == first || r.Engine().Rules() != 2 {
+		t.Fatal("fixed rules were not loaded")
+	}
+	if status = LastReload(); status.Error != "" || !status.RuleTime.Equal(ruleTime) {
+		t.Fatalf("unexpected status %+v", status)
+	}
+}
+
+func TestReloaderSignal(t *testing.T) {
+	loaded := make(chan struct{}, 1)
+	r := NewReloader(time.Hour, nil)
+	r.lastTime = func() (time.Time, error) { return time.Time{}, nil }
+	r.load = func() (*Engine, error) {
+		loaded <- struct{}{}
+		return NewEngine(nil, nil, nil)
+	}
+	r.Start()
+	defer r.Stop()
+
+	SignalReload()
+	select {
+	case <-loaded:
+	case <-time.After(time.Second):
+		t.Fatal("signal did not reload the rules")
+	}
+}
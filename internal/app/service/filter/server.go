@@ -0,0 +1,147 @@
+package filter
+
+import (
+	"easymail/internal/app/service/milter"
+	"easymail/internal/easylog"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// actions the filter may perform at end of body
+const filterActions = milter.OptAddHeader | milter.OptChangeHeader | milter.OptQuarantine
+
+/*
+Server filter server, postfix hands every message over as a milter and the
+filter rules decide what happens to it.
+*/
+type Server struct {
+	name    string
+	family  string
+	listen  string
+	debug   bool
+	lock    *sync.Mutex
+	started bool
+	_log    *easylog.Logger
+
+	reloadInterval time.Duration
+	reloader       *Reloader
+	logs           *LogWriter
+	opts           Options
+	milter         *milter.Server
+
+	// rc counts the metrics of the rules, they are left out without it
+	rc *redis.Client
+}
+
+func New(family, listen string) *Server {
+	s := &Server{
+		name:   "filter",
+		family: family,
+		listen: listen,
+		lock:   &sync.Mutex{},
+	}
+	s.milter = milter.New(family, listen, s.newMilter)
+	if s.milter == nil {
+		return nil
+	}
+	s.milter.SetErrorHandler(func(err error) {
+		if s._log != nil {
+			s._log.Errorf("%s: %v", s.name, err)
+		}
+	})
+	return s
+}
+
+func (s *Server) SetDebug(debug bool) {
+	s.debug = debug
+}
+
+func (s *Server) SetLogger(_log *easylog.Logger) error {
+	if _log == nil {
+		return fmt.Errorf("%s logger is nil", s.name)
+	}
+	s._log = _log
+	return nil
+}
+
+// SetReloadInterval sets how often the rules are checked for changes
+func (s *Server) SetReloadInterval(interval time.Duration) {
+	s.reloadInterval = interval
+}
+
+// SetRedis sets where the metrics of the rules are counted, before Start
+func (s *Server) SetRedis(rc *redis.Client) {
+	s.rc = rc
+}
+
+// SetOptions sets the optional checks of the filter, before Start
+func (s *Server) SetOptions(opts Options) {
+	s.opts = opts
+}
+
+// newMilter initializes the filter of one postfix connection, the connection
+// keeps the engine it started with when rules are reloaded.
+func (s *Server) newMilter() (milter.Milter, milter.OptAction, milter.OptProtocol) {
+	f := NewFilter(s.reloader.Engine(), s.rc, s._log, s.opts)
+	f.SetLogWriter(s.logs)
+	// headers are verified as they were signed, with the space after the colon
+	return f, filterActions, milter.OptHeaderLeadingSpace
+}
+
+func (s *Server) Start() error {
+	if s._log == nil {
+		return fmt.Errorf("%s logger is nil", s.name)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.started {
+		return fmt.Errorf("%s server already started", s.name)
+	}
+
+	s.reloader = NewReloader(s.reloadInterval, s._log)
+	// broken rules do not stop the server, mail passes until they are fixed
+	if err := s.reloader.Reload(true); err != nil {
+		s._log.Errorf("%s load rules: %v", s.name, err)
+	}
+	if e := s.reloader.Engine(); e != nil {
+		for id, err := range e.Skipped() {
+			s._log.Warnf("%s skip rule %d: %v", s.name, id, err)
+		}
+	}
+
+	s.logs = NewLogWriter(s._log)
+	s.logs.Start()
+	if err := s.milter.Start(); err != nil {
+		s.logs.Stop()
+		return err
+	}
+	s.reloader.Start()
+	s.started = true
+	s._log.Infof("%s server started!", s.name)
+	return nil
+}
+
+func (s *Server) Stop() error {
+	s.lock.Lock()
+	if !s.started {
+		s.lock.Unlock()
+		return fmt.Errorf("%s server not started", s.name)
+	}
+	s.started = false
+	s.lock.Unlock()
+
+	s.reloader.Stop()
+	err := s.milter.Stop()
+	// sessions are done, the last logs are flushed
+	s.logs.Stop()
+	s._log.Infof("%s server stopped!", s.name)
+	return err
+}
+
+func (s *Server) Name() string {
+	return s.name
+}
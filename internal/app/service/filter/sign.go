@@ -0,0 +1,87 @@
+package filter
+
+import (
+	"easymail/internal/app/service/milter"
+	"easymail/internal/app/service/milter/third_party/dkim"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// DKIMSigner gives the options signing mail of a domain, nil for domains without a key
+type DKIMSigner interface {
+	SignOptions(domain string) (*dkim.SignOptions, error)
+}
+
+// signingDomain is the domain of the From header, the sender domain when it has none
+func (f *Filter) signingDomain(h textproto.MIMEHeader) string {
+	if addr, err := mail.ParseAddress(headerGet(h, "From")); err == nil {
+		if i := strings.LastIndex(addr.Address, "@"); i >= 0 {
+			return strings.ToLower(addr.Address[i+1:])
+		}
+	}
+	return f.features[FeatureSenderDomain].Value
+}
+
+// startSigning starts signing a message of a logged in client when its domain
+// has a key, the body is streamed into the signer as it arrives.
+func (f *Filter) startSigning(h textproto.MIMEHeader) {
+	if f.opts.Signer == nil || f.features[FeatureSaslUsername].Value == "" {
+		return
+	}
+	domain := f.signingDomain(h)
+	if domain == "" {
+		return
+	}
+	options, err := f.opts.Signer.SignOptions(domain)
+	if err != nil {
+		f.logf("filter dkim key of %s: %v", domain, err)
+		return
+	}
+	if options == nil {
+		return
+	}
+	if f.dkimSigner, err = dkim.NewSigner(options); err != nil {
+		f.logf("filter dkim signer of %s: %v", domain, err)
+		return
+	}
+	f.writeSigner(f.header.Bytes())
+	f.writeSigner([]byte("\r\n"))
+}
+
+func (f *Filter) writeSigner(p []byte) {
+	if f.dkimSigner == nil {
+		return
+	}
+	if _, err := f.dkimSigner.Write(p); err != nil {
+		f.logf("filter dkim sign: %v", err)
+		_ = f.dkimSigner.Close()
+		f.dkimSigner = nil
+	}
+}
+
+// stopSigning drops the signer of an aborted or refused message
+func (f *Filter) stopSigning() {
+	if f.dkimSigner != nil {
+		_ = f.dkimSigner.Close()
+		f.dkimSigner = nil
+	}
+}
+
+// addSignature puts the DKIM-Signature on top of the headers, a message
+// which can not be signed goes out unsigned.
+func (f *Filter) addSignature(m *milter.Modifier) {
+	s := f.dkimSigner
+	f.dkimSigner = nil
+	if s == nil || m == nil {
+		return
+	}
+	if err := s.Close(); err != nil {
+		f.logf("filter dkim sign: %v", err)
+		return
+	}
+	name, value, _ := strings.Cut(strings.TrimSuffix(s.Signature(), "\r\n"), ":")
+	if err := m.InsertHeader(0, name, strings.TrimLeft(value, " ")); err != nil {
+		f.logf("filter dkim signature: %v", err)
+	}
+}
@@ -0,0 +1,38 @@
+package filter
+
+import (
+	"easymail/internal/app/service/milter"
+	"easymail/internal/app/service/similarity"
+	"strings"
+
+	"github.com/jhillyerd/enmime"
+)
+
+// Similarity compares messages with the earlier ones by fuzzy hashes, *similarity.Index implements it
+type Similarity interface {
+	// Match scores the message and stores it under sessionID, the postfix queue id
+	Match(sessionID, text string, attachments [][]byte) (similarity.Match, error)
+}
+
+// similar gives the best similarity of the body and the attachments to earlier
+// messages and the queue ids of those similar enough, e.g. of a campaign. The
+// text of html only messages is converted by enmime.
+func (f *Filter) similar(env *enmime.Envelope, queueID string) []milter.Feature {
+	if f.opts.Similarity == nil {
+		return nil
+	}
+	attachments := make([][]byte, 0, len(env.Attachments))
+	for _, a := range env.Attachments {
+		attachments = append(attachments, a.Content)
+	}
+	match, err := f.opts.Similarity.Match(queueID, env.Text, attachments)
+	if err != nil {
+		// the scores of the parts which were compared are still valid
+		f.logf("filter similarity: %v", err)
+	}
+	return []milter.Feature{
+		intFeature(FeatureBodySimilarityMax, int64(match.BodyMax)),
+		intFeature(FeatureAttachSimilarityMax, int64(match.AttachMax)),
+		stringFeature(FeatureSimilarSessions, strings.Join(match.Sessions, ";")),
+	}
+}
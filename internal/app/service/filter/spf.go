@@ -0,0 +1,160 @@
+package filter
+
+import (
+	"easymail/internal/app/service/milter"
+	"easymail/internal/app/service/milter/third_party/spf"
+	"easymail/internal/easydns"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// SPFMode tells what the filter does with the SPF result of the sender
+type SPFMode uint8
+
+const (
+	// SPFOff skips the check, the spf feature stays empty
+	SPFOff SPFMode = iota
+	// SPFHeader gives the result to the rules and records it in the headers
+	SPFHeader
+	// SPFReject also rejects a fail at MAIL FROM unless a rule accepted the message
+	SPFReject
+)
+
+// ParseSPFMode parses the mode of the filter configuration, empty is off
+func ParseSPFMode(s string) (SPFMode, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "off":
+		return SPFOff, nil
+	case "header":
+		return SPFHeader, nil
+	case "reject":
+		return SPFReject, nil
+	}
+	return SPFOff, fmt.Errorf("invalid spf mode %q", s)
+}
+
+// SPFChecker evaluates the SPF policy of the sender, or of the helo name for bounces
+type SPFChecker interface {
+	CheckHost(ip net.IP, helo, sender string) (spf.Result, error)
+}
+
+type resolverSPF struct {
+	resolver *easydns.Resolver
+}
+
+// NewSPFChecker returns a checker querying the project resolver
+func NewSPFChecker() SPFChecker {
+	return resolverSPF{resolver: easydns.CreateDefaultResolver()}
+}
+
+func (r resolverSPF) CheckHost(ip net.IP, helo, sender string) (spf.Result, error) {
+	return spf.CheckHostWithSender(r.resolver, ip, helo, sender)
+}
+
+// spfIdentity is what SPF checked, the helo name stands in for the null sender
+func spfIdentity(helo, sender string) (identity, value string) {
+	if strings.Contains(sender, "@") {
+		return "mailfrom", sender
+	}
+	return "helo", helo
+}
+
+// checkSPF runs the check of the sender, logged in clients are not checked. The
+// result is recorded for the headers and the rules.
+func (f *Filter) checkSPF(sender, login string) []milter.Feature {
+	if f.opts.SPF == nil || f.opts.SPFMode == SPFOff || login != "" {
+		return nil
+	}
+	ip := net.ParseIP(f.features[FeatureClientIP].Value)
+	if ip == nil {
+		return nil
+	}
+	helo := f.features[FeatureHelo].Value
+	result, err := f.opts.SPF.CheckHost(ip, helo, sender)
+	if err != nil && (result == spf.TempError || result == spf.PermError) {
+		f.logf("filter spf of %s: %v", sender, err)
+	}
+	identity, value := spfIdentity(helo, sender)
+	f.receivedSPF = receivedSPF(result, ip, helo, sender, identity, value)
+	f.authResults = append(f.authResults, fmt.Sprintf("spf=%s smtp.%s=%s", result, identity, headerValue(value)))
+	return []milter.Feature{stringFeature(FeatureSPF, string(result))}
+}
+
+// spfPassed tells whether the envelope sender passed, a pass of the helo name does not vouch for it
+func (f *Filter) spfPassed() bool {
+	return f.features[FeatureSPF].Value == string(spf.Pass) && strings.Contains(f.features[FeatureSender].Value, "@")
+}
+
+// spfRejected answers a fail in reject mode, resp is what the rules decided
+func (f *Filter) spfRejected(resp milter.Response) milter.Response {
+	if resp != milter.RespContinue || f.opts.SPFMode != SPFReject || f.features[FeatureSPF].Value != string(spf.Fail) {
+		return resp
+	}
+	return milter.NewResponseStr(byte(milter.ActReplyCode), "550 5.7.23 SPF validation failed")
+}
+
+// receivedSPF builds the Received-SPF header of RFC 7208 section 9.1
+func receivedSPF(result spf.Result, ip net.IP, helo, sender, identity, value string) string {
+	domain := value
+	if i := strings.LastIndex(value, "@"); i >= 0 {
+		domain = value[i+1:]
+	}
+	var comment string
+	switch result {
+	case spf.Pass:
+		comment = fmt.Sprintf("domain of %s designates %s as permitted sender", value, ip)
+	case spf.Fail:
+		comment = fmt.Sprintf("domain of %s does not designate %s as permitted sender", value, ip)
+	case spf.SoftFail:
+		comment = fmt.Sprintf("domain of transitioning %s does not designate %s as permitted sender", value, ip)
+	case spf.Neutral:
+		comment = fmt.Sprintf("%s is neither permitted nor denied by domain of %s", ip, value)
+	case spf.None:
+		comment = fmt.Sprintf("domain %s does not designate permitted sender hosts", domain)
+	default:
+		comment = fmt.Sprintf("error in processing during lookup of %s", domain)
+	}
+	return fmt.Sprintf("%s (%s) client-ip=%s; envelope-from=\"%s\"; helo=%s; identity=%s;",
+		result, headerValue(comment), ip, headerValue(sender), headerValue(helo), identity)
+}
+
+// headerValue drops what would break out of a header field or a quoted string
+func headerValue(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '\r', '\n', '"', '\\', '(', ')', ';':
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// authServID identifies this host in Authentication-Results, postfix sends its name as macro j
+func authServID(m *milter.Modifier) string {
+	if m != nil && m.Macros["j"] != "" {
+		return m.Macros["j"]
+	}
+	host, _ := os.Hostname()
+	return host
+}
+
+// addAuthHeaders records the authentication results of the message on top of
+// its headers, the ones the sender wrote in our name were stripped before
+func (f *Filter) addAuthHeaders(m *milter.Modifier) {
+	if m == nil || (f.receivedSPF == "" && len(f.authResults) == 0) {
+		return
+	}
+	if f.receivedSPF != "" {
+		if err := m.InsertHeader(0, "Received-SPF", f.receivedSPF); err != nil {
+			f.logf("filter received-spf: %v", err)
+		}
+	}
+	if len(f.authResults) > 0 {
+		value := authServID(m) + ";\r\n\t" + strings.Join(f.authResults, ";\r\n\t")
+		if err := m.InsertHeader(0, "Authentication-Results", value); err != nil {
+			f.logf("filter authentication-results: %v", err)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package filter
+
+import (
+	"easymail/internal/app/service/links"
+	"easymail/internal/app/service/milter"
+	"strings"
+)
+
+// urlFeatures gives the features of the links of a message, lists are joined
+// by ; like attach_name, flags are set when any link has them.
+func urlFeatures(found []links.Link) []milter.Feature {
+	urls := make([]string, 0, len(found))
+	domains := make([]string, 0)
+	seen := make(map[string]bool)
+	var mismatch, ip, shortener, redirect, obfuscated bool
+	for _, l := range found {
+		urls = append(urls, l.URL)
+		if !seen[l.Domain] {
+			seen[l.Domain] = true
+			domains = append(domains, l.Domain)
+		}
+		mismatch = mismatch || l.Mismatch
+		ip = ip || l.IP
+		shortener = shortener || l.Shortener
+		redirect = redirect || l.Source == links.SourceRedirect
+		obfuscated = obfuscated || l.Obfuscated
+	}
+	return []milter.Feature{
+		stringFeature(FeatureURL, strings.Join(urls, ";")),
+		intFeature(FeatureURLCount, int64(len(urls))),
+		stringFeature(FeatureURLDomains, strings.Join(domains, ";")),
+		intFeature(FeatureURLDomainCount, int64(len(domains))),
+		boolFeature(FeatureURLMismatch, mismatch),
+		boolFeature(FeatureURLIP, ip),
+		boolFeature(FeatureURLShortener, shortener),
+		boolFeature(FeatureURLRedirect, redirect),
+		boolFeature(FeatureURLObfuscated, obfuscated),
+	}
+}
@@ -0,0 +1,133 @@
+package filter
+
+import (
+	"easymail/internal/app/service/clamd"
+	"easymail/internal/app/service/milter"
+	"easymail/internal/model"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// virusTimeout bounds the wait for the verdict at end of body
+const virusTimeout = time.Minute
+
+var errVirusAborted = errors.New("virus scan: message aborted")
+
+// VirusScanner scans a message while it is read, *clamd.Client implements it
+type VirusScanner interface {
+	Scan(r io.Reader) (clamd.Result, error)
+}
+
+// VirusFailMode tells what happens to a message the scanner failed on, a
+// message over the size limit of clamd is no failure, it is passed on with
+// feature.virus=="too_big" in both modes.
+type VirusFailMode uint8
+
+const (
+	// VirusFailOpen passes the message on, rules see feature.virus=="error"
+	VirusFailOpen VirusFailMode = iota
+	// VirusFailClosed defers the message unless a rule decided on it
+	VirusFailClosed
+)
+
+// ParseVirusFailMode parses the mode of the filter configuration, empty is open
+func ParseVirusFailMode(s string) (VirusFailMode, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "open":
+		return VirusFailOpen, nil
+	case "closed":
+		return VirusFailClosed, nil
+	}
+	return VirusFailOpen, fmt.Errorf("invalid virus fail mode %q", s)
+}
+
+// virusOutcome is what the scanner of a message returns
+type virusOutcome struct {
+	result clamd.Result
+	err    error
+}
+
+// startScan starts the scan of a message, the header is streamed into it at
+// once and the body chunk by chunk as it arrives.
+func (f *Filter) startScan() {
+	if f.opts.Scanner == nil {
+		return
+	}
+	pr, pw := io.Pipe()
+	done := make(chan virusOutcome, 1)
+	scanner := f.opts.Scanner
+	go func() {
+		result, err := scanner.Scan(pr)
+		// the scanner may stop before the end, the writer must not block
+		_, _ = io.Copy(io.Discard, pr)
+		done <- virusOutcome{result, err}
+	}()
+	f.scanWriter, f.scanDone = pw, done
+	f.writeScan(f.header.Bytes())
+	f.writeScan([]byte("\r\n"))
+}
+
+func (f *Filter) writeScan(p []byte) {
+	if f.scanWriter == nil {
+		return
+	}
+	if _, err := f.scanWriter.Write(p); err != nil {
+		f.logf("filter virus scan: %v", err)
+		f.scanWriter = nil
+	}
+}
+
+// stopScan drops a running scan, e.g. when the message is aborted
+func (f *Filter) stopScan() {
+	if f.scanWriter != nil {
+		_ = f.scanWriter.CloseWithError(errVirusAborted)
+	}
+	f.scanWriter, f.scanDone, f.scanFailed = nil, nil, false
+}
+
+// finishScan waits for the verdict, feature.virus is clean, infected, too_big
+// or error
+func (f *Filter) finishScan() []milter.Feature {
+	if f.scanDone == nil {
+		return nil
+	}
+	if f.scanWriter != nil {
+		_ = f.scanWriter.Close()
+	}
+	var outcome virusOutcome
+	select {
+	case outcome = <-f.scanDone:
+	case <-time.After(virusTimeout):
+		outcome.err = errors.New("virus scan timed out")
+	}
+	f.scanWriter, f.scanDone = nil, nil
+	if errors.Is(outcome.err, clamd.ErrSizeLimit) {
+		// a retry is just as big, the rules decide on it
+		return []milter.Feature{stringFeature(FeatureVirus, "too_big")}
+	}
+	if outcome.err != nil {
+		f.logf("filter virus scan: %v", outcome.err)
+		f.scanFailed = true
+		return []milter.Feature{stringFeature(FeatureVirus, "error")}
+	}
+	if outcome.result.Infected {
+		return []milter.Feature{
+			stringFeature(FeatureVirus, "infected"),
+			stringFeature(FeatureVirusName, outcome.result.Virus),
+		}
+	}
+	return []milter.Feature{stringFeature(FeatureVirus, "clean")}
+}
+
+// scanFailClosed defers a message the scanner failed on in fail closed
+// mode, a decision of the rules is kept.
+func (f *Filter) scanFailClosed(resp milter.Response, m *milter.Modifier) milter.Response {
+	if resp != milter.RespContinue || !f.scanFailed || f.opts.ScanFailMode != VirusFailClosed {
+		return resp
+	}
+	f.finish(model.FilterStageData, &Result{Action: int64(model.FilterActionDefer)}, m)
+	return milter.NewResponseStr(byte(milter.ActReplyCode), "451 4.7.1 Virus scan failed, please try again later")
+}
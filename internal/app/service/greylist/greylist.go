@@ -0,0 +1,242 @@
+package greylist
+
+import (
+	"context"
+	"easymail/internal/app/service/policy"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	keyPrefix = "greylist"
+	// passed marks a triplet that retried in time
+	passed = "pass"
+	// reloadInterval is how long loaded settings are used before they are read again
+	reloadInterval = time.Minute
+)
+
+// Triplet identifies a delivery attempt, the client by its network
+type Triplet struct {
+	IP     net.IP
+	Sender string
+	Rcpt   string
+}
+
+// network is the client network, mail farms retry from another address of it
+func (t Triplet) network() string {
+	if ip := t.IP.To4(); ip != nil {
+		return ip.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return t.IP.Mask(net.CIDRMask(64, 128)).String()
+}
+
+// sender is the lower case sender, bounces have the null sender
+func (t Triplet) sender() string {
+	if t.Sender == "" {
+		return "<>"
+	}
+	return strings.ToLower(t.Sender)
+}
+
+func (t Triplet) key() string {
+	return fmt.Sprintf("%s:triplet:%s:%s:%s", keyPrefix, t.network(), t.sender(), strings.ToLower(t.Rcpt))
+}
+
+// whitelistKey is the key of the sender at the client network
+func (t Triplet) whitelistKey() string {
+	return fmt.Sprintf("%s:whitelist:%s:%s", keyPrefix, t.network(), t.sender())
+}
+
+// reasons a triplet passed or was deferred
+const (
+	ReasonExempt      = "exempt"
+	ReasonWhitelisted = "whitelisted"
+	ReasonPassed      = "passed"
+	ReasonRetried     = "retried"
+	ReasonNew         = "new"
+	ReasonEarly       = "early"
+)
+
+// Result is the decision on a triplet, Wait is how long a deferred one has to wait
+type Result struct {
+	Pass   bool
+	Wait   time.Duration
+	Reason string
+}
+
+/*
+Greylist defers the first attempt of every client network, sender and
+recipient triplet, a retry after the delay and within the window passes the
+triplet and whitelists the sender at that network. Senders are also
+whitelisted by Whitelist, e.g. after passing SPF or DKIM.
+*/
+type Greylist struct {
+	rc   *redis.Client
+	load func() (*Settings, error)
+	now  func() time.Time
+	logf func(format string, args ...any)
+
+	lock     sync.Mutex
+	settings *Settings
+	loaded   time.Time
+}
+
+// New creates a greylist kept in redis with the settings of the configure tree
+func New(rc *redis.Client) *Greylist {
+	return &Greylist{
+		rc:   rc,
+		load: LoadSettings,
+		now:  time.Now,
+	}
+}
+
+// SetLogf sets where broken settings are reported
+func (g *Greylist) SetLogf(logf func(format string, args ...any)) {
+	g.logf = logf
+}
+
+// SetSettings uses fixed settings instead of the configure tree
+func (g *Greylist) SetSettings(s *Settings) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.load = nil
+	g.settings = s
+}
+
+// Settings returns the current settings, they are read again once a minute
+func (g *Greylist) Settings() *Settings {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.load == nil || (g.settings != nil && g.now().Sub(g.loaded) < reloadInterval) {
+		return g.settings
+	}
+	s, err := g.load()
+	if err != nil && g.logf != nil {
+		g.logf("greylist settings: %v", err)
+	}
+	// the last settings are kept when the database is not reachable
+	if s != nil && (err == nil || g.settings == nil) {
+		g.settings = s
+	}
+	g.loaded = g.now()
+	return g.settings
+}
+
+// Check decides on a triplet, a new triplet is recorded and deferred
+func (g *Greylist) Check(ctx context.Context, t Triplet) (Result, error) {
+	s := g.Settings()
+	if s == nil {
+		s = NewSettings()
+	}
+	if t.IP == nil || s.exempt(t) {
+		return Result{Pass: true, Reason: ReasonExempt}, nil
+	}
+	if g.rc == nil {
+		return Result{Pass: true}, errors.New("greylist redis is not available")
+	}
+
+	whitelisted, err := g.rc.Expire(ctx, t.whitelistKey(), s.Expire).Result()
+	if err != nil {
+		return Result{Pass: true}, err
+	}
+	if whitelisted {
+		return Result{Pass: true, Reason: ReasonWhitelisted}, nil
+	}
+
+	now := g.now()
+	key := t.key()
+	created, err := g.rc.SetNX(ctx, key, now.Unix(), s.Window).Result()
+	if err != nil {
+		return Result{Pass: true}, err
+	}
+	if created {
+		return Result{Wait: s.Delay, Reason: ReasonNew}, nil
+	}
+	value, err := g.rc.Get(ctx, key).Result()
+	if errors.Is(err, redis.Nil) {
+		// the window closed right now, the next attempt starts over
+		return Result{Wait: s.Delay, Reason: ReasonNew}, nil
+	}
+	if err != nil {
+		return Result{Pass: true}, err
+	}
+	if value == passed {
+		return Result{Pass: true, Reason: ReasonPassed}, g.rc.Expire(ctx, key, s.Expire).Err()
+	}
+	first, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return Result{Pass: true}, fmt.Errorf("greylist %s: %w", key, err)
+	}
+	if wait := time.Unix(first, 0).Add(s.Delay).Sub(now); wait > 0 {
+		return Result{Wait: wait, Reason: ReasonEarly}, nil
+	}
+
+	_, err = g.rc.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.Set(ctx, key, passed, s.Expire)
+		p.Set(ctx, t.whitelistKey(), now.Unix(), s.Expire)
+		return nil
+	})
+	return Result{Pass: true, Reason: ReasonRetried}, err
+}
+
+// Whitelist lets the sender at the network of the client pass without greylisting
+func (g *Greylist) Whitelist(ctx context.Context, ip net.IP, sender string) error {
+	if ip == nil {
+		return nil
+	}
+	if g.rc == nil {
+		return errors.New("greylist redis is not available")
+	}
+	s := g.Settings()
+	if s == nil {
+		s = NewSettings()
+	}
+	t := Triplet{IP: ip, Sender: sender}
+	return g.rc.Set(ctx, t.whitelistKey(), g.now().Unix(), s.Expire).Err()
+}
+
+// Greylist checks a recipient for the milter, wait is 0 when it passes
+func (g *Greylist) Greylist(ctx context.Context, ip net.IP, sender, rcpt string) (time.Duration, error) {
+	result, err := g.Check(ctx, Triplet{IP: ip, Sender: sender, Rcpt: rcpt})
+	if result.Pass {
+		return 0, err
+	}
+	return result.Wait, err
+}
+
+// Policy returns the greylist as a check of the policy server
+func (g *Greylist) Policy() policy.Check {
+	return policyCheck{g}
+}
+
+type policyCheck struct {
+	g *Greylist
+}
+
+// Check greylists recipients, logged in clients and other states pass
+func (c policyCheck) Check(ctx context.Context, req policy.Request) (string, error) {
+	if !strings.EqualFold(req["protocol_state"], "RCPT") || req["sasl_username"] != "" {
+		return "", nil
+	}
+	ip := net.ParseIP(req["client_address"])
+	if ip == nil {
+		return "", nil
+	}
+	result, err := c.g.Check(ctx, Triplet{IP: ip, Sender: req["sender"], Rcpt: req["recipient"]})
+	if err != nil || result.Pass {
+		return "", err
+	}
+	return deferAction(result.Wait), nil
+}
+
+// deferAction is the reply to a deferred triplet
+func deferAction(wait time.Duration) string {
+	return fmt.Sprintf("DEFER_IF_PERMIT 4.7.1 Greylisted, please try again in %d seconds", int64(wait.Round(time.Second)/time.Second))
+}
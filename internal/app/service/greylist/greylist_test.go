@@ -0,0 +1,127 @@
+package greylist
+
+import (
+	"context"
+	"easymail/internal/app/service/filter"
+	"easymail/internal/app/service/policy"
+	"easymail/internal/model"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// the milter greylists with the same triplets
+var _ filter.Greylister = (*Greylist)(nil)
+
+func TestSettings(t *testing.T) {
+	s := NewSettings()
+	nodes := []struct {
+		section string
+		node    model.Configure
+		ok      bool
+	}{
+		{sectionSetting, model.Configure{Name: "delay", Value: "60"}, true},
+		{sectionSetting, model.Configure{Name: "delay", Value: "soon"}, false},
+		{sectionSetting, model.Configure{Name: "unknown", Value: "60"}, false},
+		{sectionClient, model.Configure{Name: "198.51.100.0/24"}, true},
+		{sectionClient, model.Configure{Name: "2001:db8::1"}, true},
+		{sectionClient, model.Configure{Name: "198.51.100"}, false},
+		{sectionSender, model.Configure{Name: "@Partner.example"}, true},
+		{sectionRecipient, model.Configure{Name: "abuse@example.com"}, true},
+		{"other", model.Configure{Name: "x"}, false},
+	}
+	for _, n := range nodes {
+		if err := s.set(n.section, n.node); (err == nil) != n.ok {
+			t.Fatalf("%s/%s: unexpected error %v", n.section, n.node.Name, err)
+		}
+	}
+	if s.Delay != time.Minute || s.Window != DefaultWindow {
+		t.Fatalf("unexpected settings %+v", s)
+	}
+	cases := []struct {
+		triplet Triplet
+		exempt  bool
+	}{
+		{Triplet{IP: net.ParseIP("198.51.100.7"), Sender: "a@example.org", Rcpt: "b@example.com"}, true},
+		{Triplet{IP: net.ParseIP("2001:db8::1"), Sender: "a@example.org", Rcpt: "b@example.com"}, true},
+		{Triplet{IP: net.ParseIP("2001:db8::2"), Sender: "a@example.org", Rcpt: "b@example.com"}, false},
+		{Triplet{IP: net.ParseIP("192.0.2.1"), Sender: "news@partner.example", Rcpt: "b@example.com"}, true},
+		{Triplet{IP: net.ParseIP("192.0.2.1"), Sender: "news@mail.partner.example", Rcpt: "b@example.com"}, false},
+		{Triplet{IP: net.ParseIP("192.0.2.1"), Sender: "", Rcpt: "Abuse@example.com"}, true},
+		{Triplet{IP: net.ParseIP("192.0.2.1"), Sender: "", Rcpt: "b@example.com"}, false},
+	}
+	for i, c := range cases {
+		if got := s.exempt(c.triplet); got != c.exempt {
+			t.Fatalf("case %d: expected exempt %v, got %v", i, c.exempt, got)
+		}
+	}
+}
+
+func TestTripletKey(t *testing.T) {
+	a := Triplet{IP: net.ParseIP("192.0.2.1"), Sender: "A@example.org", Rcpt: "B@example.com"}
+	b := Triplet{IP: net.ParseIP("192.0.2.200"), Sender: "a@example.org", Rcpt: "b@example.com"}
+	if a.key() != b.key() || a.key() != "greylist:triplet:192.0.2.0:a@example.org:b@example.com" {
+		t.Fatalf("unexpected keys %s, %s", a.key(), b.key())
+	}
+	v6 := Triplet{IP: net.ParseIP("2001:db8:1:2:3::1"), Rcpt: "b@example.com"}
+	if v6.key() != "greylist:triplet:2001:db8:1:2:::<>:b@example.com" {
+		t.Fatalf("unexpected key %s", v6.key())
+	}
+}
+
+func TestGreylist(t *testing.T) {
+	rc := redis.NewClient(&redis.Options{Addr: "127.0.0.1:6379"})
+	defer rc.Close()
+	ctx := context.Background()
+	if err := rc.Ping(ctx).Err(); err != nil {
+		t.Skip(err)
+	}
+	now := time.Now()
+	g := New(rc)
+	g.now = func() time.Time { return now }
+	s := NewSettings()
+	s.Delay, s.Window, s.Expire = time.Minute, time.Hour, time.Hour
+	g.SetSettings(s)
+
+	// a network of the documentation range nobody else uses
+	ip := net.ParseIP("203.0.113.9")
+	sender := "test-" + now.Format("150405.000000") + "@example.org"
+	triplet := Triplet{IP: ip, Sender: sender, Rcpt: "rcpt@example.com"}
+	defer rc.Del(ctx, triplet.key(), triplet.whitelistKey())
+
+	check := func(reason string, pass bool) {
+		t.Helper()
+		result, err := g.Check(ctx, triplet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Reason != reason || result.Pass != pass {
+			t.Fatalf("expected %s, got %+v", reason, result)
+		}
+	}
+	check(ReasonNew, false)
+	now = now.Add(30 * time.Second)
+	check(ReasonEarly, false)
+	// the retry from another address of the network passes
+	now = now.Add(time.Minute)
+	triplet.IP = net.ParseIP("203.0.113.10")
+	check(ReasonRetried, true)
+	// the sender is whitelisted for other recipients
+	triplet.Rcpt = "other@example.com"
+	check(ReasonWhitelisted, true)
+
+	// the policy check defers new triplets of other senders
+	req := policy.Request{"protocol_state": "RCPT", "client_address": "203.0.113.9", "sender": "x" + sender, "recipient": "rcpt@example.com"}
+	defer rc.Del(ctx, Triplet{IP: ip, Sender: "x" + sender, Rcpt: "rcpt@example.com"}.key())
+	action, err := g.Policy().Check(ctx, req)
+	if err != nil || !strings.HasPrefix(action, "DEFER_IF_PERMIT 4.7.1 Greylisted, please try again in 60 seconds") {
+		t.Fatalf("unexpected action %q, err %v", action, err)
+	}
+	req["sasl_username"] = "bob"
+	if action, err = g.Policy().Check(ctx, req); err != nil || action != "" {
+		t.Fatalf("expected logins to pass, got %q, err %v", action, err)
+	}
+}
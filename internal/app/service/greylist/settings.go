@@ -0,0 +1,188 @@
+package greylist
+
+import (
+	"easymail/internal/model"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+/*
+the configure tree of greylisting, admins manage it as any other node:
+
+	greylist/setting/delay      seconds a triplet is deferred for
+	greylist/setting/window     seconds a retry is waited for after the first attempt
+	greylist/setting/expire     seconds passed triplets and whitelisted senders are kept
+	greylist/client/<ip|cidr>   clients never greylisted
+	greylist/sender/<addr|dom>  senders never greylisted
+	greylist/recipient/<addr|dom> recipients never greylisted
+*/
+const (
+	configRoot       = "greylist"
+	sectionSetting   = "setting"
+	sectionClient    = "client"
+	sectionSender    = "sender"
+	sectionRecipient = "recipient"
+)
+
+// defaults of the settings not configured
+const (
+	DefaultDelay  = 5 * time.Minute
+	DefaultWindow = 48 * time.Hour
+	DefaultExpire = 35 * 24 * time.Hour
+)
+
+// Settings are the greylisting parameters and the exemptions
+type Settings struct {
+	// Delay is how long a new triplet is deferred
+	Delay time.Duration
+	// Window is how long a retry is waited for, a later one starts over
+	Window time.Duration
+	// Expire is how long passed triplets and whitelisted senders are kept since last seen
+	Expire time.Duration
+
+	clients []*net.IPNet
+	// senders and rcpts hold lower case addresses and domains
+	senders map[string]struct{}
+	rcpts   map[string]struct{}
+}
+
+// NewSettings returns the default settings without exemptions
+func NewSettings() *Settings {
+	return &Settings{
+		Delay:   DefaultDelay,
+		Window:  DefaultWindow,
+		Expire:  DefaultExpire,
+		senders: make(map[string]struct{}),
+		rcpts:   make(map[string]struct{}),
+	}
+}
+
+// ExemptClient exempts an address or a network in CIDR notation
+func (s *Settings) ExemptClient(client string) error {
+	if !strings.Contains(client, "/") {
+		ip := net.ParseIP(client)
+		if ip == nil {
+			return fmt.Errorf("invalid client %q", client)
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+		s.clients = append(s.clients, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		return nil
+	}
+	_, network, err := net.ParseCIDR(client)
+	if err != nil {
+		return fmt.Errorf("invalid client %q", client)
+	}
+	s.clients = append(s.clients, network)
+	return nil
+}
+
+// ExemptSender exempts an address or all addresses of a domain
+func (s *Settings) ExemptSender(sender string) {
+	s.senders[strings.ToLower(strings.TrimPrefix(sender, "@"))] = struct{}{}
+}
+
+// ExemptRecipient exempts an address or all addresses of a domain
+func (s *Settings) ExemptRecipient(rcpt string) {
+	s.rcpts[strings.ToLower(strings.TrimPrefix(rcpt, "@"))] = struct{}{}
+}
+
+// exempt tells whether the triplet is never greylisted
+func (s *Settings) exempt(t Triplet) bool {
+	for _, network := range s.clients {
+		if network.Contains(t.IP) {
+			return true
+		}
+	}
+	return matchAddress(s.senders, t.Sender) || matchAddress(s.rcpts, t.Rcpt)
+}
+
+// matchAddress matches an address by itself or by its domain
+func matchAddress(list map[string]struct{}, addr string) bool {
+	if addr == "" || len(list) == 0 {
+		return false
+	}
+	addr = strings.ToLower(addr)
+	if _, ok := list[addr]; ok {
+		return true
+	}
+	if i := strings.LastIndex(addr, "@"); i >= 0 {
+		_, ok := list[addr[i+1:]]
+		return ok
+	}
+	return false
+}
+
+// LoadSettings reads the settings from the configure tree, defaults are kept
+// for the missing nodes, a broken node is skipped and reported.
+func LoadSettings() (*Settings, error) {
+	s := NewSettings()
+	root, err := model.GetConfigureByName(configRoot, 0)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return s, nil
+	}
+	if err != nil {
+		return s, err
+	}
+	sections, err := model.GetSubConfigureByParentId(root.ID)
+	if err != nil {
+		return s, err
+	}
+	errs := make([]error, 0)
+	for _, section := range sections {
+		nodes, err := model.GetSubConfigureByParentId(section.ID)
+		if err != nil {
+			return s, err
+		}
+		for _, node := range nodes {
+			if err := s.set(section.Name, node); err != nil {
+				errs = append(errs, fmt.Errorf("greylist %s/%s: %w", section.Name, node.Name, err))
+			}
+		}
+	}
+	// a retry is never in time when the window closes before the delay is over
+	if s.Window <= s.Delay {
+		errs = append(errs, fmt.Errorf("greylist window %s is not longer than delay %s", s.Window, s.Delay))
+		s.Window = s.Delay + DefaultWindow
+	}
+	return s, errors.Join(errs...)
+}
+
+// set applies one node of a section
+func (s *Settings) set(section string, node model.Configure) error {
+	switch section {
+	case sectionSetting:
+		seconds, err := strconv.ParseInt(strings.TrimSpace(node.Value), 10, 64)
+		if err != nil || seconds <= 0 {
+			return fmt.Errorf("invalid seconds %q", node.Value)
+		}
+		d := time.Duration(seconds) * time.Second
+		switch node.Name {
+		case "delay":
+			s.Delay = d
+		case "window":
+			s.Window = d
+		case "expire":
+			s.Expire = d
+		default:
+			return errors.New("unknown setting")
+		}
+	case sectionClient:
+		return s.ExemptClient(node.Name)
+	case sectionSender:
+		s.ExemptSender(node.Name)
+	case sectionRecipient:
+		s.ExemptRecipient(node.Name)
+	default:
+		return errors.New("unknown section")
+	}
+	return nil
+}
@@ -0,0 +1,269 @@
+package links
+
+import (
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"golang.org/x/net/idna"
+	"golang.org/x/net/publicsuffix"
+)
+
+const (
+	// maxLinks bounds the links taken from a message
+	maxLinks = 500
+	// maxRedirects bounds how deep targets are unwrapped from redirect links
+	maxRedirects = 3
+)
+
+// Source tells where in a message a link was found
+type Source string
+
+const (
+	SourceText   Source = "text"
+	SourceAnchor Source = "anchor"
+	SourceImage  Source = "image"
+	SourceForm   Source = "form"
+	// SourceRedirect is the target carried in the query of another link
+	SourceRedirect Source = "redirect"
+)
+
+// Link is a normalized link of a message
+type Link struct {
+	URL  string
+	Host string
+	// Domain is the registrable domain of Host, the host itself for addresses and unknown suffixes
+	Domain string
+	Source Source
+	// Text is the text of an anchor
+	Text string
+	// Mismatch is set for an anchor whose text shows a link to another domain
+	Mismatch bool
+	// IP is set for hosts given as address, also in decimal or hex notation
+	IP        bool
+	Shortener bool
+	// Obfuscated is set for links written to escape filters, e.g. hxxp://example[.]com
+	Obfuscated bool
+}
+
+var (
+	// urlPattern finds links in text, with or without scheme, hxxp and [.] included
+	urlPattern = regexp.MustCompile(`(?i)\b(?:(?:https?|hxxps?|h\*\*ps?)://|www(?:\.|\[\.\]|\(\.\)))[^\s<>"'()\[\]{}]*(?:(?:\[\.\]|\(\.\)|\[dot\]|\(dot\))[^\s<>"'()\[\]{}]+)*`)
+	// domainPattern tells whether anchor text names a domain, e.g. paypal.com/login
+	domainPattern = regexp.MustCompile(`(?i)^(?:[a-z][a-z0-9+.-]*://)?(?:[a-z0-9-]+\.)+[a-z]{2,63}(?::\d+)?(?:[/?#]\S*)?$`)
+	// dotPattern matches the ways a dot is written out
+	dotPattern = regexp.MustCompile(`(?i)\[\.\]|\(\.\)|\[dot\]|\(dot\)`)
+)
+
+// shorteners are URL shortening services, their links hide the target
+var shorteners = map[string]bool{
+	"bit.ly": true, "bitly.com": true, "tinyurl.com": true, "t.co": true, "goo.gl": true,
+	"ow.ly": true, "is.gd": true, "v.gd": true, "buff.ly": true, "rebrand.ly": true,
+	"cutt.ly": true, "shorturl.at": true, "rb.gy": true, "t.ly": true, "tiny.cc": true,
+	"s.id": true, "lnkd.in": true, "bl.ink": true, "short.io": true, "surl.li": true,
+	"dwz.cn": true, "url.cn": true, "t.cn": true, "suo.im": true,
+}
+
+// extractor collects the distinct links of a message
+type extractor struct {
+	links []Link
+	seen  map[string]int
+}
+
+/*
+Extract returns the distinct links of a message in order of appearance, the
+plain text first. Anchors, images and forms are taken from html, a link
+carrying another one in its query, e.g. a tracking redirect, adds the target.
+*/
+func Extract(text, html string) []Link {
+	e := &extractor{seen: make(map[string]int)}
+	e.text(text, SourceText)
+	if html != "" {
+		e.html(html)
+	}
+	return e.links
+}
+
+func (e *extractor) text(s string, source Source) {
+	for _, raw := range urlPattern.FindAllString(s, -1) {
+		e.add(raw, source, "")
+	}
+}
+
+func (e *extractor) html(s string) {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(s))
+	if err != nil {
+		return
+	}
+	doc.Find("a[href], area[href]").Each(func(_ int, sel *goquery.Selection) {
+		href, _ := sel.Attr("href")
+		e.add(href, SourceAnchor, strings.Join(strings.Fields(sel.Text()), " "))
+	})
+	doc.Find("img[src]").Each(func(_ int, sel *goquery.Selection) {
+		src, _ := sel.Attr("src")
+		e.add(src, SourceImage, "")
+	})
+	doc.Find("form[action]").Each(func(_ int, sel *goquery.Selection) {
+		action, _ := sel.Attr("action")
+		e.add(action, SourceForm, "")
+	})
+	// links written out in the text, anchors already taken are not added again
+	doc.Find("script, style").Remove()
+	e.text(doc.Text(), SourceText)
+}
+
+func (e *extractor) add(raw string, source Source, text string) {
+	e.addDepth(raw, source, text, 0)
+}
+
+func (e *extractor) addDepth(raw string, source Source, text string, depth int) {
+	if len(e.links) >= maxLinks {
+		return
+	}
+	link, u, ok := Normalize(raw)
+	if !ok {
+		return
+	}
+	link.Source, link.Text = source, text
+	if source == SourceAnchor {
+		link.Mismatch = mismatch(text, link.Domain)
+	}
+	if i, ok := e.seen[link.URL]; ok {
+		// the same link as anchor with misleading text still counts
+		e.links[i].Mismatch = e.links[i].Mismatch || link.Mismatch
+	} else {
+		e.seen[link.URL] = len(e.links)
+		e.links = append(e.links, link)
+	}
+	if depth >= maxRedirects {
+		return
+	}
+	for _, values := range u.Query() {
+		for _, v := range values {
+			if target := strings.ToLower(strings.TrimSpace(v)); strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+				e.addDepth(v, SourceRedirect, "", depth+1)
+			}
+		}
+	}
+}
+
+/*
+Normalize parses a link as it was written and returns it normalized: the
+obfuscations are undone, scheme and host are lower case, the host is in its
+ascii form, numeric hosts are dotted addresses, default ports and fragments
+are dropped. ok is false for anything but http and https links.
+*/
+func Normalize(raw string) (link Link, u *url.URL, ok bool) {
+	s := strings.TrimSpace(raw)
+	s = strings.TrimRight(s, ".,;:!?")
+	deobfuscated := dotPattern.ReplaceAllString(s, ".")
+	lower := strings.ToLower(deobfuscated)
+	for _, prefix := range []string{"hxxp", "h**p"} {
+		if strings.HasPrefix(lower, prefix) {
+			deobfuscated = "http" + deobfuscated[len(prefix):]
+			lower = strings.ToLower(deobfuscated)
+		}
+	}
+	link.Obfuscated = deobfuscated != s
+	if strings.HasPrefix(lower, "www.") {
+		deobfuscated = "http://" + deobfuscated
+	}
+	u, err := url.Parse(deobfuscated)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return Link{}, nil, false
+	}
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	if ip := numericHost(host); ip != nil {
+		link.IP = true
+		link.Obfuscated = link.Obfuscated || ip.String() != host
+		host = ip.String()
+	} else if ascii, err := idna.Lookup.ToASCII(host); err == nil {
+		host = ascii
+	} else {
+		return Link{}, nil, false
+	}
+	port := u.Port()
+	if (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+		port = ""
+	}
+	u.Host = host
+	if strings.Contains(host, ":") {
+		u.Host = "[" + host + "]"
+	}
+	if port != "" {
+		u.Host += ":" + port
+	}
+	u.User, u.Fragment, u.RawFragment = nil, "", ""
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	link.URL, link.Host, link.Domain = u.String(), host, Domain(host)
+	link.Shortener = shorteners[link.Domain] || shorteners[host]
+	return link, u, true
+}
+
+// Domain returns the registrable domain of a host, the host itself for addresses and unknown suffixes
+func Domain(host string) string {
+	if net.ParseIP(host) != nil {
+		return host
+	}
+	if domain, err := publicsuffix.EffectiveTLDPlusOne(host); err == nil {
+		return domain
+	}
+	return host
+}
+
+// numericHost parses hosts given as address, dotted or as a single decimal,
+// octal or hex number as browsers accept them, e.g. 3221225985 or 0xc0000201.
+func numericHost(host string) net.IP {
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4
+		}
+		return ip
+	}
+	parts := strings.Split(host, ".")
+	if len(parts) > 4 {
+		return nil
+	}
+	nums := make([]uint64, len(parts))
+	for i, p := range parts {
+		n, err := strconv.ParseUint(p, 0, 32)
+		if err != nil {
+			return nil
+		}
+		nums[i] = n
+	}
+	// the last part fills the remaining bytes, a.b.c.d, a.b.cd, a.bcd or abcd
+	var v uint64
+	for i, n := range nums[:len(nums)-1] {
+		if n > 0xff {
+			return nil
+		}
+		v |= n << (8 * (3 - i))
+	}
+	last := nums[len(nums)-1]
+	if last >= 1<<(8*(5-len(nums))) {
+		return nil
+	}
+	v |= last
+	return net.IPv4(byte(v>>24), byte(v>>16), byte(v>>8), byte(v)).To4()
+}
+
+// mismatch tells whether anchor text shows a link or a domain other than where the anchor leads
+func mismatch(text, domain string) bool {
+	text = strings.TrimSpace(text)
+	if text == "" || !domainPattern.MatchString(text) {
+		return false
+	}
+	shown, _, ok := Normalize(text)
+	if !ok {
+		if shown, _, ok = Normalize("http://" + text); !ok {
+			return false
+		}
+	}
+	return shown.Domain != domain
+}
@@ -0,0 +1,86 @@
+package links
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	cases := []struct {
+		raw, url, domain string
+		ip, obfuscated   bool
+	}{
+		{"HTTPS://User@WWW.Example.CO.UK:443/a?b=c#top", "https://www.example.co.uk/a?b=c", "example.co.uk", false, false},
+		{"www.example.com.", "http://www.example.com/", "example.com", false, false},
+		{"hxxp://evil[.]example(.)com/x", "http://evil.example.com/x", "example.com", false, true},
+		{"http://3221225985/login", "http://192.0.2.1/login", "192.0.2.1", true, true},
+		{"http://0xc0.0.2.1:8080/", "http://192.0.2.1:8080/", "192.0.2.1", true, true},
+		{"http://192.0.2.1/", "http://192.0.2.1/", "192.0.2.1", true, false},
+		{"http://bücher.example/", "http://xn--bcher-kva.example/", "xn--bcher-kva.example", false, false},
+	}
+	for _, c := range cases {
+		link, _, ok := Normalize(c.raw)
+		if !ok || link.URL != c.url || link.Domain != c.domain || link.IP != c.ip || link.Obfuscated != c.obfuscated {
+			t.Fatalf("%s: got %+v %v", c.raw, link, ok)
+		}
+	}
+	for _, raw := range []string{"mailto:a@example.com", "/relative", "javascript:alert(1)", "http://"} {
+		if _, _, ok := Normalize(raw); ok {
+			t.Fatalf("%s: expected no link", raw)
+		}
+	}
+}
+
+func TestExtract(t *testing.T) {
+	text := "login at hxxps://secure-bank[.]example/verify, see https://Example.com/a."
+	html := `<p>Visit <a href="https://evil.example.net/pay">https://www.paypal.com/signin</a>
+<a href="https://www.example.com/docs">example.com/docs</a>
+<a href="https://bit.ly/3abc">here</a>
+<a href="https://click.example.org/r?url=https%3A%2F%2Fphish.example%2Fx">track</a>
+<img src="http://0xc0000201/pixel.gif"><form action="https://collect.example.info/post"></form>
+<script>var u = "https://script.example/";</script>
+mirror: https://mirror.example/file</p>`
+	found := Extract(text, html)
+	urls := make([]string, 0, len(found))
+	for _, l := range found {
+		urls = append(urls, l.URL)
+	}
+	expected := []string{
+		"https://secure-bank.example/verify",
+		"https://example.com/a",
+		"https://evil.example.net/pay",
+		"https://www.example.com/docs",
+		"https://bit.ly/3abc",
+		"https://click.example.org/r?url=https%3A%2F%2Fphish.example%2Fx",
+		"https://phish.example/x",
+		"http://192.0.2.1/pixel.gif",
+		"https://collect.example.info/post",
+		"https://www.paypal.com/signin",
+		"https://mirror.example/file",
+	}
+	if !reflect.DeepEqual(urls, expected) {
+		t.Fatalf("expected %v, got %v", expected, urls)
+	}
+	byURL := make(map[string]Link)
+	for _, l := range found {
+		byURL[l.URL] = l
+	}
+	if l := byURL["https://evil.example.net/pay"]; !l.Mismatch || l.Source != SourceAnchor {
+		t.Fatalf("expected a mismatch, got %+v", l)
+	}
+	if l := byURL["https://www.example.com/docs"]; l.Mismatch {
+		t.Fatalf("expected no mismatch, got %+v", l)
+	}
+	if l := byURL["https://bit.ly/3abc"]; !l.Shortener || l.Mismatch {
+		t.Fatalf("expected a shortener, got %+v", l)
+	}
+	if l := byURL["https://phish.example/x"]; l.Source != SourceRedirect {
+		t.Fatalf("expected a redirect target, got %+v", l)
+	}
+	if l := byURL["http://192.0.2.1/pixel.gif"]; !l.IP || l.Source != SourceImage {
+		t.Fatalf("expected an image on an address, got %+v", l)
+	}
+	if l := byURL["https://secure-bank.example/verify"]; !l.Obfuscated {
+		t.Fatalf("expected an obfuscated link, got %+v", l)
+	}
+}
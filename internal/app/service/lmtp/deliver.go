@@ -0,0 +1,340 @@
+package lmtp
+
+import (
+	"bytes"
+	"easymail/internal/app/service/filter"
+	"easymail/internal/app/service/mailrule"
+	"easymail/internal/app/service/sieve"
+	"easymail/internal/model"
+	"errors"
+	"fmt"
+	"mime"
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+var (
+	wordDecoder = new(mime.WordDecoder)
+	// queueIDRe finds the postfix queue id in the Received header postfix added on receipt
+	queueIDRe = regexp.MustCompile(`\bid\s+([0-9A-Za-z]+)`)
+)
+
+// Deliverer stores a message for one recipient, *sieve.Deliverer implements it
+type Deliverer interface {
+	Deliver(msg sieve.Message, email *model.Email) (*sieve.Delivery, error)
+}
+
+// status is the reply to a recipient, code and enhanced code as in RFC 3463
+type status struct {
+	code     int
+	enhanced string
+	text     string
+}
+
+func (s status) String() string {
+	return fmt.Sprintf("%d %s %s", s.code, s.enhanced, s.text)
+}
+
+func (s status) ok() bool {
+	return s.code/100 == 2
+}
+
+var (
+	statusUnknownUser = status{550, "5.1.1", "User unknown"}
+	statusMailboxFull = status{552, "5.2.2", "Mailbox full"}
+	statusTempFail    = status{451, "4.3.0", "Temporary failure, try again later"}
+)
+
+// envelope is a message received in one transaction
+type envelope struct {
+	Sender string
+	Helo   string
+	Remote string
+	Raw    []byte
+	Header mail.Header
+}
+
+/*
+agent checks recipients and delivers the message of a transaction to each of
+them: the folder the filter asked for, then the personal rules, then the sieve
+script of the recipient decide where it is stored.
+*/
+type agent struct {
+	hostname  string
+	deliverer Deliverer
+	relay     Relay
+	sealer    Sealer
+	vacations *vacationLog
+	logf      func(format string, args ...any)
+
+	// the lookups are replaced in tests
+	findAccount   func(name string) (*model.Account, error)
+	findDomain    func(id int64) (*model.Domain, error)
+	usage         func(accountID int64) (int64, error)
+	personalRules func(accountID int64) ([]model.PersonalRule, error)
+}
+
+func newAgent() *agent {
+	return &agent{
+		vacations:     newVacationLog(),
+		logf:          func(string, ...any) {},
+		findAccount:   model.FindAccountByName,
+		findDomain:    model.FindDomainByID,
+		usage:         model.GetMailUsage,
+		personalRules: model.GetPersonalRules,
+	}
+}
+
+// account finds the active account of a recipient in an active domain
+func (a *agent) account(rcpt string) (*model.Account, status) {
+	acc, err := a.findAccount(rcpt)
+	if errors.Is(err, model.ErrAccountNotExists) || errors.Is(err, model.ErrDomainNotExists) ||
+		errors.Is(err, model.ErrInvalidUsername) {
+		return nil, statusUnknownUser
+	}
+	if err != nil {
+		a.logf("lmtp find account %s: %v", rcpt, err)
+		return nil, statusTempFail
+	}
+	if !model.ValidateAccount(*acc) {
+		return nil, statusUnknownUser
+	}
+	domain, err := a.findDomain(acc.DomainID)
+	if err != nil {
+		a.logf("lmtp find domain of %s: %v", rcpt, err)
+		return nil, statusTempFail
+	}
+	if domain == nil || domain.ID <= 0 || !model.ValidateDomain(*domain) {
+		return nil, statusUnknownUser
+	}
+	return acc, status{250, "2.1.5", "Ok"}
+}
+
+// quota checks whether size more bytes fit, StorageQuota is in MB and not positive means unlimited
+func (a *agent) quota(acc *model.Account, size int64) status {
+	if acc.StorageQuota <= 0 {
+		return status{250, "2.0.0", "Ok"}
+	}
+	used, err := a.usage(acc.ID)
+	if err != nil {
+		a.logf("lmtp usage of account %d: %v", acc.ID, err)
+		return statusTempFail
+	}
+	if limit := acc.StorageQuota << 20; used >= limit || used+size > limit {
+		return statusMailboxFull
+	}
+	return status{250, "2.0.0", "Ok"}
+}
+
+// deliver stores the message for one recipient and sends what the rules ask for
+func (a *agent) deliver(env *envelope, rcpt string) status {
+	acc, st := a.account(rcpt)
+	if acc == nil {
+		return st
+	}
+	raw := a.traceHeaders(env, rcpt)
+	if st = a.quota(acc, int64(len(raw))); !st.ok() {
+		return st
+	}
+
+	email := newEmail(env, raw)
+	folder := model.Inbox
+	// the filter removes the header when the sender wrote it, what is left is its own
+	if values := env.Header[filter.FolderHeader]; len(values) > 0 {
+		folder, _ = sieve.Folder(values[len(values)-1])
+	}
+
+	rules, err := a.personalRules(acc.ID)
+	if err != nil {
+		a.logf("lmtp personal rules of %s: %v", rcpt, err)
+	}
+	personal, err := mailrule.Evaluate(rules, mailrule.Message{Sender: env.Sender, Rcpt: rcpt, Header: env.Header}, folder)
+	if err != nil {
+		a.logf("lmtp personal rules of %s: %v", rcpt, err)
+	}
+	looped := a.looped(env.Header, rcpt)
+	if len(personal.Forward) > 0 {
+		a.forward(env.Sender, personal.Forward, raw, rcpt, looped)
+	}
+	if personal.Discard {
+		return status{250, "2.0.0", "Ok, discarded"}
+	}
+	email.FolderId = int64(personal.Folder)
+	if personal.Read {
+		email.ReadStatus = model.ImapRead
+	}
+
+	delivery, err := a.deliverer.Deliver(sieve.Message{Sender: env.Sender, Rcpt: rcpt, Raw: raw}, email)
+	if err != nil {
+		a.logf("lmtp deliver to %s: %v", rcpt, err)
+		return statusTempFail
+	}
+	if delivery.Err != nil {
+		a.logf("lmtp sieve of %s: %v", rcpt, delivery.Err)
+	}
+	if delivery.Rejected {
+		reason := strings.Join(strings.Fields(delivery.Reject), " ")
+		if reason == "" {
+			reason = "Rejected by recipient"
+		}
+		return status{550, "5.7.1", reason}
+	}
+	if len(delivery.Redirect) > 0 {
+		a.forward(env.Sender, delivery.Redirect, raw, rcpt, looped)
+	}
+	if delivery.Vacation != nil {
+		a.vacation(env, acc.ID, delivery.Vacation)
+	}
+	return status{250, "2.0.0", "Ok"}
+}
+
+// traceHeaders prepends the headers of the final delivery to the message of a recipient
+func (a *agent) traceHeaders(env *envelope, rcpt string) []byte {
+	var b bytes.Buffer
+	b.Grow(len(env.Raw) + 256)
+	fmt.Fprintf(&b, "Return-Path: <%s>\r\n", env.Sender)
+	fmt.Fprintf(&b, "Delivered-To: %s\r\n", rcpt)
+	fmt.Fprintf(&b, "Received: from %s (%s)\r\n\tby %s (easymail) with LMTP\r\n\tfor <%s>; %s\r\n",
+		env.Helo, env.Remote, a.hostname, rcpt, time.Now().Format(time.RFC1123Z))
+	b.Write(env.Raw)
+	return b.Bytes()
+}
+
+// stripHeader removes every field of name with its folded lines from the header of raw
+func stripHeader(raw []byte, name string) []byte {
+	var b bytes.Buffer
+	b.Grow(len(raw))
+	stripped := false
+	rest := raw
+	for len(rest) > 0 {
+		line := rest
+		if i := bytes.IndexByte(rest, '\n'); i >= 0 {
+			line = rest[:i+1]
+		}
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			break
+		}
+		rest = rest[len(line):]
+		if line[0] == ' ' || line[0] == '\t' {
+			if !stripped {
+				b.Write(line)
+			}
+			continue
+		}
+		field, _, _ := bytes.Cut(line, []byte(":"))
+		stripped = strings.EqualFold(strings.TrimRight(string(field), " \t"), name)
+		if !stripped {
+			b.Write(line)
+		}
+	}
+	b.Write(rest)
+	return b.Bytes()
+}
+
+// looped reports a message that was delivered to the recipient before, it is not forwarded again
+func (a *agent) looped(header mail.Header, rcpt string) bool {
+	for _, v := range header["Delivered-To"] {
+		if strings.EqualFold(strings.TrimSpace(v), rcpt) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *agent) forward(sender string, to []string, raw []byte, rcpt string, looped bool) {
+	if looped {
+		a.logf("lmtp forward of %s skipped, the message looped", rcpt)
+		return
+	}
+	if a.relay == nil {
+		a.logf("lmtp forward of %s to %s dropped, no relay", rcpt, strings.Join(to, ","))
+		return
+	}
+	if a.sealer != nil {
+		// the next hops see the checks passed here though SPF and DKIM break on the way
+		sealed, err := a.sealer.Seal(rcpt[strings.LastIndexByte(rcpt, '@')+1:], raw)
+		if err != nil {
+			a.logf("lmtp arc seal of %s: %v", rcpt, err)
+		}
+		raw = sealed
+	}
+	if err := a.relay.Send(sender, to, raw); err != nil {
+		a.logf("lmtp forward of %s to %s: %v", rcpt, strings.Join(to, ","), err)
+	}
+}
+
+func (a *agent) vacation(env *envelope, accountID int64, v *sieve.Vacation) {
+	if a.relay == nil {
+		a.logf("lmtp vacation reply to %s dropped, no relay", v.To)
+		return
+	}
+	key := fmt.Sprintf("%d\x00%s\x00%s", accountID, v.Handle, strings.ToLower(v.To))
+	if !a.vacations.reply(key, time.Duration(v.Days)*24*time.Hour) {
+		return
+	}
+	// replies go with the null sender, nobody answers them
+	if err := a.relay.Send("", []string{v.To}, vacationMessage(v, env.Header.Get("Message-Id"))); err != nil {
+		a.logf("lmtp vacation reply to %s: %v", v.To, err)
+	}
+}
+
+// newEmail fills the email record from the headers, raw is what is stored
+func newEmail(env *envelope, raw []byte) *model.Email {
+	now := time.Now()
+	email := &model.Email{
+		JobID:    uuid.NewString(),
+		Date:     now,
+		Sender:   env.Sender,
+		MailTime: now,
+		Size:     int64(len(raw)),
+		FolderId: int64(model.Inbox),
+	}
+	if date, err := env.Header.Date(); err == nil {
+		email.Date = date
+	}
+	if from, err := env.Header.AddressList("From"); err == nil && len(from) > 0 {
+		email.Sender = from[0].Address
+	}
+	email.Recipient = addresses(env.Header, "To")
+	email.CarbonCopy = addresses(env.Header, "Cc")
+	subject := env.Header.Get("Subject")
+	if decoded, err := wordDecoder.DecodeHeader(subject); err == nil {
+		subject = decoded
+	}
+	email.Subject = truncate(subject, 255)
+	if received := env.Header.Get("Received"); received != "" {
+		if m := queueIDRe.FindStringSubmatch(received); m != nil {
+			email.QueueID = truncate(m[1], 16)
+		}
+	}
+	return email
+}
+
+// addresses joins the clean addresses of a header by ,
+func addresses(header mail.Header, key string) string {
+	list, err := header.AddressList(key)
+	if err != nil {
+		return ""
+	}
+	clean := make([]string, 0, len(list))
+	for _, addr := range list {
+		clean = append(clean, addr.Address)
+	}
+	return truncate(strings.Join(clean, ","), 1024)
+}
+
+// truncate cuts s to at most n bytes without splitting a character
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
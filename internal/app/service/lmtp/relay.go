@@ -0,0 +1,128 @@
+package lmtp
+
+import (
+	"easymail/internal/app/service/sieve"
+	"fmt"
+	"mime"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// maxVacationEntries bounds the reply log, expired entries are dropped beyond it
+const maxVacationEntries = 100000
+
+// Relay sends messages out, an empty from is the null sender
+type Relay interface {
+	Send(from string, to []string, msg []byte) error
+}
+
+// Sealer adds an ARC set of the domain to a forwarded message, *dkimkey.ARCSealer implements it
+type Sealer interface {
+	Seal(domain string, raw []byte) ([]byte, error)
+}
+
+// SMTPRelay hands messages to a local MTA, usually postfix on 127.0.0.1:25
+type SMTPRelay struct {
+	Addr     string
+	Hostname string
+}
+
+func NewSMTPRelay(addr, hostname string) *SMTPRelay {
+	return &SMTPRelay{Addr: addr, Hostname: hostname}
+}
+
+func (r *SMTPRelay) Send(from string, to []string, msg []byte) error {
+	c, err := smtp.Dial(r.Addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if err = c.Hello(r.Hostname); err != nil {
+		return err
+	}
+	if err = c.Mail(from); err != nil {
+		return err
+	}
+	for _, addr := range to {
+		if err = c.Rcpt(addr); err != nil {
+			return fmt.Errorf("rcpt %s: %w", addr, err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(msg); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+/*
+vacationLog remembers to whom a vacation reply went, a sender gets one reply
+per handle within the days of the script. It is kept in memory, a restart
+may send a reply again.
+*/
+type vacationLog struct {
+	lock    sync.Mutex
+	replies map[string]time.Time
+}
+
+func newVacationLog() *vacationLog {
+	return &vacationLog{replies: make(map[string]time.Time)}
+}
+
+// reply reports whether a reply is due for key and records it
+func (l *vacationLog) reply(key string, period time.Duration) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	if until, ok := l.replies[key]; ok && now.Before(until) {
+		return false
+	}
+	if len(l.replies) >= maxVacationEntries {
+		for k, until := range l.replies {
+			if !now.Before(until) {
+				delete(l.replies, k)
+			}
+		}
+	}
+	l.replies[key] = now.Add(period)
+	return true
+}
+
+// vacationMessage builds the auto reply, inReplyTo is the Message-Id of the message answered
+func vacationMessage(v *sieve.Vacation, inReplyTo string) []byte {
+	var b strings.Builder
+	domain := "localhost"
+	if i := strings.LastIndexByte(v.From, '@'); i >= 0 {
+		domain = strings.TrimRight(v.From[i+1:], ">")
+	}
+	fmt.Fprintf(&b, "From: %s\r\n", v.From)
+	fmt.Fprintf(&b, "To: %s\r\n", v.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", v.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-Id: <%s@%s>\r\n", uuid.NewString(), domain)
+	if inReplyTo = strings.TrimSpace(inReplyTo); inReplyTo != "" {
+		fmt.Fprintf(&b, "In-Reply-To: %s\r\nReferences: %s\r\n", inReplyTo, inReplyTo)
+	}
+	b.WriteString("Auto-Submitted: auto-replied (vacation)\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	reason := strings.ReplaceAll(strings.ReplaceAll(v.Reason, "\r\n", "\n"), "\n", "\r\n")
+	if !v.Mime {
+		b.WriteString("Content-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: 8bit\r\n\r\n")
+	}
+	// with :mime the reason starts with its own MIME headers
+	b.WriteString(reason)
+	if !strings.HasSuffix(reason, "\r\n") {
+		b.WriteString("\r\n")
+	}
+	return []byte(b.String())
+}
@@ -0,0 +1,201 @@
+package lmtp
+
+import (
+	"context"
+	"easymail/internal/app/service/sieve"
+	"easymail/internal/app/service/storage"
+	"easymail/internal/easylog"
+	"easymail/internal/observability/sessiontrace"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// idleTimeout closes sessions without a command for a while
+const idleTimeout = 5 * time.Minute
+
+/*
+Server lmtp server (RFC 2033), postfix hands over the messages of local
+recipients and they are stored through the storage. Every recipient gets a
+status of its own after DATA.
+*/
+type Server struct {
+	name     string
+	family   string
+	listen   string
+	hostname string
+	debug    bool
+	lock     *sync.Mutex
+	started  bool
+	_log     *easylog.Logger
+	listener net.Listener
+	// conns are the open sessions, they are closed on stop
+	conns map[net.Conn]struct{}
+	wg    sync.WaitGroup
+
+	tracer sessiontrace.Tracer
+	agent  *agent
+}
+
+func New(family, listen string) *Server {
+	if family != "tcp" && family != "unix" {
+		return nil
+	}
+	if family == "tcp" {
+		if _, _, err := net.SplitHostPort(listen); err != nil {
+			return nil
+		}
+	}
+	if family == "unix" && strings.TrimSpace(listen) == "" {
+		return nil
+	}
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "localhost"
+	}
+	a := newAgent()
+	a.hostname = hostname
+	return &Server{
+		name:     "lmtp",
+		family:   family,
+		listen:   listen,
+		hostname: hostname,
+		lock:     &sync.Mutex{},
+		conns:    make(map[net.Conn]struct{}),
+		agent:    a,
+	}
+}
+
+func (s *Server) SetDebug(debug bool) {
+	s.debug = debug
+}
+
+func (s *Server) SetLogger(_log *easylog.Logger) error {
+	if _log == nil {
+		return fmt.Errorf("%s logger is nil", s.name)
+	}
+	s._log = _log
+	return nil
+}
+
+func (s *Server) SetTracer(t sessiontrace.Tracer) {
+	s.tracer = t
+}
+
+/*
+SetStorage sets where messages are stored, it is required. Messages pass
+through the personal rules and the sieve script of the recipient on the way.
+*/
+func (s *Server) SetStorage(st storage.Storager) {
+	s.agent.deliverer = sieve.NewDeliverer(st)
+}
+
+// SetRelay sets where forwards, redirects and vacation replies are sent, without it they are dropped
+func (s *Server) SetRelay(r Relay) {
+	s.agent.relay = r
+}
+
+// SetSealer makes forwards and redirects carry an ARC set of the recipient domain
+func (s *Server) SetSealer(sealer Sealer) {
+	s.agent.sealer = sealer
+}
+
+func (s *Server) Start() error {
+	if s._log == nil {
+		return fmt.Errorf("%s logger is nil", s.name)
+	}
+	if s.agent.deliverer == nil {
+		return fmt.Errorf("%s storage is nil", s.name)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.started {
+		return fmt.Errorf("%s server already started", s.name)
+	}
+	listener, err := net.Listen(s.family, s.listen)
+	if err != nil {
+		return err
+	}
+	s.agent.logf = s._log.Errorf
+	s.listener = listener
+	s.started = true
+	s._log.Infof("%s server started!", s.name)
+	go s.run(listener)
+	return nil
+}
+
+func (s *Server) Stop() error {
+	s.lock.Lock()
+	if !s.started {
+		s.lock.Unlock()
+		return fmt.Errorf("%s server not started", s.name)
+	}
+	s.started = false
+	err := s.listener.Close()
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+	s.lock.Unlock()
+	// sessions return once their connection is closed
+	s.wg.Wait()
+	s._log.Infof("%s server stopped!", s.name)
+	return err
+}
+
+func (s *Server) Name() string {
+	return s.name
+}
+
+func (s *Server) run(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				s._log.Errorf("%s accept: %v", s.name, err)
+			}
+			return
+		}
+		s.lock.Lock()
+		if !s.started {
+			s.lock.Unlock()
+			_ = conn.Close()
+			return
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.lock.Unlock()
+		go func() {
+			defer s.wg.Done()
+			s.Handle(conn)
+			s.lock.Lock()
+			delete(s.conns, conn)
+			s.lock.Unlock()
+		}()
+	}
+}
+
+// Handle serves one client until it quits or the connection breaks
+func (s *Server) Handle(conn net.Conn) {
+	defer conn.Close()
+	if s.debug {
+		s._log.Debugf("%s client connected from %s", s.name, conn.RemoteAddr())
+	}
+	sess := newSession(conn, s.agent)
+	if s.tracer != nil {
+		sess.span = s.tracer.NewSession(context.Background(), sessiontrace.SessionMeta{
+			Protocol: sessiontrace.ProtocolLMTP,
+			Remote:   conn.RemoteAddr().String(),
+			Local:    conn.LocalAddr().String(),
+		})
+		sess.span.Event("connect", nil)
+		defer sess.span.End("disconnect", nil)
+	}
+	if err := sess.serve(); err != nil && s.debug {
+		s._log.Debugf("%s client %s: %v", s.name, conn.RemoteAddr(), err)
+	}
+}
@@ -0,0 +1,307 @@
+package lmtp
+
+import (
+	"bufio"
+	"bytes"
+	"easymail/internal/app/service/filter"
+	"easymail/internal/observability/sessiontrace"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	maxLineSize = 4 << 10
+	// maxMessageSize is announced with SIZE, postfix checks it before it connects
+	maxMessageSize = 64 << 20
+	maxRecipients  = 1000
+)
+
+var errTooBig = errors.New("message too big")
+
+type session struct {
+	conn  net.Conn
+	r     *bufio.Reader
+	w     *bufio.Writer
+	agent *agent
+	span  sessiontrace.Session
+
+	helo   string
+	sender *string
+	rcpts  []string
+}
+
+func newSession(conn net.Conn, a *agent) *session {
+	return &session{
+		conn:  conn,
+		r:     bufio.NewReaderSize(conn, maxLineSize),
+		w:     bufio.NewWriter(conn),
+		agent: a,
+	}
+}
+
+func (s *session) event(stage string, fields map[string]any) {
+	if s.span != nil {
+		s.span.Event(stage, fields)
+	}
+}
+
+// reply writes a response and flushes it
+func (s *session) reply(code int, enhanced, text string) error {
+	if _, err := fmt.Fprintf(s.w, "%d %s %s\r\n", code, enhanced, text); err != nil {
+		return err
+	}
+	return s.w.Flush()
+}
+
+func (s *session) reset() {
+	s.sender = nil
+	s.rcpts = s.rcpts[:0]
+}
+
+// readLine reads a command line, a line over the limit is dropped and reported as too long
+func (s *session) readLine() (string, error) {
+	_ = s.conn.SetReadDeadline(time.Now().Add(idleTimeout))
+	line, err := s.r.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		for errors.Is(err, bufio.ErrBufferFull) {
+			_, err = s.r.ReadSlice('\n')
+		}
+		if err != nil {
+			return "", err
+		}
+		return "", errTooBig
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+/*
+readData reads the message up to the line with a single dot, leading dots are
+unstuffed. A message over maxMessageSize is read to the end and dropped.
+*/
+func (s *session) readData() ([]byte, error) {
+	var buf bytes.Buffer
+	start, tooBig := true, false
+	for {
+		_ = s.conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		line, err := s.r.ReadSlice('\n')
+		if err != nil && !errors.Is(err, bufio.ErrBufferFull) {
+			return nil, err
+		}
+		complete := err == nil
+		if start && complete && (string(line) == ".\r\n" || string(line) == ".\n") {
+			break
+		}
+		if start && line[0] == '.' {
+			line = line[1:]
+		}
+		if buf.Len()+len(line) > maxMessageSize {
+			tooBig = true
+		}
+		if !tooBig {
+			buf.Write(line)
+		}
+		start = complete
+	}
+	if tooBig {
+		return nil, errTooBig
+	}
+	return buf.Bytes(), nil
+}
+
+// path parses the address of MAIL FROM:<addr> or RCPT TO:<addr>, the parameters after it are returned too
+func path(arg, prefix string) (addr string, params []string, ok bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", nil, false
+	}
+	arg = strings.TrimLeft(arg[len(prefix):], " ")
+	if !strings.HasPrefix(arg, "<") {
+		return "", nil, false
+	}
+	end := strings.IndexByte(arg, '>')
+	if end < 0 {
+		return "", nil, false
+	}
+	addr = arg[1:end]
+	// a source route is ignored, @a,@b:user@domain
+	if i := strings.IndexByte(addr, ':'); i >= 0 && strings.HasPrefix(addr, "@") {
+		addr = addr[i+1:]
+	}
+	return addr, strings.Fields(arg[end+1:]), true
+}
+
+func (s *session) serve() error {
+	if err := s.reply(220, "2.0.0", s.agent.hostname+" LMTP easymail ready"); err != nil {
+		return err
+	}
+	for {
+		line, err := s.readLine()
+		if errors.Is(err, errTooBig) {
+			if err = s.reply(500, "5.5.2", "Line too long"); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		done, err := s.command(strings.ToUpper(verb), strings.TrimSpace(arg))
+		if err != nil || done {
+			return err
+		}
+	}
+}
+
+// command runs one command, done is set when the session ends
+func (s *session) command(verb, arg string) (done bool, err error) {
+	switch verb {
+	case "LHLO":
+		if arg == "" {
+			return false, s.reply(501, "5.5.4", "Syntax: LHLO hostname")
+		}
+		s.helo = arg
+		s.reset()
+		s.event("lhlo", map[string]any{"helo": arg})
+		_, err = fmt.Fprintf(s.w, "250-%s\r\n250-PIPELINING\r\n250-ENHANCEDSTATUSCODES\r\n250-8BITMIME\r\n250 SIZE %d\r\n",
+			s.agent.hostname, maxMessageSize)
+		if err != nil {
+			return true, err
+		}
+		return false, s.w.Flush()
+	case "HELO", "EHLO":
+		return false, s.reply(500, "5.5.1", "This is LMTP, use LHLO")
+	case "MAIL":
+		return false, s.mail(arg)
+	case "RCPT":
+		return false, s.rcpt(arg)
+	case "DATA":
+		return false, s.data()
+	case "RSET":
+		s.reset()
+		return false, s.reply(250, "2.0.0", "Ok")
+	case "NOOP":
+		return false, s.reply(250, "2.0.0", "Ok")
+	case "VRFY":
+		return false, s.reply(252, "2.5.0", "Cannot VRFY user")
+	case "QUIT":
+		return true, s.reply(221, "2.0.0", "Bye")
+	}
+	return false, s.reply(500, "5.5.2", "Command not recognized")
+}
+
+func (s *session) mail(arg string) error {
+	if s.helo == "" {
+		return s.reply(503, "5.5.1", "Send LHLO first")
+	}
+	if s.sender != nil {
+		return s.reply(503, "5.5.1", "Nested MAIL command")
+	}
+	sender, params, ok := path(arg, "FROM:")
+	if !ok {
+		return s.reply(501, "5.5.4", "Syntax: MAIL FROM:<address>")
+	}
+	for _, param := range params {
+		key, value, _ := strings.Cut(param, "=")
+		if strings.EqualFold(key, "SIZE") {
+			if size, err := strconv.ParseInt(value, 10, 64); err == nil && size > maxMessageSize {
+				return s.reply(552, "5.3.4", "Message size exceeds fixed limit")
+			}
+		}
+	}
+	s.sender = &sender
+	s.event("mail_from", map[string]any{"sender": sessiontrace.MaskEmail(sender)})
+	return s.reply(250, "2.1.0", "Ok")
+}
+
+func (s *session) rcpt(arg string) error {
+	if s.sender == nil {
+		return s.reply(503, "5.5.1", "Need MAIL command")
+	}
+	rcpt, _, ok := path(arg, "TO:")
+	if !ok || rcpt == "" {
+		return s.reply(501, "5.5.4", "Syntax: RCPT TO:<address>")
+	}
+	if len(s.rcpts) >= maxRecipients {
+		return s.reply(452, "4.5.3", "Too many recipients")
+	}
+	rcpt = strings.ToLower(rcpt)
+	acc, st := s.agent.account(rcpt)
+	if acc != nil {
+		// a message that does not fit later is still refused for the recipient after DATA
+		st = s.agent.quota(acc, 0)
+		if st.ok() {
+			st = status{250, "2.1.5", "Ok"}
+		}
+	}
+	s.event("rcpt", map[string]any{"rcpt": sessiontrace.MaskEmail(rcpt), "code": st.code})
+	if !st.ok() {
+		return s.reply(st.code, st.enhanced, fmt.Sprintf("<%s> %s", rcpt, st.text))
+	}
+	s.rcpts = append(s.rcpts, rcpt)
+	return s.reply(st.code, st.enhanced, st.text)
+}
+
+// data reads the message and answers for every accepted recipient in order
+func (s *session) data() error {
+	if s.sender == nil {
+		return s.reply(503, "5.5.1", "Need MAIL command")
+	}
+	if len(s.rcpts) == 0 {
+		return s.reply(503, "5.5.1", "No valid recipients")
+	}
+	if _, err := s.w.WriteString("354 Start mail input; end with <CRLF>.<CRLF>\r\n"); err != nil {
+		return err
+	}
+	if err := s.w.Flush(); err != nil {
+		return err
+	}
+	defer s.reset()
+	raw, err := s.readData()
+	if err != nil && !errors.Is(err, errTooBig) {
+		return err
+	}
+	s.event("data", map[string]any{"size": len(raw), "rcpts": len(s.rcpts), "too_big": err != nil})
+
+	statuses := make(map[string]status, len(s.rcpts))
+	if err == nil {
+		env := &envelope{Sender: *s.sender, Helo: s.helo, Remote: s.conn.RemoteAddr().String(), Raw: raw}
+		msg, parseErr := mail.ReadMessage(bytes.NewReader(raw))
+		if parseErr == nil {
+			env.Header = msg.Header
+		} else {
+			// a message with broken headers is still delivered, it just has no header fields
+			env.Header = mail.Header{}
+		}
+		// the folder is taken from the header, it is not stored or forwarded with the message
+		env.Raw = stripHeader(raw, filter.FolderHeader)
+		for _, rcpt := range s.rcpts {
+			// a recipient given twice gets the message once
+			if _, ok := statuses[rcpt]; !ok {
+				statuses[rcpt] = s.agent.deliver(env, rcpt)
+			}
+		}
+	}
+	for _, rcpt := range s.rcpts {
+		st, ok := statuses[rcpt]
+		if !ok {
+			st = status{552, "5.3.4", "Message size exceeds fixed limit"}
+		}
+		s.event("deliver", map[string]any{"rcpt": sessiontrace.MaskEmail(rcpt), "code": st.code})
+		if _, err = fmt.Fprintf(s.w, "%d %s <%s> %s\r\n", st.code, st.enhanced, rcpt, st.text); err != nil {
+			return err
+		}
+	}
+	return s.w.Flush()
+}
@@ -0,0 +1,220 @@
+package lmtp
+
+import (
+	"bufio"
+	"easymail/internal/app/service/filter"
+	"easymail/internal/app/service/sieve"
+	"easymail/internal/model"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testMessage = "Received: from mx.example.org (mx.example.org [192.0.2.1])\r\n" +
+	"\tby mail.example.com (Postfix) with ESMTPS id 4Xk9Lp2sQ7z1\r\n" +
+	"\tfor <bob@example.com>; Mon, 12 Oct 2026 10:00:00 +0800\r\n" +
+	"From: Alice <alice@example.org>\r\n" +
+	"To: Bob <bob@example.com>, carol@example.com\r\n" +
+	"Subject: =?UTF-8?B?5Lya6K6u?= notes\r\n" +
+	"Date: Mon, 12 Oct 2026 09:59:58 +0800\r\n" +
+	"X-Easymail-Folder: Trash\r\n" +
+	"\r\n" +
+	"..leading dot\r\n" +
+	"bye\r\n"
+
+type fakeDeliverer struct {
+	emails []model.Email
+	raws   []string
+}
+
+func (f *fakeDeliverer) Deliver(msg sieve.Message, email *model.Email) (*sieve.Delivery, error) {
+	if msg.Rcpt == "carol@example.com" {
+		return &sieve.Delivery{Rejected: true, Reject: "not\r\nwanted"}, nil
+	}
+	f.emails = append(f.emails, *email)
+	f.raws = append(f.raws, string(msg.Raw))
+	return &sieve.Delivery{Stored: []int64{int64(len(f.emails))}}, nil
+}
+
+type fakeRelay struct {
+	sent [][]string
+	msgs []string
+}
+
+func (f *fakeRelay) Send(from string, to []string, msg []byte) error {
+	f.sent = append(f.sent, append([]string{from}, to...))
+	f.msgs = append(f.msgs, string(msg))
+	return nil
+}
+
+type fakeSealer struct{}
+
+func (fakeSealer) Seal(domain string, raw []byte) ([]byte, error) {
+	return append([]byte("ARC-Seal: d="+domain+"\r\n"), raw...), nil
+}
+
+func testAgent(t *testing.T, d Deliverer, relay Relay) *agent {
+	a := newAgent()
+	a.hostname = "lmtp.example.com"
+	a.deliverer = d
+	a.relay = relay
+	a.logf = t.Logf
+	accounts := map[string]*model.Account{
+		"bob@example.com":   {ID: 1, DomainID: 1, Active: true},
+		"carol@example.com": {ID: 2, DomainID: 1, Active: true},
+		"full@example.com":  {ID: 3, DomainID: 1, Active: true, StorageQuota: 1},
+	}
+	a.findAccount = func(name string) (*model.Account, error) {
+		if acc, ok := accounts[name]; ok {
+			return acc, nil
+		}
+		return nil, model.ErrAccountNotExists
+	}
+	a.findDomain = func(id int64) (*model.Domain, error) {
+		return &model.Domain{ID: id, Name: "example.com", Active: true}, nil
+	}
+	a.usage = func(accountID int64) (int64, error) {
+		if accountID == 3 {
+			return 1 << 20, nil
+		}
+		return 0, nil
+	}
+	conditions, _ := json.Marshal([]model.PersonalCondition{{Field: model.PersonalFieldFrom, Operator: model.OperatorContains, Value: "alice"}})
+	actions, _ := json.Marshal([]model.PersonalAction{
+		{Type: model.PersonalActionRead},
+		{Type: model.PersonalActionForward, Address: "archive@example.net"},
+	})
+	a.personalRules = func(accountID int64) ([]model.PersonalRule, error) {
+		if accountID != 1 {
+			return nil, nil
+		}
+		return []model.PersonalRule{{ID: 9, Logic: model.ConditionAnd, Conditions: string(conditions), Actions: string(actions)}}, nil
+	}
+	return a
+}
+
+func TestSession(t *testing.T) {
+	deliverer := &fakeDeliverer{}
+	relay := &fakeRelay{}
+	server, conn := net.Pipe()
+	done := make(chan error, 1)
+	a := testAgent(t, deliverer, relay)
+	a.sealer = fakeSealer{}
+	go func() {
+		done <- newSession(server, a).serve()
+	}()
+	r := bufio.NewReader(conn)
+	expect := func(prefix string) string {
+		t.Helper()
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(line, prefix) {
+			t.Fatalf("expected %q, got %q", prefix, line)
+		}
+		return line
+	}
+	send := func(line string) {
+		t.Helper()
+		if _, err := fmt.Fprintf(conn, "%s\r\n", line); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expect("220 ")
+	send("EHLO mx")
+	expect("500 ")
+	send("MAIL FROM:<alice@example.org>")
+	expect("503 ")
+	send("LHLO mail.example.com")
+	// the last line of the multiline reply has a space after the code
+	for line := expect("250"); line[3] == '-'; line = expect("250") {
+	}
+	send("MAIL FROM:<alice@example.org> SIZE=300 BODY=8BITMIME")
+	expect("250 2.1.0")
+	send("RCPT TO:<nobody@example.com>")
+	expect("550 5.1.1 <nobody@example.com>")
+	send("RCPT TO:<full@example.com>")
+	expect("552 5.2.2")
+	send("RCPT TO:<Bob@example.com>")
+	expect("250 2.1.5")
+	send("RCPT TO:<carol@example.com>")
+	expect("250 2.1.5")
+	send("RCPT TO:<bob@example.com>")
+	expect("250 2.1.5")
+	send("DATA")
+	expect("354 ")
+	if _, err := conn.Write([]byte(testMessage + ".\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	// one reply for every accepted recipient, in order
+	expect("250 2.0.0 <bob@example.com>")
+	expect("550 5.7.1 <carol@example.com> not wanted")
+	expect("250 2.0.0 <bob@example.com>")
+	send("DATA")
+	expect("503 ")
+	send("QUIT")
+	expect("221 ")
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if len(deliverer.emails) != 1 {
+		t.Fatalf("expected one stored email, got %d", len(deliverer.emails))
+	}
+	email := deliverer.emails[0]
+	if email.Subject != "会议 notes" || email.Sender != "alice@example.org" || email.Recipient != "bob@example.com,carol@example.com" ||
+		email.QueueID != "4Xk9Lp2sQ7z1" || email.FolderId != int64(model.Trash) || email.ReadStatus != model.ImapRead ||
+		email.Size != int64(len(deliverer.raws[0])) || email.Date.Day() != 12 {
+		t.Fatalf("unexpected email %+v", email)
+	}
+	raw := deliverer.raws[0]
+	if !strings.HasPrefix(raw, "Return-Path: <alice@example.org>\r\nDelivered-To: bob@example.com\r\n") ||
+		!strings.Contains(raw, "\r\n.leading dot\r\n") || strings.Contains(raw, filter.FolderHeader) {
+		t.Fatalf("unexpected stored message %q", raw)
+	}
+	if len(relay.sent) != 1 || relay.sent[0][0] != "alice@example.org" || relay.sent[0][1] != "archive@example.net" {
+		t.Fatalf("unexpected forwards %v", relay.sent)
+	}
+	// the forward is sealed by the domain of the recipient
+	if !strings.HasPrefix(relay.msgs[0], "ARC-Seal: d=example.com\r\nReturn-Path: <alice@example.org>\r\n") ||
+		strings.Contains(relay.msgs[0], filter.FolderHeader) {
+		t.Fatalf("unexpected forwarded message %q", relay.msgs[0])
+	}
+}
+
+func TestStripHeader(t *testing.T) {
+	cases := []struct{ raw, expected string }{
+		{"A: 1\r\nX-Easymail-Folder: Trash\r\nB: 2\r\n\r\nbody\r\n", "A: 1\r\nB: 2\r\n\r\nbody\r\n"},
+		// folded lines go with their field, a field of the same name in the body is kept
+		{"x-easymail-folder : a\r\n\tb\r\nA: 1\r\n continued\r\n\r\nX-Easymail-Folder: Inbox\r\n", "A: 1\r\n continued\r\n\r\nX-Easymail-Folder: Inbox\r\n"},
+		{"X-Easymail-Folder-Note: kept\nX-Easymail-Folder: Trash\n", "X-Easymail-Folder-Note: kept\n"},
+	}
+	for _, c := range cases {
+		if got := string(stripHeader([]byte(c.raw), filter.FolderHeader)); got != c.expected {
+			t.Fatalf("%q: expected %q, got %q", c.raw, c.expected, got)
+		}
+	}
+}
+
+func TestVacationLog(t *testing.T) {
+	l := newVacationLog()
+	if !l.reply("1\x00h\x00alice@example.org", 24*time.Hour) {
+		t.Fatal("first reply must be sent")
+	}
+	if l.reply("1\x00h\x00alice@example.org", 24*time.Hour) {
+		t.Fatal("second reply within the period must not be sent")
+	}
+	if !l.reply("1\x00other\x00alice@example.org", 24*time.Hour) {
+		t.Fatal("another handle gets its own reply")
+	}
+	msg := string(vacationMessage(&sieve.Vacation{To: "alice@example.org", From: "bob@example.com", Subject: "Auto: 会议", Reason: "away\nback monday"}, "<m1@example.org>"))
+	if !strings.Contains(msg, "Auto-Submitted: auto-replied") || !strings.Contains(msg, "In-Reply-To: <m1@example.org>\r\n") ||
+		!strings.HasSuffix(msg, "\r\n\r\naway\r\nback monday\r\n") || !strings.Contains(msg, "Subject: =?utf-8?q?") {
+		t.Fatalf("unexpected vacation message %q", msg)
+	}
+}
@@ -0,0 +1,189 @@
+package mailrule
+
+import (
+	"easymail/internal/model"
+	"errors"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+var (
+	wordDecoder = new(mime.WordDecoder)
+	// patterns caches compiled regex conditions, rules are read on every delivery
+	patterns sync.Map
+)
+
+// Message is what personal rules see of a message delivered to one recipient
+type Message struct {
+	Sender string
+	Rcpt   string
+	Header mail.Header
+}
+
+/*
+Delivery is the outcome of the personal rules of a recipient, the message is
+stored in Folder unless it is discarded, and copies go to Forward.
+*/
+type Delivery struct {
+	Folder  model.FolderID
+	Read    bool
+	Forward []string
+	Discard bool
+	// Rules are the ids of the matched rules in order
+	Rules []int64
+}
+
+/*
+Evaluate runs the personal rules of a recipient in order, the actions of every
+matched rule are applied until a rule asks to stop. A rule that can not be
+parsed is skipped and reported in the error, the others still apply.
+*/
+func Evaluate(rules []model.PersonalRule, msg Message, folder model.FolderID) (Delivery, error) {
+	d := Delivery{Folder: folder, Forward: make([]string, 0), Rules: make([]int64, 0)}
+	errs := make([]error, 0)
+	for _, rule := range rules {
+		conditions, actions, err := rule.Parse()
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if !matchRule(rule.Logic, conditions, msg) {
+			continue
+		}
+		d.Rules = append(d.Rules, rule.ID)
+		for _, a := range actions {
+			switch a.Type {
+			case model.PersonalActionMove:
+				d.Folder = a.Folder
+			case model.PersonalActionRead:
+				d.Read = true
+			case model.PersonalActionForward:
+				d.Forward = append(d.Forward, a.Address)
+			case model.PersonalActionDiscard:
+				d.Discard = true
+			}
+		}
+		if rule.Stop {
+			break
+		}
+	}
+	return d, errors.Join(errs...)
+}
+
+func matchRule(logic model.ConditionLogic, conditions []model.PersonalCondition, msg Message) bool {
+	if len(conditions) == 0 {
+		return false
+	}
+	for _, c := range conditions {
+		matched := match(c, msg)
+		if logic == model.ConditionOr && matched {
+			return true
+		}
+		if logic != model.ConditionOr && !matched {
+			return false
+		}
+	}
+	return logic != model.ConditionOr
+}
+
+// values returns the values of the field, header values are decoded
+func values(c model.PersonalCondition, msg Message) []string {
+	switch c.Field {
+	case model.PersonalFieldSender:
+		return []string{msg.Sender}
+	case model.PersonalFieldRcpt:
+		return []string{msg.Rcpt}
+	case model.PersonalFieldFrom:
+		return addresses(msg.Header, "From")
+	case model.PersonalFieldTo:
+		return append(addresses(msg.Header, "To"), addresses(msg.Header, "Cc")...)
+	case model.PersonalFieldSubject:
+		return decoded(msg.Header["Subject"])
+	case model.PersonalFieldHeader:
+		return decoded(msg.Header[textproto.CanonicalMIMEHeaderKey(c.Header)])
+	}
+	return nil
+}
+
+// addresses returns the addresses of an address header, it falls back to the
+// raw value when the header does not parse.
+func addresses(h mail.Header, key string) []string {
+	list, err := h.AddressList(key)
+	if err != nil {
+		return decoded(h[key])
+	}
+	result := make([]string, 0, len(list))
+	for _, a := range list {
+		result = append(result, a.Address)
+	}
+	return result
+}
+
+func decoded(raw []string) []string {
+	result := make([]string, 0, len(raw))
+	for _, v := range raw {
+		if s, err := wordDecoder.DecodeHeader(v); err == nil {
+			v = s
+		}
+		result = append(result, v)
+	}
+	return result
+}
+
+// match compares case insensitively like sieve does, a negated operator
+// matches when no value equals.
+func match(c model.PersonalCondition, msg Message) bool {
+	vs := values(c, msg)
+	if c.Operator == model.OperatorNotEquals {
+		for _, v := range vs {
+			if strings.EqualFold(v, c.Value) {
+				return false
+			}
+		}
+		return true
+	}
+	want := strings.ToLower(c.Value)
+	for _, v := range vs {
+		v = strings.ToLower(v)
+		switch c.Operator {
+		case model.OperatorEquals:
+			if v == want {
+				return true
+			}
+		case model.OperatorContains:
+			if strings.Contains(v, want) {
+				return true
+			}
+		case model.OperatorHasPrefix:
+			if strings.HasPrefix(v, want) {
+				return true
+			}
+		case model.OperatorHasSuffix:
+			if strings.HasSuffix(v, want) {
+				return true
+			}
+		case model.OperatorRegex:
+			re := pattern(c.Value)
+			if re != nil && re.MatchString(v) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func pattern(expr string) *regexp.Regexp {
+	if re, ok := patterns.Load(expr); ok {
+		return re.(*regexp.Regexp)
+	}
+	re, err := regexp.Compile("(?i)" + expr)
+	if err != nil {
+		return nil
+	}
+	patterns.Store(expr, re)
+	return re
+}
@@ -0,0 +1,62 @@
+package mailrule
+
+import (
+	"easymail/internal/model"
+	"encoding/json"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+func personalRule(t *testing.T, id int64, logic model.ConditionLogic, stop bool, conditions []model.PersonalCondition, actions ...model.PersonalAction) model.PersonalRule {
+	c, err := json.Marshal(conditions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := json.Marshal(actions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return model.PersonalRule{ID: id, Logic: logic, Stop: stop, Conditions: string(c), Actions: string(a)}
+}
+
+func TestEvaluate(t *testing.T) {
+	raw := "From: Shop <News@Shop.example.com>\r\nTo: me@example.com\r\nSubject: =?UTF-8?B?5LyY5oOg?= weekly deals\r\nList-Id: <deals.shop.example.com>\r\n\r\nbody\r\n"
+	m, err := mail.ReadMessage(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := Message{Sender: "bounce@shop.example.com", Rcpt: "me@example.com", Header: m.Header}
+
+	rules := []model.PersonalRule{
+		personalRule(t, 1, model.ConditionAnd, false, []model.PersonalCondition{
+			{Field: model.PersonalFieldFrom, Operator: model.OperatorHasSuffix, Value: "@shop.example.com"},
+			{Field: model.PersonalFieldSubject, Operator: model.OperatorContains, Value: "优惠"},
+		}, model.PersonalAction{Type: model.PersonalActionMove, Folder: model.Trash}, model.PersonalAction{Type: model.PersonalActionRead}),
+		personalRule(t, 2, model.ConditionOr, true, []model.PersonalCondition{
+			{Field: model.PersonalFieldSender, Operator: model.OperatorEquals, Value: "nobody@example.org"},
+			{Field: model.PersonalFieldHeader, Header: "list-id", Operator: model.OperatorRegex, Value: `deals\.shop`},
+		}, model.PersonalAction{Type: model.PersonalActionForward, Address: "archive@example.com"}),
+		// not reached, the rule before stops
+		personalRule(t, 3, model.ConditionAnd, false, []model.PersonalCondition{
+			{Field: model.PersonalFieldRcpt, Operator: model.OperatorNotEquals, Value: "other@example.com"},
+		}, model.PersonalAction{Type: model.PersonalActionDiscard}),
+	}
+	d, err := Evaluate(rules, msg, model.Inbox)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Folder != model.Trash || !d.Read || d.Discard || len(d.Forward) != 1 || d.Forward[0] != "archive@example.com" {
+		t.Fatalf("unexpected delivery %+v", d)
+	}
+	if len(d.Rules) != 2 || d.Rules[0] != 1 || d.Rules[1] != 2 {
+		t.Fatalf("unexpected matched rules %v", d.Rules)
+	}
+
+	// a broken rule is reported, the others apply
+	rules[0].Actions = "{"
+	d, err = Evaluate(rules, msg, model.Inbox)
+	if err == nil || d.Folder != model.Inbox || len(d.Rules) != 1 {
+		t.Fatalf("unexpected delivery %+v, err %v", d, err)
+	}
+}
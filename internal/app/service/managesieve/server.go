@@ -0,0 +1,229 @@
+package managesieve
+
+import (
+	"context"
+	"crypto/tls"
+	"easymail/internal/app/service/auth"
+	"easymail/internal/easylog"
+	"easymail/internal/model"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// idleTimeout closes sessions without a command for a while
+const idleTimeout = 30 * time.Minute
+
+// Authenticator checks the credentials of a user, *auth.Service implements it
+type Authenticator interface {
+	Authenticate(ctx context.Context, username, password string) (*auth.Account, error)
+}
+
+// ScriptStore keeps the sieve scripts of the accounts
+type ScriptStore interface {
+	List(accountID int64) ([]model.SieveScript, error)
+	Get(accountID int64, name string) (*model.SieveScript, error)
+	Put(accountID int64, name, content string) error
+	SetActive(accountID int64, name string) error
+	Delete(accountID int64, name string) error
+	Rename(accountID int64, oldName, newName string) error
+}
+
+// modelStore keeps the scripts in the database
+type modelStore struct{}
+
+func (modelStore) List(accountID int64) ([]model.SieveScript, error) {
+	return model.ListSieveScripts(accountID)
+}
+
+func (modelStore) Get(accountID int64, name string) (*model.SieveScript, error) {
+	return model.GetSieveScript(accountID, name)
+}
+
+func (modelStore) Put(accountID int64, name, content string) error {
+	return model.PutSieveScript(accountID, name, content)
+}
+
+func (modelStore) SetActive(accountID int64, name string) error {
+	return model.SetActiveSieveScript(accountID, name)
+}
+
+func (modelStore) Delete(accountID int64, name string) error {
+	return model.DeleteSieveScript(accountID, name)
+}
+
+func (modelStore) Rename(accountID int64, oldName, newName string) error {
+	return model.RenameSieveScript(accountID, oldName, newName)
+}
+
+/*
+Server managesieve server (RFC 5804), users upload and activate the sieve
+scripts run at delivery. Passwords are only taken over TLS, or from local
+clients on a loopback address or unix socket.
+*/
+type Server struct {
+	name     string
+	family   string
+	listen   string
+	debug    bool
+	lock     *sync.Mutex
+	started  bool
+	_log     *easylog.Logger
+	listener net.Listener
+	// conns are the open sessions, they are closed on stop
+	conns map[net.Conn]struct{}
+	wg    sync.WaitGroup
+
+	auth      Authenticator
+	store     ScriptStore
+	tlsConfig *tls.Config
+}
+
+func New(family, listen string) *Server {
+	if family != "tcp" && family != "unix" {
+		return nil
+	}
+	if family == "tcp" {
+		if _, _, err := net.SplitHostPort(listen); err != nil {
+			return nil
+		}
+	}
+	if family == "unix" && strings.TrimSpace(listen) == "" {
+		return nil
+	}
+	return &Server{
+		name:   "managesieve",
+		family: family,
+		listen: listen,
+		lock:   &sync.Mutex{},
+		conns:  make(map[net.Conn]struct{}),
+		store:  modelStore{},
+	}
+}
+
+func (s *Server) SetDebug(debug bool) {
+	s.debug = debug
+}
+
+func (s *Server) SetLogger(_log *easylog.Logger) error {
+	if _log == nil {
+		return fmt.Errorf("%s logger is nil", s.name)
+	}
+	s._log = _log
+	return nil
+}
+
+// SetAuthenticator sets the service checking user credentials, it is required
+func (s *Server) SetAuthenticator(a Authenticator) {
+	s.auth = a
+}
+
+// SetTLSConfig offers STARTTLS with the certificates of config
+func (s *Server) SetTLSConfig(config *tls.Config) {
+	s.tlsConfig = config
+}
+
+func (s *Server) Start() error {
+	if s._log == nil {
+		return fmt.Errorf("%s logger is nil", s.name)
+	}
+	if s.auth == nil {
+		return fmt.Errorf("%s authenticator is nil", s.name)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.started {
+		return fmt.Errorf("%s server already started", s.name)
+	}
+	listener, err := net.Listen(s.family, s.listen)
+	if err != nil {
+		return err
+	}
+	s.listener = listener
+	s.started = true
+	s._log.Infof("%s server started!", s.name)
+	go s.run(listener)
+	return nil
+}
+
+func (s *Server) Stop() error {
+	s.lock.Lock()
+	if !s.started {
+		s.lock.Unlock()
+		return fmt.Errorf("%s server not started", s.name)
+	}
+	s.started = false
+	err := s.listener.Close()
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+	s.lock.Unlock()
+	// sessions return once their connection is closed
+	s.wg.Wait()
+	s._log.Infof("%s server stopped!", s.name)
+	return err
+}
+
+func (s *Server) Name() string {
+	return s.name
+}
+
+func (s *Server) run(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				s._log.Errorf("%s accept: %v", s.name, err)
+			}
+			return
+		}
+		s.lock.Lock()
+		if !s.started {
+			s.lock.Unlock()
+			_ = conn.Close()
+			return
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.lock.Unlock()
+		go func() {
+			defer s.wg.Done()
+			s.Handle(conn)
+			s.lock.Lock()
+			delete(s.conns, conn)
+			s.lock.Unlock()
+		}()
+	}
+}
+
+// local tells a client on a unix socket or a loopback address
+func local(conn net.Conn) bool {
+	switch addr := conn.RemoteAddr().(type) {
+	case *net.UnixAddr:
+		return true
+	case *net.TCPAddr:
+		return addr.IP.IsLoopback()
+	}
+	return false
+}
+
+// Handle serves one client until it logs out or the connection breaks
+func (s *Server) Handle(conn net.Conn) {
+	defer conn.Close()
+	if s.debug {
+		s._log.Debugf("%s client connected from %s", s.name, conn.RemoteAddr())
+	}
+	sess := newSession(conn, s.auth, s.store)
+	sess.tlsConfig = s.tlsConfig
+	sess.secure = local(conn)
+	if err := sess.serve(); err != nil && s.debug {
+		s._log.Debugf("%s client %s: %v", s.name, conn.RemoteAddr(), err)
+	}
+	if sess.account != nil {
+		s._log.Infof("%s %s logged out", s.name, sess.account.Username)
+	}
+}
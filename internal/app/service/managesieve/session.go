@@ -0,0 +1,474 @@
+package managesieve
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"easymail/internal/app/service/auth"
+	"easymail/internal/app/service/sieve"
+	"easymail/internal/model"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	maxLineSize     = 8 << 10
+	maxAuthFailures = 3
+	maxNameLength   = 128
+)
+
+// errSyntax is answered with NO, the session goes on
+var errSyntax = errors.New("syntax error")
+
+type session struct {
+	conn     net.Conn
+	r        *bufio.Reader
+	w        *bufio.Writer
+	auth     Authenticator
+	store    ScriptStore
+	account  *auth.Account
+	failures int
+	// tlsConfig offers STARTTLS when set
+	tlsConfig *tls.Config
+	// secure is set on tls and local connections, passwords are only taken on them
+	secure bool
+	tls    bool
+}
+
+func newSession(conn net.Conn, a Authenticator, store ScriptStore) *session {
+	return &session{
+		conn:  conn,
+		r:     bufio.NewReaderSize(conn, maxLineSize),
+		w:     bufio.NewWriter(conn),
+		auth:  a,
+		store: store,
+	}
+}
+
+// quote writes a string as quoted string, or as literal when it spans lines
+func quote(s string) string {
+	if strings.ContainsAny(s, "\r\n\x00") || len(s) > 1024 {
+		return fmt.Sprintf("{%d}\r\n%s", len(s), s)
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+func (s *session) writeLine(line string) error {
+	if _, err := s.w.WriteString(line + "\r\n"); err != nil {
+		return err
+	}
+	return s.w.Flush()
+}
+
+func (s *session) ok(text string) error {
+	if text == "" {
+		return s.writeLine("OK")
+	}
+	return s.writeLine("OK " + quote(text))
+}
+
+// no answers a failed command, code is a response code like NONEXISTENT
+func (s *session) no(code, text string) error {
+	if code != "" {
+		return s.writeLine(fmt.Sprintf("NO (%s) %s", code, quote(text)))
+	}
+	return s.writeLine("NO " + quote(text))
+}
+
+func (s *session) bye(text string) error {
+	return s.writeLine("BYE " + quote(text))
+}
+
+func (s *session) capability() error {
+	lines := []string{
+		`"IMPLEMENTATION" "easymail"`,
+		`"SIEVE" ` + quote(strings.Join(sieve.Extensions, " ")),
+		`"SASL" ""`,
+		`"MAXREDIRECTS" ` + quote(strconv.Itoa(sieve.MaxRedirects)),
+		`"VERSION" "1.0"`,
+	}
+	if s.secure {
+		lines[2] = `"SASL" "PLAIN"`
+	} else if s.tlsConfig != nil {
+		lines = append(lines, `"STARTTLS"`)
+	}
+	for _, line := range lines {
+		if _, err := s.w.WriteString(line + "\r\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *session) readLine() (string, error) {
+	line, err := s.r.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return "", errors.New("line too long")
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+/*
+readCommand reads a command with its arguments, quoted strings and literals
+are unquoted. A literal may be written as {n+} or {n}, the server never asks
+for continuation.
+*/
+func (s *session) readCommand() ([]string, error) {
+	args := make([]string, 0, 4)
+	var syntax error
+	for {
+		_ = s.conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		line, err := s.readLine()
+		if err != nil {
+			return nil, err
+		}
+		literal := -1
+		rest := line
+		for syntax == nil {
+			rest = strings.TrimLeft(rest, " ")
+			if rest == "" {
+				break
+			}
+			switch rest[0] {
+			case '"':
+				str, n, err := unquote(rest)
+				if err != nil {
+					syntax = err
+					break
+				}
+				args = append(args, str)
+				rest = rest[n:]
+			case '{':
+				size := strings.TrimSuffix(strings.TrimPrefix(rest, "{"), "}")
+				n, err := strconv.Atoi(strings.TrimSuffix(size, "+"))
+				if !strings.HasSuffix(rest, "}") || err != nil || n < 0 {
+					syntax = errSyntax
+					break
+				}
+				literal, rest = n, ""
+			default:
+				end := strings.IndexByte(rest, ' ')
+				if end < 0 {
+					end = len(rest)
+				}
+				args = append(args, rest[:end])
+				rest = rest[end:]
+			}
+		}
+		if literal < 0 {
+			if syntax != nil {
+				return nil, syntax
+			}
+			return args, nil
+		}
+		if literal > model.MaxSieveScriptSize {
+			return nil, fmt.Errorf("literal of %d bytes is too large", literal)
+		}
+		data := make([]byte, literal)
+		if _, err = io.ReadFull(s.r, data); err != nil {
+			return nil, err
+		}
+		args = append(args, string(data))
+		// the command goes on after the literal up to the end of line
+	}
+}
+
+// unquote reads a quoted string at the start of s and returns how much it took
+func unquote(s string) (string, int, error) {
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			return b.String(), i + 1, nil
+		case '\\':
+			i++
+			if i == len(s) || (s[i] != '"' && s[i] != '\\') {
+				return "", 0, errSyntax
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return "", 0, errSyntax
+}
+
+// validName checks a script name as RFC 5804 section 1.6 asks
+func validName(name string) bool {
+	if name == "" || utf8.RuneCountInString(name) > maxNameLength || !utf8.ValidString(name) {
+		return false
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) || r == '\u2028' || r == '\u2029' {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *session) serve() error {
+	if err := s.capability(); err != nil {
+		return err
+	}
+	if err := s.ok("easymail managesieve ready"); err != nil {
+		return err
+	}
+	for {
+		args, err := s.readCommand()
+		if errors.Is(err, errSyntax) {
+			if err = s.no("", "Syntax error"); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				_ = s.bye(err.Error())
+			}
+			return err
+		}
+		if len(args) == 0 {
+			continue
+		}
+		done, err := s.command(strings.ToUpper(args[0]), args[1:])
+		if err != nil || done {
+			return err
+		}
+	}
+}
+
+// command runs one command, done is set when the session ends
+func (s *session) command(name string, args []string) (done bool, err error) {
+	switch name {
+	case "CAPABILITY":
+		if err = s.capability(); err != nil {
+			return true, err
+		}
+		return false, s.ok("")
+	case "NOOP":
+		return false, s.ok("Done")
+	case "LOGOUT":
+		return true, s.ok("Logout completed")
+	case "STARTTLS":
+		return s.startTLS()
+	case "AUTHENTICATE":
+		return s.authenticate(args)
+	}
+	if s.account == nil {
+		return false, s.no("", "Authenticate first")
+	}
+
+	expect := map[string]int{
+		"LISTSCRIPTS": 0, "GETSCRIPT": 1, "PUTSCRIPT": 2, "CHECKSCRIPT": 1,
+		"SETACTIVE": 1, "DELETESCRIPT": 1, "RENAMESCRIPT": 2, "HAVESPACE": 2,
+	}
+	n, ok := expect[name]
+	if !ok {
+		return false, s.no("", "Unknown command "+name)
+	}
+	if len(args) != n {
+		return false, s.no("", "Syntax error")
+	}
+	switch name {
+	case "LISTSCRIPTS":
+		err = s.listScripts()
+	case "GETSCRIPT":
+		err = s.getScript(args[0])
+	case "PUTSCRIPT":
+		err = s.putScript(args[0], args[1])
+	case "CHECKSCRIPT":
+		if _, compileErr := sieve.Compile(args[0]); compileErr != nil {
+			err = s.no("", compileErr.Error())
+		} else {
+			err = s.ok("Script is valid")
+		}
+	case "SETACTIVE":
+		err = s.result(s.store.SetActive(s.account.ID, args[0]), "Script activated")
+	case "DELETESCRIPT":
+		err = s.result(s.store.Delete(s.account.ID, args[0]), "Script deleted")
+	case "RENAMESCRIPT":
+		if !validName(args[1]) {
+			return false, s.no("", "Invalid script name")
+		}
+		err = s.result(s.store.Rename(s.account.ID, args[0], args[1]), "Script renamed")
+	case "HAVESPACE":
+		err = s.haveSpace(args[0], args[1])
+	}
+	return false, err
+}
+
+// result answers a store operation, store errors are mapped to response codes
+func (s *session) result(err error, text string) error {
+	switch {
+	case err == nil:
+		return s.ok(text)
+	case errors.Is(err, model.ErrSieveScriptNotExists):
+		return s.no("NONEXISTENT", "Script does not exist")
+	case errors.Is(err, model.ErrSieveScriptExists):
+		return s.no("ALREADYEXISTS", "Script already exists")
+	case errors.Is(err, model.ErrSieveScriptActive):
+		return s.no("ACTIVE", "Script is active")
+	case errors.Is(err, model.ErrSieveScriptQuota):
+		return s.no("QUOTA/MAXSCRIPTS", err.Error())
+	}
+	return s.no("TRYLATER", err.Error())
+}
+
+// startTLS switches the connection to tls, the capabilities are sent again
+// as RFC 5804 section 2.2 asks
+func (s *session) startTLS() (bool, error) {
+	if s.tlsConfig == nil {
+		return false, s.no("", "STARTTLS is not supported")
+	}
+	if s.tls {
+		return false, s.no("", "TLS is already active")
+	}
+	if err := s.ok("Begin TLS negotiation now"); err != nil {
+		return true, err
+	}
+	conn := tls.Server(s.conn, s.tlsConfig)
+	_ = conn.SetDeadline(time.Now().Add(idleTimeout))
+	if err := conn.Handshake(); err != nil {
+		return true, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	s.conn = conn
+	s.r = bufio.NewReaderSize(conn, maxLineSize)
+	s.w = bufio.NewWriter(conn)
+	s.tls, s.secure = true, true
+	if err := s.capability(); err != nil {
+		return true, err
+	}
+	return false, s.ok("")
+}
+
+func (s *session) authenticate(args []string) (bool, error) {
+	if s.account != nil {
+		return false, s.no("", "Already authenticated")
+	}
+	if !s.secure {
+		return false, s.no("ENCRYPT-NEEDED", "Use STARTTLS first")
+	}
+	if len(args) < 1 || len(args) > 2 {
+		return false, s.no("", "Syntax error")
+	}
+	if !strings.EqualFold(args[0], "PLAIN") {
+		return false, s.no("", "Unsupported mechanism")
+	}
+	var response string
+	if len(args) == 2 {
+		response = args[1]
+	} else {
+		// an empty challenge asks for the response
+		if err := s.writeLine(`""`); err != nil {
+			return true, err
+		}
+		reply, err := s.readCommand()
+		if errors.Is(err, errSyntax) || err == nil && len(reply) != 1 {
+			return false, s.no("", "Syntax error")
+		}
+		if err != nil {
+			return true, err
+		}
+		if reply[0] == "*" {
+			return false, s.no("", "Authentication cancelled")
+		}
+		response = reply[0]
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(response)
+	parts := bytes.SplitN(decoded, []byte{0}, 3)
+	if err != nil || len(parts) != 3 {
+		return false, s.no("", "Invalid response")
+	}
+	authz, user, password := string(parts[0]), string(parts[1]), string(parts[2])
+	var acc *auth.Account
+	if authz == "" || authz == user {
+		acc, err = s.auth.Authenticate(context.Background(), user, password)
+	} else {
+		err = errors.New("authorization identity differs")
+	}
+	if err != nil || acc == nil {
+		s.failures++
+		if s.failures >= maxAuthFailures {
+			return true, s.bye("Too many authentication failures")
+		}
+		return false, s.no("", "Authentication failed")
+	}
+	s.account = acc
+	return false, s.ok("Logged in")
+}
+
+func (s *session) listScripts() error {
+	scripts, err := s.store.List(s.account.ID)
+	if err != nil {
+		return s.result(err, "")
+	}
+	for _, script := range scripts {
+		line := quote(script.Name)
+		if script.Active {
+			line += " ACTIVE"
+		}
+		if _, err = s.w.WriteString(line + "\r\n"); err != nil {
+			return err
+		}
+	}
+	return s.ok("Listscripts completed")
+}
+
+func (s *session) getScript(name string) error {
+	script, err := s.store.Get(s.account.ID, name)
+	if err != nil {
+		return s.result(err, "")
+	}
+	if _, err = fmt.Fprintf(s.w, "{%d}\r\n%s\r\n", len(script.Content), script.Content); err != nil {
+		return err
+	}
+	return s.ok("Getscript completed")
+}
+
+func (s *session) putScript(name, content string) error {
+	if !validName(name) {
+		return s.no("", "Invalid script name")
+	}
+	if len(content) > model.MaxSieveScriptSize {
+		return s.no("QUOTA/MAXSIZE", fmt.Sprintf("Script is larger than %d bytes", model.MaxSieveScriptSize))
+	}
+	if _, err := sieve.Compile(content); err != nil {
+		return s.no("", err.Error())
+	}
+	return s.result(s.store.Put(s.account.ID, name, content), "Putscript completed")
+}
+
+func (s *session) haveSpace(name, size string) error {
+	n, err := strconv.Atoi(size)
+	if err != nil || n < 0 || !validName(name) {
+		return s.no("", "Syntax error")
+	}
+	if n > model.MaxSieveScriptSize {
+		return s.no("QUOTA/MAXSIZE", fmt.Sprintf("Script is larger than %d bytes", model.MaxSieveScriptSize))
+	}
+	scripts, err := s.store.List(s.account.ID)
+	if err != nil {
+		return s.result(err, "")
+	}
+	if len(scripts) >= model.MaxSieveScripts {
+		for _, script := range scripts {
+			if script.Name == name {
+				return s.ok("Putscript would succeed")
+			}
+		}
+		return s.no("QUOTA/MAXSCRIPTS", model.ErrSieveScriptQuota.Error())
+	}
+	return s.ok("Putscript would succeed")
+}
@@ -0,0 +1,240 @@
+package managesieve
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"easymail/internal/app/service/auth"
+	"easymail/internal/model"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakeAuth struct{}
+
+func (fakeAuth) Authenticate(_ context.Context, username, password string) (*auth.Account, error) {
+	if username == "bob@example.com" && password == "secret" {
+		return &auth.Account{ID: 7, Username: username, Active: true}, nil
+	}
+	return nil, errors.New("invalid credentials")
+}
+
+type memoryStore struct {
+	scripts []model.SieveScript
+}
+
+func (m *memoryStore) find(name string) int {
+	for i := range m.scripts {
+		if m.scripts[i].Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func (m *memoryStore) List(int64) ([]model.SieveScript, error) {
+	return m.scripts, nil
+}
+
+func (m *memoryStore) Get(_ int64, name string) (*model.SieveScript, error) {
+	i := m.find(name)
+	if i < 0 {
+		return nil, model.ErrSieveScriptNotExists
+	}
+	return &m.scripts[i], nil
+}
+
+func (m *memoryStore) Put(accountID int64, name, content string) error {
+	if i := m.find(name); i >= 0 {
+		m.scripts[i].Content = content
+		return nil
+	}
+	m.scripts = append(m.scripts, model.SieveScript{AccountID: accountID, Name: name, Content: content})
+	return nil
+}
+
+func (m *memoryStore) SetActive(_ int64, name string) error {
+	i := m.find(name)
+	if name != "" && i < 0 {
+		return model.ErrSieveScriptNotExists
+	}
+	for j := range m.scripts {
+		m.scripts[j].Active = j == i
+	}
+	return nil
+}
+
+func (m *memoryStore) Delete(_ int64, name string) error {
+	i := m.find(name)
+	if i < 0 {
+		return model.ErrSieveScriptNotExists
+	}
+	if m.scripts[i].Active {
+		return model.ErrSieveScriptActive
+	}
+	m.scripts = append(m.scripts[:i], m.scripts[i+1:]...)
+	return nil
+}
+
+func (m *memoryStore) Rename(_ int64, oldName, newName string) error {
+	i := m.find(oldName)
+	if i < 0 {
+		return model.ErrSieveScriptNotExists
+	}
+	if m.find(newName) >= 0 {
+		return model.ErrSieveScriptExists
+	}
+	m.scripts[i].Name = newName
+	return nil
+}
+
+type client struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// response reads lines up to the final OK, NO or BYE and returns them all
+func (c *client) response() []string {
+	c.t.Helper()
+	var lines []string
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			c.t.Fatalf("read response: %v (got %q)", err, lines)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		lines = append(lines, line)
+		if strings.HasPrefix(line, "OK") || strings.HasPrefix(line, "NO") || strings.HasPrefix(line, "BYE") {
+			return lines
+		}
+	}
+}
+
+func (c *client) send(command string, expect string) []string {
+	c.t.Helper()
+	if _, err := fmt.Fprintf(c.conn, "%s\r\n", command); err != nil {
+		c.t.Fatal(err)
+	}
+	lines := c.response()
+	if last := lines[len(lines)-1]; !strings.HasPrefix(last, expect) {
+		c.t.Fatalf("%s: expected %s, got %q", strings.SplitN(command, " ", 2)[0], expect, lines)
+	}
+	return lines
+}
+
+func TestSession(t *testing.T) {
+	server, conn := net.Pipe()
+	store := &memoryStore{}
+	done := make(chan error, 1)
+	sess := newSession(server, fakeAuth{}, store)
+	// a local client may send its password in the clear
+	sess.secure = true
+	go func() {
+		done <- sess.serve()
+	}()
+	c := &client{t: t, conn: conn, r: bufio.NewReader(conn)}
+
+	greeting := c.response()
+	if len(greeting) < 2 || !strings.Contains(strings.Join(greeting, "\n"), `"SIEVE" "fileinto`) {
+		t.Fatalf("unexpected greeting %q", greeting)
+	}
+
+	c.send("LISTSCRIPTS", `NO "Authenticate first"`)
+	bad := base64.StdEncoding.EncodeToString([]byte("\x00bob@example.com\x00wrong"))
+	c.send(`AUTHENTICATE "PLAIN" "`+bad+`"`, "NO")
+	plain := base64.StdEncoding.EncodeToString([]byte("\x00bob@example.com\x00secret"))
+	c.send(`AUTHENTICATE "PLAIN" "`+plain+`"`, "OK")
+
+	script := "require \"fileinto\";\r\nif header :contains \"subject\" \"spam\" { fileinto \"Junk\"; }\r\n"
+	c.send(fmt.Sprintf("PUTSCRIPT \"main\" {%d+}\r\n%s", len(script), script), "OK")
+	c.send("PUTSCRIPT \"broken\" {9+}\r\nfileinto;", "NO")
+	c.send("SETACTIVE \"missing\"", "NO (NONEXISTENT)")
+	c.send("SETACTIVE \"main\"", "OK")
+
+	if lines := c.send("LISTSCRIPTS", "OK"); lines[0] != `"main" ACTIVE` {
+		t.Fatalf("unexpected list %q", lines)
+	}
+	lines := c.send(`GETSCRIPT "main"`, "OK")
+	if lines[0] != fmt.Sprintf("{%d}", len(script)) || !strings.Contains(strings.Join(lines, "\n"), "fileinto \"Junk\"") {
+		t.Fatalf("unexpected script %q", lines)
+	}
+	c.send(`CHECKSCRIPT "keep;"`, "OK")
+	c.send(`HAVESPACE "other" 999999999`, "NO (QUOTA/MAXSIZE)")
+	c.send(`DELETESCRIPT "main"`, "NO (ACTIVE)")
+	c.send(`RENAMESCRIPT "main" "other"`, "OK")
+	c.send(`SETACTIVE ""`, "OK")
+	c.send(`DELETESCRIPT "other"`, "OK")
+	c.send(`GETSCRIPT "other"`, "NO (NONEXISTENT)")
+	c.send("LOGOUT", "OK")
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if len(store.scripts) != 0 {
+		t.Fatalf("unexpected scripts %+v", store.scripts)
+	}
+}
+
+// testTLSConfig returns a config with a self signed certificate of localhost
+func testTLSConfig(t *testing.T) *tls.Config {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+func TestSessionSTARTTLS(t *testing.T) {
+	server, conn := net.Pipe()
+	done := make(chan error, 1)
+	sess := newSession(server, fakeAuth{}, &memoryStore{})
+	sess.tlsConfig = testTLSConfig(t)
+	go func() {
+		done <- sess.serve()
+	}()
+	c := &client{t: t, conn: conn, r: bufio.NewReader(conn)}
+
+	// a remote client gets no mechanism before tls
+	greeting := strings.Join(c.response(), "\n")
+	if !strings.Contains(greeting, `"SASL" ""`) || !strings.Contains(greeting, `"STARTTLS"`) {
+		t.Fatalf("unexpected greeting %q", greeting)
+	}
+	plain := base64.StdEncoding.EncodeToString([]byte("\x00bob@example.com\x00secret"))
+	c.send(`AUTHENTICATE "PLAIN" "`+plain+`"`, "NO (ENCRYPT-NEEDED)")
+
+	c.send("STARTTLS", "OK")
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: "localhost", InsecureSkipVerify: true})
+	c.conn, c.r = tlsConn, bufio.NewReader(tlsConn)
+	capabilities := strings.Join(c.response(), "\n")
+	if !strings.Contains(capabilities, `"SASL" "PLAIN"`) || strings.Contains(capabilities, `"STARTTLS"`) {
+		t.Fatalf("unexpected capabilities %q", capabilities)
+	}
+	c.send(`AUTHENTICATE "PLAIN" "`+plain+`"`, "OK")
+	c.send("STARTTLS", "NO")
+	c.send("LOGOUT", "OK")
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
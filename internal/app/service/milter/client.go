@@ -0,0 +1,333 @@
+package milter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrUnexpectedReply is returned when the milter answers with an unknown packet
+var ErrUnexpectedReply = errors.New("milter: unexpected reply")
+
+// Action is the final answer of the milter for a single MTA command
+type Action struct {
+	Code     ActionCode
+	SMTPCode int
+	Text     string
+}
+
+// Continue reports whether the MTA goes on with the transaction
+func (a *Action) Continue() bool {
+	return a == nil || a.Code == ActContinue || a.Code == ActSkip
+}
+
+// Modification is a single message change requested at end of body
+type Modification struct {
+	Code  ModifyActCode
+	Index uint32
+	Name  string
+	Value string
+	Body  []byte
+}
+
+// Client speaks the MTA side of the milter protocol, it is mainly used to
+// replay messages through a Milter without a running postfix.
+type Client struct {
+	conn     io.ReadWriteCloser
+	version  uint32
+	actions  OptAction
+	protocol OptProtocol
+}
+
+// Dial connects to a milter listening on network/address and negotiates options
+func Dial(network, address string, timeout time.Duration, actions OptAction, protocol OptProtocol) (*Client, error) {
+	conn, err := net.DialTimeout(network, address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	c, err := NewClient(conn, actions, protocol)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// NewClient negotiates options over an established connection, actions and
+// protocol are the capabilities offered by the MTA.
+func NewClient(conn io.ReadWriteCloser, actions OptAction, protocol OptProtocol) (*Client, error) {
+	c := &Client{conn: conn}
+	var buffer bytes.Buffer
+	for _, v := range []uint32{MilterVersion, uint32(actions), uint32(protocol)} {
+		if err := binary.Write(&buffer, binary.BigEndian, v); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.writePacket(CodeOptNeg, buffer.Bytes()); err != nil {
+		return nil, err
+	}
+	msg, err := c.readPacket()
+	if err != nil {
+		return nil, err
+	}
+	if Code(msg.Code) != CodeOptNeg || len(msg.Data) < 12 {
+		return nil, ErrUnexpectedReply
+	}
+	c.version = binary.BigEndian.Uint32(msg.Data[0:4])
+	c.actions = OptAction(binary.BigEndian.Uint32(msg.Data[4:8])) & actions
+	c.protocol = OptProtocol(binary.BigEndian.Uint32(msg.Data[8:12])) & protocol
+	return c, nil
+}
+
+// Actions returns the negotiated actions
+func (c *Client) Actions() OptAction {
+	return c.actions
+}
+
+// Protocol returns the negotiated protocol options
+func (c *Client) Protocol() OptProtocol {
+	return c.protocol
+}
+
+func (c *Client) writePacket(code Code, data []byte) error {
+	var buffer bytes.Buffer
+	if err := binary.Write(&buffer, binary.BigEndian, uint32(len(data)+1)); err != nil {
+		return err
+	}
+	buffer.WriteByte(byte(code))
+	buffer.Write(data)
+	_, err := c.conn.Write(buffer.Bytes())
+	return err
+}
+
+func (c *Client) readPacket() (*Message, error) {
+	var length uint32
+	if err := binary.Read(c.conn, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	if length == 0 || length > maxPacketSize {
+		return nil, fmt.Errorf("milter: invalid packet length %d", length)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(c.conn, data); err != nil {
+		return nil, err
+	}
+	return &Message{Code: data[0], Data: data[1:]}, nil
+}
+
+// readAction reads the reply of a command, modifications are only valid at end of body
+func (c *Client) readAction(mods *[]Modification) (*Action, error) {
+	for {
+		msg, err := c.readPacket()
+		if err != nil {
+			return nil, err
+		}
+		switch ActionCode(msg.Code) {
+		case ActAccept, ActContinue, ActDiscard, ActReject, ActTempFail, ActSkip:
+			return &Action{Code: ActionCode(msg.Code)}, nil
+		case ActReplyCode:
+			return parseReplyCode(msg.Data)
+		}
+		if mods == nil {
+			return nil, fmt.Errorf("%w: %c", ErrUnexpectedReply, msg.Code)
+		}
+		mod, err := parseModification(msg)
+		if err != nil {
+			return nil, err
+		}
+		*mods = append(*mods, *mod)
+	}
+}
+
+func parseReplyCode(data []byte) (*Action, error) {
+	text := ReadCString(data)
+	if len(text) < 3 {
+		return nil, fmt.Errorf("%w: reply code %q", ErrUnexpectedReply, text)
+	}
+	code, err := strconv.Atoi(text[:3])
+	if err != nil {
+		return nil, fmt.Errorf("%w: reply code %q", ErrUnexpectedReply, text)
+	}
+	return &Action{
+		Code:     ActReplyCode,
+		SMTPCode: code,
+		Text:     strings.TrimSpace(text[3:]),
+	}, nil
+}
+
+func parseModification(msg *Message) (*Modification, error) {
+	mod := &Modification{Code: ModifyActCode(msg.Code)}
+	switch mod.Code {
+	case ActAddRcpt, ActDelRcpt, ActQuarantine, ActChangeFrom:
+		mod.Value = strings.Trim(ReadCString(msg.Data), "<>")
+		if mod.Code == ActQuarantine {
+			mod.Value = ReadCString(msg.Data)
+		}
+	case ActReplBody:
+		mod.Body = msg.Data
+	case ActAddHeader:
+		fields := DecodeCStrings(msg.Data)
+		if len(fields) < 1 {
+			return nil, fmt.Errorf("%w: header %q", ErrUnexpectedReply, msg.Data)
+		}
+		mod.Name = fields[0]
+		if len(fields) > 1 {
+			mod.Value = fields[1]
+		}
+	case ActChangeHeader, ActInsertHeader:
+		if len(msg.Data) < 4 {
+			return nil, fmt.Errorf("%w: header %q", ErrUnexpectedReply, msg.Data)
+		}
+		mod.Index = binary.BigEndian.Uint32(msg.Data[0:4])
+		fields := DecodeCStrings(msg.Data[4:])
+		if len(fields) < 1 {
+			return nil, fmt.Errorf("%w: header %q", ErrUnexpectedReply, msg.Data)
+		}
+		mod.Name = fields[0]
+		if len(fields) > 1 {
+			mod.Value = fields[1]
+		}
+	default:
+		return nil, fmt.Errorf("%w: %c", ErrUnexpectedReply, msg.Code)
+	}
+	return mod, nil
+}
+
+// command sends a command and reads its reply unless the milter disabled
+// the step or negotiated no reply for it.
+func (c *Client) command(code Code, data []byte, skip, noReply OptProtocol) (*Action, error) {
+	if skip != 0 && c.protocol&skip != 0 {
+		return &Action{Code: ActContinue}, nil
+	}
+	if err := c.writePacket(code, data); err != nil {
+		return nil, err
+	}
+	if noReply != 0 && c.protocol&noReply != 0 {
+		return &Action{Code: ActContinue}, nil
+	}
+	return c.readAction(nil)
+}
+
+func encodeCStrings(s ...string) []byte {
+	var buffer bytes.Buffer
+	for _, v := range s {
+		buffer.WriteString(v + Null)
+	}
+	return buffer.Bytes()
+}
+
+// Macros defines macros for the given command, they are sent before the command itself
+func (c *Client) Macros(code Code, macros map[string]string) error {
+	if len(macros) == 0 {
+		return nil
+	}
+	data := []byte{byte(code)}
+	for k, v := range macros {
+		if len(k) > 1 && !strings.HasPrefix(k, "{") {
+			k = "{" + k + "}"
+		}
+		data = append(data, encodeCStrings(k, v)...)
+	}
+	return c.writePacket(CodeMacro, data)
+}
+
+// Connect sends SMTP connection information
+func (c *Client) Connect(host string, family ProtoFamily, port uint16, address string) (*Action, error) {
+	data := encodeCStrings(host)
+	data = append(data, byte(family))
+	if family != FamilyUnknown {
+		data = binary.BigEndian.AppendUint16(data, port)
+		data = append(data, encodeCStrings(address)...)
+	}
+	return c.command(CodeConn, data, OptNoConnect, OptNoConnReply)
+}
+
+// Helo sends the HELO/EHLO name
+func (c *Client) Helo(name string) (*Action, error) {
+	return c.command(CodeHelo, encodeCStrings(name), OptNoHelo, OptNoHeloReply)
+}
+
+// Mail sends the envelope sender and its esmtp arguments
+func (c *Client) Mail(from string, args ...string) (*Action, error) {
+	return c.command(CodeMail, encodeCStrings(append([]string{"<" + from + ">"}, args...)...), OptNoMailFrom, OptNoMailReply)
+}
+
+// Rcpt sends one envelope recipient and its esmtp arguments
+func (c *Client) Rcpt(to string, args ...string) (*Action, error) {
+	return c.command(CodeRcpt, encodeCStrings(append([]string{"<" + to + ">"}, args...)...), OptNoRcptTo, OptNoRcptReply)
+}
+
+// Data announces the DATA command
+func (c *Client) Data() (*Action, error) {
+	return c.command(CodeData, nil, OptNoData, OptNoDataReply)
+}
+
+// Header sends a single message header
+func (c *Client) Header(name, value string) (*Action, error) {
+	return c.command(CodeHeader, encodeCStrings(name, value), OptNoHeaders, OptNoHeaderReply)
+}
+
+// EOH announces the end of headers
+func (c *Client) EOH() (*Action, error) {
+	return c.command(CodeEOH, nil, OptNoEOH, OptNoEOHReply)
+}
+
+// Body sends the message body, split into chunks of MaxBodyChunk bytes
+func (c *Client) Body(body []byte) (*Action, error) {
+	act := &Action{Code: ActContinue}
+	for len(body) > 0 {
+		n := len(body)
+		if n > MaxBodyChunk {
+			n = MaxBodyChunk
+		}
+		var err error
+		act, err = c.command(CodeBody, body[:n], OptNoBody, OptNoBodyReply)
+		if err != nil {
+			return nil, err
+		}
+		// the milter skips the rest of body or already made a decision
+		if act.Code != ActContinue {
+			return act, nil
+		}
+		body = body[n:]
+	}
+	return act, nil
+}
+
+// EOB announces the end of body and returns the final action with all modifications
+func (c *Client) EOB() (*Action, []Modification, error) {
+	if err := c.writePacket(CodeEOB, nil); err != nil {
+		return nil, nil, err
+	}
+	mods := make([]Modification, 0)
+	act, err := c.readAction(&mods)
+	if err != nil {
+		return nil, nil, err
+	}
+	return act, mods, nil
+}
+
+// Abort aborts the current message, connection data is kept by the milter
+func (c *Client) Abort() error {
+	return c.writePacket(CodeAbort, nil)
+}
+
+// QuitNewConn tells the milter the connection is reused for a new SMTP session
+func (c *Client) QuitNewConn() error {
+	return c.writePacket(CodeQuitNewConn, nil)
+}
+
+// Close sends quit and closes the connection
+func (c *Client) Close() error {
+	err := c.writePacket(CodeQuit, nil)
+	if cerr := c.conn.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
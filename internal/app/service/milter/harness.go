@@ -0,0 +1,225 @@
+package milter
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"strings"
+)
+
+// MTAActions and MTAProtocol are every action and protocol step of milter
+// protocol v6, postfix offers all of them
+const (
+	MTAActions  = OptAddHeader | OptChangeBody | OptAddRcpt | OptRemoveRcpt | OptChangeHeader | OptQuarantine | OptChangeFrom | OptAddRcptWithArgs | OptSetSymList
+	MTAProtocol = OptProtocol(1<<21 - 1)
+)
+
+// Envelope describes the SMTP transaction a message is replayed with, the
+// macros are keyed by the command character in JSON, e.g. "C" or "E"
+type Envelope struct {
+	Host   string                     `json:"host"`
+	Addr   string                     `json:"addr"`
+	Port   uint16                     `json:"port"`
+	Helo   string                     `json:"helo"`
+	From   string                     `json:"from"`
+	Rcpts  []string                   `json:"rcpts"`
+	Macros map[Code]map[string]string `json:"macros"`
+}
+
+// ReplayResult is the outcome of a message replayed through a milter
+type ReplayResult struct {
+	// Stage is the command the final action was returned for
+	Stage         Code
+	Action        Action
+	Rejected      []string
+	Modifications []Modification
+}
+
+// NewPipeClient runs a milter session in-process and returns a client
+// connected to it, the client offers the same capabilities as postfix.
+func NewPipeClient(init MilterInit) (*Client, error) {
+	server, client := net.Pipe()
+	go func() {
+		_ = newMilterSession(server, init).HandleMilterCommands()
+	}()
+	c, err := NewClient(client, MTAActions, MTAProtocol)
+	if err != nil {
+		_ = client.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// ReplayFile replays an .eml file through the milter behind the client
+func ReplayFile(c *Client, env Envelope, filename string) (*ReplayResult, error) {
+	fd, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	return Replay(c, env, fd)
+}
+
+// Replay sends the envelope and message through the milter the same way
+// postfix does, and records the final action and all modifications.
+func Replay(c *Client, env Envelope, message io.Reader) (*ReplayResult, error) {
+	raw, err := io.ReadAll(message)
+	if err != nil {
+		return nil, err
+	}
+	headers, body := splitMessage(raw, c.protocol&OptHeaderLeadingSpace != 0)
+
+	result := &ReplayResult{}
+	// done records a final action, message stages are aborted to reset the milter
+	done := func(stage Code, act *Action) (*ReplayResult, error) {
+		result.Stage = stage
+		result.Action = *act
+		if stage != CodeConn && stage != CodeHelo {
+			if err := c.Abort(); err != nil {
+				return nil, err
+			}
+		}
+		return result, nil
+	}
+
+	family := FamilyUnknown
+	if ip := net.ParseIP(env.Addr); ip != nil {
+		family = FamilyInet
+		if ip.To4() == nil {
+			family = FamilyInet6
+		}
+	}
+	if err = c.Macros(CodeConn, env.Macros[CodeConn]); err != nil {
+		return nil, err
+	}
+	act, err := c.Connect(env.Host, family, env.Port, env.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if !act.Continue() {
+		return done(CodeConn, act)
+	}
+
+	if err = c.Macros(CodeHelo, env.Macros[CodeHelo]); err != nil {
+		return nil, err
+	}
+	if act, err = c.Helo(env.Helo); err != nil {
+		return nil, err
+	}
+	if !act.Continue() {
+		return done(CodeHelo, act)
+	}
+
+	if err = c.Macros(CodeMail, env.Macros[CodeMail]); err != nil {
+		return nil, err
+	}
+	if act, err = c.Mail(env.From); err != nil {
+		return nil, err
+	}
+	if !act.Continue() {
+		return done(CodeMail, act)
+	}
+
+	// a rejected recipient only drops itself, the message goes on with the
+	// others, a discard drops the whole message as postfix does
+	accepted := 0
+	for _, rcpt := range env.Rcpts {
+		if err = c.Macros(CodeRcpt, env.Macros[CodeRcpt]); err != nil {
+			return nil, err
+		}
+		if act, err = c.Rcpt(rcpt); err != nil {
+			return nil, err
+		}
+		switch act.Code {
+		case ActContinue, ActSkip:
+			accepted++
+		case ActAccept, ActDiscard:
+			return done(CodeRcpt, act)
+		default:
+			result.Rejected = append(result.Rejected, rcpt)
+		}
+	}
+	if accepted == 0 {
+		return done(CodeRcpt, act)
+	}
+
+	if err = c.Macros(CodeData, env.Macros[CodeData]); err != nil {
+		return nil, err
+	}
+	if act, err = c.Data(); err != nil {
+		return nil, err
+	}
+	if !act.Continue() {
+		return done(CodeData, act)
+	}
+
+	for _, h := range headers {
+		if act, err = c.Header(h[0], h[1]); err != nil {
+			return nil, err
+		}
+		if !act.Continue() {
+			return done(CodeHeader, act)
+		}
+	}
+	if err = c.Macros(CodeEOH, env.Macros[CodeEOH]); err != nil {
+		return nil, err
+	}
+	if act, err = c.EOH(); err != nil {
+		return nil, err
+	}
+	if !act.Continue() {
+		return done(CodeEOH, act)
+	}
+
+	if act, err = c.Body(body); err != nil {
+		return nil, err
+	}
+	if !act.Continue() {
+		return done(CodeBody, act)
+	}
+
+	if err = c.Macros(CodeEOB, env.Macros[CodeEOB]); err != nil {
+		return nil, err
+	}
+	act, mods, err := c.EOB()
+	if err != nil {
+		return nil, err
+	}
+	result.Stage = CodeEOB
+	result.Action = *act
+	result.Modifications = mods
+	return result, nil
+}
+
+// splitMessage splits a raw message into headers, folded the way postfix sends
+// them, and a CRLF terminated body
+func splitMessage(raw []byte, leadingSpace bool) (headers [][2]string, body []byte) {
+	raw = bytes.ReplaceAll(raw, []byte("\r\n"), []byte("\n"))
+	lines := strings.Split(string(raw), "\n")
+	i := 0
+	for ; i < len(lines); i++ {
+		line := lines[i]
+		if line == "" {
+			i++
+			break
+		}
+		// continuation lines are kept with the LF separator, the way postfix sends them
+		if (line[0] == ' ' || line[0] == '\t') && len(headers) > 0 {
+			headers[len(headers)-1][1] += "\n" + line
+			continue
+		}
+		name, value, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		if !leadingSpace {
+			value = strings.TrimPrefix(value, " ")
+		}
+		headers = append(headers, [2]string{strings.TrimSpace(name), value})
+	}
+	if i < len(lines) {
+		body = []byte(strings.Join(lines[i:], "\r\n"))
+	}
+	return headers, body
+}
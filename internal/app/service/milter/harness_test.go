@@ -0,0 +1,244 @@
+package milter
+
+import (
+	"encoding/json"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+// subjectMilter decides on the subject and the envelope only
+type subjectMilter struct {
+	body strings.Builder
+	from string
+}
+
+func (s *subjectMilter) Connect(host string, addr net.IP, payload map[string]string, m *Modifier) (Response, []Feature, error) {
+	if addr.Equal(net.ParseIP("198.51.100.1")) {
+		return NewResponseStr(byte(ActReplyCode), "554 5.7.1 client blocked"), nil, nil
+	}
+	return RespContinue, nil, nil
+}
+
+func (s *subjectMilter) Helo(name string, payload map[string]string, m *Modifier) (Response, []Feature, error) {
+	return RespContinue, nil, nil
+}
+
+func (s *subjectMilter) MailFrom(from string, payload map[string]string, m *Modifier) (Response, []Feature, error) {
+	s.from = from
+	s.body.Reset()
+	return RespContinue, nil, nil
+}
+
+func (s *subjectMilter) RcptTo(rcptTo string, payload map[string]string, m *Modifier) (Response, []Feature, error) {
+	if strings.HasPrefix(rcptTo, "unknown@") {
+		return RespReject, nil, nil
+	}
+	if strings.HasPrefix(rcptTo, "trap@") {
+		return RespDiscard, nil, nil
+	}
+	return RespContinue, nil, nil
+}
+
+func (s *subjectMilter) Header(name string, value string, payload map[string]string, m *Modifier) (Response, []Feature, error) {
+	return RespContinue, nil, nil
+}
+
+func (s *subjectMilter) Headers(h textproto.MIMEHeader, payload map[string]string, m *Modifier) (Response, []Feature, error) {
+	if strings.Contains(h.Get("Subject"), "spam") {
+		return RespReject, nil, nil
+	}
+	return RespContinue, nil, nil
+}
+
+func (s *subjectMilter) BodyChunk(chunk []byte, payload map[string]string, m *Modifier) (Response, []Feature, error) {
+	s.body.Write(chunk)
+	return RespContinue, nil, nil
+}
+
+func (s *subjectMilter) Body(payload map[string]string, m *Modifier, macro map[string]string) (Response, []Feature, error) {
+	if strings.Contains(m.Headers.Get("Subject"), "hold") {
+		if err := m.Quarantine("subject hold"); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := m.InsertHeader(0, "X-Queue-ID", macro["i"]); err != nil {
+		return nil, nil, err
+	}
+	if err := m.AddHeader("X-Body-Lines", strings.Repeat("x", strings.Count(s.body.String(), "\r\n"))); err != nil {
+		return nil, nil, err
+	}
+	return RespAccept, nil, nil
+}
+
+func (s *subjectMilter) Abort(m *Modifier) error {
+	s.body.Reset()
+	s.from = ""
+	return nil
+}
+
+func TestReplayFile(t *testing.T) {
+	init := func() (Milter, OptAction, OptProtocol) {
+		return &subjectMilter{}, OptAddHeader | OptQuarantine, OptNoHeaderReply | OptNoHelo
+	}
+	baseEnvelope := func() Envelope {
+		return Envelope{
+			Host:  "client.example.com",
+			Addr:  "192.0.2.1",
+			Port:  40000,
+			Helo:  "client.example.com",
+			From:  "sender@example.com",
+			Rcpts: []string{"rcpt@example.com"},
+			Macros: map[Code]map[string]string{
+				CodeEOB: {"i": "4ABC123"},
+			},
+		}
+	}
+
+	cases := []struct {
+		name     string
+		envelope func(e *Envelope)
+		stage    Code
+		action   ActionCode
+		smtpCode int
+		rejected int
+		mods     []string
+	}{
+		{
+			name:   "accepted with headers",
+			stage:  CodeEOB,
+			action: ActAccept,
+			mods:   []string{"i:X-Queue-ID=4ABC123", "h:X-Body-Lines=xx"},
+		},
+		{
+			name:     "blocked client",
+			envelope: func(e *Envelope) { e.Addr = "198.51.100.1" },
+			stage:    CodeConn,
+			action:   ActReplyCode,
+			smtpCode: 554,
+		},
+		{
+			name:     "one recipient rejected",
+			envelope: func(e *Envelope) { e.Rcpts = append(e.Rcpts, "unknown@example.com") },
+			stage:    CodeEOB,
+			action:   ActAccept,
+			rejected: 1,
+			mods:     []string{"i:X-Queue-ID=4ABC123", "h:X-Body-Lines=xx"},
+		},
+		{
+			name:     "all recipients rejected",
+			envelope: func(e *Envelope) { e.Rcpts = []string{"unknown@example.com"} },
+			stage:    CodeRcpt,
+			action:   ActReject,
+			rejected: 1,
+		},
+		{
+			name:     "discarded at a recipient",
+			envelope: func(e *Envelope) { e.Rcpts = append(e.Rcpts, "trap@example.com", "other@example.com") },
+			stage:    CodeRcpt,
+			action:   ActDiscard,
+		},
+	}
+
+	// the same connection is reused for every case, like a postfix smtpd process
+	client, err := NewPipeClient(init)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if client.Actions() != OptAddHeader|OptQuarantine {
+		t.Fatalf("unexpected negotiated actions %b", client.Actions())
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			env := baseEnvelope()
+			if c.envelope != nil {
+				c.envelope(&env)
+			}
+			result, err := ReplayFile(client, env, "testdata/simple.eml")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Stage != c.stage || result.Action.Code != c.action {
+				t.Fatalf("expected %c/%c, got %c/%c", c.stage, c.action, result.Stage, result.Action.Code)
+			}
+			if result.Action.SMTPCode != c.smtpCode {
+				t.Fatalf("expected smtp code %d, got %d", c.smtpCode, result.Action.SMTPCode)
+			}
+			if len(result.Rejected) != c.rejected {
+				t.Fatalf("expected %d rejected recipients, got %v", c.rejected, result.Rejected)
+			}
+			if len(result.Modifications) != len(c.mods) {
+				t.Fatalf("unexpected modifications %+v", result.Modifications)
+			}
+			for i, mod := range result.Modifications {
+				if got := string(mod.Code) + ":" + mod.Name + "=" + mod.Value; got != c.mods[i] {
+					t.Fatalf("modification %d: expected %q, got %q", i, c.mods[i], got)
+				}
+			}
+		})
+	}
+}
+
+func TestEnvelopeJSON(t *testing.T) {
+	var env Envelope
+	if err := json.Unmarshal([]byte(`{"addr":"192.0.2.1","macros":{"C":{"j":"mx.example.com"},"E":{"i":"4ABC123"}}}`), &env); err != nil {
+		t.Fatal(err)
+	}
+	if env.Macros[CodeConn]["j"] != "mx.example.com" || env.Macros[CodeEOB]["i"] != "4ABC123" {
+		t.Fatalf("unexpected macros %v", env.Macros)
+	}
+	data, err := json.Marshal(Envelope{Macros: map[Code]map[string]string{CodeEOB: {"i": "4ABC123"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"macros":{"E":{"i":"4ABC123"}}`) {
+		t.Fatalf("unexpected json %s", data)
+	}
+	if err = json.Unmarshal([]byte(`{"macros":{"69":{"i":"x"}}}`), &env); err == nil {
+		t.Fatal("expected an error for a numeric code")
+	}
+}
+
+func TestReplaySubjectRules(t *testing.T) {
+	init := func() (Milter, OptAction, OptProtocol) {
+		return &subjectMilter{}, OptAddHeader | OptQuarantine, 0
+	}
+	client, err := NewPipeClient(init)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	env := Envelope{Addr: "192.0.2.1", Helo: "client", From: "a@example.com", Rcpts: []string{"b@example.com"}}
+	result, err := Replay(client, env, strings.NewReader("Subject: buy spam now\r\n\r\nbody\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Stage != CodeEOH || result.Action.Code != ActReject {
+		t.Fatalf("expected reject at EOH, got %c/%c", result.Stage, result.Action.Code)
+	}
+
+	result, err = Replay(client, env, strings.NewReader("Subject: hold\n\tfolded\n\nbody\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Modifications) == 0 || result.Modifications[0].Code != ActQuarantine || result.Modifications[0].Value != "subject hold" {
+		t.Fatalf("expected quarantine, got %+v", result.Modifications)
+	}
+}
+
+func TestSplitMessage(t *testing.T) {
+	headers, body := splitMessage([]byte("Subject: a\r\n b\r\nTo:  x@example.com\r\n\r\nline1\nline2"), false)
+	if len(headers) != 2 {
+		t.Fatalf("unexpected headers %v", headers)
+	}
+	if headers[0][1] != "a\n b" || headers[1][1] != " x@example.com" {
+		t.Fatalf("unexpected header values %q", headers)
+	}
+	if string(body) != "line1\r\nline2" {
+		t.Fatalf("unexpected body %q", body)
+	}
+}
@@ -1,5 +1,7 @@
 package milter
 
+import "fmt"
+
 // Message represents a command sent from milter client
 type Message struct {
 	Code byte
@@ -37,6 +39,20 @@ const (
 
 type Code byte
 
+// MarshalText writes a code as its character, e.g. the macros of SMFIC_CONNECT under "C"
+func (c Code) MarshalText() ([]byte, error) {
+	return []byte{byte(c)}, nil
+}
+
+// UnmarshalText reads a code written as its character
+func (c *Code) UnmarshalText(text []byte) error {
+	if len(text) != 1 {
+		return fmt.Errorf("milter: invalid command code %q", text)
+	}
+	*c = Code(text[0])
+	return nil
+}
+
 const (
 	CodeOptNeg Code = 'O' // SMFIC_OPTNEG
 	CodeMacro  Code = 'D' // SMFIC_MACRO
@@ -5,10 +5,14 @@ package milter
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"net/textproto"
 )
 
+// ErrActionNotNegotiated is returned when a modification was not agreed with the MTA
+var ErrActionNotNegotiated = errors.New("milter: action not negotiated")
+
 // postfix wants LF lines endings. Using CRLF results in double CR sequences.
 func crlfToLF(b []byte) []byte {
 	return bytes.ReplaceAll(b, []byte{'\r', '\n'}, []byte{'\n'})
@@ -21,67 +25,111 @@ type Modifier struct {
 	Headers textproto.MIMEHeader
 
 	WritePacket func(*Message) error
+
+	actions  OptAction
+	protocol OptProtocol
+}
+
+// allowed checks the action was negotiated in SMFIC_OPTNEG
+func (m *Modifier) allowed(action OptAction) error {
+	if m.actions&action == 0 {
+		return ErrActionNotNegotiated
+	}
+	return nil
+}
+
+// headerValue returns the value of an added or changed header, postfix does not
+// put the space after the colon when the leading space option was negotiated.
+func (m *Modifier) headerValue(value string) []byte {
+	if m.protocol&OptHeaderLeadingSpace != 0 && value != "" && value[0] != ' ' && value[0] != '\t' {
+		value = " " + value
+	}
+	return crlfToLF([]byte(value))
 }
 
 // AddRecipient appends a new envelope recipient for current message
 func (m *Modifier) AddRecipient(r string) error {
+	if err := m.allowed(OptAddRcpt); err != nil {
+		return err
+	}
 	data := []byte(fmt.Sprintf("<%s>", r) + Null)
 	return m.WritePacket(NewResponse('+', data).Response())
 }
 
 // DeleteRecipient removes an envelope recipient address from message
 func (m *Modifier) DeleteRecipient(r string) error {
+	if err := m.allowed(OptRemoveRcpt); err != nil {
+		return err
+	}
 	data := []byte(fmt.Sprintf("<%s>", r) + Null)
 	return m.WritePacket(NewResponse('-', data).Response())
 }
 
 // ReplaceBody substitutes message body with provided body
 func (m *Modifier) ReplaceBody(body []byte) error {
+	if err := m.allowed(OptChangeBody); err != nil {
+		return err
+	}
 	body = crlfToLF(body)
 	return m.WritePacket(NewResponse('b', body).Response())
 }
 
 // AddHeader appends a new email message header the message
 func (m *Modifier) AddHeader(name, value string) error {
+	if err := m.allowed(OptAddHeader); err != nil {
+		return err
+	}
 	var buffer bytes.Buffer
 	buffer.WriteString(name + Null)
-	buffer.Write(crlfToLF([]byte(value)))
+	buffer.Write(m.headerValue(value))
 	buffer.WriteString(Null)
 	return m.WritePacket(NewResponse('h', buffer.Bytes()).Response())
 }
 
 // Quarantine a message by giving a reason to hold it
 func (m *Modifier) Quarantine(reason string) error {
+	if err := m.allowed(OptQuarantine); err != nil {
+		return err
+	}
 	return m.WritePacket(NewResponse('q', []byte(reason+Null)).Response())
 }
 
 // ChangeHeader replaces the header at the specified position with a new one.
-// The index is per name.
+// The index is per name, an empty value removes the header.
 func (m *Modifier) ChangeHeader(index int, name, value string) error {
+	if err := m.allowed(OptChangeHeader); err != nil {
+		return err
+	}
 	var buffer bytes.Buffer
 	if err := binary.Write(&buffer, binary.BigEndian, uint32(index)); err != nil {
 		return err
 	}
 	buffer.WriteString(name + Null)
-	buffer.Write(crlfToLF([]byte(value)))
+	buffer.Write(m.headerValue(value))
 	buffer.WriteString(Null)
 	return m.WritePacket(NewResponse('m', buffer.Bytes()).Response())
 }
 
 // InsertHeader inserts the header at the specified position
 func (m *Modifier) InsertHeader(index int, name, value string) error {
+	if err := m.allowed(OptAddHeader); err != nil {
+		return err
+	}
 	var buffer bytes.Buffer
 	if err := binary.Write(&buffer, binary.BigEndian, uint32(index)); err != nil {
 		return err
 	}
 	buffer.WriteString(name + Null)
-	buffer.Write(crlfToLF([]byte(value)))
+	buffer.Write(m.headerValue(value))
 	buffer.WriteString(Null)
 	return m.WritePacket(NewResponse('i', buffer.Bytes()).Response())
 }
 
 // ChangeFrom replaces the FROM envelope header with a new one
 func (m *Modifier) ChangeFrom(value string) error {
+	if err := m.allowed(OptChangeFrom); err != nil {
+		return err
+	}
 	data := []byte(value + Null)
 	return m.WritePacket(NewResponse('e', data).Response())
 }
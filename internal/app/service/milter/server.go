@@ -0,0 +1,174 @@
+package milter
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// idleTimeout is longer than the milter timeouts of postfix, it closes sessions of a vanished MTA
+const idleTimeout = 10 * time.Minute
+
+// MilterInit initializes a new Milter instance for each connection, the
+// returned masks declare which actions and protocol steps the handler wants.
+type MilterInit func() (Milter, OptAction, OptProtocol)
+
+/*
+Server milter server, accept postfix connections and drive a Milter per connection
+*/
+type Server struct {
+	name     string
+	family   string
+	listen   string
+	init     MilterInit
+	lock     *sync.Mutex
+	started  bool
+	listener net.Listener
+	wg       sync.WaitGroup
+	// conns are the open sessions, they are closed on stop
+	conns map[net.Conn]struct{}
+
+	// errorHandler receives errors of single connections, they never stop the server
+	errorHandler func(err error)
+}
+
+func New(family, listen string, init MilterInit) *Server {
+	if family != "tcp" && family != "unix" {
+		return nil
+	}
+
+	if family == "tcp" {
+		fields := strings.Split(listen, ":")
+		if len(fields) != 2 {
+			return nil
+		}
+	}
+	if family == "unix" && strings.TrimSpace(listen) == "" {
+		return nil
+	}
+	if init == nil {
+		return nil
+	}
+
+	return &Server{
+		name:    "milter",
+		family:  family,
+		listen:  listen,
+		init:    init,
+		lock:    &sync.Mutex{},
+		started: false,
+		conns:   make(map[net.Conn]struct{}),
+	}
+}
+
+func (s *Server) Name() string {
+	return s.name
+}
+
+func (s *Server) SetErrorHandler(handler func(err error)) {
+	s.errorHandler = handler
+}
+
+// Addr returns the listening address, nil if the server is not started
+func (s *Server) Addr() net.Addr {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+func (s *Server) Start() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.started {
+		return fmt.Errorf("%s server already started", s.name)
+	}
+
+	listener, err := net.Listen(s.family, s.listen)
+	if err != nil {
+		return err
+	}
+	s.listener = listener
+	s.started = true
+	go func() {
+		if err := s.Serve(listener); err != nil {
+			s.handleError(err)
+		}
+	}()
+	return nil
+}
+
+func (s *Server) Stop() error {
+	s.lock.Lock()
+	if !s.started {
+		s.lock.Unlock()
+		return fmt.Errorf("%s server not started", s.name)
+	}
+	s.started = false
+	err := s.listener.Close()
+	s.listener = nil
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+	s.lock.Unlock()
+
+	// sessions return once their connection is closed
+	s.wg.Wait()
+	return err
+}
+
+// Serve accepts connections on the listener until it is closed
+func (s *Server) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		s.lock.Lock()
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.lock.Unlock()
+		go func() {
+			defer s.wg.Done()
+			s.Handle(conn)
+			s.lock.Lock()
+			delete(s.conns, conn)
+			s.lock.Unlock()
+		}()
+	}
+}
+
+// Handle runs the milter protocol on a single MTA connection
+func (s *Server) Handle(conn net.Conn) {
+	session := newMilterSession(&idleConn{Conn: conn}, s.init)
+	if err := session.HandleMilterCommands(); err != nil && !errors.Is(err, net.ErrClosed) {
+		s.handleError(fmt.Errorf("%s session from %s: %w", s.name, conn.RemoteAddr(), err))
+	}
+}
+
+// idleConn renews the read deadline before each read
+type idleConn struct {
+	net.Conn
+}
+
+func (c *idleConn) Read(p []byte) (int, error) {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(idleTimeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(p)
+}
+
+func (s *Server) handleError(err error) {
+	if s.errorHandler != nil {
+		s.errorHandler(err)
+	}
+}
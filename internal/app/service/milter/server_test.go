@@ -0,0 +1,296 @@
+package milter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/textproto"
+	"testing"
+	"time"
+)
+
+type recordMilter struct {
+	calls  []string
+	macros map[string]string
+}
+
+func (r *recordMilter) Connect(host string, addr net.IP, payload map[string]string, m *Modifier) (Response, []Feature, error) {
+	r.calls = append(r.calls, "connect:"+host+":"+addr.String())
+	r.macros = payload
+	return RespContinue, nil, nil
+}
+
+func (r *recordMilter) Helo(name string, payload map[string]string, m *Modifier) (Response, []Feature, error) {
+	r.calls = append(r.calls, "helo:"+name)
+	return RespContinue, nil, nil
+}
+
+func (r *recordMilter) MailFrom(from string, payload map[string]string, m *Modifier) (Response, []Feature, error) {
+	r.calls = append(r.calls, "mail:"+from)
+	return RespContinue, nil, nil
+}
+
+func (r *recordMilter) RcptTo(rcptTo string, payload map[string]string, m *Modifier) (Response, []Feature, error) {
+	r.calls = append(r.calls, "rcpt:"+rcptTo)
+	if rcptTo == "bad@example.com" {
+		return RespReject, nil, nil
+	}
+	return RespContinue, nil, nil
+}
+
+func (r *recordMilter) Header(name string, value string, payload map[string]string, m *Modifier) (Response, []Feature, error) {
+	r.calls = append(r.calls, "header:"+name)
+	return RespContinue, nil, nil
+}
+
+func (r *recordMilter) Headers(h textproto.MIMEHeader, payload map[string]string, m *Modifier) (Response, []Feature, error) {
+	r.calls = append(r.calls, "eoh:"+h.Get("Subject"))
+	return RespContinue, nil, nil
+}
+
+func (r *recordMilter) BodyChunk(chunk []byte, payload map[string]string, m *Modifier) (Response, []Feature, error) {
+	r.calls = append(r.calls, "body:"+string(chunk))
+	return RespContinue, nil, nil
+}
+
+func (r *recordMilter) Body(payload map[string]string, m *Modifier, macro map[string]string) (Response, []Feature, error) {
+	r.calls = append(r.calls, "eob")
+	if err := m.AddHeader("X-Test", "yes"); err != nil {
+		return nil, nil, err
+	}
+	if err := m.ChangeFrom("other@example.com"); err != ErrActionNotNegotiated {
+		return nil, nil, err
+	}
+	return RespAccept, nil, nil
+}
+
+func (r *recordMilter) Abort(m *Modifier) error {
+	r.calls = append(r.calls, "abort")
+	return nil
+}
+
+type mtaConn struct {
+	t    *testing.T
+	conn net.Conn
+}
+
+func (c *mtaConn) send(code Code, data ...[]byte) {
+	c.t.Helper()
+	payload := bytes.Join(data, nil)
+	var buf bytes.Buffer
+	_ = binary.Write(&buf, binary.BigEndian, uint32(len(payload)+1))
+	buf.WriteByte(byte(code))
+	buf.Write(payload)
+	if _, err := c.conn.Write(buf.Bytes()); err != nil {
+		c.t.Fatalf("write %c: %v", code, err)
+	}
+}
+
+func (c *mtaConn) read() *Message {
+	c.t.Helper()
+	var length uint32
+	if err := binary.Read(c.conn, binary.BigEndian, &length); err != nil {
+		c.t.Fatalf("read length: %v", err)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(c.conn, data); err != nil {
+		c.t.Fatalf("read data: %v", err)
+	}
+	return &Message{Code: data[0], Data: data[1:]}
+}
+
+func (c *mtaConn) expect(code byte) *Message {
+	c.t.Helper()
+	msg := c.read()
+	if msg.Code != code {
+		c.t.Fatalf("expected reply %c, got %c", code, msg.Code)
+	}
+	return msg
+}
+
+func cstr(s ...string) []byte {
+	var buf bytes.Buffer
+	for _, v := range s {
+		buf.WriteString(v + Null)
+	}
+	return buf.Bytes()
+}
+
+func u32(v ...uint32) []byte {
+	var buf bytes.Buffer
+	for _, n := range v {
+		_ = binary.Write(&buf, binary.BigEndian, n)
+	}
+	return buf.Bytes()
+}
+
+func TestSessionNegotiateAndDispatch(t *testing.T) {
+	instances := make([]*recordMilter, 0)
+	init := func() (Milter, OptAction, OptProtocol) {
+		r := &recordMilter{}
+		instances = append(instances, r)
+		return r, OptAddHeader | OptChangeFrom, OptNoHeaderReply | OptNoUnknown
+	}
+
+	server, client := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- newMilterSession(server, init).HandleMilterCommands()
+	}()
+	mta := &mtaConn{t: t, conn: client}
+
+	// the MTA does not offer SMFIF_CHGFROM, it must be masked out
+	mta.send(CodeOptNeg, u32(6, uint32(OptAddHeader|OptQuarantine), uint32(OptNoHeaderReply)))
+	reply := mta.expect(byte(CodeOptNeg))
+	if got := binary.BigEndian.Uint32(reply.Data[0:4]); got != MilterVersion {
+		t.Fatalf("unexpected version %d", got)
+	}
+	if got := OptAction(binary.BigEndian.Uint32(reply.Data[4:8])); got != OptAddHeader {
+		t.Fatalf("unexpected actions %b", got)
+	}
+	if got := OptProtocol(binary.BigEndian.Uint32(reply.Data[8:12])); got != OptNoHeaderReply {
+		t.Fatalf("unexpected protocol %b", got)
+	}
+
+	mta.send(CodeMacro, []byte{byte(CodeConn)}, cstr("j", "mx.example.com", "{daemon_name}", "smtpd"))
+	mta.send(CodeConn, cstr("client.example.com"), []byte{byte(FamilyInet)}, []byte{0, 25}, cstr("192.0.2.1"))
+	mta.expect(byte(ActContinue))
+	mta.send(CodeHelo, cstr("client.example.com"))
+	mta.expect(byte(ActContinue))
+	mta.send(CodeMail, cstr("<sender@example.com>", "SIZE=100"))
+	mta.expect(byte(ActContinue))
+	mta.send(CodeRcpt, cstr("<bad@example.com>"))
+	mta.expect(byte(ActReject))
+	mta.send(CodeRcpt, cstr("<rcpt@example.com>"))
+	mta.expect(byte(ActContinue))
+	mta.send(CodeData)
+	mta.expect(byte(ActContinue))
+
+	// no reply for headers, the next reply must belong to EOH
+	mta.send(CodeHeader, cstr("Subject", "hello"))
+	mta.send(CodeEOH)
+	mta.expect(byte(ActContinue))
+	mta.send(CodeBody, []byte("body text"))
+	mta.expect(byte(ActContinue))
+	mta.send(CodeEOB)
+	header := mta.expect(byte(ActAddHeader))
+	if !bytes.Equal(header.Data, cstr("X-Test", "yes")) {
+		t.Fatalf("unexpected header data %q", header.Data)
+	}
+	mta.expect(byte(ActAccept))
+
+	mta.send(CodeAbort)
+	mta.send(CodeQuitNewConn)
+	mta.send(CodeConn, cstr("unknown"), []byte{byte(FamilyUnknown)})
+	mta.expect(byte(ActContinue))
+	mta.send(CodeQuit)
+
+	if err := <-done; err != nil {
+		t.Fatalf("session failed: %v", err)
+	}
+	if len(instances) != 2 {
+		t.Fatalf("expected a new milter after QUIT_NC, got %d instances", len(instances))
+	}
+	first := instances[0]
+	want := []string{
+		"connect:client.example.com:192.0.2.1",
+		"helo:client.example.com",
+		"mail:sender@example.com",
+		"rcpt:bad@example.com",
+		"rcpt:rcpt@example.com",
+		"header:Subject",
+		"eoh:hello",
+		"body:body text",
+		"eob",
+		"abort",
+		"abort",
+	}
+	if len(first.calls) != len(want) {
+		t.Fatalf("unexpected calls %v", first.calls)
+	}
+	for i := range want {
+		if first.calls[i] != want[i] {
+			t.Fatalf("call %d: expected %q, got %q", i, want[i], first.calls[i])
+		}
+	}
+	if first.macros["daemon_name"] != "smtpd" || first.macros["j"] != "mx.example.com" {
+		t.Fatalf("unexpected connect macros %v", first.macros)
+	}
+	if len(instances[1].calls) != 1 || instances[1].calls[0] != "connect:unknown:<nil>" {
+		t.Fatalf("unexpected calls of second milter %v", instances[1].calls)
+	}
+}
+
+func TestServerStartStop(t *testing.T) {
+	if New("udp", "127.0.0.1:0", nil) != nil {
+		t.Fatalf("expected nil server for invalid family")
+	}
+	s := New("tcp", "127.0.0.1:0", func() (Milter, OptAction, OptProtocol) {
+		return &recordMilter{}, 0, 0
+	})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	mta := &mtaConn{t: t, conn: conn}
+	mta.send(CodeOptNeg, u32(6, 0x1ff, 0x1fffff))
+	mta.expect(byte(CodeOptNeg))
+	mta.send(CodeQuit)
+	_ = conn.Close()
+	if err = s.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Stop(); err == nil {
+		t.Fatalf("expected error on second stop")
+	}
+}
+
+func TestServerStopClosesSessions(t *testing.T) {
+	s := New("tcp", "127.0.0.1:0", func() (Milter, OptAction, OptProtocol) {
+		return &recordMilter{}, 0, 0
+	})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	mta := &mtaConn{t: t, conn: conn}
+	mta.send(CodeOptNeg, u32(6, 0x1ff, 0x1fffff))
+	mta.expect(byte(CodeOptNeg))
+
+	// the mta keeps the session open, stop must not wait for it
+	stopped := make(chan error, 1)
+	go func() { stopped <- s.Stop() }()
+	select {
+	case err = <-stopped:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stop waits for the idle session")
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the session closed, got %v", err)
+	}
+}
+
+func TestModifierLeadingSpace(t *testing.T) {
+	for protocol, expected := range map[OptProtocol]string{0: "a\nb", OptHeaderLeadingSpace: " a\nb"} {
+		var sent *Message
+		m := &Modifier{WritePacket: func(msg *Message) error { sent = msg; return nil }, actions: OptAddHeader, protocol: protocol}
+		if err := m.AddHeader("X-Test", "a\r\nb"); err != nil {
+			t.Fatal(err)
+		}
+		if got := string(sent.Data); got != "X-Test"+Null+expected+Null {
+			t.Fatalf("protocol %d: unexpected header %q", protocol, got)
+		}
+	}
+}
@@ -0,0 +1,319 @@
+package milter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+)
+
+// MilterVersion is the highest milter protocol version supported
+const MilterVersion = 6
+
+// maxPacketSize bounds a single packet read from the MTA, a body chunk
+// plus command byte never exceeds MaxBodyChunk+1 but macros and headers may.
+const maxPacketSize = 1 << 20
+
+// errCloseSession is returned by Process when the MTA asked to close the connection
+var errCloseSession = errors.New("milter: close session")
+
+// milterSession keeps session state during MTA communication
+type milterSession struct {
+	init     MilterInit
+	milter   Milter
+	actions  OptAction
+	protocol OptProtocol
+	sock     io.ReadWriteCloser
+
+	// macros received per command code, merged view is handed to Modifier
+	macros  map[Code]map[string]string
+	headers textproto.MIMEHeader
+}
+
+// newMilterSession creates a session for an accepted MTA connection
+func newMilterSession(sock io.ReadWriteCloser, init MilterInit) *milterSession {
+	milter, actions, protocol := init()
+	return &milterSession{
+		init:     init,
+		milter:   milter,
+		actions:  actions,
+		protocol: protocol,
+		sock:     sock,
+		macros:   make(map[Code]map[string]string),
+		headers:  make(textproto.MIMEHeader),
+	}
+}
+
+// ReadPacket reads incoming milter packet
+func (m *milterSession) ReadPacket() (*Message, error) {
+	var length uint32
+	if err := binary.Read(m.sock, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	if length == 0 || length > maxPacketSize {
+		return nil, fmt.Errorf("milter: invalid packet length %d", length)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(m.sock, data); err != nil {
+		return nil, err
+	}
+	return &Message{Code: data[0], Data: data[1:]}, nil
+}
+
+// WritePacket sends a milter response packet to socket stream
+func (m *milterSession) WritePacket(msg *Message) error {
+	var buffer bytes.Buffer
+	if err := binary.Write(&buffer, binary.BigEndian, uint32(len(msg.Data)+1)); err != nil {
+		return err
+	}
+	buffer.WriteByte(msg.Code)
+	buffer.Write(msg.Data)
+	_, err := m.sock.Write(buffer.Bytes())
+	return err
+}
+
+// newModifier creates a Modifier bound to the current session state
+func (m *milterSession) newModifier() *Modifier {
+	return &Modifier{
+		Macros:      m.mergedMacros(),
+		Headers:     m.headers,
+		WritePacket: m.WritePacket,
+		actions:     m.actions,
+		protocol:    m.protocol,
+	}
+}
+
+// mergedMacros returns all macros received so far in a single map
+func (m *milterSession) mergedMacros() map[string]string {
+	merged := make(map[string]string)
+	for _, code := range []Code{CodeConn, CodeHelo, CodeMail, CodeRcpt, CodeData, CodeHeader, CodeEOH, CodeBody, CodeEOB} {
+		for k, v := range m.macros[code] {
+			merged[k] = v
+		}
+	}
+	return merged
+}
+
+// payload returns the macros sent with the given command
+func (m *milterSession) payload(code Code) map[string]string {
+	if p, ok := m.macros[code]; ok {
+		return p
+	}
+	return map[string]string{}
+}
+
+// resetMessage drops message scoped state, connection data is preserved
+func (m *milterSession) resetMessage() {
+	for _, code := range []Code{CodeMail, CodeRcpt, CodeData, CodeHeader, CodeEOH, CodeBody, CodeEOB} {
+		delete(m.macros, code)
+	}
+	m.headers = make(textproto.MIMEHeader)
+}
+
+// reply converts a callback response to what is sent back to the MTA,
+// nil means the MTA was told not to expect a reply for this stage
+func (m *milterSession) reply(resp Response, noReply OptProtocol) Response {
+	if noReply != 0 && m.protocol&noReply != 0 {
+		return nil
+	}
+	if resp == nil {
+		return RespContinue
+	}
+	return resp
+}
+
+// negotiate handles SMFIC_OPTNEG and returns the option reply
+func (m *milterSession) negotiate(data []byte) (Response, error) {
+	if len(data) < 12 {
+		return nil, fmt.Errorf("milter: optneg packet too short (%d)", len(data))
+	}
+	version := binary.BigEndian.Uint32(data[0:4])
+	mtaActions := OptAction(binary.BigEndian.Uint32(data[4:8]))
+	mtaProtocol := OptProtocol(binary.BigEndian.Uint32(data[8:12]))
+	if version < 2 {
+		return nil, fmt.Errorf("milter: unsupported protocol version %d", version)
+	}
+	if version > MilterVersion {
+		version = MilterVersion
+	}
+
+	// only keep the options the MTA offered, everything else is not negotiated
+	m.actions &= mtaActions
+	m.protocol &= mtaProtocol
+
+	var buffer bytes.Buffer
+	for _, v := range []uint32{version, uint32(m.actions), uint32(m.protocol)} {
+		if err := binary.Write(&buffer, binary.BigEndian, v); err != nil {
+			return nil, err
+		}
+	}
+	return NewResponse(byte(CodeOptNeg), buffer.Bytes()), nil
+}
+
+// Process processes incoming milter commands
+func (m *milterSession) Process(msg *Message) (Response, error) {
+	switch Code(msg.Code) {
+	case CodeOptNeg:
+		return m.negotiate(msg.Data)
+
+	case CodeMacro:
+		// define macros for the command given in the first byte
+		if len(msg.Data) == 0 {
+			return nil, errors.New("milter: empty macro packet")
+		}
+		code := Code(msg.Data[0])
+		macros := make(map[string]string)
+		pairs := DecodeCStrings(msg.Data[1:])
+		for i := 0; i+1 < len(pairs); i += 2 {
+			macros[strings.Trim(pairs[i], "{}")] = pairs[i+1]
+		}
+		m.macros[code] = macros
+		return nil, nil
+
+	case CodeConn:
+		// new connection, get hostname, family, port and address
+		hostname := ReadCString(msg.Data)
+		msg.Data = msg.Data[len(hostname)+1:]
+		if len(msg.Data) == 0 {
+			return nil, errors.New("milter: connect packet too short")
+		}
+		family := ProtoFamily(msg.Data[0])
+		var address net.IP
+		if family != FamilyUnknown {
+			if len(msg.Data) < 3 {
+				return nil, errors.New("milter: connect packet too short")
+			}
+			// port is not used by handlers, only the address
+			address = net.ParseIP(ReadCString(msg.Data[3:]))
+		}
+		resp, _, err := m.milter.Connect(hostname, address, m.payload(CodeConn), m.newModifier())
+		if err != nil {
+			return nil, err
+		}
+		return m.reply(resp, OptNoConnReply), nil
+
+	case CodeHelo:
+		name := ReadCString(msg.Data)
+		resp, _, err := m.milter.Helo(name, m.payload(CodeHelo), m.newModifier())
+		if err != nil {
+			return nil, err
+		}
+		return m.reply(resp, OptNoHeloReply), nil
+
+	case CodeMail:
+		// envelope from address, esmtp arguments are ignored
+		from := strings.Trim(ReadCString(msg.Data), "<>")
+		resp, _, err := m.milter.MailFrom(from, m.payload(CodeMail), m.newModifier())
+		if err != nil {
+			return nil, err
+		}
+		return m.reply(resp, OptNoMailReply), nil
+
+	case CodeRcpt:
+		to := strings.Trim(ReadCString(msg.Data), "<>")
+		resp, _, err := m.milter.RcptTo(to, m.payload(CodeRcpt), m.newModifier())
+		if err != nil {
+			return nil, err
+		}
+		return m.reply(resp, OptNoRcptReply), nil
+
+	case CodeData:
+		// DATA command, there is no callback for it
+		return m.reply(RespContinue, OptNoDataReply), nil
+
+	case CodeHeader:
+		headerData := DecodeCStrings(msg.Data)
+		if len(headerData) == 0 {
+			return nil, errors.New("milter: empty header packet")
+		}
+		name, value := headerData[0], ""
+		if len(headerData) > 1 {
+			value = headerData[1]
+		}
+		m.headers.Add(name, value)
+		resp, _, err := m.milter.Header(name, value, m.payload(CodeHeader), m.newModifier())
+		if err != nil {
+			return nil, err
+		}
+		return m.reply(resp, OptNoHeaderReply), nil
+
+	case CodeEOH:
+		resp, _, err := m.milter.Headers(m.headers, m.payload(CodeEOH), m.newModifier())
+		if err != nil {
+			return nil, err
+		}
+		return m.reply(resp, OptNoEOHReply), nil
+
+	case CodeBody:
+		resp, _, err := m.milter.BodyChunk(msg.Data, m.payload(CodeBody), m.newModifier())
+		if err != nil {
+			return nil, err
+		}
+		return m.reply(resp, OptNoBodyReply), nil
+
+	case CodeEOB:
+		// end of message, modifications are written by the handler before the reply
+		mod := m.newModifier()
+		resp, _, err := m.milter.Body(m.payload(CodeEOB), mod, mod.Macros)
+		if err != nil {
+			return nil, err
+		}
+		m.resetMessage()
+		return m.reply(resp, 0), nil
+
+	case CodeAbort:
+		// abort current message, no reply is expected
+		err := m.milter.Abort(m.newModifier())
+		m.resetMessage()
+		return nil, err
+
+	case CodeQuitNewConn:
+		// the connection is reused for a new SMTP session, start with a clean handler
+		if err := m.milter.Abort(m.newModifier()); err != nil {
+			return nil, err
+		}
+		m.milter, _, _ = m.init()
+		m.macros = make(map[Code]map[string]string)
+		m.headers = make(textproto.MIMEHeader)
+		return nil, nil
+
+	case CodeQuit:
+		return nil, errCloseSession
+
+	default:
+		// unknown SMTP command, continue unless told otherwise
+		return m.reply(RespContinue, OptNoUnknownReply), nil
+	}
+}
+
+// HandleMilterCommands processes all milter commands in the same connection
+func (m *milterSession) HandleMilterCommands() error {
+	defer m.sock.Close()
+
+	for {
+		msg, err := m.ReadPacket()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		resp, err := m.Process(msg)
+		if err != nil {
+			if errors.Is(err, errCloseSession) {
+				return nil
+			}
+			return err
+		}
+		if resp == nil {
+			continue
+		}
+		if err = m.WritePacket(resp.Response()); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,369 @@
+package dkim
+
+import (
+	"bufio"
+	"crypto"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ARC header fields, as specified in RFC 8617.
+const (
+	arcSealField           = "ARC-Seal"
+	arcMessageSigField     = "ARC-Message-Signature"
+	arcAuthResultsField    = "ARC-Authentication-Results"
+	maxARCInstances        = 50
+	arcHeaderCanonicalizer = CanonicalizationRelaxed
+)
+
+// ARCResult is the validation status of an ARC chain.
+type ARCResult string
+
+const (
+	ARCNone ARCResult = "none"
+	ARCPass ARCResult = "pass"
+	ARCFail ARCResult = "fail"
+)
+
+// An ARCVerification is produced by VerifyARC when it validates the chain of
+// a message.
+type ARCVerification struct {
+	Result ARCResult
+	// Instance is the number of ARC sets in the chain.
+	Instance int
+	// The SDID and selector of the newest ARC-Seal.
+	Domain   string
+	Selector string
+
+	// Err is the reason the chain failed.
+	Err error
+}
+
+// arcSet holds the three header fields of one instance.
+type arcSet struct {
+	instance int
+	aar      string
+	ams      string
+	as       string
+}
+
+// arcInstance parses the i= tag leading the value of an ARC header field.
+func arcInstance(value string) (int, error) {
+	tag, _, _ := strings.Cut(value, ";")
+	k, v, ok := strings.Cut(tag, "=")
+	if !ok || stripWhitespace(k) != "i" {
+		return 0, permFailError("ARC header field without instance")
+	}
+	i, err := strconv.Atoi(stripWhitespace(v))
+	if err != nil || i < 1 || i > maxARCInstances {
+		return 0, permFailError("invalid ARC instance")
+	}
+	return i, nil
+}
+
+// parseARCSets collects the ARC sets of a header in instance order, a chain
+// with a missing or duplicated field is invalid.
+func parseARCSets(h header) ([]*arcSet, error) {
+	sets := make(map[int]*arcSet)
+	for _, kv := range h {
+		k, v := parseHeaderField(kv)
+		var i int
+		var err error
+		switch {
+		case strings.EqualFold(k, arcSealField), strings.EqualFold(k, arcMessageSigField):
+			params, perr := parseHeaderParams(v)
+			if perr != nil {
+				return nil, permFailError("malformed ARC header field")
+			}
+			i, err = arcInstance("i=" + params["i"])
+		case strings.EqualFold(k, arcAuthResultsField):
+			i, err = arcInstance(v)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		set, ok := sets[i]
+		if !ok {
+			set = &arcSet{instance: i}
+			sets[i] = set
+		}
+		field := &set.aar
+		if strings.EqualFold(k, arcSealField) {
+			field = &set.as
+		} else if strings.EqualFold(k, arcMessageSigField) {
+			field = &set.ams
+		}
+		if *field != "" {
+			return nil, permFailError("duplicate ARC header field")
+		}
+		*field = kv
+	}
+
+	chain := make([]*arcSet, 0, len(sets))
+	for _, set := range sets {
+		chain = append(chain, set)
+	}
+	sort.Slice(chain, func(i, j int) bool { return chain[i].instance < chain[j].instance })
+	for n, set := range chain {
+		if set.instance != n+1 {
+			return nil, permFailError("ARC chain has a gap")
+		}
+		if set.aar == "" || set.ams == "" || set.as == "" {
+			return nil, permFailError("incomplete ARC set")
+		}
+	}
+	return chain, nil
+}
+
+func fieldParams(kv string) map[string]string {
+	_, v := parseHeaderField(kv)
+	params, _ := parseHeaderParams(v)
+	return params
+}
+
+// sealHash hashes the ARC sets a seal covers, the b= tag of the last seal is
+// left empty.
+func sealHash(hash crypto.Hash, chain []*arcSet) []byte {
+	can := canonicalizers[arcHeaderCanonicalizer]
+	hasher := hash.New()
+	for n, set := range chain {
+		as := set.as
+		last := n == len(chain)-1
+		if last {
+			as = removeSignature(as)
+		}
+		io.WriteString(hasher, can.CanonicalizeHeader(set.aar))
+		io.WriteString(hasher, can.CanonicalizeHeader(set.ams))
+		as = can.CanonicalizeHeader(as)
+		if last {
+			as = strings.TrimRight(as, crlf)
+		}
+		io.WriteString(hasher, as)
+	}
+	return hasher.Sum(nil)
+}
+
+// verifySeal checks the ARC-Seal of the last set of chain.
+func verifySeal(chain []*arcSet, options *VerifyOptions) error {
+	params := fieldParams(chain[len(chain)-1].as)
+	for _, tag := range []string{"a", "b", "cv", "d", "s"} {
+		if _, ok := params[tag]; !ok {
+			return permFailError("ARC-Seal missing required tag")
+		}
+	}
+	res, hash, err := queryKey(params, options)
+	if err != nil {
+		return err
+	}
+	sig, err := decodeBase64String(params["b"])
+	if err != nil {
+		return permFailError("malformed signature: " + err.Error())
+	}
+	if err := res.Verifier.Verify(hash, sealHash(hash, chain), sig); err != nil {
+		return failError("ARC-Seal did not verify: " + err.Error())
+	}
+	return nil
+}
+
+// VerifyARC validates the ARC chain of a message as section 5.2 of RFC 8617
+// describes: the newest ARC-Message-Signature and every ARC-Seal must verify.
+//
+// Errors of the chain are reported in the verification, the returned error
+// is for failures to read the message.
+func VerifyARC(r io.Reader, options *VerifyOptions) (*ARCVerification, error) {
+	bufr := bufio.NewReader(r)
+	h, err := readHeader(bufr)
+	if err != nil {
+		return nil, err
+	}
+	verif := &ARCVerification{Result: ARCNone}
+	chain, err := parseARCSets(h)
+	if err != nil {
+		verif.Result, verif.Err = ARCFail, err
+		return verif, nil
+	}
+	if len(chain) == 0 {
+		return verif, nil
+	}
+	last := chain[len(chain)-1]
+	params := fieldParams(last.as)
+	verif.Instance = last.instance
+	verif.Domain, verif.Selector = stripWhitespace(params["d"]), stripWhitespace(params["s"])
+	verif.Result = ARCFail
+
+	for _, set := range chain {
+		cv := ARCResult(stripWhitespace(fieldParams(set.as)["cv"]))
+		if (set.instance == 1 && cv != ARCNone) || (set.instance > 1 && cv != ARCPass) {
+			verif.Err = permFailError("ARC chain validation status is " + string(cv))
+			return verif, nil
+		}
+	}
+
+	_, amsValue := parseHeaderField(last.ams)
+	amsParams, err := parseHeaderParams(amsValue)
+	if err != nil {
+		verif.Err = permFailError("malformed ARC-Message-Signature")
+		return verif, nil
+	}
+	if err := checkSignature(h, bufr, last.ams, amsParams, options); err != nil {
+		if !IsTempFail(err) && !IsPermFail(err) && !isFail(err) {
+			return nil, err
+		}
+		verif.Err = err
+		return verif, nil
+	}
+	for n := len(chain); n > 0; n-- {
+		if err := verifySeal(chain[:n], options); err != nil {
+			verif.Err = err
+			return verif, nil
+		}
+	}
+	verif.Result = ARCPass
+	return verif, nil
+}
+
+// SealOptions is used to configure Seal. Domain, Selector, Signer and
+// AuthServID are mandatory.
+type SealOptions struct {
+	// The domain and selector of the key, as in SignOptions.
+	Domain   string
+	Selector string
+	Signer   crypto.Signer
+
+	// AuthServID names the sealer in ARC-Authentication-Results.
+	AuthServID string
+	// Results are the authentication results of the sealer, as in its
+	// Authentication-Results header field without the authserv-id. If empty,
+	// "none" is recorded.
+	Results string
+	// ChainValidation is the status of the chain received, see VerifyARC.
+	// It is ignored for messages without a chain.
+	ChainValidation ARCResult
+
+	// A list of header fields to include in the ARC-Message-Signature. If nil,
+	// all header fields but the ARC ones are included.
+	HeaderKeys []string
+}
+
+// Seal adds an ARC set to a message read from r, as section 5.1 of RFC 8617
+// describes. It returns the ARC-Seal, ARC-Message-Signature and
+// ARC-Authentication-Results header fields the caller should prepend to the
+// message, each with its final CRLF.
+//
+// A failed chain can't be extended, Seal returns an error for it.
+func Seal(r io.Reader, options *SealOptions) (string, error) {
+	if options == nil {
+		return "", fmt.Errorf("dkim: no options specified")
+	}
+	if options.Domain == "" || options.Selector == "" || options.Signer == nil || options.AuthServID == "" {
+		return "", fmt.Errorf("dkim: domain, selector, signer and authserv-id are required")
+	}
+	keyAlgo, err := keyAlgorithm(options.Signer)
+	if err != nil {
+		return "", err
+	}
+
+	br := bufio.NewReader(r)
+	h, err := readHeader(br)
+	if err != nil {
+		return "", err
+	}
+	chain, err := parseARCSets(h)
+	if err != nil {
+		return "", fmt.Errorf("dkim: ARC chain failed: %w", err)
+	}
+	cv := ARCNone
+	if len(chain) > 0 {
+		if options.ChainValidation != ARCPass {
+			return "", fmt.Errorf("dkim: ARC chain is %q, it is not sealed", options.ChainValidation)
+		}
+		cv = ARCPass
+	}
+	if len(chain) >= maxARCInstances {
+		return "", fmt.Errorf("dkim: ARC chain has %d sets already", len(chain))
+	}
+	instance := strconv.Itoa(len(chain) + 1)
+	hash := crypto.SHA256
+	signHash := hash
+	// ed25519 signs the hash itself, see NewSigner
+	if keyAlgo == "ed25519" {
+		signHash = crypto.Hash(0)
+	}
+
+	results := strings.ReplaceAll(strings.TrimSpace(options.Results), crlf, "\n")
+	results = strings.ReplaceAll(results, "\n", crlf)
+	if results == "" {
+		results = "none"
+	}
+	aar := fmt.Sprintf("%s: i=%s; %s; %s%s", arcAuthResultsField, instance, options.AuthServID, results, crlf)
+
+	// ARC-Message-Signature
+	hasher := hash.New()
+	can := canonicalizers[CanonicalizationRelaxed].CanonicalizeBody(hasher)
+	if _, err := io.Copy(can, br); err != nil {
+		return "", err
+	}
+	if err := can.Close(); err != nil {
+		return "", err
+	}
+	amsParams := map[string]string{
+		"i":  instance,
+		"a":  keyAlgo + "-sha256",
+		"bh": base64.StdEncoding.EncodeToString(hasher.Sum(nil)),
+		"c":  string(CanonicalizationRelaxed) + "/" + string(CanonicalizationRelaxed),
+		"d":  options.Domain,
+		"s":  options.Selector,
+		"t":  formatTime(now()),
+	}
+	headerKeys := options.HeaderKeys
+	if headerKeys == nil {
+		for _, kv := range h {
+			k, _ := parseHeaderField(kv)
+			if !strings.HasPrefix(strings.ToLower(k), "arc-") {
+				headerKeys = append(headerKeys, k)
+			}
+		}
+	}
+	amsParams["h"] = formatTagList(headerKeys)
+
+	hasher.Reset()
+	picker := newHeaderPicker(h)
+	headerCan := canonicalizers[CanonicalizationRelaxed]
+	for _, k := range headerKeys {
+		if kv := picker.Pick(k); kv != "" {
+			io.WriteString(hasher, headerCan.CanonicalizeHeader(kv))
+		}
+	}
+	amsParams["b"] = ""
+	io.WriteString(hasher, strings.TrimRight(headerCan.CanonicalizeHeader(formatHeaderParams(arcMessageSigField, amsParams)), crlf))
+	sig, err := options.Signer.Sign(randReader, hasher.Sum(nil), signHash)
+	if err != nil {
+		return "", err
+	}
+	amsParams["b"] = base64.StdEncoding.EncodeToString(sig)
+	ams := formatHeaderParams(arcMessageSigField, amsParams)
+
+	// ARC-Seal
+	asParams := map[string]string{
+		"i":  instance,
+		"a":  keyAlgo + "-sha256",
+		"cv": string(cv),
+		"d":  options.Domain,
+		"s":  options.Selector,
+		"t":  formatTime(now()),
+		"b":  "",
+	}
+	chain = append(chain, &arcSet{instance: len(chain) + 1, aar: aar, ams: ams, as: formatHeaderParams(arcSealField, asParams)})
+	sig, err = options.Signer.Sign(randReader, sealHash(hash, chain), signHash)
+	if err != nil {
+		return "", err
+	}
+	asParams["b"] = base64.StdEncoding.EncodeToString(sig)
+	return formatHeaderParams(arcSealField, asParams) + ams + aar, nil
+}
@@ -1,4 +1,5 @@
-// Package dkim creates and verifies DKIM signatures, as specified in RFC 6376.
+// Package dkim creates and verifies DKIM signatures, as specified in RFC 6376,
+// and validates and seals ARC chains, as specified in RFC 8617.
 //
 // # FAQ
 //
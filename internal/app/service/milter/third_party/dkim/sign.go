@@ -117,14 +117,9 @@ func NewSigner(options *SignOptions) (*Signer, error) {
 		return nil, fmt.Errorf("dkim: unknown body canonicalization %q", bodyCan)
 	}
 
-	var keyAlgo string
-	switch options.Signer.Public().(type) {
-	case *rsa.PublicKey:
-		keyAlgo = "rsa"
-	case ed25519.PublicKey:
-		keyAlgo = "ed25519"
-	default:
-		return nil, fmt.Errorf("dkim: unsupported key algorithm %T", options.Signer.Public())
+	keyAlgo, err := keyAlgorithm(options.Signer)
+	if err != nil {
+		return nil, err
 	}
 
 	hash := options.Hash
@@ -280,6 +275,17 @@ func NewSigner(options *SignOptions) (*Signer, error) {
 	return s, nil
 }
 
+// keyAlgorithm names the algorithm of a signing key as in the a= tag.
+func keyAlgorithm(signer crypto.Signer) (string, error) {
+	switch signer.Public().(type) {
+	case *rsa.PublicKey:
+		return "rsa", nil
+	case ed25519.PublicKey:
+		return "ed25519", nil
+	}
+	return "", fmt.Errorf("dkim: unsupported key algorithm %T", signer.Public())
+}
+
 // Write implements io.WriteCloser.
 func (s *Signer) Write(b []byte) (n int, err error) {
 	return s.pw.Write(b)
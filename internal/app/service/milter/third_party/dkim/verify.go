@@ -66,6 +66,8 @@ type Verification struct {
 	// The SDID claiming responsibility for an introduction of a message into the
 	// mail stream.
 	Domain string
+	// The selector of the key the signature refers to.
+	Selector string
 	// The Agent or User Identifier (AUID) on behalf of which the SDID is taking
 	// responsibility.
 	Identifier string
@@ -221,6 +223,7 @@ func verify(h header, r io.Reader, sigField, sigValue string, options *VerifyOpt
 	}
 
 	verif.Domain = stripWhitespace(params["d"])
+	verif.Selector = stripWhitespace(params["s"])
 
 	for _, tag := range requiredTags {
 		if _, ok := params[tag]; !ok {
@@ -268,33 +271,44 @@ func verify(h header, r io.Reader, sigField, sigValue string, options *VerifyOpt
 		}
 	}
 
+	if err := checkSignature(h, r, sigField, params, options); err != nil {
+		return verif, err
+	}
+	return verif, nil
+}
+
+// queryKey fetches the public key of a signature and checks the algorithms
+// against it.
+func queryKey(params map[string]string, options *VerifyOptions) (*queryResult, crypto.Hash, error) {
 	// Query public key
 	// TODO: compute hash in parallel
 	methods := []string{string(QueryMethodDNSTXT)}
 	if methodsStr, ok := params["q"]; ok {
 		methods = parseTagList(methodsStr)
 	}
+	domain, selector := stripWhitespace(params["d"]), stripWhitespace(params["s"])
 	var res *queryResult
+	var err error
 	for _, method := range methods {
 		if query, ok := queryMethods[QueryMethod(method)]; ok {
 			if options != nil {
-				res, err = query(verif.Domain, stripWhitespace(params["s"]), options.LookupTXT)
+				res, err = query(domain, selector, options.LookupTXT)
 			} else {
-				res, err = query(verif.Domain, stripWhitespace(params["s"]), nil)
+				res, err = query(domain, selector, nil)
 			}
 			break
 		}
 	}
 	if err != nil {
-		return verif, err
+		return nil, 0, err
 	} else if res == nil {
-		return verif, permFailError("unsupported public key query method")
+		return nil, 0, permFailError("unsupported public key query method")
 	}
 
 	// Parse algos
 	keyAlgo, hashAlgo, ok := strings.Cut(stripWhitespace(params["a"]), "-")
 	if !ok {
-		return verif, permFailError("malformed algorithm name")
+		return nil, 0, permFailError("malformed algorithm name")
 	}
 
 	// Check hash algo
@@ -307,7 +321,7 @@ func verify(h header, r io.Reader, sigField, sigValue string, options *VerifyOpt
 			}
 		}
 		if !ok {
-			return verif, permFailError("inappropriate hash algorithm")
+			return nil, 0, permFailError("inappropriate hash algorithm")
 		}
 	}
 	var hash crypto.Hash
@@ -315,16 +329,16 @@ func verify(h header, r io.Reader, sigField, sigValue string, options *VerifyOpt
 	case "sha1":
 		// RFC 8301 section 3.1: rsa-sha1 MUST NOT be used for signing or
 		// verifying.
-		return verif, permFailError(fmt.Sprintf("hash algorithm too weak: %v", hashAlgo))
+		return nil, 0, permFailError(fmt.Sprintf("hash algorithm too weak: %v", hashAlgo))
 	case "sha256":
 		hash = crypto.SHA256
 	default:
-		return verif, permFailError("unsupported hash algorithm")
+		return nil, 0, permFailError("unsupported hash algorithm")
 	}
 
 	// Check key algo
 	if res.KeyAlgo != keyAlgo {
-		return verif, permFailError("inappropriate key algorithm")
+		return nil, 0, permFailError("inappropriate key algorithm")
 	}
 
 	if res.Services != nil {
@@ -336,52 +350,62 @@ func verify(h header, r io.Reader, sigField, sigValue string, options *VerifyOpt
 			}
 		}
 		if !ok {
-			return verif, permFailError("inappropriate service")
+			return nil, 0, permFailError("inappropriate service")
 		}
 	}
+	return res, hash, nil
+}
+
+// checkSignature verifies the body hash and the signature of the header
+// fields listed in the h tag, for DKIM-Signature and ARC-Message-Signature.
+func checkSignature(h header, r io.Reader, sigField string, params map[string]string, options *VerifyOptions) error {
+	res, hash, err := queryKey(params, options)
+	if err != nil {
+		return err
+	}
 
 	headerCan, bodyCan := parseCanonicalization(params["c"])
 	if _, ok := canonicalizers[headerCan]; !ok {
-		return verif, permFailError("unsupported header canonicalization algorithm")
+		return permFailError("unsupported header canonicalization algorithm")
 	}
 	if _, ok := canonicalizers[bodyCan]; !ok {
-		return verif, permFailError("unsupported body canonicalization algorithm")
+		return permFailError("unsupported body canonicalization algorithm")
 	}
 
 	// The body length "l" parameter is insecure, because it allows parts of
 	// the message body to not be signed. Reject messages which have it set.
 	if _, ok := params["l"]; ok {
 		// TODO: technically should be policyError
-		return verif, failError("message contains an insecure body length tag")
+		return failError("message contains an insecure body length tag")
 	}
 
 	// Parse body hash and signature
 	bodyHashed, err := decodeBase64String(params["bh"])
 	if err != nil {
-		return verif, permFailError("malformed body hash: " + err.Error())
+		return permFailError("malformed body hash: " + err.Error())
 	}
 	sig, err := decodeBase64String(params["b"])
 	if err != nil {
-		return verif, permFailError("malformed signature: " + err.Error())
+		return permFailError("malformed signature: " + err.Error())
 	}
 
 	// Check body hash
 	hasher := hash.New()
 	wc := canonicalizers[bodyCan].CanonicalizeBody(hasher)
 	if _, err := io.Copy(wc, r); err != nil {
-		return verif, err
+		return err
 	}
 	if err := wc.Close(); err != nil {
-		return verif, err
+		return err
 	}
 	if subtle.ConstantTimeCompare(hasher.Sum(nil), bodyHashed) != 1 {
-		return verif, failError("body hash did not verify")
+		return failError("body hash did not verify")
 	}
 
 	// Compute data hash
 	hasher.Reset()
 	picker := newHeaderPicker(h)
-	for _, key := range headerKeys {
+	for _, key := range parseTagList(params["h"]) {
 		kv := picker.Pick(key)
 		if kv == "" {
 			// The field MAY contain names of header fields that do not exist
@@ -392,23 +416,22 @@ func verify(h header, r io.Reader, sigField, sigValue string, options *VerifyOpt
 
 		kv = canonicalizers[headerCan].CanonicalizeHeader(kv)
 		if _, err := hasher.Write([]byte(kv)); err != nil {
-			return verif, err
+			return err
 		}
 	}
 	canSigField := removeSignature(sigField)
 	canSigField = canonicalizers[headerCan].CanonicalizeHeader(canSigField)
 	canSigField = strings.TrimRight(canSigField, "\r\n")
 	if _, err := hasher.Write([]byte(canSigField)); err != nil {
-		return verif, err
+		return err
 	}
 	hashed := hasher.Sum(nil)
 
 	// Check signature
 	if err := res.Verifier.Verify(hash, hashed, sig); err != nil {
-		return verif, failError("signature did not verify: " + err.Error())
+		return failError("signature did not verify: " + err.Error())
 	}
-
-	return verif, nil
+	return nil
 }
 
 func parseTagList(s string) []string {
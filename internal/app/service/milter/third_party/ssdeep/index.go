@@ -0,0 +1,56 @@
+package ssdeep
+
+import "strings"
+
+// Gram is a substring of rollingWindow characters of a signature, keyed by the
+// block size of the part it was taken from.
+//
+// Distance scores two signatures above zero only when the parts it compares
+// have such a substring in common, see hasCommonSubstring. An index of the
+// grams of stored signatures therefore finds every candidate for a match.
+type Gram struct {
+	BlockSize int
+	Value     int64
+}
+
+// Grams returns the distinct grams of both parts of a signature, the second
+// part is keyed by the doubled block size.
+func Grams(hash string) ([]Gram, error) {
+	blockSize, part1, part2, err := splitSsdeep(hash)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[Gram]struct{})
+	grams := make([]Gram, 0, len(part1)+len(part2))
+	for _, p := range []struct {
+		blockSize int
+		s         string
+	}{{blockSize, part1}, {blockSize * 2, part2}} {
+		for i := 0; i+rollingWindow <= len(p.s); i++ {
+			v, ok := gramValue(p.s[i : i+rollingWindow])
+			if !ok {
+				return nil, ErrInvalidFormat
+			}
+			g := Gram{BlockSize: p.blockSize, Value: v}
+			if _, ok := seen[g]; ok {
+				continue
+			}
+			seen[g] = struct{}{}
+			grams = append(grams, g)
+		}
+	}
+	return grams, nil
+}
+
+// gramValue packs the base64 characters of a gram into 42 bits
+func gramValue(s string) (int64, bool) {
+	var v int64
+	for i := 0; i < len(s); i++ {
+		n := strings.IndexByte(b64String, s[i])
+		if n < 0 {
+			return 0, false
+		}
+		v = v<<6 | int64(n)
+	}
+	return v, true
+}
@@ -0,0 +1,96 @@
+package policy
+
+import (
+	"context"
+	"easymail/internal/app/service/filter"
+	"easymail/internal/app/service/milter"
+	"easymail/internal/model"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ActionDunno lets postfix go on with its other restrictions
+const ActionDunno = "DUNNO"
+
+/*
+Request is one policy delegation request, the attributes as postfix sends
+them, e.g. protocol_state, client_address, sender and recipient.
+*/
+type Request map[string]string
+
+// states maps protocol_state to the last filter stage whose features are known
+var states = map[string]model.FilterStage{
+	"CONNECT":        model.FilterStageConnect,
+	"EHLO":           model.FilterStageHelo,
+	"HELO":           model.FilterStageHelo,
+	"MAIL":           model.FilterStageMailFrom,
+	"RCPT":           model.FilterStageRcptTo,
+	"DATA":           model.FilterStageRcptTo,
+	"END-OF-MESSAGE": model.FilterStageRcptTo,
+}
+
+// Stage returns the filter stage of the request, ok is false for states rules do not run at
+func (r Request) Stage() (model.FilterStage, bool) {
+	stage, ok := states[strings.ToUpper(r["protocol_state"])]
+	return stage, ok
+}
+
+func stringFeature(name, value string) milter.Feature {
+	return milter.Feature{Name: name, Value: value, ValueType: milter.DataTypeString}
+}
+
+func rcptCount(n int64) milter.Feature {
+	return milter.Feature{Name: filter.FeatureRcptCount, Value: strconv.FormatInt(n, 10), ValueType: milter.DataTypeInt}
+}
+
+// Features maps the attributes of the request to the built-in filter features
+func (r Request) Features() filter.Features {
+	features := make(filter.Features)
+	add := func(name, attr string) {
+		if v := r[attr]; v != "" {
+			features.Add(stringFeature(name, v))
+		}
+	}
+	add(filter.FeatureClientIP, "client_address")
+	add(filter.FeatureClientHost, "client_name")
+	add(filter.FeatureHelo, "helo_name")
+	add(filter.FeatureSender, "sender")
+	add(filter.FeatureSaslUsername, "sasl_username")
+	add(filter.FeatureRcpt, "recipient")
+	if i := strings.LastIndex(r["sender"], "@"); i >= 0 {
+		features.Add(stringFeature(filter.FeatureSenderDomain, strings.ToLower(r["sender"][i+1:])))
+	}
+	if size, err := strconv.ParseInt(r["size"], 10, 64); err == nil && size > 0 {
+		features.Add(milter.Feature{Name: filter.FeatureSize, Value: r["size"], ValueType: milter.DataTypeInt})
+	}
+	return features
+}
+
+/*
+Check decides on a request after the filter rules passed it, an empty action
+leaves the decision to the next check. Checks are run in the order they were
+added, greylisting is one of them.
+*/
+type Check interface {
+	Check(ctx context.Context, req Request) (action string, err error)
+}
+
+// ruleAction maps the action of a matched filter rule to a policy action
+func ruleAction(result *filter.Result) string {
+	switch model.FilterAction(result.Action) {
+	case model.FilterActionDefer:
+		return "DEFER_IF_PERMIT 4.7.1 Service temporarily unavailable, try again later"
+	case model.FilterActionReject:
+		return "REJECT 5.7.1 Message rejected by policy"
+	case model.FilterActionDiscard:
+		return "DISCARD filter rule " + strconv.FormatInt(result.RuleID, 10)
+	case model.FilterActionTrash:
+		return fmt.Sprintf("PREPEND %s: Trash", filter.FolderHeader)
+	case model.FilterActionQuarantine:
+		// the message waits in the postfix hold queue, the same as a milter quarantine
+		return "HOLD filter rule " + strconv.FormatInt(result.RuleID, 10)
+	}
+	// accept must not skip the restrictions after the policy, e.g. reject_unauth_destination
+	return ActionDunno
+}
@@ -0,0 +1,105 @@
+package policy
+
+import (
+	"bufio"
+	"context"
+	"easymail/internal/app/service/filter"
+	"easymail/internal/model"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+type fakeCheck struct{}
+
+func (fakeCheck) Check(_ context.Context, req Request) (string, error) {
+	if req["sender"] == "new@example.net" {
+		return "DEFER_IF_PERMIT 4.7.1 Greylisted", nil
+	}
+	return "", nil
+}
+
+func attributes(n int) string {
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&b, "a%d=b\n", i)
+	}
+	return b.String()
+}
+
+func TestReadRequest(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("\nrequest=smtpd_access_policy\nprotocol_state=RCPT\nsender=a@example.org\nccert_subject=\n\nrequest=smtpd_access_policy\n"))
+	req, err := readRequest(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(req) != 4 || req["sender"] != "a@example.org" || req["ccert_subject"] != "" {
+		t.Fatalf("unexpected request %v", req)
+	}
+	if _, err = readRequest(r); err == nil {
+		t.Fatal("expected error for a request cut short")
+	}
+	if _, err = readRequest(bufio.NewReader(strings.NewReader(attributes(maxAttributes+1) + "\n"))); err != errTooLarge {
+		t.Fatalf("expected too large, got %v", err)
+	}
+}
+
+func TestDecide(t *testing.T) {
+	rules := []model.FilterRule{
+		{ID: 1, Priority: 10, Action: model.FilterActionReject, ClientIP: "equals::198.51.100.1"},
+		{ID: 2, Priority: 9, Action: model.FilterActionDefer, Assembly: `sender_domain=="defer.example.com"`},
+		{ID: 3, Priority: 8, Action: model.FilterActionTrash, Assembly: `rcpt=="trash@example.com"`},
+		{ID: 4, Priority: 7, Action: model.FilterActionReject, Assembly: `rcpt_count>2`},
+		{ID: 5, Priority: 6, Action: model.FilterActionAccept, Assembly: `sasl_username=="bob"`},
+		// evaluated at end of body, the policy never sees it
+		{ID: 6, Priority: 5, Action: model.FilterActionReject, Assembly: `attach_count>0`},
+	}
+	e, err := filter.NewEngine(rules, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New("tcp", "127.0.0.1:0")
+	s.engine = func() *filter.Engine { return e }
+	s.AddCheck(fakeCheck{})
+	sess := &session{server: s}
+
+	request := func(state, addr, sender, rcpt, instance string) Request {
+		return Request{
+			"request":        policyRequest,
+			"protocol_state": state,
+			"client_address": addr,
+			"helo_name":      "client.example.org",
+			"sender":         sender,
+			"recipient":      rcpt,
+			"instance":       instance,
+		}
+	}
+	cases := []struct {
+		name   string
+		req    Request
+		action string
+	}{
+		{"not a policy request", Request{"request": "other"}, ActionDunno},
+		{"rejected client", request("CONNECT", "198.51.100.1", "", "", ""), "REJECT "},
+		{"rejected client at rcpt", request("RCPT", "198.51.100.1", "a@example.org", "b@example.com", "i1"), "REJECT "},
+		{"deferred sender", request("RCPT", "192.0.2.1", "a@defer.example.com", "b@example.com", "i2"), "DEFER_IF_PERMIT "},
+		{"trashed rcpt", request("RCPT", "192.0.2.1", "a@example.org", "trash@example.com", "i3"), "PREPEND X-Easymail-Folder: Trash"},
+		{"second rcpt", request("RCPT", "192.0.2.1", "a@example.org", "c@example.com", "i3"), ActionDunno},
+		{"third rcpt", request("RCPT", "192.0.2.1", "a@example.org", "d@example.com", "i3"), "REJECT "},
+		{"mail stage skips rcpt rules", request("MAIL", "192.0.2.1", "a@example.org", "", "i4"), ActionDunno},
+		{"greylisted", request("RCPT", "192.0.2.1", "new@example.net", "b@example.com", "i5"), "DEFER_IF_PERMIT 4.7.1 Greylisted"},
+		{"vrfy", request("VRFY", "198.51.100.1", "", "", ""), ActionDunno},
+	}
+	for _, c := range cases {
+		if action := sess.decide(c.req); !strings.HasPrefix(action, c.action) {
+			t.Errorf("%s: expected %q, got %q", c.name, c.action, action)
+		}
+	}
+
+	// an accepted login skips the checks, postfix still runs the restrictions after the policy
+	req := request("RCPT", "192.0.2.1", "new@example.net", "b@example.com", "i6")
+	req["sasl_username"] = "bob"
+	if action := sess.decide(req); action != ActionDunno {
+		t.Fatalf("expected DUNNO for accepted login, got %q", action)
+	}
+}
@@ -0,0 +1,253 @@
+package policy
+
+import (
+	"bufio"
+	"context"
+	"easymail/internal/app/service/filter"
+	"easymail/internal/easylog"
+	"easymail/internal/observability/sessiontrace"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// idleTimeout is longer than smtpd_policy_service_timeout, postfix closes idle connections first
+	idleTimeout   = 10 * time.Minute
+	maxLineSize   = 8 << 10
+	maxAttributes = 128
+	checkTimeout  = 3 * time.Second
+	policyRequest = "smtpd_access_policy"
+)
+
+var errTooLarge = errors.New("policy request too large")
+
+/*
+Server postfix policy delegation server (check_policy_service), it evaluates
+the filter rules of the stages before DATA with the metrics they refer to,
+then the checks added, and answers with a postfix access action.
+*/
+type Server struct {
+	name     string
+	family   string
+	listen   string
+	debug    bool
+	lock     *sync.Mutex
+	started  bool
+	_log     *easylog.Logger
+	listener net.Listener
+	// conns are the open sessions, they are closed on stop
+	conns map[net.Conn]struct{}
+	wg    sync.WaitGroup
+
+	tracer         sessiontrace.Tracer
+	reloadInterval time.Duration
+	reloader       *filter.Reloader
+	logs           *filter.LogWriter
+	checks         []Check
+	// rc is where metrics are read from, they are counted by the filter
+	rc *redis.Client
+	// engine returns the rules new requests are evaluated with
+	engine func() *filter.Engine
+}
+
+func New(family, listen string) *Server {
+	if family != "tcp" && family != "unix" {
+		return nil
+	}
+	if family == "tcp" {
+		if _, _, err := net.SplitHostPort(listen); err != nil {
+			return nil
+		}
+	}
+	if family == "unix" && strings.TrimSpace(listen) == "" {
+		return nil
+	}
+	return &Server{
+		name:   "policy",
+		family: family,
+		listen: listen,
+		lock:   &sync.Mutex{},
+		conns:  make(map[net.Conn]struct{}),
+	}
+}
+
+func (s *Server) SetDebug(debug bool) {
+	s.debug = debug
+}
+
+func (s *Server) SetLogger(_log *easylog.Logger) error {
+	if _log == nil {
+		return fmt.Errorf("%s logger is nil", s.name)
+	}
+	s._log = _log
+	return nil
+}
+
+func (s *Server) SetTracer(t sessiontrace.Tracer) {
+	s.tracer = t
+}
+
+// SetReloadInterval sets how often the rules are checked for changes
+func (s *Server) SetReloadInterval(interval time.Duration) {
+	s.reloadInterval = interval
+}
+
+// SetRedis sets where the metrics of the rules are read from, before Start
+func (s *Server) SetRedis(rc *redis.Client) {
+	s.rc = rc
+}
+
+// AddCheck appends a check run after the filter rules, it must be added before start
+func (s *Server) AddCheck(c Check) {
+	s.checks = append(s.checks, c)
+}
+
+func (s *Server) Start() error {
+	if s._log == nil {
+		return fmt.Errorf("%s logger is nil", s.name)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.started {
+		return fmt.Errorf("%s server already started", s.name)
+	}
+	// the policy keeps its own copy of the rules, it may run without the filter
+	s.reloader = filter.NewReloader(s.reloadInterval, s._log)
+	if err := s.reloader.Reload(true); err != nil {
+		s._log.Errorf("%s load rules: %v", s.name, err)
+	}
+	listener, err := net.Listen(s.family, s.listen)
+	if err != nil {
+		return err
+	}
+	s.logs = filter.NewLogWriter(s._log)
+	s.logs.Start()
+	s.reloader.Start()
+	s.engine = s.reloader.Engine
+	s.listener = listener
+	s.started = true
+	s._log.Infof("%s server started!", s.name)
+	go s.run(listener)
+	return nil
+}
+
+func (s *Server) Stop() error {
+	s.lock.Lock()
+	if !s.started {
+		s.lock.Unlock()
+		return fmt.Errorf("%s server not started", s.name)
+	}
+	s.started = false
+	err := s.listener.Close()
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+	s.lock.Unlock()
+	// sessions return once their connection is closed
+	s.wg.Wait()
+	s.reloader.Stop()
+	s.logs.Stop()
+	s._log.Infof("%s server stopped!", s.name)
+	return err
+}
+
+func (s *Server) Name() string {
+	return s.name
+}
+
+func (s *Server) run(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				s._log.Errorf("%s accept: %v", s.name, err)
+			}
+			return
+		}
+		s.lock.Lock()
+		if !s.started {
+			s.lock.Unlock()
+			_ = conn.Close()
+			return
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.lock.Unlock()
+		go func() {
+			defer s.wg.Done()
+			s.Handle(conn)
+			s.lock.Lock()
+			delete(s.conns, conn)
+			s.lock.Unlock()
+		}()
+	}
+}
+
+// Handle answers the requests of one postfix connection until it is closed
+func (s *Server) Handle(conn net.Conn) {
+	defer conn.Close()
+	var span sessiontrace.Session
+	if s.tracer != nil {
+		span = s.tracer.NewSession(context.Background(), sessiontrace.SessionMeta{
+			Protocol: sessiontrace.ProtocolPolicy,
+			Remote:   conn.RemoteAddr().String(),
+			Local:    conn.LocalAddr().String(),
+		})
+		span.Event("connect", nil)
+		defer span.End("disconnect", nil)
+	}
+	sess := &session{server: s, span: span}
+	r := bufio.NewReaderSize(conn, maxLineSize)
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		req, err := readRequest(r)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) && s.debug {
+				s._log.Debugf("%s client %s: %v", s.name, conn.RemoteAddr(), err)
+			}
+			return
+		}
+		action := sess.decide(req)
+		if _, err = fmt.Fprintf(conn, "action=%s\n\n", action); err != nil {
+			return
+		}
+	}
+}
+
+// readRequest reads name=value lines up to the empty line ending a request
+func readRequest(r *bufio.Reader) (Request, error) {
+	req := make(Request)
+	for {
+		line, err := r.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) {
+			return nil, errTooLarge
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) && len(line) > 0 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		text := strings.TrimRight(string(line), "\r\n")
+		if text == "" {
+			if len(req) == 0 {
+				// empty lines between requests are skipped
+				continue
+			}
+			return req, nil
+		}
+		if len(req) >= maxAttributes {
+			return nil, errTooLarge
+		}
+		name, value, _ := strings.Cut(text, "=")
+		req[name] = value
+	}
+}
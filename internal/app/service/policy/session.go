@@ -0,0 +1,109 @@
+package policy
+
+import (
+	"context"
+	"easymail/internal/app/service/filter"
+	"easymail/internal/model"
+	"easymail/internal/observability/sessiontrace"
+)
+
+// session is one postfix connection, it keeps the rule instances between requests
+type session struct {
+	server  *Server
+	span    sessiontrace.Session
+	checker *filter.Checker
+
+	// instance tells the messages of the connection apart, rcpts counts the recipients of it
+	instance string
+	rcpts    int64
+}
+
+func (s *session) event(stage string, fields map[string]any) {
+	if s.span != nil {
+		s.span.Event(stage, fields)
+	}
+}
+
+func (s *session) logf(format string, args ...any) {
+	if s.server._log != nil {
+		s.server._log.Errorf(format, args...)
+	}
+}
+
+// decide answers a request, errors are logged and the request passes
+func (s *session) decide(req Request) string {
+	if req["request"] != policyRequest {
+		return ActionDunno
+	}
+	stage, ok := req.Stage()
+	if !ok {
+		return ActionDunno
+	}
+	features := req.Features()
+	if req["protocol_state"] == "RCPT" {
+		if req["instance"] != s.instance {
+			s.instance, s.rcpts = req["instance"], 0
+		}
+		s.rcpts++
+	}
+	if s.rcpts > 0 && req["instance"] == s.instance {
+		features.Add(rcptCount(s.rcpts))
+	}
+
+	// a matched accept rule answers DUNNO too, but skips the checks
+	action, matched := s.rules(req, stage, features)
+	if !matched {
+		action = s.checks(req)
+	}
+	s.event("request", map[string]any{
+		"state":  req["protocol_state"],
+		"sender": sessiontrace.MaskEmail(req["sender"]),
+		"rcpt":   sessiontrace.MaskEmail(req["recipient"]),
+		"action": action,
+	})
+	return action
+}
+
+// rules evaluates the filter rules, a reloaded engine is picked up by the next request
+func (s *session) rules(req Request, stage model.FilterStage, features filter.Features) (string, bool) {
+	e := s.server.engine()
+	if e == nil {
+		return ActionDunno, false
+	}
+	if s.checker == nil || s.checker.Engine() != e {
+		s.checker = filter.NewChecker(e, s.server.rc)
+	}
+	result, matched, err := s.checker.Check(stage, features)
+	if err != nil {
+		s.logf("%s %v", s.server.name, err)
+	}
+	if !result.Matched() {
+		return ActionDunno, false
+	}
+	if s.server.logs != nil {
+		log, err := s.checker.Log(matched, result, features, req["queue_id"])
+		if err != nil {
+			s.logf("%s filter log: %v", s.server.name, err)
+		} else {
+			s.server.logs.Write(log)
+		}
+	}
+	return ruleAction(result), true
+}
+
+// checks runs the added checks in order, the first action given decides
+func (s *session) checks(req Request) string {
+	for _, c := range s.server.checks {
+		ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+		action, err := c.Check(ctx, req)
+		cancel()
+		if err != nil {
+			s.logf("%s check: %v", s.server.name, err)
+			continue
+		}
+		if action != "" {
+			return action
+		}
+	}
+	return ActionDunno
+}
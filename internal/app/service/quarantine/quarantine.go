@@ -0,0 +1,144 @@
+package quarantine
+
+import (
+	"bytes"
+	"easymail/internal/app/service/storage"
+	"easymail/internal/model"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ErrNotLocal is returned when a recipient has no local mailbox to hold the message
+var ErrNotLocal = errors.New("recipient is not a local account")
+
+// Message is a message the filter quarantines
+type Message struct {
+	QueueID string
+	Sender  string
+	Rcpts   []string
+	Subject string
+	RuleID  int64
+	Reason  string
+	Content []byte
+}
+
+/*
+Store keeps quarantined messages in the Quarantine folder of every recipient,
+the message is released by moving it to the Inbox.
+*/
+type Store struct {
+	storage storage.Storager
+
+	// findAccount, create and remove are replaced in tests
+	findAccount func(name string) (*model.Account, error)
+	create      func(qs []*model.QuarantineMail) error
+	remove      func(email *model.Email) error
+}
+
+func NewStore(s storage.Storager) *Store {
+	return &Store{
+		storage:     s,
+		findAccount: model.FindAccountByName,
+		create:      model.CreateQuarantineMails,
+		remove:      storage.RemoveEmail,
+	}
+}
+
+/*
+Hold saves a copy of the message for every recipient, it fails with
+ErrNotLocal before anything is saved when a recipient is not local. The
+copies are kept for all recipients or for none, when one fails the ones
+saved before are removed again.
+*/
+func (s *Store) Hold(msg Message) error {
+	if len(msg.Rcpts) == 0 {
+		return errors.New("quarantine message has no recipient")
+	}
+	for _, rcpt := range msg.Rcpts {
+		_, err := s.findAccount(rcpt)
+		if errors.Is(err, model.ErrAccountNotExists) || errors.Is(err, model.ErrDomainNotExists) ||
+			errors.Is(err, model.ErrInvalidUsername) {
+			return fmt.Errorf("%w: %s", ErrNotLocal, rcpt)
+		}
+		if err != nil {
+			return fmt.Errorf("quarantine find account %s: %w", rcpt, err)
+		}
+	}
+	now := time.Now()
+	saved := make([]*model.Email, 0, len(msg.Rcpts))
+	records := make([]*model.QuarantineMail, 0, len(msg.Rcpts))
+	for _, rcpt := range msg.Rcpts {
+		email := &model.Email{
+			JobID:     uuid.NewString(),
+			QueueID:   msg.QueueID,
+			Date:      now,
+			Sender:    msg.Sender,
+			Recipient: rcpt,
+			Subject:   msg.Subject,
+			MailTime:  now,
+			Size:      int64(len(msg.Content)),
+			FolderId:  int64(model.Quarantine),
+		}
+		if _, err := s.storage.Save(rcpt, email, bytes.NewReader(msg.Content)); err != nil {
+			return s.rollback(saved, fmt.Errorf("quarantine save for %s: %w", rcpt, err))
+		}
+		saved = append(saved, email)
+		records = append(records, &model.QuarantineMail{
+			EmailID:    email.ID,
+			AccountID:  email.AccountID,
+			QueueID:    msg.QueueID,
+			Sender:     msg.Sender,
+			Rcpt:       rcpt,
+			Subject:    msg.Subject,
+			Size:       email.Size,
+			RuleID:     msg.RuleID,
+			Reason:     msg.Reason,
+			CreateTime: now,
+		})
+	}
+	if err := s.create(records); err != nil {
+		return s.rollback(saved, fmt.Errorf("quarantine record: %w", err))
+	}
+	return nil
+}
+
+// rollback removes the copies saved before err, the errors of removing are joined to err
+func (s *Store) rollback(saved []*model.Email, err error) error {
+	errs := []error{err}
+	for _, email := range saved {
+		if rerr := s.remove(email); rerr != nil {
+			errs = append(errs, fmt.Errorf("quarantine remove copy for %s: %w", email.Recipient, rerr))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Preview is a quarantined message with its parsed content
+type Preview struct {
+	model.QuarantineMail
+	Content *storage.MailContent `json:"content"`
+}
+
+// GetPreview reads the quarantined message of the record
+func GetPreview(id int64) (*Preview, error) {
+	q, err := model.GetQuarantineMailByID(id)
+	if err != nil {
+		return nil, err
+	}
+	email, err := model.GetMail(q.AccountID, q.EmailID)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(email.SavePath) == "" {
+		return nil, errors.New("quarantined email has no content")
+	}
+	content, err := (&storage.LocalStorage{}).Read(email.SavePath)
+	if err != nil {
+		return nil, err
+	}
+	return &Preview{QuarantineMail: q, Content: content}, nil
+}
@@ -0,0 +1,92 @@
+package quarantine
+
+import (
+	"easymail/internal/model"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+type memoryStorage struct {
+	saved map[string]string
+	next  int64
+	fail  string
+}
+
+func (m *memoryStorage) Save(accountName string, email *model.Email, content io.Reader) (string, error) {
+	if accountName == m.fail {
+		return "", errors.New("disk is full")
+	}
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return "", err
+	}
+	m.next++
+	email.ID = m.next
+	email.AccountID = m.next * 10
+	m.saved[accountName] = string(data)
+	return email.JobID, nil
+}
+
+func TestHold(t *testing.T) {
+	st := &memoryStorage{saved: make(map[string]string)}
+	records := make([]model.QuarantineMail, 0)
+	s := NewStore(st)
+	s.findAccount = func(name string) (*model.Account, error) {
+		switch {
+		case strings.HasSuffix(name, "@example.com"):
+			return &model.Account{}, nil
+		case strings.HasSuffix(name, "@down.example.com"):
+			return nil, errors.New("database is down")
+		}
+		return nil, model.ErrAccountNotExists
+	}
+	s.create = func(qs []*model.QuarantineMail) error {
+		for _, q := range qs {
+			records = append(records, *q)
+		}
+		return nil
+	}
+	s.remove = func(email *model.Email) error {
+		delete(st.saved, email.Recipient)
+		return nil
+	}
+
+	msg := Message{QueueID: "ABC", Sender: "s@example.org", Rcpts: []string{"a@example.com", "b@example.com"}, RuleID: 3, Reason: "filter rule 3", Content: []byte("Subject: x\r\n\r\nhi\r\n")}
+	if err := s.Hold(msg); err != nil {
+		t.Fatal(err)
+	}
+	if len(st.saved) != 2 || st.saved["b@example.com"] != string(msg.Content) {
+		t.Fatalf("unexpected saved messages %v", st.saved)
+	}
+	if len(records) != 2 || records[1].EmailID != 2 || records[1].AccountID != 20 || records[1].RuleID != 3 || records[1].Rcpt != "b@example.com" {
+		t.Fatalf("unexpected records %+v", records)
+	}
+
+	// a remote recipient keeps the whole message out of the store
+	msg.Rcpts = []string{"a@example.com", "c@remote.example.org"}
+	if err := s.Hold(msg); !errors.Is(err, ErrNotLocal) {
+		t.Fatalf("expected ErrNotLocal, got %v", err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("remote recipient saved %d records", len(records))
+	}
+
+	// an account which cannot be looked up is not taken for a remote one
+	msg.Rcpts = []string{"a@example.com", "d@down.example.com"}
+	if err := s.Hold(msg); err == nil || errors.Is(err, ErrNotLocal) {
+		t.Fatalf("expected a lookup error, got %v", err)
+	}
+
+	// a failing copy removes the copies saved before it
+	st.saved = make(map[string]string)
+	st.fail = "b@example.com"
+	msg.Rcpts = []string{"a@example.com", "b@example.com"}
+	if err := s.Hold(msg); err == nil {
+		t.Fatal("expected an error")
+	}
+	if len(st.saved) != 0 || len(records) != 2 {
+		t.Fatalf("expected nothing kept, got %v and %d records", st.saved, len(records))
+	}
+}
@@ -0,0 +1,170 @@
+package sieve
+
+import (
+	"bytes"
+	"easymail/internal/app/service/storage"
+	"easymail/internal/model"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// FlagSeen marks the stored message as read
+const FlagSeen = `\Seen`
+
+// folders maps mailbox names of fileinto to folders, the usual names of other clients included
+var folders = map[string]model.FolderID{
+	"inbox":            model.Inbox,
+	"sent":             model.Sent,
+	"sent items":       model.Sent,
+	"sent messages":    model.Sent,
+	"drafts":           model.Draft,
+	"draft":            model.Draft,
+	"trash":            model.Trash,
+	"deleted items":    model.Trash,
+	"deleted messages": model.Trash,
+	"junk":             model.Spam,
+	"spam":             model.Spam,
+}
+
+// Folder returns the folder of a fileinto mailbox, an unknown mailbox falls back to the Inbox
+func Folder(mailbox string) (model.FolderID, bool) {
+	folder, ok := folders[strings.ToLower(strings.TrimSpace(mailbox))]
+	if !ok {
+		return model.Inbox, false
+	}
+	return folder, true
+}
+
+// compiled caches compiled scripts by id, an updated script is compiled again
+type compiled struct {
+	updateTime time.Time
+	script     *Script
+}
+
+/*
+Delivery is what is left to the delivery agent once the message is stored,
+Err is the error of the script, the message was kept when it failed.
+*/
+type Delivery struct {
+	Stored   []int64
+	Redirect []string
+	Reject   string
+	Rejected bool
+	Vacation *Vacation
+	Err      error
+}
+
+// Deliverer runs the active sieve script of the recipient and saves the message through the storage
+type Deliverer struct {
+	storage storage.Storager
+	cache   sync.Map
+
+	// findAccount, activeScript and remove are replaced in tests
+	findAccount  func(name string) (*model.Account, error)
+	activeScript func(accountID int64) (*model.SieveScript, error)
+	remove       func(email *model.Email) error
+}
+
+func NewDeliverer(s storage.Storager) *Deliverer {
+	return &Deliverer{
+		storage:      s,
+		findAccount:  model.FindAccountByName,
+		activeScript: model.GetActiveSieveScript,
+		remove:       storage.RemoveEmail,
+	}
+}
+
+func (d *Deliverer) script(accountID int64) (*Script, error) {
+	stored, err := d.activeScript(accountID)
+	if err != nil || stored == nil {
+		return nil, err
+	}
+	if c, ok := d.cache.Load(stored.ID); ok && c.(compiled).updateTime.Equal(stored.UpdateTime) {
+		return c.(compiled).script, nil
+	}
+	script, err := Compile(stored.Content)
+	if err != nil {
+		return nil, fmt.Errorf("sieve script %s: %w", stored.Name, err)
+	}
+	d.cache.Store(stored.ID, compiled{updateTime: stored.UpdateTime, script: script})
+	return script, nil
+}
+
+/*
+Deliver stores the message for one recipient, email carries the default
+folder which keep uses. A failing script keeps the message and is reported
+in Delivery.Err, a storage failure is returned as error and the copies
+saved before are removed again, the redelivery stores them once.
+*/
+func (d *Deliverer) Deliver(msg Message, email *model.Email) (*Delivery, error) {
+	acc, err := d.findAccount(msg.Rcpt)
+	if err != nil {
+		return nil, err
+	}
+	result := &Result{Keep: true}
+	delivery := &Delivery{}
+	script, err := d.script(acc.ID)
+	if err != nil {
+		delivery.Err = err
+	} else if script != nil {
+		if result, err = script.Run(msg); err != nil {
+			delivery.Err = err
+		}
+	}
+
+	type target struct {
+		folder model.FolderID
+		flags  []string
+	}
+	targets := make([]target, 0, len(result.FileInto)+1)
+	if result.Keep {
+		targets = append(targets, target{folder: model.FolderID(email.FolderId), flags: result.KeepFlags})
+	}
+	for _, f := range result.FileInto {
+		folder, _ := Folder(f.Mailbox)
+		targets = append(targets, target{folder: folder, flags: f.Flags})
+	}
+	saved := make(map[model.FolderID]bool, len(targets))
+	copies := make([]*model.Email, 0, len(targets))
+	for _, t := range targets {
+		if saved[t.folder] {
+			continue
+		}
+		saved[t.folder] = true
+		copied := *email
+		if len(delivery.Stored) > 0 {
+			// every copy is a file of its own
+			copied.JobID = uuid.NewString()
+		}
+		copied.FolderId = int64(t.folder)
+		if containsFold(t.flags, FlagSeen) {
+			copied.ReadStatus = model.ImapRead
+		}
+		if _, err = d.storage.Save(msg.Rcpt, &copied, bytes.NewReader(msg.Raw)); err != nil {
+			return nil, d.rollback(copies, err)
+		}
+		copies = append(copies, &copied)
+		delivery.Stored = append(delivery.Stored, copied.ID)
+	}
+	delivery.Redirect = result.Redirect
+	delivery.Reject = result.Reject
+	delivery.Rejected = result.Rejected
+	delivery.Vacation = result.Vacation
+	return delivery, nil
+}
+
+// rollback removes the copies saved before err, the errors of removing are joined to err
+func (d *Deliverer) rollback(saved []*model.Email, err error) error {
+	errs := []error{err}
+	for _, email := range saved {
+		if rerr := d.remove(email); rerr != nil {
+			errs = append(errs, fmt.Errorf("sieve remove copy in folder %d: %w", email.FolderId, rerr))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,86 @@
+package sieve
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// asciiLower folds ASCII letters only, like the i;ascii-casemap comparator
+func asciiLower(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'A' && r <= 'Z' {
+			return r + 'a' - 'A'
+		}
+		return r
+	}, s)
+}
+
+// matchAny reports whether any value matches any key with the match type and comparator
+func matchAny(o *options, values, keys []string) bool {
+	for _, v := range values {
+		for _, k := range keys {
+			if match(o.match, o.comparator, v, k) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func match(matchType, comparator, value, key string) bool {
+	if comparator == "i;ascii-casemap" {
+		value, key = asciiLower(value), asciiLower(key)
+	}
+	switch matchType {
+	case "contains":
+		return strings.Contains(value, key)
+	case "matches":
+		return glob(key, value)
+	}
+	return value == key
+}
+
+// glob matches value against a pattern of * and ?, a backslash escapes the next character
+func glob(pattern, value string) bool {
+	// star and mark remember the last * to backtrack to
+	star, mark := -1, 0
+	p, v := 0, 0
+	for v < len(value) {
+		if p < len(pattern) {
+			switch c := pattern[p]; c {
+			case '*':
+				star, mark = p, v
+				p++
+				continue
+			case '?':
+				_, size := utf8.DecodeRuneInString(value[v:])
+				p++
+				v += size
+				continue
+			case '\\':
+				if p+1 < len(pattern) && pattern[p+1] == value[v] {
+					p += 2
+					v++
+					continue
+				}
+			default:
+				if c == value[v] {
+					p++
+					v++
+					continue
+				}
+			}
+		}
+		if star < 0 {
+			return false
+		}
+		// let the last * take one more character
+		_, size := utf8.DecodeRuneInString(value[mark:])
+		mark += size
+		p, v = star+1, mark
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
@@ -0,0 +1,427 @@
+package sieve
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type tokenKind uint8
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokTag
+	tokNumber
+	tokString
+	tokPunct
+)
+
+type token struct {
+	kind  tokenKind
+	text  string
+	num   int64
+	line  int
+	punct byte
+}
+
+// SyntaxError is an error in a script with the line it was found at
+type SyntaxError struct {
+	Line int
+	Msg  string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+}
+
+type lexer struct {
+	src  string
+	pos  int
+	line int
+}
+
+func (l *lexer) errorf(format string, a ...any) error {
+	return &SyntaxError{Line: l.line, Msg: fmt.Sprintf(format, a...)}
+}
+
+// skip passes white space and comments
+func (l *lexer) skip() error {
+	for l.pos < len(l.src) {
+		switch c := l.src[l.pos]; {
+		case c == '\n':
+			l.line++
+			l.pos++
+		case c == ' ' || c == '\t' || c == '\r':
+			l.pos++
+		case c == '#':
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+				l.pos++
+			}
+		case strings.HasPrefix(l.src[l.pos:], "/*"):
+			end := strings.Index(l.src[l.pos+2:], "*/")
+			if end < 0 {
+				return l.errorf("unterminated comment")
+			}
+			l.line += strings.Count(l.src[l.pos:l.pos+2+end], "\n")
+			l.pos += end + 4
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isIdent(c byte) bool {
+	return isIdentStart(c) || (c >= '0' && c <= '9')
+}
+
+func (l *lexer) next() (token, error) {
+	if err := l.skip(); err != nil {
+		return token{}, err
+	}
+	if l.pos >= len(l.src) {
+		return token{kind: tokEOF, line: l.line}, nil
+	}
+	start, c := l.pos, l.src[l.pos]
+	switch {
+	case c == ':':
+		l.pos++
+		for l.pos < len(l.src) && isIdent(l.src[l.pos]) {
+			l.pos++
+		}
+		if l.pos == start+1 {
+			return token{}, l.errorf("empty tag")
+		}
+		return token{kind: tokTag, text: strings.ToLower(l.src[start+1 : l.pos]), line: l.line}, nil
+	case c >= '0' && c <= '9':
+		for l.pos < len(l.src) && l.src[l.pos] >= '0' && l.src[l.pos] <= '9' {
+			l.pos++
+		}
+		n, err := strconv.ParseInt(l.src[start:l.pos], 10, 64)
+		if err != nil {
+			return token{}, l.errorf("invalid number %s", l.src[start:l.pos])
+		}
+		if l.pos < len(l.src) {
+			shift := map[byte]uint{'K': 10, 'k': 10, 'M': 20, 'm': 20, 'G': 30, 'g': 30}[l.src[l.pos]]
+			if shift > 0 {
+				n <<= shift
+				l.pos++
+			}
+		}
+		return token{kind: tokNumber, num: n, line: l.line}, nil
+	case c == '"':
+		return l.quoted()
+	case isIdentStart(c):
+		for l.pos < len(l.src) && isIdent(l.src[l.pos]) {
+			l.pos++
+		}
+		word := strings.ToLower(l.src[start:l.pos])
+		if word == "text" && l.pos < len(l.src) && l.src[l.pos] == ':' {
+			l.pos++
+			return l.multiline()
+		}
+		return token{kind: tokIdent, text: word, line: l.line}, nil
+	case strings.IndexByte("[](){},;", c) >= 0:
+		l.pos++
+		return token{kind: tokPunct, punct: c, line: l.line}, nil
+	}
+	return token{}, l.errorf("unexpected character %q", c)
+}
+
+// quoted reads a quoted string, a backslash escapes the next character
+func (l *lexer) quoted() (token, error) {
+	line := l.line
+	l.pos++
+	var b strings.Builder
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		switch c {
+		case '"':
+			l.pos++
+			return token{kind: tokString, text: b.String(), line: line}, nil
+		case '\\':
+			if l.pos+1 < len(l.src) {
+				l.pos++
+				c = l.src[l.pos]
+			}
+		case '\n':
+			l.line++
+		}
+		b.WriteByte(c)
+		l.pos++
+	}
+	return token{}, &SyntaxError{Line: line, Msg: "unterminated string"}
+}
+
+// multiline reads a text: string up to a line with a single dot
+func (l *lexer) multiline() (token, error) {
+	line := l.line
+	for l.pos < len(l.src) && (l.src[l.pos] == ' ' || l.src[l.pos] == '\t') {
+		l.pos++
+	}
+	if l.pos < len(l.src) && l.src[l.pos] == '#' {
+		for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+			l.pos++
+		}
+	}
+	if strings.HasPrefix(l.src[l.pos:], "\r\n") {
+		l.pos += 2
+	} else if strings.HasPrefix(l.src[l.pos:], "\n") {
+		l.pos++
+	} else {
+		return token{}, l.errorf("text: must be followed by a new line")
+	}
+	l.line++
+	var b strings.Builder
+	for l.pos < len(l.src) {
+		end := strings.IndexByte(l.src[l.pos:], '\n')
+		if end < 0 {
+			break
+		}
+		text := strings.TrimSuffix(l.src[l.pos:l.pos+end], "\r")
+		l.pos += end + 1
+		l.line++
+		if text == "." {
+			return token{kind: tokString, text: b.String(), line: line}, nil
+		}
+		// dot stuffing
+		if strings.HasPrefix(text, "..") {
+			text = text[1:]
+		}
+		b.WriteString(text)
+		b.WriteString("\r\n")
+	}
+	return token{}, &SyntaxError{Line: line, Msg: "unterminated multi-line string"}
+}
+
+type argKind uint8
+
+const (
+	argTag argKind = iota
+	argNumber
+	argStrings
+)
+
+// Arg is an argument of a command or test
+type Arg struct {
+	Kind    argKind
+	Tag     string
+	Number  int64
+	Strings []string
+	// List is set when the strings were written in brackets
+	List bool
+	Line int
+}
+
+// Test is a test with its arguments, allof, anyof and not hold the nested tests
+type Test struct {
+	Name  string
+	Args  []Arg
+	Tests []*Test
+	Line  int
+}
+
+// Command is a command with its arguments, if, elsif and else hold a block
+type Command struct {
+	Name  string
+	Args  []Arg
+	Tests []*Test
+	Block []*Command
+	Line  int
+}
+
+type parser struct {
+	lex  *lexer
+	tok  token
+	peek *token
+}
+
+func (p *parser) advance() error {
+	if p.peek != nil {
+		p.tok, p.peek = *p.peek, nil
+		return nil
+	}
+	var err error
+	p.tok, err = p.lex.next()
+	return err
+}
+
+func (p *parser) errorf(format string, a ...any) error {
+	return &SyntaxError{Line: p.tok.line, Msg: fmt.Sprintf(format, a...)}
+}
+
+func (p *parser) isPunct(c byte) bool {
+	return p.tok.kind == tokPunct && p.tok.punct == c
+}
+
+// parse reads the commands of a script up to the end or a closing brace
+func parse(src string) ([]*Command, error) {
+	p := &parser{lex: &lexer{src: src, line: 1}}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	commands, err := p.commands()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokEOF {
+		return nil, p.errorf("unexpected %s", p.describe())
+	}
+	return commands, nil
+}
+
+func (p *parser) describe() string {
+	switch p.tok.kind {
+	case tokEOF:
+		return "end of script"
+	case tokIdent:
+		return p.tok.text
+	case tokTag:
+		return ":" + p.tok.text
+	case tokNumber:
+		return strconv.FormatInt(p.tok.num, 10)
+	case tokString:
+		return strconv.Quote(p.tok.text)
+	}
+	return string(p.tok.punct)
+}
+
+func (p *parser) commands() ([]*Command, error) {
+	commands := make([]*Command, 0)
+	for p.tok.kind == tokIdent {
+		cmd := &Command{Name: p.tok.text, Line: p.tok.line}
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		args, tests, err := p.arguments()
+		if err != nil {
+			return nil, err
+		}
+		cmd.Args, cmd.Tests = args, tests
+		switch {
+		case p.isPunct(';'):
+		case p.isPunct('{'):
+			if err = p.advance(); err != nil {
+				return nil, err
+			}
+			if cmd.Block, err = p.commands(); err != nil {
+				return nil, err
+			}
+			if !p.isPunct('}') {
+				return nil, p.errorf("expected } but found %s", p.describe())
+			}
+		default:
+			return nil, p.errorf("expected ; or { after %s but found %s", cmd.Name, p.describe())
+		}
+		if err = p.advance(); err != nil {
+			return nil, err
+		}
+		commands = append(commands, cmd)
+	}
+	return commands, nil
+}
+
+// arguments reads the arguments of a command or test with its tests
+func (p *parser) arguments() ([]Arg, []*Test, error) {
+	args := make([]Arg, 0)
+	for {
+		switch {
+		case p.tok.kind == tokTag:
+			args = append(args, Arg{Kind: argTag, Tag: p.tok.text, Line: p.tok.line})
+		case p.tok.kind == tokNumber:
+			args = append(args, Arg{Kind: argNumber, Number: p.tok.num, Line: p.tok.line})
+		case p.tok.kind == tokString:
+			args = append(args, Arg{Kind: argStrings, Strings: []string{p.tok.text}, Line: p.tok.line})
+		case p.isPunct('['):
+			arg, err := p.stringList()
+			if err != nil {
+				return nil, nil, err
+			}
+			args = append(args, arg)
+		case p.tok.kind == tokIdent:
+			test, err := p.test()
+			if err != nil {
+				return nil, nil, err
+			}
+			return args, []*Test{test}, nil
+		case p.isPunct('('):
+			tests, err := p.testList()
+			if err != nil {
+				return nil, nil, err
+			}
+			return args, tests, nil
+		default:
+			return args, nil, nil
+		}
+		if err := p.advance(); err != nil {
+			return nil, nil, err
+		}
+	}
+}
+
+func (p *parser) stringList() (Arg, error) {
+	arg := Arg{Kind: argStrings, List: true, Line: p.tok.line}
+	for {
+		if err := p.advance(); err != nil {
+			return arg, err
+		}
+		if p.tok.kind != tokString {
+			return arg, p.errorf("expected string but found %s", p.describe())
+		}
+		arg.Strings = append(arg.Strings, p.tok.text)
+		if err := p.advance(); err != nil {
+			return arg, err
+		}
+		if p.isPunct(']') {
+			return arg, nil
+		}
+		if !p.isPunct(',') {
+			return arg, p.errorf("expected , or ] but found %s", p.describe())
+		}
+	}
+}
+
+// test reads a test, the current token is left after it
+func (p *parser) test() (*Test, error) {
+	if p.tok.kind != tokIdent {
+		return nil, p.errorf("expected test but found %s", p.describe())
+	}
+	test := &Test{Name: p.tok.text, Line: p.tok.line}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	args, tests, err := p.arguments()
+	if err != nil {
+		return nil, err
+	}
+	test.Args, test.Tests = args, tests
+	return test, nil
+}
+
+func (p *parser) testList() ([]*Test, error) {
+	tests := make([]*Test, 0)
+	for {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		test, err := p.test()
+		if err != nil {
+			return nil, err
+		}
+		tests = append(tests, test)
+		if p.isPunct(')') {
+			if err = p.advance(); err != nil {
+				return nil, err
+			}
+			return tests, nil
+		}
+		if !p.isPunct(',') {
+			return nil, p.errorf("expected , or ) but found %s", p.describe())
+		}
+	}
+}
@@ -0,0 +1,468 @@
+package sieve
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"strings"
+
+	"github.com/jhillyerd/enmime"
+)
+
+var wordDecoder = new(mime.WordDecoder)
+
+const defaultVacationDays = 7
+
+// Message is the message a script runs against
+type Message struct {
+	// Sender and Rcpt are the envelope addresses, Sender is empty for bounces
+	Sender string
+	Rcpt   string
+	Raw    []byte
+}
+
+type FileInto struct {
+	Mailbox string
+	Flags   []string
+}
+
+// Vacation is an auto reply the caller sends unless it replied to To within Days
+type Vacation struct {
+	To      string
+	From    string
+	Subject string
+	Reason  string
+	Mime    bool
+	Days    int
+	// Handle tells vacation actions apart when tracking replies
+	Handle string
+}
+
+/*
+Result is what a script decided, Keep stores the message in the default
+folder, FileInto in other mailboxes. Redirect, Reject and Vacation are carried
+out by the delivery agent.
+*/
+type Result struct {
+	Keep      bool
+	KeepFlags []string
+	FileInto  []FileInto
+	Redirect  []string
+	Reject    string
+	Rejected  bool
+	Discarded bool
+	Vacation  *Vacation
+}
+
+type runtime struct {
+	msg      Message
+	result   *Result
+	flags    []string
+	implicit bool
+	stopped  bool
+
+	parsed bool
+	header mail.Header
+	body   []byte
+	text   *string
+}
+
+/*
+Run executes the script, a runtime error cancels all actions and the message
+is kept, as RFC 5228 asks.
+*/
+func (s *Script) Run(msg Message) (*Result, error) {
+	r := &runtime{msg: msg, result: &Result{}, implicit: true}
+	if err := r.commands(s.commands); err != nil {
+		return &Result{Keep: true}, err
+	}
+	res := r.result
+	if res.Rejected && (res.Keep || len(res.FileInto) > 0 || res.Vacation != nil) {
+		return &Result{Keep: true}, errors.New("reject can not be combined with keep, fileinto or vacation")
+	}
+	if r.implicit && !res.Keep {
+		res.Keep = true
+		res.KeepFlags = append([]string(nil), r.flags...)
+	}
+	return res, nil
+}
+
+func (r *runtime) commands(commands []*Command) error {
+	// done is set once a branch of an if chain ran
+	done := false
+	for _, cmd := range commands {
+		if r.stopped {
+			return nil
+		}
+		switch cmd.Name {
+		case "require":
+		case "if", "elsif", "else":
+			if cmd.Name == "if" {
+				done = false
+			}
+			if done {
+				continue
+			}
+			ok := true
+			if cmd.Name != "else" {
+				var err error
+				if ok, err = r.test(cmd.Tests[0]); err != nil {
+					return err
+				}
+			}
+			if ok {
+				done = true
+				if err := r.commands(cmd.Block); err != nil {
+					return err
+				}
+			}
+		default:
+			if err := r.action(cmd); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (r *runtime) action(cmd *Command) error {
+	o, err := parseArgs(cmd.Name, commandSpecs[cmd.Name], cmd.Args, cmd.Line)
+	if err != nil {
+		return err
+	}
+	res := r.result
+	switch cmd.Name {
+	case "stop":
+		r.stopped = true
+	case "keep":
+		res.Keep = true
+		res.KeepFlags = r.actionFlags(o)
+	case "discard":
+		r.implicit = false
+		res.Discarded = true
+	case "redirect":
+		r.implicit = false
+		addr := o.positional[0].Strings[0]
+		for _, a := range res.Redirect {
+			if strings.EqualFold(a, addr) {
+				return nil
+			}
+		}
+		if len(res.Redirect) >= MaxRedirects {
+			return fmt.Errorf("line %d: more than %d redirects", cmd.Line, MaxRedirects)
+		}
+		res.Redirect = append(res.Redirect, addr)
+	case "fileinto":
+		r.implicit = false
+		mailbox := o.positional[0].Strings[0]
+		for i, f := range res.FileInto {
+			if f.Mailbox == mailbox {
+				res.FileInto[i].Flags = r.actionFlags(o)
+				return nil
+			}
+		}
+		res.FileInto = append(res.FileInto, FileInto{Mailbox: mailbox, Flags: r.actionFlags(o)})
+	case "reject":
+		r.implicit = false
+		res.Rejected = true
+		res.Reject = o.positional[0].Strings[0]
+	case "setflag":
+		r.flags = addFlags(nil, o.positional[0].Strings)
+	case "addflag":
+		r.flags = addFlags(r.flags, o.positional[0].Strings)
+	case "removeflag":
+		remove := addFlags(nil, o.positional[0].Strings)
+		flags := make([]string, 0, len(r.flags))
+		for _, f := range r.flags {
+			if !containsFold(remove, f) {
+				flags = append(flags, f)
+			}
+		}
+		r.flags = flags
+	case "vacation":
+		r.vacation(o)
+	}
+	return nil
+}
+
+// actionFlags returns the flags of keep or fileinto, :flags overrides the internal variable
+func (r *runtime) actionFlags(o *options) []string {
+	if arg, ok := o.tags["flags"]; ok {
+		return addFlags(nil, arg.Strings)
+	}
+	return append([]string(nil), r.flags...)
+}
+
+// addFlags adds space separated flags, duplicates are dropped
+func addFlags(flags []string, list []string) []string {
+	for _, s := range list {
+		for _, f := range strings.Fields(s) {
+			if !containsFold(flags, f) {
+				flags = append(flags, f)
+			}
+		}
+	}
+	return flags
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// parse splits the raw message into header and body once
+func (r *runtime) parse() {
+	if r.parsed {
+		return
+	}
+	r.parsed = true
+	r.header = make(mail.Header)
+	m, err := mail.ReadMessage(bytes.NewReader(r.msg.Raw))
+	if err != nil {
+		return
+	}
+	r.header = m.Header
+	if i := bytes.Index(r.msg.Raw, []byte("\r\n\r\n")); i >= 0 {
+		r.body = r.msg.Raw[i+4:]
+	} else if i = bytes.Index(r.msg.Raw, []byte("\n\n")); i >= 0 {
+		r.body = r.msg.Raw[i+2:]
+	}
+}
+
+// headerValues returns the decoded values of a header
+func (r *runtime) headerValues(name string) []string {
+	r.parse()
+	raw := r.header[textproto.CanonicalMIMEHeaderKey(name)]
+	values := make([]string, 0, len(raw))
+	for _, v := range raw {
+		if decoded, err := wordDecoder.DecodeHeader(v); err == nil {
+			v = decoded
+		}
+		values = append(values, v)
+	}
+	return values
+}
+
+// addresses returns the addresses in a header, unparsable values are used as they are
+func (r *runtime) addresses(name string) []string {
+	result := make([]string, 0)
+	for _, v := range r.headerValues(name) {
+		list, err := mail.ParseAddressList(v)
+		if err != nil {
+			result = append(result, strings.TrimSpace(v))
+			continue
+		}
+		for _, a := range list {
+			result = append(result, a.Address)
+		}
+	}
+	return result
+}
+
+// bodyText returns the decoded text and html parts of the message
+func (r *runtime) bodyText() string {
+	if r.text != nil {
+		return *r.text
+	}
+	text := ""
+	if env, err := enmime.ReadEnvelope(bytes.NewReader(r.msg.Raw)); err == nil {
+		text = env.Text
+		if env.HTML != "" {
+			text += "\n" + env.HTML
+		}
+	}
+	r.text = &text
+	return text
+}
+
+func addressPart(addr, part string) string {
+	i := strings.LastIndex(addr, "@")
+	switch part {
+	case "localpart":
+		if i < 0 {
+			return addr
+		}
+		return addr[:i]
+	case "domain":
+		if i < 0 {
+			return ""
+		}
+		return addr[i+1:]
+	}
+	return addr
+}
+
+func (r *runtime) test(t *Test) (bool, error) {
+	o, err := parseArgs(t.Name, testSpecs[t.Name], t.Args, t.Line)
+	if err != nil {
+		return false, err
+	}
+	switch t.Name {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "not":
+		ok, err := r.test(t.Tests[0])
+		return !ok, err
+	case "allof", "anyof":
+		anyof := t.Name == "anyof"
+		for _, child := range t.Tests {
+			ok, err := r.test(child)
+			if err != nil {
+				return false, err
+			}
+			if ok == anyof {
+				return anyof, nil
+			}
+		}
+		return !anyof, nil
+	case "exists":
+		r.parse()
+		for _, name := range o.positional[0].Strings {
+			if len(r.header[textproto.CanonicalMIMEHeaderKey(name)]) == 0 {
+				return false, nil
+			}
+		}
+		return true, nil
+	case "size":
+		limit := o.positional[0].Number
+		size := int64(len(r.msg.Raw))
+		if o.flags["over"] {
+			return size > limit, nil
+		}
+		return size < limit, nil
+	case "header":
+		values := make([]string, 0)
+		for _, name := range o.positional[0].Strings {
+			values = append(values, r.headerValues(name)...)
+		}
+		return matchAny(o, values, o.positional[1].Strings), nil
+	case "address":
+		values := make([]string, 0)
+		for _, name := range o.positional[0].Strings {
+			for _, addr := range r.addresses(name) {
+				values = append(values, addressPart(addr, o.addressPart))
+			}
+		}
+		return matchAny(o, values, o.positional[1].Strings), nil
+	case "envelope":
+		values := make([]string, 0)
+		for _, part := range o.positional[0].Strings {
+			addr := r.msg.Rcpt
+			if strings.EqualFold(part, "from") {
+				addr = r.msg.Sender
+			}
+			if addr == "" {
+				// the null sender only matches an empty key for any part
+				values = append(values, "")
+				continue
+			}
+			values = append(values, addressPart(addr, o.addressPart))
+		}
+		return matchAny(o, values, o.positional[1].Strings), nil
+	case "body":
+		var body string
+		if o.flags["raw"] {
+			r.parse()
+			body = string(r.body)
+		} else {
+			body = r.bodyText()
+		}
+		// body only supports :contains in practice, :is and :matches see the whole text
+		return matchAny(o, []string{body}, o.positional[0].Strings), nil
+	case "hasflag":
+		return matchAny(o, r.flags, o.positional[0].Strings), nil
+	}
+	return false, fmt.Errorf("line %d: unknown test %s", t.Line, t.Name)
+}
+
+// vacationFrom checks the :from of a vacation, the script may name the
+// recipient but neither another address nor lines of its own in the header
+func vacationFrom(from, rcpt string) (string, bool) {
+	if strings.ContainsAny(from, "\r\n") {
+		return "", false
+	}
+	addr, err := mail.ParseAddress(from)
+	if err != nil || !strings.EqualFold(addr.Address, rcpt) {
+		return "", false
+	}
+	return addr.String(), true
+}
+
+// vacation decides whether the message gets an auto reply, following RFC 5230
+func (r *runtime) vacation(o *options) {
+	reason := o.positional[0].Strings[0]
+	rcpts := []string{r.msg.Rcpt}
+	if arg, ok := o.tags["addresses"]; ok {
+		rcpts = append(rcpts, arg.Strings...)
+	}
+	sender := r.msg.Sender
+	if sender == "" || containsFold(rcpts, sender) {
+		return
+	}
+	local := strings.ToLower(addressPart(sender, "localpart"))
+	if local == "mailer-daemon" || local == "listserv" || local == "majordomo" ||
+		strings.HasPrefix(local, "owner-") || strings.HasSuffix(local, "-request") {
+		return
+	}
+	r.parse()
+	if v := r.header.Get("Auto-Submitted"); v != "" && !strings.EqualFold(strings.TrimSpace(v), "no") {
+		return
+	}
+	for _, h := range []string{"List-Id", "List-Help", "List-Subscribe", "List-Unsubscribe", "List-Post", "List-Owner", "List-Archive"} {
+		if r.header.Get(h) != "" {
+			return
+		}
+	}
+	if p := strings.ToLower(strings.TrimSpace(r.header.Get("Precedence"))); p == "bulk" || p == "list" || p == "junk" {
+		return
+	}
+	// only messages sent to the user directly are answered
+	addressed := false
+	for _, h := range []string{"To", "Cc", "Bcc", "Resent-To", "Resent-Cc", "Resent-Bcc"} {
+		for _, addr := range r.addresses(h) {
+			if containsFold(rcpts, addr) {
+				addressed = true
+			}
+		}
+	}
+	if !addressed {
+		return
+	}
+
+	v := &Vacation{To: sender, From: r.msg.Rcpt, Reason: reason, Mime: o.flags["mime"], Days: defaultVacationDays}
+	if arg, ok := o.tags["days"]; ok {
+		v.Days = int(arg.Number)
+	}
+	if arg, ok := o.tags["from"]; ok {
+		if from, ok := vacationFrom(arg.Strings[0], r.msg.Rcpt); ok {
+			v.From = from
+		}
+	}
+	if arg, ok := o.tags["subject"]; ok {
+		v.Subject = arg.Strings[0]
+	} else {
+		subjects := r.headerValues("Subject")
+		v.Subject = "Auto: "
+		if len(subjects) > 0 {
+			v.Subject += subjects[0]
+		}
+	}
+	if arg, ok := o.tags["handle"]; ok {
+		v.Handle = arg.Strings[0]
+	} else {
+		sum := sha1.Sum([]byte(fmt.Sprintf("%s\x00%s\x00%s\x00%t", v.Reason, v.Subject, v.From, v.Mime)))
+		v.Handle = hex.EncodeToString(sum[:])
+	}
+	r.result.Vacation = v
+}
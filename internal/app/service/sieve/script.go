@@ -0,0 +1,308 @@
+package sieve
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+)
+
+// Extensions are the capabilities a script may require
+var Extensions = []string{
+	"fileinto",
+	"reject",
+	"envelope",
+	"body",
+	"imap4flags",
+	"vacation",
+	"comparator-i;octet",
+	"comparator-i;ascii-casemap",
+}
+
+const (
+	// MaxRedirects caps the redirect actions of one script run
+	MaxRedirects = 5
+	// maxNesting caps nested blocks and tests
+	maxNesting = 32
+)
+
+var comparators = map[string]string{
+	"i;octet":         "comparator-i;octet",
+	"i;ascii-casemap": "comparator-i;ascii-casemap",
+}
+
+// Script is a compiled sieve script
+type Script struct {
+	commands []*Command
+	require  map[string]bool
+}
+
+/*
+Compile parses a script and checks commands, tests and their arguments, a
+script using an extension it did not require is rejected.
+*/
+func Compile(src string) (*Script, error) {
+	commands, err := parse(src)
+	if err != nil {
+		return nil, err
+	}
+	s := &Script{commands: commands, require: make(map[string]bool)}
+	supported := make(map[string]bool, len(Extensions))
+	for _, ext := range Extensions {
+		supported[ext] = true
+	}
+	// require is only allowed at the start of the script
+	leading := true
+	for _, cmd := range commands {
+		if cmd.Name != "require" {
+			leading = false
+			continue
+		}
+		if !leading {
+			return nil, &SyntaxError{Line: cmd.Line, Msg: "require must come before other commands"}
+		}
+		if len(cmd.Args) != 1 || cmd.Args[0].Kind != argStrings || len(cmd.Tests) > 0 || cmd.Block != nil {
+			return nil, &SyntaxError{Line: cmd.Line, Msg: "require needs a string list"}
+		}
+		for _, ext := range cmd.Args[0].Strings {
+			if !supported[ext] {
+				return nil, &SyntaxError{Line: cmd.Line, Msg: fmt.Sprintf("unsupported extension %q", ext)}
+			}
+			s.require[ext] = true
+		}
+	}
+	if err = s.check(commands, 0, ""); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// spec describes the arguments of a command or test
+type spec struct {
+	extension string
+	// tags maps a tagged argument to the kind of its value
+	tags map[string]argKind
+	// flags are tags without a value
+	flags map[string]bool
+	// comparator, match and addressPart allow the tags of RFC 5228 section 2.7
+	comparator, match, addressPart bool
+	positional                     []argKind
+	// tests is the number of tests, -1 for a test list
+	tests int
+}
+
+var commandSpecs = map[string]spec{
+	"require":    {positional: []argKind{argStrings}},
+	"if":         {tests: 1},
+	"elsif":      {tests: 1},
+	"else":       {},
+	"stop":       {},
+	"keep":       {tags: map[string]argKind{"flags": argStrings}},
+	"discard":    {},
+	"redirect":   {positional: []argKind{argStrings}},
+	"fileinto":   {extension: "fileinto", tags: map[string]argKind{"flags": argStrings}, positional: []argKind{argStrings}},
+	"reject":     {extension: "reject", positional: []argKind{argStrings}},
+	"setflag":    {extension: "imap4flags", positional: []argKind{argStrings}},
+	"addflag":    {extension: "imap4flags", positional: []argKind{argStrings}},
+	"removeflag": {extension: "imap4flags", positional: []argKind{argStrings}},
+	"vacation": {
+		extension:  "vacation",
+		tags:       map[string]argKind{"days": argNumber, "subject": argStrings, "from": argStrings, "addresses": argStrings, "handle": argStrings},
+		flags:      map[string]bool{"mime": true},
+		positional: []argKind{argStrings},
+	},
+}
+
+var testSpecs = map[string]spec{
+	"address":  {comparator: true, match: true, addressPart: true, positional: []argKind{argStrings, argStrings}},
+	"envelope": {extension: "envelope", comparator: true, match: true, addressPart: true, positional: []argKind{argStrings, argStrings}},
+	"header":   {comparator: true, match: true, positional: []argKind{argStrings, argStrings}},
+	"exists":   {positional: []argKind{argStrings}},
+	"size":     {flags: map[string]bool{"over": true, "under": true}, positional: []argKind{argNumber}},
+	"body": {
+		extension: "body", comparator: true, match: true,
+		flags:      map[string]bool{"raw": true, "text": true},
+		tags:       map[string]argKind{"content": argStrings},
+		positional: []argKind{argStrings},
+	},
+	"hasflag": {extension: "imap4flags", comparator: true, match: true, positional: []argKind{argStrings}},
+	"allof":   {tests: -1},
+	"anyof":   {tests: -1},
+	"not":     {tests: 1},
+	"true":    {},
+	"false":   {},
+}
+
+var matchTypes = map[string]bool{"is": true, "contains": true, "matches": true}
+var addressParts = map[string]bool{"all": true, "localpart": true, "domain": true}
+
+// options are the tagged arguments of a command or test with its positional arguments
+type options struct {
+	comparator  string
+	match       string
+	addressPart string
+	tags        map[string]Arg
+	flags       map[string]bool
+	positional  []Arg
+}
+
+// parseArgs splits the arguments by the spec, it is used at compile and run time
+func parseArgs(name string, sp spec, args []Arg, line int) (*options, error) {
+	o := &options{comparator: "i;ascii-casemap", match: "is", addressPart: "all", tags: make(map[string]Arg), flags: make(map[string]bool)}
+	fail := func(format string, a ...any) error {
+		return &SyntaxError{Line: line, Msg: name + ": " + fmt.Sprintf(format, a...)}
+	}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg.Kind != argTag {
+			o.positional = append(o.positional, arg)
+			continue
+		}
+		if len(o.positional) > 0 {
+			return nil, fail("tag :%s after positional arguments", arg.Tag)
+		}
+		switch {
+		case sp.match && matchTypes[arg.Tag]:
+			o.match = arg.Tag
+		case sp.addressPart && addressParts[arg.Tag]:
+			o.addressPart = arg.Tag
+		case sp.comparator && arg.Tag == "comparator":
+			if i+1 >= len(args) || args[i+1].Kind != argStrings || len(args[i+1].Strings) != 1 {
+				return nil, fail(":comparator needs a string")
+			}
+			i++
+			o.comparator = args[i].Strings[0]
+			if _, ok := comparators[o.comparator]; !ok {
+				return nil, fail("unsupported comparator %q", o.comparator)
+			}
+		case sp.flags[arg.Tag]:
+			o.flags[arg.Tag] = true
+		default:
+			kind, ok := sp.tags[arg.Tag]
+			if !ok {
+				return nil, fail("unknown tag :%s", arg.Tag)
+			}
+			if i+1 >= len(args) || args[i+1].Kind != kind {
+				return nil, fail(":%s needs a value", arg.Tag)
+			}
+			i++
+			o.tags[arg.Tag] = args[i]
+		}
+	}
+	if len(o.positional) != len(sp.positional) {
+		return nil, fail("expected %d arguments, got %d", len(sp.positional), len(o.positional))
+	}
+	for i, kind := range sp.positional {
+		if o.positional[i].Kind != kind {
+			return nil, fail("argument %d has a wrong type", i+1)
+		}
+	}
+	return o, nil
+}
+
+func (s *Script) check(commands []*Command, depth int, prev string) error {
+	if depth > maxNesting && len(commands) > 0 {
+		return &SyntaxError{Line: commands[0].Line, Msg: "too deeply nested"}
+	}
+	for _, cmd := range commands {
+		sp, ok := commandSpecs[cmd.Name]
+		if !ok {
+			return &SyntaxError{Line: cmd.Line, Msg: fmt.Sprintf("unknown command %s", cmd.Name)}
+		}
+		if sp.extension != "" && !s.require[sp.extension] {
+			return &SyntaxError{Line: cmd.Line, Msg: fmt.Sprintf("%s requires %q", cmd.Name, sp.extension)}
+		}
+		if (cmd.Name == "elsif" || cmd.Name == "else") && prev != "if" && prev != "elsif" {
+			return &SyntaxError{Line: cmd.Line, Msg: cmd.Name + " without if"}
+		}
+		prev = cmd.Name
+		o, err := parseArgs(cmd.Name, sp, cmd.Args, cmd.Line)
+		if err != nil {
+			return err
+		}
+		if len(cmd.Tests) != sp.tests {
+			return &SyntaxError{Line: cmd.Line, Msg: fmt.Sprintf("%s expects %d tests", cmd.Name, sp.tests)}
+		}
+		isBlock := cmd.Name == "if" || cmd.Name == "elsif" || cmd.Name == "else"
+		if isBlock != (cmd.Block != nil) {
+			return &SyntaxError{Line: cmd.Line, Msg: fmt.Sprintf("%s block mismatch", cmd.Name)}
+		}
+		if err = s.checkOptions(cmd.Name, o, cmd.Line); err != nil {
+			return err
+		}
+		for _, t := range cmd.Tests {
+			if err = s.checkTest(t, depth+1); err != nil {
+				return err
+			}
+		}
+		if isBlock {
+			if err = s.check(cmd.Block, depth+1, ""); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Script) checkOptions(name string, o *options, line int) error {
+	if cmp, ok := comparators[o.comparator]; ok && o.comparator != "i;ascii-casemap" && !s.require[cmp] {
+		return &SyntaxError{Line: line, Msg: fmt.Sprintf("comparator %s requires %q", o.comparator, cmp)}
+	}
+	switch name {
+	case "redirect":
+		if _, err := mail.ParseAddress(o.positional[0].Strings[0]); err != nil || len(o.positional[0].Strings) != 1 {
+			return &SyntaxError{Line: line, Msg: fmt.Sprintf("redirect: invalid address %q", strings.Join(o.positional[0].Strings, ","))}
+		}
+	case "fileinto", "reject":
+		if len(o.positional[0].Strings) != 1 {
+			return &SyntaxError{Line: line, Msg: name + " needs a single string"}
+		}
+	case "vacation":
+		if days, ok := o.tags["days"]; ok && days.Number < 1 {
+			return &SyntaxError{Line: line, Msg: "vacation: :days must be at least 1"}
+		}
+	case "envelope":
+		for _, part := range o.positional[0].Strings {
+			if p := strings.ToLower(part); p != "from" && p != "to" {
+				return &SyntaxError{Line: line, Msg: fmt.Sprintf("envelope: unsupported part %q", part)}
+			}
+		}
+	case "size":
+		if o.flags["over"] == o.flags["under"] {
+			return &SyntaxError{Line: line, Msg: "size needs one of :over and :under"}
+		}
+	case "body":
+		if o.flags["raw"] && o.flags["text"] {
+			return &SyntaxError{Line: line, Msg: "body takes one transform"}
+		}
+	}
+	return nil
+}
+
+func (s *Script) checkTest(t *Test, depth int) error {
+	if depth > maxNesting {
+		return &SyntaxError{Line: t.Line, Msg: "too deeply nested"}
+	}
+	sp, ok := testSpecs[t.Name]
+	if !ok {
+		return &SyntaxError{Line: t.Line, Msg: fmt.Sprintf("unknown test %s", t.Name)}
+	}
+	if sp.extension != "" && !s.require[sp.extension] {
+		return &SyntaxError{Line: t.Line, Msg: fmt.Sprintf("%s requires %q", t.Name, sp.extension)}
+	}
+	o, err := parseArgs(t.Name, sp, t.Args, t.Line)
+	if err != nil {
+		return err
+	}
+	if sp.tests >= 0 && len(t.Tests) != sp.tests || sp.tests < 0 && len(t.Tests) == 0 {
+		return &SyntaxError{Line: t.Line, Msg: fmt.Sprintf("%s has a wrong number of tests", t.Name)}
+	}
+	if err = s.checkOptions(t.Name, o, t.Line); err != nil {
+		return err
+	}
+	for _, child := range t.Tests {
+		if err = s.checkTest(child, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
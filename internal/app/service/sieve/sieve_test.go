@@ -0,0 +1,233 @@
+package sieve
+
+import (
+	"easymail/internal/model"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+const testMessage = "From: Alice <alice@example.org>\r\n" +
+	"To: bob@example.com\r\n" +
+	"Subject: =?UTF-8?B?5Lya6K6u?= Meeting\r\n" +
+	"X-Spam-Level: ****\r\n" +
+	"\r\n" +
+	"Let's meet on Friday.\r\n"
+
+func run(t *testing.T, src string, msg Message) *Result {
+	t.Helper()
+	script, err := Compile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := script.Run(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestCompileErrors(t *testing.T) {
+	cases := map[string]string{
+		"missing require":   `fileinto "Junk";`,
+		"unknown extension": `require "variables";`,
+		"late require":      "keep;\nrequire \"fileinto\";",
+		"unknown command":   `frobnicate;`,
+		"unknown test":      `if frob { keep; }`,
+		"missing semicolon": `keep`,
+		"else without if":   `else { keep; }`,
+		"bad tag":           `if header :over "a" "b" { keep; }`,
+		"bad redirect":      `redirect "not an address";`,
+		"size needs tag":    `if size 100 { keep; }`,
+		"bad comparator":    `if header :comparator "i;unicode" "a" "b" { keep; }`,
+		"unterminated":      `if header "a" "b { keep; }`,
+	}
+	for name, src := range cases {
+		if _, err := Compile(src); err == nil {
+			t.Errorf("%s: expected error for %q", name, src)
+		}
+	}
+	var syntaxErr *SyntaxError
+	_, err := Compile("keep;\n\nfoo;")
+	if !errors.As(err, &syntaxErr) || syntaxErr.Line != 3 {
+		t.Fatalf("expected error on line 3, got %v", err)
+	}
+}
+
+func TestRun(t *testing.T) {
+	msg := Message{Sender: "alice@example.org", Rcpt: "bob@example.com", Raw: []byte(testMessage)}
+	cases := []struct {
+		name   string
+		src    string
+		check  func(r *Result) bool
+		expect string
+	}{
+		{"implicit keep", `# nothing`, func(r *Result) bool { return r.Keep && len(r.FileInto) == 0 }, "keep"},
+		{"header contains", "require \"fileinto\";\nif header :contains \"subject\" \"会议\" { fileinto \"Work\"; }",
+			func(r *Result) bool { return !r.Keep && len(r.FileInto) == 1 && r.FileInto[0].Mailbox == "Work" }, "fileinto Work"},
+		{"matches", "require \"fileinto\";\nif header :matches \"X-Spam-Level\" \"\\\\*\\\\*\\\\*\\\\**\" { fileinto \"Junk\"; stop; }\nkeep;",
+			func(r *Result) bool { return !r.Keep && len(r.FileInto) == 1 && r.FileInto[0].Mailbox == "Junk" }, "fileinto Junk and stop"},
+		{"address domain", `if address :domain :is "from" "EXAMPLE.org" { discard; }`,
+			func(r *Result) bool { return r.Discarded && !r.Keep }, "discard"},
+		{"octet comparator", "require \"comparator-i;octet\";\nif address :domain :comparator \"i;octet\" \"from\" \"EXAMPLE.org\" { discard; }",
+			func(r *Result) bool { return !r.Discarded && r.Keep }, "keep"},
+		{"envelope", "require \"envelope\";\nif envelope :localpart \"from\" \"alice\" { redirect \"carol@example.net\"; }",
+			func(r *Result) bool { return !r.Keep && len(r.Redirect) == 1 }, "redirect"},
+		{"elsif", "if false { discard; } elsif exists \"x-spam-level\" { redirect \"a@example.net\"; keep; } else { discard; }",
+			func(r *Result) bool { return r.Keep && len(r.Redirect) == 1 && !r.Discarded }, "redirect and keep"},
+		{"anyof not", `if anyof (not true, size :under 10) { discard; }`,
+			func(r *Result) bool { return r.Keep }, "keep"},
+		{"body", "require \"body\";\nif body :contains \"friday\" { discard; }",
+			func(r *Result) bool { return r.Discarded }, "discard"},
+		{"reject", "require \"reject\";\nif size :over 10 { reject text:\nno thanks\n.\n; }",
+			func(r *Result) bool { return r.Rejected && r.Reject == "no thanks\r\n" && !r.Keep }, "reject"},
+		{"imap4flags", "require [\"imap4flags\", \"fileinto\"];\naddflag \"\\\\Seen \\\\Flagged\";\nremoveflag \"\\\\Flagged\";\nif hasflag \"\\\\seen\" { fileinto :flags \"\\\\Answered\" \"Trash\"; }",
+			func(r *Result) bool {
+				return len(r.FileInto) == 1 && r.FileInto[0].Flags[0] == `\Answered` && !r.Keep
+			}, "fileinto with flags"},
+		{"implicit keep flags", "require \"imap4flags\";\nsetflag \"\\\\Seen\";",
+			func(r *Result) bool { return r.Keep && len(r.KeepFlags) == 1 && r.KeepFlags[0] == FlagSeen }, "keep seen"},
+	}
+	for _, c := range cases {
+		if r := run(t, c.src, msg); !c.check(r) {
+			t.Errorf("%s: expected %s, got %+v", c.name, c.expect, r)
+		}
+	}
+
+	script, err := Compile("require [\"reject\", \"fileinto\"];\nfileinto \"Junk\";\nreject \"no\";")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, err := script.Run(msg); err == nil || !r.Keep || len(r.FileInto) > 0 {
+		t.Fatalf("expected runtime error with keep, got %+v %v", r, err)
+	}
+}
+
+func TestGlob(t *testing.T) {
+	cases := []struct {
+		pattern, value string
+		match          bool
+	}{
+		{"*", "", true},
+		{"a*c", "abbbc", true},
+		{"a?c", "a会c", true},
+		{"a*c", "abd", false},
+		{`a\*`, "a*", true},
+		{`a\*`, "ab", false},
+		{"*@example.com", "x@example.com", true},
+	}
+	for _, c := range cases {
+		if glob(c.pattern, c.value) != c.match {
+			t.Errorf("glob(%q, %q) expected %v", c.pattern, c.value, c.match)
+		}
+	}
+}
+
+func TestVacation(t *testing.T) {
+	src := "require \"vacation\";\nvacation :days 3 :addresses [\"bob@example.com\"] \"I am away\";"
+	msg := Message{Sender: "alice@example.org", Rcpt: "bob@example.com", Raw: []byte(testMessage)}
+	r := run(t, src, msg)
+	if r.Vacation == nil || r.Vacation.To != "alice@example.org" || r.Vacation.Days != 3 || !strings.HasPrefix(r.Vacation.Subject, "Auto: ") || r.Vacation.Handle == "" {
+		t.Fatalf("unexpected vacation %+v", r.Vacation)
+	}
+	if !r.Keep {
+		t.Fatal("vacation cancelled the implicit keep")
+	}
+
+	// :from may only name the recipient, anything else replies from the recipient
+	froms := map[string]string{
+		`"Bob <bob@example.com>"`:                   `"Bob" <bob@example.com>`,
+		`"boss@example.com"`:                        "bob@example.com",
+		"\"bob@example.com\r\nBcc: x@example.net\"": "bob@example.com",
+		`"bob@example.com, x@example.net"`:          "bob@example.com",
+	}
+	for from, want := range froms {
+		src := "require \"vacation\";\nvacation :from " + from + " \"I am away\";"
+		if r := run(t, src, msg); r.Vacation == nil || r.Vacation.From != want {
+			t.Fatalf("%s: unexpected vacation %+v", from, r.Vacation)
+		}
+	}
+
+	noReply := []Message{
+		{Sender: "", Rcpt: "bob@example.com", Raw: []byte(testMessage)},
+		{Sender: "owner-list@example.org", Rcpt: "bob@example.com", Raw: []byte(testMessage)},
+		{Sender: "alice@example.org", Rcpt: "bob@example.com", Raw: []byte("Auto-Submitted: auto-replied\r\n" + testMessage)},
+		{Sender: "alice@example.org", Rcpt: "bob@example.com", Raw: []byte("List-Id: <list.example.org>\r\n" + testMessage)},
+		{Sender: "alice@example.org", Rcpt: "dave@example.com", Raw: []byte(testMessage)},
+	}
+	src = "require \"vacation\";\nvacation \"I am away\";"
+	for i, m := range noReply {
+		if r := run(t, src, m); r.Vacation != nil {
+			t.Errorf("message %d must not be answered", i)
+		}
+	}
+}
+
+type memoryStorage struct {
+	emails []model.Email
+	// full fails the saves once that many emails are stored
+	full int
+}
+
+func (m *memoryStorage) Save(accountName string, email *model.Email, content io.Reader) (string, error) {
+	if m.full > 0 && len(m.emails) >= m.full {
+		return "", errors.New("disk full")
+	}
+	if _, err := io.ReadAll(content); err != nil {
+		return "", err
+	}
+	email.ID = int64(len(m.emails) + 1)
+	m.emails = append(m.emails, *email)
+	return email.JobID, nil
+}
+
+func TestDeliver(t *testing.T) {
+	st := &memoryStorage{}
+	d := NewDeliverer(st)
+	d.findAccount = func(name string) (*model.Account, error) { return &model.Account{ID: 7}, nil }
+	content := "require [\"fileinto\", \"imap4flags\"];\nif header :contains \"subject\" \"meeting\" { fileinto :flags \"\\\\Seen\" \"Junk\"; keep; fileinto \"Unknown\"; }"
+	d.activeScript = func(accountID int64) (*model.SieveScript, error) {
+		return &model.SieveScript{ID: 1, Name: "main", Content: content}, nil
+	}
+
+	msg := Message{Sender: "alice@example.org", Rcpt: "bob@example.com", Raw: []byte(testMessage)}
+	delivery, err := d.Deliver(msg, &model.Email{JobID: "d5b9f5d2-2f7e-4a43-8a37-6d6a5e0f6f59", FolderId: int64(model.Inbox)})
+	if err != nil || delivery.Err != nil {
+		t.Fatal(err, delivery.Err)
+	}
+	// keep and the unknown mailbox both land in the Inbox, it is stored once
+	if len(st.emails) != 2 || st.emails[0].FolderId != int64(model.Inbox) || st.emails[1].FolderId != int64(model.Spam) {
+		t.Fatalf("unexpected stored emails %+v", st.emails)
+	}
+	if st.emails[1].ReadStatus != model.ImapRead || st.emails[0].JobID == st.emails[1].JobID {
+		t.Fatalf("unexpected copy %+v", st.emails[1])
+	}
+
+	// a failed copy removes the ones saved before, the redelivery stores them again
+	st.emails, st.full = nil, 1
+	d.remove = func(email *model.Email) error {
+		for i := range st.emails {
+			if st.emails[i].ID == email.ID {
+				st.emails = append(st.emails[:i], st.emails[i+1:]...)
+				return nil
+			}
+		}
+		return errors.New("not saved")
+	}
+	if _, err = d.Deliver(msg, &model.Email{JobID: "a1", FolderId: int64(model.Inbox)}); err == nil || len(st.emails) != 0 {
+		t.Fatalf("expected no copy left, got %+v %v", st.emails, err)
+	}
+	st.full = 0
+
+	// a broken script keeps the message
+	content = "fileinto \"Junk\";"
+	d.activeScript = func(accountID int64) (*model.SieveScript, error) {
+		return &model.SieveScript{ID: 2, Name: "broken", Content: content}, nil
+	}
+	st.emails = nil
+	delivery, err = d.Deliver(msg, &model.Email{JobID: "b1", FolderId: int64(model.Inbox)})
+	if err != nil || delivery.Err == nil || len(st.emails) != 1 {
+		t.Fatalf("expected kept message with script error, got %+v %v", delivery, err)
+	}
+}
@@ -0,0 +1,175 @@
+package similarity
+
+import (
+	"easymail/internal/app/service/milter/third_party/ssdeep"
+	"easymail/internal/model"
+	"errors"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const (
+	// DefaultThreshold is the score a stored message has to reach to be reported as similar
+	DefaultThreshold = 60
+	// maxCandidates bounds the hashes compared per lookup, the newest are kept
+	maxCandidates = 200
+	// maxSessions bounds the similar sessions reported
+	maxSessions = 20
+)
+
+// Store keeps the hashes of earlier messages, the model functions in production
+type Store interface {
+	Candidates(ngrams []model.SsdeepNgram, isAttach bool, limit int) ([]model.SsdeepHash, error)
+	Create(hash, sessionID string, chunkSize int, isAttach bool, ngrams []model.SsdeepNgram) error
+}
+
+type dbStore struct{}
+
+func (dbStore) Candidates(ngrams []model.SsdeepNgram, isAttach bool, limit int) ([]model.SsdeepHash, error) {
+	return model.FindSsdeepCandidates(ngrams, isAttach, limit)
+}
+
+func (dbStore) Create(hash, sessionID string, chunkSize int, isAttach bool, ngrams []model.SsdeepNgram) error {
+	_, err := model.CreateSsdeepHash(hash, sessionID, chunkSize, isAttach, ngrams)
+	return err
+}
+
+// Match is how similar a message is to the earlier ones
+type Match struct {
+	// BodyMax and AttachMax are the best ssdeep scores from 0 to 100
+	BodyMax   int
+	AttachMax int
+	// Sessions are the earlier sessions scoring at least the threshold, newest first
+	Sessions []string
+}
+
+/*
+Index finds earlier messages similar to a new one by ssdeep hashes of the
+normalized body text and of every attachment. Candidates are looked up by
+the n-grams of the hashes, so only hashes sharing one are compared.
+*/
+type Index struct {
+	store     Store
+	threshold int
+}
+
+// New creates an index kept in the ssdeep tables of the database
+func New() *Index {
+	return &Index{store: dbStore{}, threshold: DefaultThreshold}
+}
+
+// SetThreshold sets the score from which a stored message is reported as similar
+func (i *Index) SetThreshold(threshold int) {
+	i.threshold = threshold
+}
+
+// Match compares a message with the stored ones and stores its hashes under
+// sessionID, attachments are stored as sessionID/n. Parts too small for a
+// meaningful hash are skipped, a message without session is not stored.
+func (i *Index) Match(sessionID, text string, attachments [][]byte) (Match, error) {
+	var match Match
+	sessions := make(map[string]struct{})
+	var errs []error
+	check := func(data []byte, id string, isAttach bool) int {
+		score, similar, err := i.match(data, id, isAttach)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		for _, s := range similar {
+			// attachments of a session are stored under the session
+			s, _, _ = strings.Cut(s, "/")
+			if _, ok := sessions[s]; ok || s == sessionID || len(match.Sessions) >= maxSessions {
+				continue
+			}
+			sessions[s] = struct{}{}
+			match.Sessions = append(match.Sessions, s)
+		}
+		return score
+	}
+	match.BodyMax = check([]byte(Normalize(text)), sessionID, false)
+	for n, data := range attachments {
+		id := ""
+		if sessionID != "" {
+			id = sessionID + "/" + strconv.Itoa(n+1)
+		}
+		if score := check(data, id, true); score > match.AttachMax {
+			match.AttachMax = score
+		}
+	}
+	return match, errors.Join(errs...)
+}
+
+// match scores one part against the candidates and stores it
+func (i *Index) match(data []byte, sessionID string, isAttach bool) (int, []string, error) {
+	hash, err := ssdeep.FuzzyBytes(data)
+	if err != nil {
+		if errors.Is(err, ssdeep.ErrFileTooSmall) {
+			err = nil
+		}
+		return 0, nil, err
+	}
+	chunkSize, _, _ := strings.Cut(hash, ":")
+	size, _ := strconv.Atoi(chunkSize)
+	grams, err := ssdeep.Grams(hash)
+	if err != nil {
+		return 0, nil, err
+	}
+	ngrams := make([]model.SsdeepNgram, len(grams))
+	for n, g := range grams {
+		ngrams[n] = model.SsdeepNgram{ChunkSize: g.BlockSize, Gram: g.Value}
+	}
+
+	candidates, err := i.store.Candidates(ngrams, isAttach, maxCandidates)
+	if err != nil {
+		return 0, nil, err
+	}
+	best := 0
+	var similar []string
+	for _, c := range candidates {
+		score, err := ssdeep.Distance(hash, c.Hash)
+		if err != nil {
+			continue
+		}
+		if score > best {
+			best = score
+		}
+		if score >= i.threshold {
+			similar = append(similar, c.SessionID)
+		}
+	}
+	if sessionID != "" {
+		err = i.store.Create(hash, sessionID, size, isAttach, ngrams)
+	}
+	return best, similar, err
+}
+
+// Normalize reduces text to what stays the same between the messages of a
+// campaign: letters are lower case, numbers and runs of spaces collapse.
+func Normalize(text string) string {
+	var b strings.Builder
+	b.Grow(len(text))
+	space, digit := false, false
+	for _, r := range text {
+		switch {
+		case unicode.IsSpace(r):
+			space, digit = true, false
+			continue
+		case unicode.IsDigit(r):
+			if digit {
+				continue
+			}
+			digit = true
+			r = '0'
+		default:
+			digit = false
+			r = unicode.ToLower(r)
+		}
+		if space && b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		space = false
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,110 @@
+package similarity
+
+import (
+	"easymail/internal/model"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// memStore looks candidates up by their n-grams like the database
+type memStore struct {
+	hashes []model.SsdeepHash
+	ngrams []model.SsdeepNgram
+}
+
+func (s *memStore) Candidates(ngrams []model.SsdeepNgram, isAttach bool, limit int) ([]model.SsdeepHash, error) {
+	want := make(map[model.SsdeepNgram]bool)
+	for _, n := range ngrams {
+		want[model.SsdeepNgram{ChunkSize: n.ChunkSize, Gram: n.Gram}] = true
+	}
+	ids := make(map[int64]bool)
+	for _, n := range s.ngrams {
+		if want[model.SsdeepNgram{ChunkSize: n.ChunkSize, Gram: n.Gram}] {
+			ids[n.HashID] = true
+		}
+	}
+	var hashes []model.SsdeepHash
+	for i := len(s.hashes) - 1; i >= 0 && len(hashes) < limit; i-- {
+		if h := s.hashes[i]; ids[h.ID] && h.IsAttach == isAttach {
+			hashes = append(hashes, h)
+		}
+	}
+	return hashes, nil
+}
+
+func (s *memStore) Create(hash, sessionID string, chunkSize int, isAttach bool, ngrams []model.SsdeepNgram) error {
+	for _, h := range s.hashes {
+		if h.Hash == hash {
+			return nil
+		}
+	}
+	id := int64(len(s.hashes) + 1)
+	s.hashes = append(s.hashes, model.SsdeepHash{ID: id, Hash: hash, SessionID: sessionID, ChunkSize: chunkSize, IsAttach: isAttach})
+	for _, n := range ngrams {
+		n.HashID = id
+		s.ngrams = append(s.ngrams, n)
+	}
+	return nil
+}
+
+func campaign(name string, order int) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Dear %s,\n\nYour order %d is waiting for you.\n", name, order)
+	for i := 0; i < 30; i++ {
+		fmt.Fprintf(&b, "Line %d of our special offer: replica watches and bags at the lowest prices, shipped worldwide.\n", i)
+	}
+	return b.String()
+}
+
+func TestIndex(t *testing.T) {
+	store := &memStore{}
+	idx := &Index{store: store, threshold: DefaultThreshold}
+
+	match, err := idx.Match("Q1", campaign("Alice", 1234), [][]byte{[]byte(strings.Repeat("attachment data ", 64))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if match.BodyMax != 0 || len(match.Sessions) != 0 || len(store.hashes) != 2 {
+		t.Fatalf("expected nothing similar on an empty index, got %+v with %d hashes", match, len(store.hashes))
+	}
+	if store.hashes[1].SessionID != "Q1/1" || !store.hashes[1].IsAttach {
+		t.Fatalf("unexpected attachment hash %+v", store.hashes[1])
+	}
+
+	// another message of the campaign
+	match, err = idx.Match("Q2", campaign("Bob Smith", 98765), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if match.BodyMax < DefaultThreshold || len(match.Sessions) != 1 || match.Sessions[0] != "Q1" {
+		t.Fatalf("expected a match of Q1, got %+v", match)
+	}
+
+	// the same attachment in another message
+	match, err = idx.Match("Q3", "short", [][]byte{[]byte(strings.Repeat("attachment data ", 64))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if match.BodyMax != 0 || match.AttachMax != 100 || len(match.Sessions) != 1 || match.Sessions[0] != "Q1" {
+		t.Fatalf("expected the attachment of Q1, got %+v", match)
+	}
+
+	other := strings.Repeat("Minutes of the weekly project meeting, the release is planned for next month. ", 20)
+	if match, err = idx.Match("", other, nil); err != nil {
+		t.Fatal(err)
+	}
+	if match.BodyMax >= DefaultThreshold || len(match.Sessions) != 0 {
+		t.Fatalf("expected no match, got %+v", match)
+	}
+	if len(store.hashes) != 3 {
+		t.Fatalf("expected a message without session not to be stored, got %d hashes", len(store.hashes))
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	got := Normalize("  Your Order 12345\r\n\tis  READY ")
+	if got != "your order 0 is ready" {
+		t.Fatalf("unexpected normalized text %q", got)
+	}
+}
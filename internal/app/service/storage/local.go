@@ -156,7 +156,10 @@ func (s *LocalStorage) Read(filename string) (m *MailContent, err error) {
 
 	m.Text = email.Text
 	m.Html = email.HTML
-	sender, err := mail.ParseAddress(email.GetHeader("From"))
+	// a broken From header leaves the sender empty
+	if sender, err := mail.ParseAddress(email.GetHeader("From")); err == nil {
+		m.Sender = *sender
+	}
 
 	for _, to := range email.GetHeaderValues("To") {
 		if recipient, err := mail.ParseAddress(to); err == nil {
@@ -164,7 +167,6 @@ func (s *LocalStorage) Read(filename string) (m *MailContent, err error) {
 		}
 	}
 
-	m.Sender = *sender
 	for _, cc := range email.GetHeaderValues("Cc") {
 		if recipient, err := mail.ParseAddress(cc); err != nil {
 			continue
@@ -216,3 +218,17 @@ func (s *LocalStorage) GetAttach(mailPath, attachName string, all bool) (data []
 	}
 	return nil, errors.New("not found")
 }
+
+// RemoveEmail deletes a saved email and its file
+func RemoveEmail(email *model.Email) error {
+	if err := model.DeleteMail(email.AccountID, email.ID); err != nil {
+		return err
+	}
+	if email.SavePath == "" {
+		return nil
+	}
+	if err := os.Remove(email.SavePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
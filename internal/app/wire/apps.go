@@ -0,0 +1,326 @@
+package wire
+
+import (
+	"crypto/tls"
+	"easymail/internal/app/service"
+	"easymail/internal/app/service/attachment"
+	"easymail/internal/app/service/auth"
+	"easymail/internal/app/service/bayes"
+	"easymail/internal/app/service/clamd"
+	"easymail/internal/app/service/dkimkey"
+	"easymail/internal/app/service/dmarc"
+	"easymail/internal/app/service/dnsbl"
+	"easymail/internal/app/service/dovecot"
+	"easymail/internal/app/service/filter"
+	"easymail/internal/app/service/greylist"
+	"easymail/internal/app/service/lmtp"
+	"easymail/internal/app/service/managesieve"
+	"easymail/internal/app/service/policy"
+	"easymail/internal/app/service/quarantine"
+	"easymail/internal/app/service/similarity"
+	"easymail/internal/app/service/storage"
+	repository "easymail/internal/infrastructure/persistence/mysql"
+	"easymail/internal/pkg/database"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// parameters reads the parameters of one app, the first value which does not parse is kept in err
+type parameters struct {
+	app    string
+	values map[string]string
+	err    error
+}
+
+func (p *parameters) check(key string, err error) {
+	if err != nil && p.err == nil {
+		p.err = fmt.Errorf("%s parameter %s: %w", p.app, key, err)
+	}
+}
+
+func (p *parameters) string(key string) string {
+	return strings.TrimSpace(p.values[key])
+}
+
+// bool reads a switch, it is off when not set
+func (p *parameters) bool(key string) bool {
+	v := p.string(key)
+	if v == "" {
+		return false
+	}
+	on, err := strconv.ParseBool(v)
+	p.check(key, err)
+	return on
+}
+
+// threshold reads a score between 1 and 100, it is 0 when not set
+func (p *parameters) threshold(key string) int {
+	v := p.string(key)
+	if v == "" {
+		return 0
+	}
+	n, err := strconv.Atoi(v)
+	if err == nil && (n < 1 || n > 100) {
+		err = fmt.Errorf("%d is not between 1 and 100", n)
+	}
+	p.check(key, err)
+	return n
+}
+
+// builder creates the apps, the ones which work together share what builder keeps
+type builder struct {
+	rt *Runtime
+	// authService checks the passwords of the logins
+	authService *auth.Service
+	// storage holds the delivered and the quarantined messages
+	storage *storage.LocalStorage
+	// hostname greets the relay and names this host in arc seals
+	hostname string
+	// greylist is shared by the policy server and the filter
+	greylist *greylist.Greylist
+	// keyring hands the dkim keys of the domains to the filter and the arc sealer
+	keyring *dkimkey.Keyring
+	// reporter is the dmarc app, the filter records its results with it
+	reporter *dmarc.Reporter
+}
+
+func newBuilder(rt *Runtime) (*builder, error) {
+	b := &builder{rt: rt}
+	b.hostname = "localhost"
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		b.hostname = hostname
+	}
+	// the keys of the domains are sealed with the secret
+	if rt.Config.DKIM.SecretFile != "" {
+		if err := dkimkey.LoadSecret(rt.Config.DKIM.SecretFile); err != nil {
+			return nil, err
+		}
+	}
+	b.keyring = dkimkey.NewKeyring()
+	return b, nil
+}
+
+func (b *builder) auth() *auth.Service {
+	if b.authService == nil {
+		b.authService = auth.NewService(repository.NewAccountAuthRepository())
+	}
+	return b.authService
+}
+
+func (b *builder) localStorage() *storage.LocalStorage {
+	if b.storage == nil {
+		b.storage = storage.NewLocalStorage(b.rt.Config.LMTP.Storage.Root, b.rt.Config.LMTP.Storage.Data, b.rt.DB)
+	}
+	return b.storage
+}
+
+func (b *builder) greylister() *greylist.Greylist {
+	if b.greylist == nil {
+		b.greylist = greylist.New(b.rt.Redis)
+		b.greylist.SetLogf(b.rt.Logger.Errorf)
+	}
+	return b.greylist
+}
+
+// build creates the enabled apps, the dmarc reporter first so the filter can record to it
+func (b *builder) build() ([]service.Manager, error) {
+	apps := make([]service.Manager, 0, len(b.rt.Config.Apps))
+	for _, app := range b.rt.Config.Apps {
+		if app.Enable && app.Name == "dmarc" {
+			reporter, err := b.dmarc(app)
+			if err != nil {
+				return nil, err
+			}
+			b.reporter = reporter
+			apps = append(apps, reporter)
+		}
+	}
+	for _, app := range b.rt.Config.Apps {
+		if !app.Enable || app.Name == "dmarc" {
+			continue
+		}
+		var m service.Manager
+		var err error
+		switch app.Name {
+		case "dovecot":
+			m, err = b.dovecot(app)
+		case "policy":
+			m, err = b.policy(app)
+		case "filter":
+			m, err = b.filter(app)
+		case "lmtp":
+			m, err = b.lmtp(app)
+		case "managesieve":
+			m, err = b.managesieve(app)
+		case "admin", "webmail":
+			m, err = b.web(app)
+		default:
+			err = fmt.Errorf("unknown app %s", app.Name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err = m.SetLogger(b.rt.Logger); err != nil {
+			return nil, err
+		}
+		apps = append(apps, m)
+	}
+	return apps, nil
+}
+
+func invalidListen(app database.App) error {
+	return fmt.Errorf("%s listen %s %q is invalid", app.Name, app.Family, app.Listen)
+}
+
+func (b *builder) dovecot(app database.App) (service.Manager, error) {
+	s := dovecot.New(app.Family, app.Listen)
+	if s == nil {
+		return nil, invalidListen(app)
+	}
+	s.SetTracer(b.rt.Tracer)
+	return s, nil
+}
+
+func (b *builder) policy(app database.App) (service.Manager, error) {
+	s := policy.New(app.Family, app.Listen)
+	if s == nil {
+		return nil, invalidListen(app)
+	}
+	p := &parameters{app: app.Name, values: app.Parameter}
+	s.SetTracer(b.rt.Tracer)
+	s.SetRedis(b.rt.Redis)
+	if p.bool("greylist") {
+		s.AddCheck(b.greylister().Policy())
+	}
+	return s, p.err
+}
+
+func (b *builder) filter(app database.App) (service.Manager, error) {
+	s := filter.New(app.Family, app.Listen)
+	if s == nil {
+		return nil, invalidListen(app)
+	}
+	s.SetRedis(b.rt.Redis)
+	opts, err := b.filterOptions(app)
+	if err != nil {
+		return nil, err
+	}
+	s.SetOptions(opts)
+	return s, nil
+}
+
+// filterOptions turns the parameters of the filter into its optional checks, a check not set is off
+func (b *builder) filterOptions(app database.App) (filter.Options, error) {
+	p := &parameters{app: app.Name, values: app.Parameter}
+	// quarantined messages are kept in the mailboxes, the admin releases them
+	opts := filter.Options{Quarantine: quarantine.NewStore(b.localStorage())}
+	var err error
+	if p.bool("greylist") {
+		opts.Greylist = b.greylister()
+	}
+	if p.bool("dnsbl") {
+		blocklist := dnsbl.New(b.rt.Redis)
+		blocklist.SetLogf(b.rt.Logger.Errorf)
+		opts.Blocklist = blocklist
+	}
+	opts.SPFMode, err = filter.ParseSPFMode(p.string("spf"))
+	p.check("spf", err)
+	if opts.SPFMode != filter.SPFOff {
+		opts.SPF = filter.NewSPFChecker()
+	}
+	if p.bool("dkim") {
+		opts.DKIM = filter.NewDKIMLookup(b.rt.Redis)
+	}
+	if p.bool("arc") {
+		opts.ARC = filter.NewDKIMLookup(b.rt.Redis)
+	}
+	if p.bool("dkim_sign") {
+		opts.Signer = b.keyring
+	}
+	opts.DMARCMode, err = filter.ParseDMARCMode(p.string("dmarc"))
+	p.check("dmarc", err)
+	if opts.DMARCMode != filter.DMARCOff {
+		evaluator := dmarc.New(nil)
+		// without the dmarc app the results are evaluated but not reported
+		if b.reporter != nil {
+			evaluator.SetRecorder(b.reporter.Recorder())
+		}
+		opts.DMARC = evaluator
+	}
+	if p.bool("bayes") {
+		opts.Bayes = bayes.New(b.rt.Redis)
+	}
+	if threshold := p.threshold("similarity"); threshold > 0 {
+		index := similarity.New()
+		index.SetThreshold(threshold)
+		opts.Similarity = index
+	}
+	if threshold := p.threshold("attach_hash"); threshold > 0 {
+		hashes := attachment.NewHashList()
+		hashes.SetSsdeepThreshold(threshold)
+		hashes.SetLogf(b.rt.Logger.Errorf)
+		opts.Hashes = hashes
+	}
+	if address := p.string("virus"); address != "" {
+		opts.Scanner = clamd.New(address)
+	}
+	opts.ScanFailMode, err = filter.ParseVirusFailMode(p.string("virus_fail"))
+	p.check("virus_fail", err)
+	return opts, p.err
+}
+
+func (b *builder) lmtp(app database.App) (service.Manager, error) {
+	s := lmtp.New(app.Family, app.Listen)
+	if s == nil {
+		return nil, invalidListen(app)
+	}
+	p := &parameters{app: app.Name, values: app.Parameter}
+	s.SetTracer(b.rt.Tracer)
+	s.SetStorage(b.localStorage())
+	hostname := p.string("hostname")
+	if hostname == "" {
+		hostname = b.hostname
+	}
+	if relay := p.string("relay"); relay != "" {
+		s.SetRelay(lmtp.NewSMTPRelay(relay, hostname))
+	}
+	if p.bool("arc_seal") {
+		s.SetSealer(dkimkey.NewARCSealer(b.keyring, hostname))
+	}
+	return s, p.err
+}
+
+func (b *builder) managesieve(app database.App) (service.Manager, error) {
+	s := managesieve.New(app.Family, app.Listen)
+	if s == nil {
+		return nil, invalidListen(app)
+	}
+	p := &parameters{app: app.Name, values: app.Parameter}
+	s.SetAuthenticator(b.auth())
+	// without a certificate only local clients can log in
+	cert, key := p.string("tls_cert"), p.string("tls_key")
+	if cert != "" || key != "" {
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("%s certificate: %w", app.Name, err)
+		}
+		s.SetTLSConfig(&tls.Config{Certificates: []tls.Certificate{pair}, MinVersion: tls.VersionTLS12})
+	}
+	return s, p.err
+}
+
+func (b *builder) dmarc(app database.App) (*dmarc.Reporter, error) {
+	p := &parameters{app: app.Name, values: app.Parameter}
+	org := dmarc.Organization{Name: p.string("org_name"), Email: p.string("email")}
+	relay := p.string("relay")
+	if org.Name == "" || org.Email == "" || relay == "" {
+		return nil, fmt.Errorf("%s needs the parameters org_name, email and relay", app.Name)
+	}
+	r := dmarc.NewReporter(org, lmtp.NewSMTPRelay(relay, b.hostname), nil)
+	if err := r.SetLogger(b.rt.Logger); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
@@ -0,0 +1,113 @@
+package wire
+
+import (
+	"context"
+	"easymail/internal/app/api/router"
+	"easymail/internal/app/service"
+	"easymail/internal/easylog"
+	"easymail/internal/pkg/database"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-contrib/sessions/cookie"
+	"github.com/gin-gonic/gin"
+)
+
+// webShutdownTimeout is how long running requests get when the app stops
+const webShutdownTimeout = 5 * time.Second
+
+/*
+webApp serves the admin or the webmail, the api is mounted behind the login
+kept in the session cookie named cookie_tag.
+*/
+type webApp struct {
+	name    string
+	listen  string
+	handler http.Handler
+	lock    sync.Mutex
+	server  *http.Server
+	_log    *easylog.Logger
+}
+
+func (b *builder) web(app database.App) (service.Manager, error) {
+	if app.Family != "tcp" {
+		return nil, invalidListen(app)
+	}
+	if _, _, err := net.SplitHostPort(app.Listen); err != nil {
+		return nil, invalidListen(app)
+	}
+	p := &parameters{app: app.Name, values: app.Parameter}
+	secret, tag := p.string("cookie_password"), p.string("cookie_tag")
+	if secret == "" || tag == "" {
+		return nil, fmt.Errorf("%s needs the parameters cookie_password and cookie_tag", app.Name)
+	}
+	engine := gin.New()
+	engine.Use(gin.Recovery(), sessions.Sessions(tag, cookie.NewStore([]byte(secret))))
+	if root := p.string("root"); root != "" {
+		engine.Static("/static", filepath.Join(root, "static"))
+	}
+	deps := router.Deps{Auth: b.auth(), Redis: b.rt.Redis}
+	if app.Name == "admin" {
+		router.Register(engine, nil, deps)
+	} else {
+		router.Register(nil, engine, deps)
+	}
+	return &webApp{name: app.Name, listen: app.Listen, handler: engine}, nil
+}
+
+func (w *webApp) SetLogger(_log *easylog.Logger) error {
+	if _log == nil {
+		return fmt.Errorf("%s logger is nil", w.name)
+	}
+	w._log = _log
+	return nil
+}
+
+func (w *webApp) Name() string {
+	return w.name
+}
+
+func (w *webApp) Start() error {
+	if w._log == nil {
+		return fmt.Errorf("%s logger is nil", w.name)
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.server != nil {
+		return fmt.Errorf("%s server already started", w.name)
+	}
+	listener, err := net.Listen("tcp", w.listen)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Handler: w.handler, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			w._log.Errorf("%s serve: %v", w.name, err)
+		}
+	}()
+	w.server = server
+	w._log.Infof("%s server started!", w.name)
+	return nil
+}
+
+func (w *webApp) Stop() error {
+	w.lock.Lock()
+	server := w.server
+	w.server = nil
+	w.lock.Unlock()
+	if server == nil {
+		return fmt.Errorf("%s server not started", w.name)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), webShutdownTimeout)
+	defer cancel()
+	err := server.Shutdown(ctx)
+	w._log.Infof("%s server stopped!", w.name)
+	return err
+}
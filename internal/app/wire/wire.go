@@ -0,0 +1,76 @@
+package wire
+
+import (
+	"easymail/internal/app/service"
+	"easymail/internal/easylog"
+	"easymail/internal/observability/sessiontrace"
+	"easymail/internal/pkg/database"
+	"fmt"
+
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+)
+
+// Runtime is what bootstrap prepared, the apps are built from it
+type Runtime struct {
+	Config *database.AppConfig
+	DB     *gorm.DB
+	Redis  *redis.Client
+	Logger *easylog.Logger
+	Tracer sessiontrace.Tracer
+}
+
+// Manager starts and stops the enabled apps of the configuration together
+type Manager struct {
+	apps []service.Manager
+	_log *easylog.Logger
+}
+
+/*
+Build creates the enabled apps of the configuration, the parameters of every
+app are parsed here so a wrong value fails at startup and not with the first
+message.
+*/
+func Build(rt *Runtime) (*Manager, error) {
+	if rt == nil || rt.Config == nil || rt.Logger == nil {
+		return nil, fmt.Errorf("wire runtime needs a configuration and a logger")
+	}
+	b, err := newBuilder(rt)
+	if err != nil {
+		return nil, err
+	}
+	apps, err := b.build()
+	if err != nil {
+		return nil, err
+	}
+	return &Manager{apps: apps, _log: rt.Logger}, nil
+}
+
+// Apps returns the apps in the order they are started
+func (m *Manager) Apps() []service.Manager {
+	return m.apps
+}
+
+// StartAll starts the apps in order, the ones started are stopped again when one fails
+func (m *Manager) StartAll() error {
+	for i, app := range m.apps {
+		if err := app.Start(); err != nil {
+			for j := i - 1; j >= 0; j-- {
+				if serr := m.apps[j].Stop(); serr != nil {
+					m._log.Errorf("stop %s: %v", m.apps[j].Name(), serr)
+				}
+			}
+			return fmt.Errorf("start %s: %w", app.Name(), err)
+		}
+	}
+	return nil
+}
+
+// StopAll stops the apps in reverse order, the filter stops before the dmarc reporter it records to
+func (m *Manager) StopAll() {
+	for i := len(m.apps) - 1; i >= 0; i-- {
+		if err := m.apps[i].Stop(); err != nil {
+			m._log.Errorf("stop %s: %v", m.apps[i].Name(), err)
+		}
+	}
+}
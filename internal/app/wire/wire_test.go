@@ -0,0 +1,139 @@
+package wire
+
+import (
+	"easymail/internal/app/service/filter"
+	"easymail/internal/easylog"
+	"easymail/internal/pkg/database"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testRuntime(apps ...database.App) *Runtime {
+	return &Runtime{Config: &database.AppConfig{Apps: apps}, Logger: &easylog.Logger{}}
+}
+
+func TestFilterOptions(t *testing.T) {
+	b, err := newBuilder(testRuntime())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		key, value string
+		set        func(opts filter.Options) bool
+	}{
+		{"greylist", "true", func(opts filter.Options) bool { return opts.Greylist != nil }},
+		{"dnsbl", "true", func(opts filter.Options) bool { return opts.Blocklist != nil }},
+		{"spf", "header", func(opts filter.Options) bool { return opts.SPF != nil && opts.SPFMode == filter.SPFHeader }},
+		{"dkim", "true", func(opts filter.Options) bool { return opts.DKIM != nil }},
+		{"dkim_sign", "true", func(opts filter.Options) bool { return opts.Signer != nil }},
+		{"dmarc", "enforce", func(opts filter.Options) bool { return opts.DMARC != nil && opts.DMARCMode == filter.DMARCEnforce }},
+		{"arc", "true", func(opts filter.Options) bool { return opts.ARC != nil }},
+		{"arc", "false", func(opts filter.Options) bool { return opts.ARC == nil }},
+		{"bayes", "true", func(opts filter.Options) bool { return opts.Bayes != nil }},
+		{"similarity", "60", func(opts filter.Options) bool { return opts.Similarity != nil }},
+		{"attach_hash", "80", func(opts filter.Options) bool { return opts.Hashes != nil }},
+		{"virus", "unix:/run/clamav/clamd.ctl", func(opts filter.Options) bool { return opts.Scanner != nil }},
+		{"virus_fail", "closed", func(opts filter.Options) bool { return opts.ScanFailMode == filter.VirusFailClosed }},
+	}
+	for _, c := range cases {
+		opts, err := b.filterOptions(database.App{Name: "filter", Parameter: map[string]string{c.key: c.value}})
+		if err != nil || !c.set(opts) {
+			t.Fatalf("%s=%s: unexpected options %+v, err %v", c.key, c.value, opts, err)
+		}
+	}
+
+	// the quarantine is always there, the checks not set are off
+	opts, err := b.filterOptions(database.App{Name: "filter"})
+	if err != nil || opts.Quarantine == nil || !reflect.DeepEqual(opts, filter.Options{Quarantine: opts.Quarantine}) {
+		t.Fatalf("expected only the quarantine, got %+v, err %v", opts, err)
+	}
+
+	// a wrong value fails at startup
+	wrong := map[string]string{
+		"greylist":    "maybe",
+		"dnsbl":       "on please",
+		"spf":         "soft",
+		"dkim":        "yes please",
+		"dmarc":       "strict",
+		"similarity":  "101",
+		"attach_hash": "high",
+		"virus_fail":  "later",
+	}
+	for key, value := range wrong {
+		_, err := b.filterOptions(database.App{Name: "filter", Parameter: map[string]string{key: value}})
+		if err == nil || !strings.Contains(err.Error(), "filter parameter "+key) {
+			t.Fatalf("%s=%s: expected an error, got %v", key, value, err)
+		}
+	}
+}
+
+func TestSharedGreylist(t *testing.T) {
+	b, err := newBuilder(testRuntime())
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := database.App{Name: "policy", Family: "tcp", Listen: "127.0.0.1:10026", Parameter: map[string]string{"greylist": "true"}}
+	if _, err = b.policy(app); err != nil {
+		t.Fatal(err)
+	}
+	opts, err := b.filterOptions(database.App{Name: "filter", Parameter: map[string]string{"greylist": "true"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the whitelist the filter keeps is the one the policy server reads
+	if b.greylist == nil || opts.Greylist != b.greylist {
+		t.Fatalf("expected one greylist, got %p and %p", opts.Greylist, b.greylist)
+	}
+}
+
+func TestBuild(t *testing.T) {
+	rt := testRuntime(
+		database.App{Name: "filter", Family: "tcp", Listen: "127.0.0.1:10027", Enable: true, Parameter: map[string]string{"dmarc": "header"}},
+		database.App{Name: "admin", Family: "tcp", Listen: "127.0.0.1:10088", Enable: true, Parameter: map[string]string{"cookie_password": "secret", "cookie_tag": "easymail_admin"}},
+		database.App{Name: "webmail", Family: "tcp", Listen: "127.0.0.1:10089", Enable: true, Parameter: map[string]string{"cookie_password": "secret", "cookie_tag": "easymail_webmail"}},
+		database.App{Name: "managesieve", Family: "unix", Listen: "/run/easymail/sieve.sock", Enable: true},
+		database.App{Name: "lmtp", Family: "tcp", Listen: "127.0.0.1:10028", Enable: true, Parameter: map[string]string{"relay": "127.0.0.1:25", "arc_seal": "true"}},
+		database.App{Name: "policy", Family: "tcp", Listen: "127.0.0.1:10026", Enable: true, Parameter: map[string]string{"greylist": "true"}},
+		database.App{Name: "dmarc", Enable: true, Parameter: map[string]string{"org_name": "easymail", "email": "dmarc@example.com", "relay": "127.0.0.1:25"}},
+		database.App{Name: "agent"},
+	)
+	m, err := Build(rt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0)
+	for _, app := range m.Apps() {
+		names = append(names, app.Name())
+	}
+	expected := []string{
+		// the reporter comes first, the filter records to it
+		"dmarc",
+		"filter",
+		"admin",
+		"webmail",
+		"managesieve",
+		"lmtp",
+		"policy",
+	}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("expected %v, got %v", expected, names)
+	}
+
+	broken := []database.App{
+		{Name: "mailer", Enable: true},
+		{Name: "filter", Family: "tcp", Listen: "10027", Enable: true},
+		{Name: "admin", Family: "tcp", Listen: "127.0.0.1:10088", Enable: true},
+		{Name: "lmtp", Family: "tcp", Listen: "10028", Enable: true},
+		{Name: "policy", Family: "tcp", Listen: "127.0.0.1:10026", Enable: true, Parameter: map[string]string{"greylist": "maybe"}},
+		{Name: "filter", Family: "tcp", Listen: "127.0.0.1:10027", Enable: true, Parameter: map[string]string{"spf": "soft"}},
+		{Name: "dmarc", Enable: true, Parameter: map[string]string{"org_name": "easymail"}},
+		{Name: "lmtp", Family: "tcp", Listen: "127.0.0.1:10028", Enable: true, Parameter: map[string]string{"arc_seal": "sure"}},
+		{Name: "managesieve", Family: "tcp", Listen: "0.0.0.0:4190", Enable: true, Parameter: map[string]string{"tls_cert": "/nonexistent/cert.pem"}},
+	}
+	for _, app := range broken {
+		if _, err := Build(testRuntime(app)); err == nil {
+			t.Fatalf("%+v: expected an error", app)
+		}
+	}
+}
@@ -2,7 +2,7 @@ package repository
 
 import (
 	"context"
-	"easymail/internal/application/auth"
+	"easymail/internal/app/service/auth"
 	"easymail/internal/model"
 )
 
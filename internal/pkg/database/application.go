@@ -29,6 +29,8 @@ type AppConfig struct {
 
 	LMTP LMTPConfig `yaml:"lmtp"`
 
+	DKIM DKIMConfig `yaml:"dkim"`
+
 	Observability ObservabilityConfig `yaml:"observability"`
 
 	Apps []App `yaml:"apps"`
@@ -83,6 +85,11 @@ type LMTPConfig struct {
 	Storage StorageConfig `yaml:"storage"`
 }
 
+type DKIMConfig struct {
+	// SecretFile holds the base64 encoded key sealing the private keys
+	SecretFile string `yaml:"secret_file"`
+}
+
 type ObservabilityConfig struct {
 	SessionTrace SessionTraceConfig `yaml:"session_trace"`
 }
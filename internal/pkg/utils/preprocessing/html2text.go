@@ -11,10 +11,12 @@ type Html2Text struct {
 	htmlTagMapper map[string]struct{}
 }
 
-var onceHtml2Text sync.Once
+var (
+	onceHtml2Text sync.Once
+	html2Text     *Html2Text
+)
 
 func NewHtml2Text(tags []string) *Html2Text {
-	var h *Html2Text
 	var tagMapper = make(map[string]struct{})
 	if len(tags) == 0 {
 		tags = defaultHtmlTags
@@ -23,11 +25,11 @@ func NewHtml2Text(tags []string) *Html2Text {
 		tagMapper[tag] = struct{}{}
 	}
 	onceHtml2Text.Do(func() {
-		h = &Html2Text{
+		html2Text = &Html2Text{
 			htmlTagMapper: tagMapper,
 		}
 	})
-	return h
+	return html2Text
 }
 
 func (h *Html2Text) matchHtmlProperty(src, key, value string) bool {
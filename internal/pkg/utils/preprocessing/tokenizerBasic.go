@@ -11,10 +11,12 @@ type TokenizerBasic struct {
 	keepSep   bool
 }
 
-var onceBasic sync.Once
+var (
+	onceBasic      sync.Once
+	tokenizerBasic *TokenizerBasic
+)
 
 func NewTokenizerBasic(separator []string) *TokenizerBasic {
-	var tokenizerBasic *TokenizerBasic
 	var separatorMap = make(map[rune]struct{})
 	if len(separator) == 0 {
 		separator = defaultSeparator
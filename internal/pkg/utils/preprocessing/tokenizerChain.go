@@ -12,10 +12,12 @@ type TokenizerChain struct {
 	stopWords map[string]struct{}
 }
 
-var onceFuzzy sync.Once
+var (
+	onceFuzzy      sync.Once
+	tokenizerChain *TokenizerChain
+)
 
 func NewTokenizerFuzzy(stopWord map[string]struct{}) *TokenizerChain {
-	var tokenizerChain *TokenizerChain
 	onceFuzzy.Do(func() {
 		tokenizerChain = &TokenizerChain{
 			stopWords: stopWord,
@@ -14,10 +14,12 @@ type TokenizerDefault struct {
 	excludeChars map[string]struct{}
 }
 
-var onceDefault sync.Once
+var (
+	onceDefault      sync.Once
+	tokenizerDefault *TokenizerDefault
+)
 
 func NewTokenizerDefault(dictList []string, stopWords map[string]struct{}, excludeChars map[string]struct{}) *TokenizerDefault {
-	var tokenizerDefault *TokenizerDefault
 	onceDefault.Do(func() {
 		var segmenter gse.Segmenter
 		err := segmenter.LoadDict(dictList...)